@@ -0,0 +1,65 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package cores
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// NewArchiveAttachment returns an attachment holding the given files as a gzip compressed tar archive, e.g. several log
+// files, which compress better together than one by one. The map keys are the paths of the files within the archive,
+// which are stored in the order of their paths. The attachment can be handed to an output implementing
+// AttachmentWriter, its name should end with ".tar.gz".
+func NewArchiveAttachment(name string, files map[string][]byte) (Attachment, error) {
+
+	// Sort the paths, as the order of the map is random
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		if path == "" {
+			return Attachment{}, fmt.Errorf("file name must not be empty")
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// Write the files to the archive, compressing it on the fly
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	modTime := time.Now()
+	for _, path := range paths {
+		hdr := &tar.Header{
+			Name:    path,
+			Mode:    0644,
+			Size:    int64(len(files[path])),
+			ModTime: modTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return Attachment{}, fmt.Errorf("could not add file '%s' to archive: %s", path, err)
+		}
+		if _, err := tw.Write(files[path]); err != nil {
+			return Attachment{}, fmt.Errorf("could not add file '%s' to archive: %s", path, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return Attachment{}, fmt.Errorf("could not finish archive: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		return Attachment{}, fmt.Errorf("could not finish archive: %s", err)
+	}
+
+	return Attachment{Name: name, ContentType: "application/gzip", Data: buf.Bytes()}, nil
+}
@@ -0,0 +1,86 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package cores
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestNewArchiveAttachment(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string][]byte
+		wantErr bool
+	}{
+		{"valid", map[string][]byte{
+			"app.log":        []byte(strings.Repeat("{\"level\":\"error\",\"msg\":\"disk full\"}\n", 100)),
+			"db/queries.log": []byte("SELECT 1;\n"),
+			"empty.log":      {},
+		}, false},
+		{"valid-none", map[string][]byte{}, false},
+		{"invalid-name", map[string][]byte{"": []byte("content")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attachment, err := NewArchiveAttachment("logs.tar.gz", tt.files)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewArchiveAttachment() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if attachment.Name != "logs.tar.gz" || attachment.ContentType != "application/gzip" {
+				t.Errorf("NewArchiveAttachment() = %s %s, want logs.tar.gz application/gzip",
+					attachment.Name, attachment.ContentType)
+			}
+
+			// Unpack the archive, which must contain all files with their content intact
+			gz, errGz := gzip.NewReader(bytes.NewReader(attachment.Data))
+			if errGz != nil {
+				t.Errorf("attachment is not gzip compressed: %s", errGz)
+				return
+			}
+			tr := tar.NewReader(gz)
+			got := make(map[string][]byte)
+			for {
+				hdr, errNext := tr.Next()
+				if errNext == io.EOF {
+					break
+				}
+				if errNext != nil {
+					t.Errorf("attachment is not a valid tar archive: %s", errNext)
+					return
+				}
+				content, errRead := ioutil.ReadAll(tr)
+				if errRead != nil {
+					t.Errorf("could not read file '%s' from archive: %s", hdr.Name, errRead)
+					return
+				}
+				got[hdr.Name] = content
+			}
+			if len(got) != len(tt.files) {
+				t.Errorf("archive holds %d files, want %d", len(got), len(tt.files))
+			}
+			for path, want := range tt.files {
+				if content, ok := got[path]; !ok || !bytes.Equal(content, want) {
+					t.Errorf("file '%s' = %q, want %q", path, content, want)
+				}
+			}
+		})
+	}
+}
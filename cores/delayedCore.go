@@ -11,33 +11,140 @@
 package cores
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"go.uber.org/multierr"
 	"go.uber.org/zap/buffer"
 	"go.uber.org/zap/zapcore"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 )
 
-type delayedCore struct {
+// SuppressionPolicy decides what happens to the entries of a batch while mails are suppressed, see SetSuppression
+type SuppressionPolicy int
+
+const (
+	SuppressDrop   SuppressionPolicy = iota // Entries are discarded, only their number is reported afterward
+	SuppressRetain                          // Entries are kept and sent once the suppression lifts
+)
+
+// EntrySpacing decides how the entries within a section of a message are separated, see SetEntrySpacing
+type EntrySpacing int
+
+const (
+	EntrySpacingEncoder   EntrySpacing = iota // Entries are kept as encoded, including the encoder's line ending
+	EntrySpacingNone                          // Entries are concatenated without any line ending
+	EntrySpacingLine                          // Every entry ends with a single line feed
+	EntrySpacingBlankLine                     // Entries are separated by a blank line, the last one ends with a line feed
+)
+
+// BatchWriter is implemented by outputs interested in details of the messages written by a DelayedCore, e.g. to
+// mention them in the subject of a mail. If the output implements it, WriteBatch is called instead of Write, with the
+// highest level and the number of entries contained in the message.
+type BatchWriter interface {
+	WriteBatch(p []byte, level zapcore.Level, count int) (int, error)
+}
+
+// Attachment is a file sent along with a message, see AttachmentWriter
+type Attachment struct {
+	Name        string // File name, e.g. "goroutines.txt"
+	ContentType string // Media type, e.g. "application/x-ndjson", derived from the file name by the output if empty
+	Data        []byte
+}
+
+// AttachmentWriter is implemented by outputs able to send files along with a message, e.g. as attachments of a mail.
+// If the output implements it, WriteAttachments is called instead of WriteBatch or Write for messages with
+// attachments, see SetGoroutineDump. Other outputs receive the message without the attachments.
+type AttachmentWriter interface {
+	WriteAttachments(p []byte, level zapcore.Level, count int, attachments []Attachment) (int, error)
+}
+
+// GroupWriter is implemented by outputs interested in the group of the entries contained in a message, e.g. to state
+// it in the subject of a mail, see SetGroupBy. If the output implements it, WriteGroup is called instead of WriteBatch
+// or Write for messages of a group, with the highest level, the number of entries and the name of the group. Messages
+// with attachments are still handed to WriteAttachments, if implemented.
+type GroupWriter interface {
+	WriteGroup(p []byte, level zapcore.Level, count int, group string) (int, error)
+}
+
+// DelayedCore is a zapcore.Core collecting log entries and writing them as a single message after a given delay
+type DelayedCore struct {
 	zapcore.LevelEnabler
 	enc zapcore.Encoder
 	out zapcore.WriteSyncer
 
+	priorityOut  zapcore.WriteSyncer // Receives the priority section separately if set
+	priorityEnc  zapcore.Encoder     // Encodes the priority entries if set, instead of the standard encoder
+	filter       func(ent zapcore.Entry, fields []zapcore.Field) bool
+	priorityFunc func(ent zapcore.Entry, fields []zapcore.Field) bool
+	metadata     bool
+	banners      bool
+	spacing      EntrySpacing
+	maxEntries   int // Number of queued entries triggering an immediate write, zero to only rely on the delays
+	priorityMin  int // Number of priority entries needed to apply the priority delay
+	syncFailure  func(ent zapcore.Entry, err error)
+	dumpStacks   bool // Whether to attach a goroutine dump to messages triggered by entries above the error level
+	ndjson       bool // Whether to attach the entries as "events.ndjson" to a summary, see SetNDJSONAttachment
+	groupBy      func(ent zapcore.Entry, fields []zapcore.Field) string
+
+	bodyPrefix *template.Template // Rendered ahead of the entries of every message if set
+	bodySuffix *template.Template // Rendered after the entries of every message if set
+
+	digestOut   zapcore.WriteSyncer  // Receives every entry enabled for the digest if set, see SetDigestOutput
+	digestEnab  zapcore.LevelEnabler // Levels of the entries written to the digest output
+	digestBuf   []*buffer.Buffer     // Entries queued for the digest output
+	levelDigest zapcore.Level        // Highest level of the queued digest entries
+
+	suppress       func(now time.Time) bool
+	suppressPolicy SuppressionPolicy
+	suppressed     int // Number of entries dropped or retained during the current suppression
+
+	rateLimit   int           // Number of messages allowed per window, zero for no limit
+	rateWindow  time.Duration // Window within which the tokens are refilled completely
+	ratePolicy  SuppressionPolicy
+	rateTokens  float64   // Messages which may currently be sent
+	rateUpdated time.Time // Time of the last refill of the tokens, zero before the first message
+	limited     int       // Number of entries dropped or retained while the rate limit is exhausted
+
+	spillBudget int      // Size of the standard entries kept in memory before further ones spill, zero to never spill
+	spillDir    string   // Directory of the spill file
+	spillFile   *os.File // File holding the spilled standard entries, nil if none were spilled
+	spillSize   int64    // Size of the valid content of the spill file
+	spilled     int      // Number of standard entries in the spill file
+	memBytes    int      // Size of the standard entries kept in memory
+
+	groupsBuf         []entryGroup // Group of each queued standard entry, only tracked if grouping
+	groupsPriorityBuf []entryGroup // Group of each queued priority entry, only tracked if grouping
+	groupsSpilled     []entryGroup // Group of each spilled standard entry, only tracked if grouping
+
 	priority           zapcore.LevelEnabler
 	delay              time.Duration
 	delayPriority      time.Duration
 	entriesBuf         []*buffer.Buffer
 	entriesPriorityBuf []*buffer.Buffer
+	levelStandard      zapcore.Level // Highest level of the queued standard entries
+	levelPriority      zapcore.Level // Highest level of the queued priority entries
 	mutex              sync.Mutex
+	writeMutex         sync.Mutex // Serializes the writes of the messages, so a flush waits for preceding ones
 	timer              *time.Timer
 	timeStart          time.Time
+	lastSend           time.Time // Time of the last message written to the output, used for heartbeats
 	errCh              chan error
 }
 
-// NewDelayedCore creates a zapcore.Core that writes logs after a given amount of time. It will write the
+// NewDelayedCore creates a DelayedCore that writes logs after a given amount of time. It will write the
 // logs quicker if it receives an entry satisfies the priority LevelEnabler. By calling Sync directly an immediate write
-// of the messages can be forced.
+// of the messages can be forced. A priority delay of zero writes priority entries immediately, along with the queued
+// standard entries, without involving the timer. The priority delay must not exceed the standard delay.
 func NewDelayedCore(
 	enab zapcore.LevelEnabler,
 	enc zapcore.Encoder,
@@ -46,30 +153,95 @@ func NewDelayedCore(
 	priority zapcore.LevelEnabler,
 	delay time.Duration,
 	delayPriority time.Duration,
-) (zapcore.Core, error) {
+) (*DelayedCore, error) {
 
 	// Validate input to avoid accidental misconfiguration
-	if delay < delayPriority {
-		return nil, fmt.Errorf("priority delay lower than standard delay")
+	if err := validateDelays(delay, delayPriority); err != nil {
+		return nil, err
 	}
 
-	return &delayedCore{
+	return &DelayedCore{
 		LevelEnabler:       enab,
 		priority:           priority,
 		enc:                enc,
 		out:                out,
 		delay:              delay,
 		delayPriority:      delayPriority,
+		banners:            !isJSONEncoder(enc),
+		maxEntries:         defaultMaxEntries,
+		priorityMin:        1,
 		entriesBuf:         make([]*buffer.Buffer, 0, 5),
 		entriesPriorityBuf: make([]*buffer.Buffer, 0, 5),
 		errCh:              make(chan error, 2),
 	}, nil
 }
 
+// entryGroup holds the group and level of a queued entry, needed to partition the queue, see SetGroupBy
+type entryGroup struct {
+	name  string
+	level zapcore.Level
+}
+
+// batch is a composed message along with the details handed to the output
+type batch struct {
+	msg         []byte
+	level       zapcore.Level
+	count       int
+	group       string
+	attachments []Attachment
+}
+
+// BodyData holds the values available to the body templates, see SetBodyTemplates
+type BodyData struct {
+	Count    int       // Number of entries in the message
+	Priority int       // Number of priority entries in the message
+	Standard int       // Number of standard entries in the message
+	Level    string    // Highest level of the entries in the message, e.g. "error"
+	Group    string    // Group of the entries in the message, empty if not grouped
+	Start    time.Time // Time the first entry of the queue was collected
+	End      time.Time // Time the message was composed
+}
+
+// defaultMaxEntries is the number of queued entries triggering an immediate write by default, keeping the size of the
+// messages within the limits of common SMTP servers
+const defaultMaxEntries = 20
+
+// validateDelays checks that the priority delay does not exceed the standard one, as a priority entry could otherwise
+// postpone the sending of the queue.
+func validateDelays(delay time.Duration, delayPriority time.Duration) error {
+	if delay < delayPriority {
+		return fmt.Errorf(
+			"priority delay (%s) exceeds standard delay (%s), use a priority delay of zero to send priority "+
+				"entries immediately", delayPriority, delay,
+		)
+	}
+	return nil
+}
+
+// isJSONEncoder reports whether the encoder produces JSON objects, judging by the output for an empty entry. The
+// encoders of zap don't reveal their type otherwise.
+func isJSONEncoder(enc zapcore.Encoder) (isJSON bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			isJSON = false
+		}
+	}()
+
+	buf, err := enc.Clone().EncodeEntry(zapcore.Entry{}, nil)
+	if err != nil {
+		return false
+	}
+	defer buf.Free()
+	return bytes.HasPrefix(bytes.TrimSpace(buf.Bytes()), []byte("{"))
+}
+
 // With is a reimplementation of ioCore.With because ioCore is not exported
-func (c *delayedCore) With(fields []zapcore.Field) zapcore.Core {
+func (c *DelayedCore) With(fields []zapcore.Field) zapcore.Core {
 	clone := c.clone()
 	addFields(clone.enc, fields)
+	if clone.priorityEnc != nil {
+		addFields(clone.priorityEnc, fields)
+	}
 	return clone
 }
 
@@ -80,27 +252,408 @@ func addFields(enc zapcore.ObjectEncoder, fields []zapcore.Field) {
 	}
 }
 
-func (c *delayedCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+func (c *DelayedCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
 	if c.Enabled(ent.Level) || c.priority.Enabled(ent.Level) {
 		return ce.AddCore(ent, c)
 	}
 	return ce
 }
 
-func (c *delayedCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+// SetFilter sets a predicate deciding whether an entry passing the level check is added to the mail queue. Entries
+// rejected by the filter are dropped by this core, but still reach other cores if it is teed. Only the fields passed
+// to the log call are handed to the filter, not the ones added via With. Must be called before the core is used.
+func (c *DelayedCore) SetFilter(filter func(ent zapcore.Entry, fields []zapcore.Field) bool) {
+	c.filter = filter
+}
+
+// SetPriorityFunc sets a predicate marking additional entries as priority, e.g. ones carrying an "escalate" field,
+// regardless of their level. Such entries are added to the priority section and shorten the delay just like entries
+// satisfying the priority LevelEnabler. The entries still need to pass the level check of the core to reach the
+// predicate. Only the fields passed to the log call are handed to the predicate, not the ones added via With. Must be
+// called before the core is used.
+func (c *DelayedCore) SetPriorityFunc(priority func(ent zapcore.Entry, fields []zapcore.Field) bool) {
+	c.priorityFunc = priority
+}
+
+// SetPriorityEncoder sets a separate encoder for the priority entries, e.g. a verbose one including stack traces,
+// while the standard entries are rendered compactly by the encoder given to the constructor. The encoder is chosen
+// when an entry is written, based on its section. The default of the banners still depends on the constructor's
+// encoder only. Passing nil encodes all entries with the constructor's encoder again. Must be called before the core
+// is used, fields added via With afterward apply to both encoders.
+func (c *DelayedCore) SetPriorityEncoder(enc zapcore.Encoder) {
+	c.priorityEnc = enc
+}
+
+// SetBanners decides whether the priority and standard entries are introduced by banner lines like
+// "=== Priority Log ===" and separated by blank lines. Without banners, the message of a JSON encoder is valid
+// newline delimited JSON, so banners are disabled by default for JSON encoders and enabled for all others. The entry
+// counts are still available via SetBatchMetadata. Must be called before the core is used.
+func (c *DelayedCore) SetBanners(enabled bool) {
+	c.banners = enabled
+}
+
+// SetPriorityThreshold sets the number of priority entries which need to accumulate before the priority delay applies,
+// e.g. to ignore a single transient error. Until then, priority entries are still listed in the priority section, but
+// sent after the standard delay. Entries above the error level are always written immediately. Defaults to one,
+// values below are treated as one. Must be called before the core is used.
+func (c *DelayedCore) SetPriorityThreshold(n int) {
+	if n < 1 {
+		n = 1
+	}
+	c.priorityMin = n
+}
+
+// SetMaxEntries sets the number of queued entries triggering an immediate write, instead of waiting for the delay to
+// expire. Defaults to 20. Passing zero disables the limit, so messages are only sent after the delays. Beware that
+// all entries logged within the delay are then kept in memory and combined into a single message, so a burst of
+// entries may consume a lot of memory and produce a message exceeding the size limit of the SMTP server. Must be
+// called before the core is used.
+func (c *DelayedCore) SetMaxEntries(n int) {
+	c.maxEntries = n
+}
+
+// SetEntrySpacing decides how the entries within the priority and standard section are separated, independently of
+// the line ending configured for the encoder. Except for EntrySpacingEncoder, which is the default and keeps the
+// entries as encoded, trailing line endings of the entries are removed before the spacing is applied. Must be called
+// before the core is used.
+func (c *DelayedCore) SetEntrySpacing(spacing EntrySpacing) {
+	c.spacing = spacing
+}
+
+// SetBatchMetadata decides whether each message starts with a line holding a JSON object describing the batch, e.g.
+// {"type":"zapsmtp_batch","priority":1,"standard":3,"generated":"2021-06-01T12:00:00Z"}, for pipelines ingesting the
+// messages programmatically. The counts refer to the entries of the priority and standard section. Disabled by
+// default. Must be called before the core is used.
+func (c *DelayedCore) SetBatchMetadata(enabled bool) {
+	c.metadata = enabled
+}
+
+// SetPriorityOutput sets a separate output for the priority section, e.g. a WriteSyncer mailing a pager address with
+// a short subject, while the standard section keeps going to the output given to the constructor, e.g. a digest
+// mailbox. A batch with entries of both sections then results in two messages, each introduced by the banner and
+// metadata of its section as configured. A report of suppressed entries goes to the standard output. Passing nil sends
+// both sections as a single message again. Must be called before the core is used.
+func (c *DelayedCore) SetPriorityOutput(out zapcore.WriteSyncer) {
+	c.priorityOut = out
+}
+
+// SetGoroutineDump decides whether the message written immediately for an entry above the error level, e.g. a fatal
+// one, comes with a dump of the stacks of all goroutines attached as "goroutines.txt", for post-mortem debugging. The
+// output needs to implement AttachmentWriter to receive the dump. Beware that the dump may be large and reveal
+// sensitive data, e.g. function arguments. Disabled by default. Must be called before the core is used.
+func (c *DelayedCore) SetGoroutineDump(enabled bool) {
+	c.dumpStacks = enabled
+}
+
+// SetNDJSONAttachment decides whether the entries of a message are attached as "events.ndjson", one JSON object per
+// line, while the body only holds a summary readable by humans, e.g. the number of entries and their highest level.
+// The body templates still surround the summary. Banners and the entry spacing don't apply to the attachment, the
+// batch metadata and reports of suppressed entries are part of it. The encoder needs to be a JSON encoder. Outputs not
+// implementing AttachmentWriter keep receiving the entries in the body. Disabled by default. Must be called before the
+// core is used.
+func (c *DelayedCore) SetNDJSONAttachment(enabled bool) error {
+	if enabled && !isJSONEncoder(c.enc) {
+		return fmt.Errorf("entries can only be attached as NDJSON with a JSON encoder")
+	}
+
+	c.ndjson = enabled
+	return nil
+}
+
+// SetGroupBy sets a function returning the group of an entry, e.g. the value of a "component" field. The entries
+// collected until a write are then partitioned by group, resulting in one message per group, in the order the groups
+// first appeared, with priority entries leading. Each message holds the sections, banners and metadata of its own
+// entries only, a report of suppressed entries goes to the first message. Outputs implementing GroupWriter learn the
+// group of a message, e.g. to mention it in the subject. Entries the function returns an empty string for form a group
+// of their own, written like ungrouped messages. The delays, limits and thresholds still apply to the queue as a
+// whole. Only the fields passed to the log call are handed to the function, not the ones added via With. Passing nil
+// disables the grouping. Must be called before the core is used.
+func (c *DelayedCore) SetGroupBy(groupBy func(ent zapcore.Entry, fields []zapcore.Field) string) {
+	c.groupBy = groupBy
+}
+
+// SetBodyTemplates sets text/templates rendered ahead of and after the entries of every message when it is written,
+// e.g. "This digest covers {{.Count}} events ({{.Priority}} priority) from {{.Start}} to {{.End}}.\n\n", see BodyData
+// for the available values. The prefix follows the batch metadata and the report of suppressed entries. The rendered
+// text is inserted as is, so it should end with a line break. Messages without entries and the ones of the digest
+// output are not decorated. A template failing to render is left out and the error is reported by the next call to
+// Write. Passing empty templates disables them. Must be called before the core is used.
+func (c *DelayedCore) SetBodyTemplates(prefix string, suffix string) error {
+	parse := func(name string, text string) (*template.Template, error) {
+		if text == "" {
+			return nil, nil
+		}
+		tmpl, errParse := template.New(name).Parse(text)
+		if errParse != nil {
+			return nil, fmt.Errorf("invalid body %s template: %s", name, errParse)
+		}
+		return tmpl, nil
+	}
+
+	tmplPrefix, errPrefix := parse("prefix", prefix)
+	if errPrefix != nil {
+		return errPrefix
+	}
+	tmplSuffix, errSuffix := parse("suffix", suffix)
+	if errSuffix != nil {
+		return errSuffix
+	}
+
+	c.bodyPrefix = tmplPrefix
+	c.bodySuffix = tmplSuffix
+	return nil
+}
+
+// SetDigestOutput sets a separate output receiving every entry of the given levels, e.g. a mail to an audit team that
+// wants everything, regardless of the level check, the filter and the priority routing of the mail queue. The digest
+// entries are written as a single message of their own whenever the queue is written, even while it is suppressed or
+// rate limited, and encoded by the constructor's encoder. An entry only enabled for the digest does not reach the mail
+// queue, but still starts the delay. Use a separate smtp.WriteSyncer as output to e.g. encrypt the digest for its
+// recipient only. Passing a nil output disables the digest. Must be called before the core is used.
+func (c *DelayedCore) SetDigestOutput(out zapcore.WriteSyncer, enab zapcore.LevelEnabler) {
+	c.digestOut = out
+	c.digestEnab = enab
+}
+
+// Enabled reports whether entries of the given level are accepted by the core, either by its own LevelEnabler or by
+// the one of the digest
+func (c *DelayedCore) Enabled(level zapcore.Level) bool {
+	return c.LevelEnabler.Enabled(level) || (c.digestOut != nil && c.digestEnab.Enabled(level))
+}
+
+// Level returns the minimum level accepted by the core, including the digest
+func (c *DelayedCore) Level() zapcore.Level {
+	level := zapcore.LevelOf(c.LevelEnabler)
+	if c.digestOut != nil {
+		if levelDigest := zapcore.LevelOf(c.digestEnab); levelDigest < level {
+			level = levelDigest
+		}
+	}
+	return level
+}
+
+// goroutineDumpLimit is the size the buffer of a goroutine dump may grow to, larger dumps are truncated
+const goroutineDumpLimit = 64 << 20
+
+// goroutineDump returns the stacks of all goroutines, growing the buffer until the dump fits or the limit is reached
+func goroutineDump() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= goroutineDumpLimit {
+			return buf[:n]
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+}
+
+// SetDiskQueue limits the memory used by the queued standard entries, e.g. on memory-constrained devices collecting
+// large batches of debug entries for a daily message. Once their encoded size exceeds the budget in bytes, further
+// standard entries are spilled to a temporary file in the given directory, the system's temporary directory if empty.
+// They are read back when the message is written or the queue is drained, which also removes the file, so syncing the
+// core on shutdown cleans up. Priority entries are always kept in memory. A budget of zero or below disables
+// spilling, which is the default. Must be called before the core is used.
+func (c *DelayedCore) SetDiskQueue(budget int, dir string) error {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if budget > 0 {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("invalid spill directory: %s", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("invalid spill directory: '%s' is not a directory", dir)
+		}
+	}
+
+	c.spillBudget = budget
+	c.spillDir = dir
+	return nil
+}
+
+// spillPool provides the buffers of the entries read back from the spill file
+var spillPool = buffer.NewPool()
+
+// spill appends the encoded entry to the spill file, creating it if necessary. Each entry is prefixed by its length,
+// so it can be read back as is. The group of the entry is kept in memory, if grouping. Must be called with the mutex
+// held.
+func (c *DelayedCore) spill(buf *buffer.Buffer, group entryGroup) error {
+	if c.spillFile == nil {
+		f, err := ioutil.TempFile(c.spillDir, "zapsmtp-queue-*")
+		if err != nil {
+			return err
+		}
+		c.spillFile, c.spillSize = f, 0
+	}
 
-	// Encode the message
-	buf, errEncode := c.enc.EncodeEntry(ent, fields)
+	record := make([]byte, 4, 4+buf.Len())
+	binary.BigEndian.PutUint32(record, uint32(buf.Len()))
+	record = append(record, buf.Bytes()...)
+	if _, err := c.spillFile.Write(record); err != nil {
+
+		// Discard a partially written record, so the next one starts at the right position
+		_ = c.spillFile.Truncate(c.spillSize)
+		_, _ = c.spillFile.Seek(c.spillSize, io.SeekStart)
+		return err
+	}
+	c.spillSize += int64(len(record))
+	c.spilled++
+	if c.groupBy != nil {
+		c.groupsSpilled = append(c.groupsSpilled, group)
+	}
+	return nil
+}
+
+// loadSpilled reads the spilled entries back into the queue of standard entries, after the ones kept in memory, and
+// removes the spill file. Must be called with the mutex held.
+func (c *DelayedCore) loadSpilled() error {
+	if c.spillFile == nil {
+		return nil
+	}
+	f, count, groups := c.spillFile, c.spilled, c.groupsSpilled
+	c.spillFile, c.spillSize, c.spilled, c.groupsSpilled = nil, 0, 0, nil
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("could not read spilled entries: %s", err)
+	}
+	r := bufio.NewReader(f)
+	for i := 0; i < count; i++ {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return fmt.Errorf("could not read spilled entries, %d lost: %s", count-i, err)
+		}
+		entry := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return fmt.Errorf("could not read spilled entries, %d lost: %s", count-i, err)
+		}
+		buf := spillPool.Get()
+		_, _ = buf.Write(entry)
+		c.entriesBuf = append(c.entriesBuf, buf)
+		c.memBytes += buf.Len()
+		if c.groupBy != nil {
+			c.groupsBuf = append(c.groupsBuf, groups[i])
+		}
+	}
+	return nil
+}
+
+// SetSuppression sets a predicate consulted whenever the collected entries are about to be sent, e.g. to silence
+// alerts during a maintenance window. While it returns true, batches are dropped or retained according to the policy.
+// The first message after the suppression lifted reports the number of affected entries. Retained entries are kept
+// in memory without limit and are lost if the program terminates meanwhile. Must be called before the core is used.
+func (c *DelayedCore) SetSuppression(active func(now time.Time) bool, policy SuppressionPolicy) {
+	c.suppress = active
+	c.suppressPolicy = policy
+}
+
+// SetRateLimit caps the number of messages written to the output per time window, e.g. to keep a flapping service
+// from exceeding the mail provider's limits. Up to n messages can be sent at once, after which the allowance refills
+// steadily over the window. While it is exhausted, batches are dropped or retained according to the policy. Retained
+// entries are coalesced into the next message. The first message sent afterward reports the number of affected
+// entries. Entries which may crash the program are always sent, but count towards the limit. Clones of the core, e.g.
+// created via With, are limited independently. Passing a non-positive n disables the limit. Must be called before the
+// core is used.
+func (c *DelayedCore) SetRateLimit(n int, window time.Duration, policy SuppressionPolicy) {
+	c.rateLimit = n
+	c.rateWindow = window
+	c.ratePolicy = policy
+}
+
+// takeToken refills the rate limit's allowance for the time passed and consumes a message of it, returning whether one
+// was left. It must be called with the mutex held.
+func (c *DelayedCore) takeToken(now time.Time) bool {
+	if c.rateUpdated.IsZero() || c.rateWindow <= 0 {
+		c.rateTokens = float64(c.rateLimit)
+	} else {
+		c.rateTokens += float64(c.rateLimit) * float64(now.Sub(c.rateUpdated)) / float64(c.rateWindow)
+		if c.rateTokens > float64(c.rateLimit) {
+			c.rateTokens = float64(c.rateLimit)
+		}
+	}
+	c.rateUpdated = now
+
+	if c.rateTokens < 1 {
+		return false
+	}
+	c.rateTokens--
+	return true
+}
+
+// SetSyncFailureHandler sets a function called if the immediate write triggered by a DPanic, Panic or Fatal entry
+// fails, with the entry and the error. The program is usually about to crash at this point, so the error returned by
+// Write is likely lost, and so is the alert. The handler can make the failure visible, e.g. by writing the entry to
+// stderr or handing it to a fallback. It is called synchronously before Write returns. Must be called before the core
+// is used.
+func (c *DelayedCore) SetSyncFailureHandler(handler func(ent zapcore.Entry, err error)) {
+	c.syncFailure = handler
+}
+
+func (c *DelayedCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+
+	// Queue the entry for the digest first, as it bypasses the level check and the filter below
+	if c.digestOut != nil && c.digestEnab.Enabled(ent.Level) {
+		if errDigest := c.queueDigest(ent, fields); errDigest != nil {
+			return errDigest
+		}
+	}
+
+	// Drop entries only enabled for the digest. Still flush the queue if we may be crashing the program.
+	if !c.LevelEnabler.Enabled(ent.Level) && !c.priority.Enabled(ent.Level) {
+		if ent.Level > zapcore.ErrorLevel {
+			return c.syncCritical(ent)
+		}
+		return nil
+	}
+
+	// Drop entries not matching the filter before spending time on encoding them. Still flush the queue if we may be
+	// crashing the program.
+	if c.filter != nil && !c.filter(ent, fields) {
+		if ent.Level > zapcore.ErrorLevel {
+			return c.syncCritical(ent)
+		}
+		return nil
+	}
+
+	// Decide on the section and group of the entry
+	isPriority := c.priority.Enabled(ent.Level) || (c.priorityFunc != nil && c.priorityFunc(ent, fields))
+	group := entryGroup{level: ent.Level}
+	if c.groupBy != nil {
+		group.name = c.groupBy(ent, fields)
+	}
+
+	// Encode the message right away, with the encoder of its section. Deferring the encoding to Sync would save work
+	// for entries which are never sent, but fields may reference values that change until then. Filtered entries
+	// already skip the encoding above.
+	enc := c.enc
+	if isPriority && c.priorityEnc != nil {
+		enc = c.priorityEnc
+	}
+	buf, errEncode := c.encodeEntry(enc, ent, fields)
 	if errEncode != nil {
 		return errEncode
 	}
 
+	// Drop entries without content, e.g. because the encoder omits all keys, which would result in a message of banners
+	// only. Still flush the queue if we may be crashing the program.
+	if len(bytes.TrimSpace(buf.Bytes())) == 0 {
+		buf.Free()
+		if ent.Level > zapcore.ErrorLevel {
+			return c.syncCritical(ent)
+		}
+		return nil
+	}
+
 	// Request mutex to avoid sending out partial messages
 	c.mutex.Lock()
 
 	// Start timer on first message
 	startRoutine := false
-	if len(c.entriesBuf) == 0 && len(c.entriesPriorityBuf) == 0 {
+	if len(c.entriesBuf) == 0 && len(c.entriesPriorityBuf) == 0 && len(c.digestBuf) == 0 {
 		// Start timer with the default (non priority) duration
 		c.timeStart = time.Now()
 		c.timer = time.NewTimer(c.delay)
@@ -109,26 +662,64 @@ func (c *delayedCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
 	}
 
 	// Check whether timer needs to execute sooner
-	if len(c.entriesBuf)+len(c.entriesPriorityBuf) >= 20 {
+	flushPriority := false
+	if c.maxEntries > 0 && len(c.entriesBuf)+len(c.entriesPriorityBuf)+c.spilled >= c.maxEntries {
 
 		// Cached messages are getting too much, SMTP delivery might not be guaranteed anymore, send messages now.
 		// A negative duration leads to the timer firing immediately.
 		c.timer.Reset(-1)
 
-	} else if c.priority.Enabled(ent.Level) && len(c.entriesPriorityBuf) == 0 {
+	} else if isPriority && len(c.entriesPriorityBuf)+1 == c.priorityMin && c.delayPriority == 0 {
 
-		// Update the timer duration if this is the first entry with a priority level. In case the timer has already
-		// expired, we would reset it to a negative duration, because it is enforced that the priority delay is smaller
-		// than the regular delay. A negative duration leads to the timer firing immediately.
+		// Without priority delay, the entries are written right away below, bypassing the timer
+		flushPriority = true
+
+	} else if isPriority && len(c.entriesPriorityBuf)+1 == c.priorityMin {
+
+		// Update the timer duration if this entry reaches the required number of priority entries. In case the timer
+		// has already expired, we would reset it to a negative duration, because it is enforced that the priority
+		// delay is smaller than the regular delay. A negative duration leads to the timer firing immediately.
 		remainingDuration := c.delayPriority - time.Since(c.timeStart)
 		c.timer.Reset(remainingDuration)
 	}
 
 	// Add message to queue
-	if c.priority.Enabled(ent.Level) {
+	if isPriority {
+		if len(c.entriesPriorityBuf) == 0 || ent.Level > c.levelPriority {
+			c.levelPriority = ent.Level
+		}
 		c.entriesPriorityBuf = append(c.entriesPriorityBuf, buf)
-	} else if c.Enabled(ent.Level) {
-		c.entriesBuf = append(c.entriesBuf, buf)
+		if c.groupBy != nil {
+			c.groupsPriorityBuf = append(c.groupsPriorityBuf, group)
+		}
+	} else if c.LevelEnabler.Enabled(ent.Level) {
+		if len(c.entriesBuf) == 0 || ent.Level > c.levelStandard {
+			c.levelStandard = ent.Level
+		}
+
+		// Spill the entry to disk if it would exceed the memory budget. Once entries were spilled, all further ones
+		// follow them, as the spilled entries are read back after the ones in memory. The first entry always stays in
+		// memory, so the queue is never empty while entries are spilled. Keep the entry in memory if it can't be
+		// spilled.
+		spilled := false
+		if c.spillBudget > 0 && len(c.entriesBuf) > 0 && (c.spillFile != nil || c.memBytes+buf.Len() > c.spillBudget) {
+			if errSpill := c.spill(buf, group); errSpill != nil {
+				select {
+				case c.errCh <- fmt.Errorf("could not spill entry to disk, keeping it in memory: %s", errSpill):
+				default:
+				}
+			} else {
+				buf.Free()
+				spilled = true
+			}
+		}
+		if !spilled {
+			c.memBytes += buf.Len()
+			c.entriesBuf = append(c.entriesBuf, buf)
+			if c.groupBy != nil {
+				c.groupsBuf = append(c.groupsBuf, group)
+			}
+		}
 	}
 
 	// At this point we're not accessing the message slices anymore
@@ -137,7 +728,12 @@ func (c *delayedCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
 	// Since we may be crashing the program, sync the output. Ignore Sync
 	// errors, pending a clean solution to issue #370.
 	if ent.Level > zapcore.ErrorLevel {
-		errSync := c.Sync()
+		errSync := c.syncCritical(ent)
+		if errSync != nil {
+			return errSync
+		}
+	} else if flushPriority {
+		errSync := c.sync(false, nil)
 		if errSync != nil {
 			return errSync
 		}
@@ -145,14 +741,7 @@ func (c *delayedCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
 
 	// Start a new goroutine for syncing after the timer expired
 	if startRoutine {
-		go func() {
-			<-c.timer.C
-
-			errSync := c.Sync()
-			if errSync != nil {
-				c.errCh <- errSync
-			}
-		}()
+		go c.awaitTimer(c.timer)
 	}
 
 	// Check if there are errors of a previous sync routines
@@ -170,56 +759,863 @@ loop:
 	return errs
 }
 
+// awaitTimer syncs the core whenever the timer expires. Retained entries need another attempt later on, as no new
+// routine is started while the queue is not empty.
+func (c *DelayedCore) awaitTimer(timer *time.Timer) {
+	for {
+		<-timer.C
+
+		// Stop if the queue was drained meanwhile, a new routine handles later entries
+		c.mutex.Lock()
+		current := c.timer == timer
+		c.mutex.Unlock()
+		if !current {
+			return
+		}
+
+		errSync := c.Sync()
+		if errSync != nil {
+			c.errCh <- errSync
+		}
+
+		c.mutex.Lock()
+		pending := c.timer == timer && (len(c.entriesBuf) > 0 || len(c.entriesPriorityBuf) > 0 || len(c.digestBuf) > 0)
+		if pending {
+			timer.Reset(c.delay)
+		}
+		c.mutex.Unlock()
+		if !pending {
+			return
+		}
+	}
+}
+
+// queueDigest encodes the entry and adds it to the digest queue, starting the timer if it is the first queued entry.
+// Too many digest entries trigger an immediate write, like the ones of the mail queue.
+func (c *DelayedCore) queueDigest(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, errEncode := c.encodeEntry(c.enc, ent, fields)
+	if errEncode != nil {
+		return errEncode
+	}
+	if len(bytes.TrimSpace(buf.Bytes())) == 0 {
+		buf.Free()
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.entriesBuf) == 0 && len(c.entriesPriorityBuf) == 0 && len(c.digestBuf) == 0 {
+		c.timeStart = time.Now()
+		c.timer = time.NewTimer(c.delay)
+		go c.awaitTimer(c.timer)
+	} else if c.maxEntries > 0 && len(c.digestBuf)+1 >= c.maxEntries {
+		c.timer.Reset(-1)
+	}
+	if len(c.digestBuf) == 0 || ent.Level > c.levelDigest {
+		c.levelDigest = ent.Level
+	}
+	c.digestBuf = append(c.digestBuf, buf)
+	return nil
+}
+
+// placeholderEncoder encodes the placeholders of entries the configured encoder panicked on. Its configuration is fixed
+// and does not include the caller or stack trace, so it can't fail itself.
+var placeholderEncoder = zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+	MessageKey:     "msg",
+	LevelKey:       "level",
+	NameKey:        "logger",
+	TimeKey:        "ts",
+	LineEnding:     zapcore.DefaultLineEnding,
+	EncodeLevel:    zapcore.LowercaseLevelEncoder,
+	EncodeTime:     zapcore.ISO8601TimeEncoder,
+	EncodeDuration: zapcore.StringDurationEncoder,
+})
+
+// encodeEntry encodes the entry with the given encoder. If the encoder panics, e.g. because of a bug in a custom
+// implementation, a placeholder stating the panic is returned instead of taking down the program. The panic is reported
+// as an error by the next call to Write, which zap prints to its error output.
+func (c *DelayedCore) encodeEntry(
+	enc zapcore.Encoder,
+	ent zapcore.Entry,
+	fields []zapcore.Field,
+) (buf *buffer.Buffer, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		buf, err = placeholderEncoder.EncodeEntry(
+			zapcore.Entry{Level: ent.Level, Time: ent.Time, LoggerName: ent.LoggerName, Message: ent.Message},
+			[]zapcore.Field{{Key: "encoderPanic", Type: zapcore.StringType, String: fmt.Sprint(r)}},
+		)
+		select {
+		case c.errCh <- fmt.Errorf("encoder panicked, sending placeholder instead: %v", r):
+		default:
+		}
+	}()
+
+	return enc.EncodeEntry(ent, fields)
+}
+
+// syncCritical syncs the output for an entry which may crash the program, attaching a goroutine dump if desired and
+// reporting a failure to the handler
+func (c *DelayedCore) syncCritical(ent zapcore.Entry) error {
+	var attachments []Attachment
+	if c.dumpStacks {
+		attachments = []Attachment{{Name: "goroutines.txt", Data: goroutineDump()}}
+	}
+	err := c.sync(true, attachments)
+	if err != nil && c.syncFailure != nil {
+		c.syncFailure(ent, err)
+	}
+	return err
+}
+
+// Drain removes all queued entries and returns them encoded, priority entries first, without writing them to the
+// output. The pending delayed write is canceled. This allows to e.g. hand over the entries to another system on
+// shutdown.
+func (c *DelayedCore) Drain() [][]byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Read back the spilled entries, a failure is reported by the next call to Write
+	if errLoad := c.loadSpilled(); errLoad != nil {
+		select {
+		case c.errCh <- errLoad:
+		default:
+		}
+	}
+
+	// Copy the entries, as the buffers are returned to the pool
+	entries := make([][]byte, 0, len(c.entriesPriorityBuf)+len(c.entriesBuf))
+	for _, buf := range c.entriesPriorityBuf {
+		entries = append(entries, append([]byte(nil), buf.Bytes()...))
+		buf.Free()
+	}
+	for _, buf := range c.entriesBuf {
+		entries = append(entries, append([]byte(nil), buf.Bytes()...))
+		buf.Free()
+	}
+
+	// Clear the slices but keep the allocated memory
+	c.entriesPriorityBuf = c.entriesPriorityBuf[:0]
+	c.entriesBuf = c.entriesBuf[:0]
+	c.groupsPriorityBuf = c.groupsPriorityBuf[:0]
+	c.groupsBuf = c.groupsBuf[:0]
+	c.memBytes = 0
+
+	// The digest entries are discarded, as they duplicate the returned ones or were never meant for the queue
+	for _, buf := range c.digestBuf {
+		buf.Free()
+	}
+	c.digestBuf = c.digestBuf[:0]
+
+	// Retained entries are gone now and must not be reported anymore
+	if c.suppressPolicy == SuppressRetain {
+		c.suppressed = 0
+	}
+	if c.ratePolicy == SuppressRetain {
+		c.limited = 0
+	}
+
+	// Let the waiting routine exit right away, the next entry starts a new timer
+	if c.timer != nil {
+		c.timer.Reset(0)
+		c.timer = nil
+	}
+
+	return entries
+}
+
 // Sync will create and send the message to the writer
-func (c *delayedCore) Sync() error {
+func (c *DelayedCore) Sync() error {
+	return c.sync(false, nil)
+}
+
+// sync creates and sends the message to the writer. Critical syncs, triggered by entries which may crash the program,
+// are not held back by the rate limit. The attachments go along with the priority section, which holds such entries.
+func (c *DelayedCore) sync(critical bool, attachments []Attachment) error {
+
+	// Wait for the messages of preceding syncs to be written, keeping the order of the messages
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 
 	// Request mutex to avoid changes to messages while resetting everything
 	c.mutex.Lock()
 
-	// Combine the priority and standard messages and prepend a nice header.
-	msg := make([]byte, 0, 1024*(len(c.entriesPriorityBuf)+len(c.entriesBuf))) // Assume a default log size of 1 KiB
-	if len(c.entriesPriorityBuf) > 0 {
-		msg = append(msg, []byte("=== Priority Log ===\n")...)
-		for _, buf := range c.entriesPriorityBuf {
-			msg = append(msg, buf.Bytes()...)
-			buf.Free()
+	// Read back the spilled entries, so they are handled like the ones in memory. Spilled entries which could not be
+	// read are lost, but must not keep the others from being sent.
+	errLoad := c.loadSpilled()
+
+	// Compose the digest, which is written regardless of a suppression or rate limit
+	var digest batch
+	if len(c.digestBuf) > 0 {
+		digest = batch{msg: c.compose(nil, c.digestBuf, ""), level: c.levelDigest, count: len(c.digestBuf)}
+		c.digestBuf = c.digestBuf[:0]
+	}
+	writeDigest := func() error {
+		if len(digest.msg) == 0 {
+			return nil
 		}
+		return writeMessage(c.digestOut, digest.msg, digest.level, digest.count, "", nil)
+	}
 
-		msg = append(msg, []byte("\n")...)
-		msg = append(msg, []byte("\n")...)
+	// Hold back the entries while suppressed, keeping track of how many were affected
+	if c.suppress != nil && c.suppress(time.Now()) {
+		if c.suppressPolicy == SuppressRetain {
+			c.suppressed = len(c.entriesPriorityBuf) + len(c.entriesBuf)
+		} else {
+			c.suppressed += len(c.entriesPriorityBuf) + len(c.entriesBuf)
+			for _, buf := range c.entriesPriorityBuf {
+				buf.Free()
+			}
+			for _, buf := range c.entriesBuf {
+				buf.Free()
+			}
+			c.entriesPriorityBuf = c.entriesPriorityBuf[:0]
+			c.entriesBuf = c.entriesBuf[:0]
+			c.groupsPriorityBuf = c.groupsPriorityBuf[:0]
+			c.groupsBuf = c.groupsBuf[:0]
+			c.memBytes = 0
+		}
+		c.mutex.Unlock()
+		return multierr.Append(errLoad, writeDigest())
+	}
 
-		// Clear the slice but keep the allocated memory
+	// Hold back the entries while the rate limit is exhausted, keeping track of how many were affected
+	queued := len(c.entriesPriorityBuf) + len(c.entriesBuf)
+	if c.rateLimit > 0 && queued > 0 && !c.takeToken(time.Now()) && !critical {
+		if c.ratePolicy == SuppressRetain {
+			c.limited = queued
+		} else {
+			c.limited += queued
+			for _, buf := range c.entriesPriorityBuf {
+				buf.Free()
+			}
+			for _, buf := range c.entriesBuf {
+				buf.Free()
+			}
+			c.entriesPriorityBuf = c.entriesPriorityBuf[:0]
+			c.entriesBuf = c.entriesBuf[:0]
+			c.groupsPriorityBuf = c.groupsPriorityBuf[:0]
+			c.groupsBuf = c.groupsBuf[:0]
+			c.memBytes = 0
+		}
+		c.mutex.Unlock()
+		return multierr.Append(errLoad, writeDigest())
+	}
+
+	// Report the entries affected by a preceding suppression or rate limit
+	var report string
+	if c.suppressed > 0 {
+		action := "dropped"
+		if c.suppressPolicy == SuppressRetain {
+			action = "retained"
+		}
+		if c.banners {
+			report = fmt.Sprintf("=== Suppressed: %d entries %s ===\n\n", c.suppressed, action)
+		} else {
+			report = fmt.Sprintf("{\"type\":\"zapsmtp_suppressed\",\"%s\":%d}\n", action, c.suppressed)
+		}
+		c.suppressed = 0
+	}
+	if c.limited > 0 {
+		action := "dropped"
+		if c.ratePolicy == SuppressRetain {
+			action = "retained"
+		}
+		if c.banners {
+			report += fmt.Sprintf("=== Rate limited: %d entries %s ===\n\n", c.limited, action)
+		} else {
+			report += fmt.Sprintf("{\"type\":\"zapsmtp_rate_limited\",\"%s\":%d}\n", action, c.limited)
+		}
+		c.limited = 0
+	}
+
+	// Split off the priority section if it goes to a separate output
+	var batchesPriority []batch
+	if c.priorityOut != nil && len(c.entriesPriorityBuf) > 0 {
+		batchesPriority = c.composeBatches(
+			c.entriesPriorityBuf, nil, c.groupsPriorityBuf, nil, "", c.ndjson && isAttachmentWriter(c.priorityOut),
+		)
 		c.entriesPriorityBuf = c.entriesPriorityBuf[:0]
+		c.groupsPriorityBuf = c.groupsPriorityBuf[:0]
+	}
+	batches := c.composeBatches(
+		c.entriesPriorityBuf, c.entriesBuf, c.groupsPriorityBuf, c.groupsBuf, report, c.ndjson && isAttachmentWriter(c.out),
+	)
+
+	// Clear the slices but keep the allocated memory
+	c.entriesPriorityBuf = c.entriesPriorityBuf[:0]
+	c.entriesBuf = c.entriesBuf[:0]
+	c.groupsPriorityBuf = c.groupsPriorityBuf[:0]
+	c.groupsBuf = c.groupsBuf[:0]
+	c.memBytes = 0
+
+	// At this point we're not accessing the message slices anymore
+	c.mutex.Unlock()
+
+	// Write the messages, a failure of the priority output or of a group must not keep the others from being sent.
+	// The attachments go along with the first message, following the ones of the message itself.
+	errs := errLoad
+	for _, b := range batchesPriority {
+		errs = multierr.Append(
+			errs, writeMessage(c.priorityOut, b.msg, b.level, b.count, b.group, append(b.attachments, attachments...)),
+		)
+		attachments = nil
+	}
+	sent, written := false, false
+	for _, b := range batches {
+		errOut := writeMessage(c.out, b.msg, b.level, b.count, b.group, append(b.attachments, attachments...))
+		attachments = nil
+		errs = multierr.Append(errs, errOut)
+		sent = sent || (errOut == nil && len(b.msg) > 0)
+		written = written || len(b.msg) > 0
+	}
+
+	// Flush the output nonetheless if syncing was requested, as expected from a zap core, but not for critical entries
+	// which were all dropped, e.g. for being blank
+	if !written && !critical {
+		errs = multierr.Append(errs, c.out.Sync())
+	}
+	if sent {
+		c.mutex.Lock()
+		c.lastSend = time.Now()
+		c.mutex.Unlock()
+	}
+	return multierr.Append(errs, writeDigest())
+}
+
+// composeBatches composes the priority and standard entries into a single message, or one message per group if
+// grouping. The groups are needed for the latter only. The report goes to the first message. The entries are attached
+// as NDJSON if attach is set, see composeBody. Must be called with the mutex held.
+func (c *DelayedCore) composeBatches(
+	priority []*buffer.Buffer,
+	standard []*buffer.Buffer,
+	groupsPriority []entryGroup,
+	groupsStandard []entryGroup,
+	report string,
+	attach bool,
+) []batch {
+
+	// Combine all entries if not grouping, or if there is nothing to partition, e.g. just a report
+	if c.groupBy == nil || len(priority)+len(standard) == 0 {
+		level := c.levelStandard
+		if len(priority) > 0 && (len(standard) == 0 || c.levelPriority > level) {
+			level = c.levelPriority
+		}
+		msg, attachments := c.composeBody(priority, standard, report, level, "", attach)
+		return []batch{{
+			msg:         msg,
+			level:       level,
+			count:       len(priority) + len(standard),
+			attachments: attachments,
+		}}
+	}
+
+	// Partition the entries by group, in the order the groups first appeared
+	type partition struct {
+		priority []*buffer.Buffer
+		standard []*buffer.Buffer
+		level    zapcore.Level
+	}
+	var names []string
+	partitions := make(map[string]*partition)
+	get := func(group entryGroup) *partition {
+		p, ok := partitions[group.name]
+		if !ok {
+			p = &partition{level: group.level}
+			partitions[group.name] = p
+			names = append(names, group.name)
+		}
+		if group.level > p.level {
+			p.level = group.level
+		}
+		return p
+	}
+	for i, buf := range priority {
+		p := get(groupsPriority[i])
+		p.priority = append(p.priority, buf)
+	}
+	for i, buf := range standard {
+		p := get(groupsStandard[i])
+		p.standard = append(p.standard, buf)
+	}
+
+	batches := make([]batch, 0, len(names))
+	for i, name := range names {
+		p := partitions[name]
+		if i > 0 {
+			report = ""
+		}
+		msg, attachments := c.composeBody(p.priority, p.standard, report, p.level, name, attach)
+		batches = append(batches, batch{
+			msg:         msg,
+			level:       p.level,
+			count:       len(p.priority) + len(p.standard),
+			group:       name,
+			attachments: attachments,
+		})
+	}
+	return batches
+}
+
+// composeBody composes a message like compose, surrounded by the rendered body templates if set and there are entries.
+// If attach is set, the entries are returned as NDJSON attachment instead, with a summary taking their place in the
+// message. A failing template is left out and reported by the next call to Write. Must be called with the mutex held.
+func (c *DelayedCore) composeBody(
+	priority []*buffer.Buffer,
+	standard []*buffer.Buffer,
+	report string,
+	level zapcore.Level,
+	group string,
+	attach bool,
+) ([]byte, []Attachment) {
+	if (c.bodyPrefix == nil && c.bodySuffix == nil && !attach) || len(priority)+len(standard) == 0 {
+		return c.compose(priority, standard, report), nil
+	}
+
+	data := BodyData{
+		Count:    len(priority) + len(standard),
+		Priority: len(priority),
+		Standard: len(standard),
+		Level:    level.String(),
+		Group:    group,
+		Start:    c.timeStart,
+		End:      time.Now(),
+	}
+	render := func(tmpl *template.Template) string {
+		if tmpl == nil {
+			return ""
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			select {
+			case c.errCh <- fmt.Errorf("could not render body template: %s", err):
+			default:
+			}
+			return ""
+		}
+		return b.String()
+	}
+
+	// Summarize the entries in the message and attach them as they are
+	if attach {
+		summary := fmt.Sprintf(
+			"%d log entries (%d priority, %d standard), highest level %s, collected from %s to %s.\n",
+			data.Count, data.Priority, data.Standard, data.Level,
+			data.Start.UTC().Format(time.RFC3339), data.End.UTC().Format(time.RFC3339),
+		)
+		if group != "" {
+			summary += fmt.Sprintf("Group: %s\n", group)
+		}
+		summary += "The entries are attached as events.ndjson, one JSON object per line.\n"
+		msg := []byte(render(c.bodyPrefix) + summary + render(c.bodySuffix))
+		return msg, []Attachment{{
+			Name:        "events.ndjson",
+			ContentType: "application/x-ndjson",
+			Data:        c.composeEvents(priority, standard, report),
+		}}
+	}
+
+	// The prefix follows the metadata and report, so they keep leading the message
+	msg := c.compose(priority, standard, report+render(c.bodyPrefix))
+	return append(msg, render(c.bodySuffix)...), nil
+}
+
+// FlushAndClose writes the queued entries, waits for messages still being written by the delayed writes and closes the
+// outputs implementing io.Closer afterward, e.g. a WriteSyncCloser removing its temporary files. It replaces calling
+// Sync and closing the outputs separately on shutdown. The final write is not held back by the rate limit, but
+// entries retained during a suppression are lost. If the context ends first, the context's error is returned and the
+// outputs are left open, as they are still in use. The errors of the write and of closing the outputs are combined.
+// The core must not be used afterward.
+func (c *DelayedCore) FlushAndClose(ctx context.Context) error {
+
+	// Write the queue in the background, waiting for preceding writes, so the context can end the wait
+	done := make(chan error, 1)
+	go func() {
+		done <- c.sync(true, nil)
+	}()
+	var errs error
+	select {
+	case err := <-done:
+		errs = err
+	case <-ctx.Done():
+		return fmt.Errorf("could not flush queued entries: %w", ctx.Err())
+	}
+
+	// Let the waiting routine exit right away, the queue is empty now
+	c.mutex.Lock()
+	if c.timer != nil {
+		c.timer.Reset(0)
+		c.timer = nil
+	}
+	c.mutex.Unlock()
+
+	// Close the outputs, each one only once
+	outs := []zapcore.WriteSyncer{c.out}
+	if c.priorityOut != nil && c.priorityOut != c.out {
+		outs = append(outs, c.priorityOut)
+	}
+	if c.digestOut != nil && c.digestOut != c.out && c.digestOut != c.priorityOut {
+		outs = append(outs, c.digestOut)
+	}
+	for _, out := range outs {
+		if closer, ok := out.(io.Closer); ok {
+			errs = multierr.Append(errs, closer.Close())
+		}
+	}
+	return errs
+}
+
+// StartHeartbeat sends a small heartbeat message to the output whenever no message was written for the given
+// interval, e.g. to feed a dead man's switch confirming that the alerting pipeline is alive. No heartbeats are sent
+// while mails are suppressed. Errors are reported by the next call to Write. The returned function stops the
+// heartbeats, it must be called once the core is not used anymore.
+func (c *DelayedCore) StartHeartbeat(interval time.Duration) (stop func()) {
+	c.mutex.Lock()
+	c.lastSend = time.Now()
+	c.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+
+			wait, err := c.writeHeartbeat(interval)
+			if err != nil {
+				select {
+				case c.errCh <- err:
+				default:
+				}
+			}
+			timer.Reset(wait)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// writeHeartbeat writes a heartbeat message to the output, unless mails are suppressed or a message was sent within
+// the given interval. It holds the write mutex like Sync, so heartbeats never interleave with flushed batches. The
+// time to wait until the next heartbeat is due is returned.
+func (c *DelayedCore) writeHeartbeat(interval time.Duration) (time.Duration, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	// Wait for the remainder of the interval if a message was sent meanwhile
+	c.mutex.Lock()
+	idle := time.Since(c.lastSend)
+	c.mutex.Unlock()
+	if idle < interval {
+		return interval - idle, nil
+	}
+
+	now := time.Now()
+	if c.suppress != nil && c.suppress(now) {
+		return interval, nil
+	}
+
+	msg := fmt.Sprintf("{\"type\":\"zapsmtp_heartbeat\",\"generated\":\"%s\"}\n", now.UTC().Format(time.RFC3339Nano))
+	if c.banners {
+		msg = fmt.Sprintf("=== Heartbeat: %s ===\n", now.UTC().Format(time.RFC3339))
+	}
+	if err := writeMessage(c.out, []byte(msg), zapcore.InfoLevel, 0, "", nil); err != nil {
+		return interval, err
+	}
+
+	c.mutex.Lock()
+	c.lastSend = now
+	c.mutex.Unlock()
+	return interval, nil
+}
+
+// compose combines the priority and standard entries into a message, prepending the batch metadata, the given
+// suppression report and the banners as configured. The buffers of the entries are returned to the pool.
+func (c *DelayedCore) compose(priority []*buffer.Buffer, standard []*buffer.Buffer, report string) []byte {
+
+	// Calculate the size of the message, so it can be allocated at once
+	size := len("=== Priority Log ===\n\n\n") + len("=== Standard Log ===\n")
+	for _, buf := range priority {
+		size += buf.Len() + 2
+	}
+	for _, buf := range standard {
+		size += buf.Len() + 2
+	}
+
+	// Describe the batch in a leading line if desired
+	meta := c.batchMetadata(len(priority), len(standard))
+	size += len(meta) + len(report)
+
+	// Combine the priority and standard messages and prepend a nice header.
+	msg := make([]byte, 0, size)
+	msg = append(msg, meta...)
+	msg = append(msg, report...)
+	if len(priority) > 0 {
+		if c.banners {
+			msg = append(msg, []byte("=== Priority Log ===\n")...)
+		}
+		msg = c.appendEntries(msg, priority)
+
+		if c.banners {
+			msg = append(msg, []byte("\n")...)
+			msg = append(msg, []byte("\n")...)
+		}
 	}
 
-	if len(c.entriesBuf) > 0 {
-		msg = append(msg, []byte("=== Standard Log ===\n")...)
-		for _, buf := range c.entriesBuf {
+	if len(standard) > 0 {
+		if c.banners {
+			msg = append(msg, []byte("=== Standard Log ===\n")...)
+		}
+		msg = c.appendEntries(msg, standard)
+	}
+
+	return msg
+}
+
+// composeEvents combines the priority and standard entries into newline delimited JSON, one entry per line, preceded
+// by the batch metadata and the given suppression report. Banners and the entry spacing don't apply. The buffers of
+// the entries are returned to the pool.
+func (c *DelayedCore) composeEvents(priority []*buffer.Buffer, standard []*buffer.Buffer, report string) []byte {
+	meta := c.batchMetadata(len(priority), len(standard))
+	events := make([]byte, 0, len(meta)+len(report))
+	events = append(events, meta...)
+	events = append(events, report...)
+	for _, entries := range [][]*buffer.Buffer{priority, standard} {
+		for _, buf := range entries {
+			events = append(events, bytes.TrimRight(buf.Bytes(), "\r\n")...)
+			events = append(events, '\n')
+			buf.Free()
+		}
+	}
+	return events
+}
+
+// batchMetadata returns the line describing a batch with the given number of entries if desired, an empty string
+// otherwise
+func (c *DelayedCore) batchMetadata(priority int, standard int) string {
+	if !c.metadata || priority+standard == 0 {
+		return ""
+	}
+	return fmt.Sprintf(
+		"{\"type\":\"zapsmtp_batch\",\"priority\":%d,\"standard\":%d,\"generated\":\"%s\"}\n",
+		priority,
+		standard,
+		time.Now().UTC().Format(time.RFC3339Nano),
+	)
+}
+
+// appendEntries appends the entries to the message, separated according to the configured spacing, and returns their
+// buffers to the pool
+func (c *DelayedCore) appendEntries(msg []byte, entries []*buffer.Buffer) []byte {
+	for i, buf := range entries {
+		if c.spacing == EntrySpacingEncoder {
 			msg = append(msg, buf.Bytes()...)
 			buf.Free()
+			continue
 		}
 
-		// Clear the slice but keep the allocated memory
-		c.entriesBuf = c.entriesBuf[:0]
+		msg = append(msg, bytes.TrimRight(buf.Bytes(), "\r\n")...)
+		switch c.spacing {
+		case EntrySpacingLine:
+			msg = append(msg, '\n')
+		case EntrySpacingBlankLine:
+			msg = append(msg, '\n')
+			if i < len(entries)-1 {
+				msg = append(msg, '\n')
+			}
+		}
+		buf.Free()
 	}
+	return msg
+}
 
-	// At this point we're not accessing the message slices anymore
-	c.mutex.Unlock()
+// isAttachmentWriter reports whether the output is able to receive attachments, see AttachmentWriter
+func isAttachmentWriter(out zapcore.WriteSyncer) bool {
+	_, ok := out.(AttachmentWriter)
+	return ok
+}
 
-	_, err := c.out.Write(msg)
-	if err != nil {
-		// Stored message to be picked up by next call to core's Write method
-		return err
+// writeMessage writes the message to the output, continuing after partial writes until it is complete, and syncs it.
+// The level and count describing the message are handed to outputs implementing BatchWriter, along with the group to
+// ones implementing GroupWriter, the attachments to ones implementing AttachmentWriter along with the first part of
+// the message.
+func writeMessage(
+	out zapcore.WriteSyncer,
+	msg []byte,
+	level zapcore.Level,
+	count int,
+	group string,
+	attachments []Attachment,
+) error {
+
+	// Nothing to flush if there is nothing to write, e.g. because all entries of the batch were dropped as blank
+	if len(msg) == 0 {
+		return nil
 	}
 
-	return c.out.Sync()
+	write := out.Write
+	if gw, ok := out.(GroupWriter); ok && group != "" {
+		write = func(p []byte) (int, error) {
+			return gw.WriteGroup(p, level, count, group)
+		}
+	} else if bw, ok := out.(BatchWriter); ok {
+		write = func(p []byte) (int, error) {
+			return bw.WriteBatch(p, level, count)
+		}
+	}
+	if aw, ok := out.(AttachmentWriter); ok && len(attachments) > 0 && len(msg) > 0 {
+		n, err := aw.WriteAttachments(msg, level, count, attachments)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return io.ErrShortWrite
+		}
+		msg = msg[n:]
+	}
+
+	for len(msg) > 0 {
+		n, err := write(msg)
+		if err != nil {
+			// Stored message to be picked up by next call to core's Write method
+			return err
+		}
+		if n <= 0 {
+			// Writer refuses to make progress without reporting an error, stop instead of looping forever
+			return io.ErrShortWrite
+		}
+		msg = msg[n:]
+	}
+
+	return out.Sync()
 }
 
-func (c *delayedCore) clone() *delayedCore {
-	return &delayedCore{
+// Describe returns a human-readable summary of the effective configuration, one setting per line, e.g. to be logged on
+// startup or attached to a support ticket. Functions like the filter are only stated to be set. The outputs describe
+// themselves, e.g. via the Describe method of the WriteSyncer.
+func (c *DelayedCore) Describe() string {
+	var b strings.Builder
+	line := func(name string, format string, args ...interface{}) {
+		_, _ = fmt.Fprintf(&b, "%s: %s\n", name, fmt.Sprintf(format, args...))
+	}
+	set := func(f bool) string {
+		if f {
+			return "set"
+		}
+		return "not set"
+	}
+	policy := func(p SuppressionPolicy) string {
+		if p == SuppressRetain {
+			return "retain"
+		}
+		return "drop"
+	}
+
+	// Describe the levels and delays
+	line("Level", "%s and above", zapcore.LevelOf(c.LevelEnabler))
+	line("Priority level", "%s and above", zapcore.LevelOf(c.priority))
+	line("Delay", "%s", c.delay)
+	if c.delayPriority == 0 {
+		line("Priority delay", "none, written immediately")
+	} else {
+		line("Priority delay", "%s", c.delayPriority)
+	}
+	line("Priority threshold", "%d entries", c.priorityMin)
+	if c.maxEntries > 0 {
+		line("Max entries", "%d", c.maxEntries)
+	} else {
+		line("Max entries", "unlimited")
+	}
+
+	// Describe the composition of the messages
+	line("Banners", "%t", c.banners)
+	line("Batch metadata", "%t", c.metadata)
+	line("Separate priority output", "%t", c.priorityOut != nil)
+	line("Separate priority encoder", "%t", c.priorityEnc != nil)
+	line("Filter", "%s", set(c.filter != nil))
+	line("Priority function", "%s", set(c.priorityFunc != nil))
+	line("Grouping", "%s", set(c.groupBy != nil))
+	line("Body templates", "%s", set(c.bodyPrefix != nil || c.bodySuffix != nil))
+	if c.digestOut != nil {
+		line("Digest", "%s and above", zapcore.LevelOf(c.digestEnab))
+	}
+	line("Goroutine dump", "%t", c.dumpStacks)
+	line("NDJSON attachment", "%t", c.ndjson)
+
+	// Describe the limits
+	if c.suppress != nil {
+		line("Suppression", "set, %s entries", policy(c.suppressPolicy))
+	}
+	if c.rateLimit > 0 {
+		line("Rate limit", "%d per %s, %s entries", c.rateLimit, c.rateWindow, policy(c.ratePolicy))
+	}
+	if c.spillBudget > 0 {
+		line("Disk queue", "beyond %d bytes, in %s", c.spillBudget, c.spillDir)
+	}
+
+	return b.String()
+}
+
+// clone returns a core with the same configuration and an empty queue of its own. The clone collects the entries of
+// the derived logger and sends them independently.
+// The delays are copied as they are, they were already validated by the constructor and With has no way to report
+// an error.
+func (c *DelayedCore) clone() *DelayedCore {
+
+	// Clone the priority encoder as well, so fields added to the clone don't leak into the original
+	var priorityEnc zapcore.Encoder
+	if c.priorityEnc != nil {
+		priorityEnc = c.priorityEnc.Clone()
+	}
+
+	return &DelayedCore{
 		LevelEnabler: c.LevelEnabler,
 		priority:     c.priority,
 		enc:          c.enc.Clone(),
 		out:          c.out,
+		priorityOut:  c.priorityOut,
+		priorityEnc:  priorityEnc,
+		filter:       c.filter,
+		priorityFunc: c.priorityFunc,
+		metadata:     c.metadata,
+		banners:      c.banners,
+		spacing:      c.spacing,
+		maxEntries:   c.maxEntries,
+		priorityMin:  c.priorityMin,
+		syncFailure:  c.syncFailure,
+		dumpStacks:   c.dumpStacks,
+		ndjson:       c.ndjson,
+		groupBy:      c.groupBy,
+		bodyPrefix:   c.bodyPrefix,
+		bodySuffix:   c.bodySuffix,
+		digestOut:    c.digestOut,
+		digestEnab:   c.digestEnab,
+
+		suppress:       c.suppress,
+		suppressPolicy: c.suppressPolicy,
+
+		rateLimit:  c.rateLimit,
+		rateWindow: c.rateWindow,
+		ratePolicy: c.ratePolicy,
+
+		spillBudget: c.spillBudget,
+		spillDir:    c.spillDir,
+
+		delay:              c.delay,
+		delayPriority:      c.delayPriority,
+		entriesBuf:         make([]*buffer.Buffer, 0, 5),
+		entriesPriorityBuf: make([]*buffer.Buffer, 0, 5),
+		errCh:              make(chan error, 2),
 	}
 }
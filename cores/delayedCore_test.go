@@ -12,12 +12,17 @@ package cores
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/siemens/ZapSmtp/zapsmtptest"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
 	. "go.uber.org/zap/zapcore"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -273,8 +278,8 @@ func TestDelayedCoreWriteFailure(t *testing.T) {
 		NewJSONEncoder(testEncoderConfig()),
 		Lock(&OneTimeFailWriter{}),
 		zap.LevelEnablerFunc(func(lvl Level) bool { return true }),
-		0,
-		0,
+		time.Nanosecond, // Tiny delays rather than zero, which would write priority entries synchronously
+		time.Nanosecond,
 	)
 	if errCore != nil {
 		t.Errorf("unable to initialize delayed core: %s", errCore)
@@ -293,3 +298,1818 @@ func TestDelayedCoreWriteFailure(t *testing.T) {
 		t.Errorf("Expected exactly one error, got %d", len(multierr.Errors(errs)))
 	}
 }
+
+func TestDelayedCore_SetFilter(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		AddSync(buf),
+		ErrorLevel,
+		time.Minute*10, // Very long delay, the test syncs manually
+		time.Minute*10, // Very long delay, the test syncs manually
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	// Only keep entries flagged as critical
+	core.SetFilter(func(ent Entry, fields []Field) bool {
+		for _, f := range fields {
+			if f.Key == "critical" && f.Type == BoolType && f.Integer == 1 {
+				return true
+			}
+		}
+		return false
+	})
+
+	logger := zap.New(core)
+	logger.Info("routine")
+	logger.Info("flagged", zap.Bool("critical", true))
+	logger.Error("not flagged", zap.Bool("critical", false))
+	logger.Debug("below level", zap.Bool("critical", true))
+
+	errSync := core.Sync()
+	if errSync != nil {
+		t.Errorf("unable to sync: %s", errSync)
+		return
+	}
+
+	logged := buf.String()
+	if !strings.Contains(logged, `"msg":"flagged"`) {
+		t.Errorf("expected critical entry in output, got: %s", logged)
+	}
+	for _, msg := range []string{"routine", "not flagged", "below level"} {
+		if strings.Contains(logged, msg) {
+			t.Errorf("expected entry '%s' to be filtered, got: %s", msg, logged)
+		}
+	}
+}
+
+// A lazyQueue retains entries along with a copy of their fields and encodes them when synced, as an alternative to
+// the eager encoding of the DelayedCore, which is kept for comparison in the benchmark below.
+type lazyQueue struct {
+	enc        Encoder
+	filter     func(ent Entry, fields []Field) bool
+	maxEntries int
+	entries    []Entry
+	fields     [][]Field
+}
+
+// Write retains an entry passing the filter, encoding the queue once it is full.
+func (q *lazyQueue) Write(ent Entry, fields []Field) error {
+	if q.filter != nil && !q.filter(ent, fields) {
+		return nil
+	}
+	q.entries = append(q.entries, ent)
+	q.fields = append(q.fields, append([]Field(nil), fields...))
+	if len(q.entries) >= q.maxEntries {
+		return q.Sync()
+	}
+	return nil
+}
+
+// Sync encodes the retained entries and empties the queue.
+func (q *lazyQueue) Sync() error {
+	for i, ent := range q.entries {
+		buf, err := q.enc.EncodeEntry(ent, q.fields[i])
+		if err != nil {
+			return err
+		}
+		buf.Free()
+	}
+	q.entries = q.entries[:0]
+	q.fields = q.fields[:0]
+	return nil
+}
+
+// BenchmarkDelayedCore_Write compares the allocations of encoding entries eagerly on Write, as the DelayedCore does,
+// to encoding them lazily on Sync. The drop-most workload drops nine out of ten entries by their message.
+func BenchmarkDelayedCore_Write(b *testing.B) {
+	dropRoutine := func(ent Entry, fields []Field) bool { return ent.Message != "routine" }
+	benchmarks := []struct {
+		name   string
+		filter func(ent Entry, fields []Field) bool
+		lazy   bool
+	}{
+		{"eager-queue-all", nil, false},
+		{"eager-drop-most", dropRoutine, false},
+		{"lazy-queue-all", nil, true},
+		{"lazy-drop-most", dropRoutine, true},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			core, errCore := NewDelayedCore(
+				DebugLevel,
+				NewJSONEncoder(testEncoderConfig()),
+				&Discarder{},
+				ErrorLevel,
+				time.Minute*10,
+				time.Minute*10,
+			)
+			if errCore != nil {
+				b.Fatalf("unable to initialize delayed core: %s", errCore)
+			}
+			core.SetFilter(bm.filter)
+			var clone interface {
+				Write(ent Entry, fields []Field) error
+				Sync() error
+			} = core.With([]Field{makeInt64Field("k", 1)})
+
+			// Retain the entries of the lazy variant up to the same number the delayed core queues
+			if bm.lazy {
+				enc := NewJSONEncoder(testEncoderConfig())
+				makeInt64Field("k", 1).AddTo(enc)
+				clone = &lazyQueue{enc: enc, filter: bm.filter, maxEntries: defaultMaxEntries}
+			}
+
+			fields := []Field{makeInt64Field("n", 1), zap.String("user", "alice")}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+
+				// Only every tenth entry passes the filter
+				if i%10 == 0 {
+					_ = clone.Write(Entry{Level: InfoLevel, Message: "incident"}, fields)
+				} else {
+					_ = clone.Write(Entry{Level: InfoLevel, Message: "routine"}, fields)
+				}
+			}
+			_ = clone.Sync()
+		})
+	}
+}
+
+// A TrickleWriter accepts at most a few bytes per write, like a slow or congested connection.
+type TrickleWriter struct {
+	Syncer
+	bytes.Buffer
+	chunk int
+}
+
+// Write implements io.Writer.
+func (w *TrickleWriter) Write(b []byte) (int, error) {
+	if len(b) > w.chunk {
+		b = b[:w.chunk]
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestDelayedCore_SyncPartialWrites(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunk   int
+		wantErr bool
+	}{
+		{"single-byte", 1, false},
+		{"few-bytes", 7, false},
+		{"no-progress", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &TrickleWriter{chunk: tt.chunk}
+			core, errCore := NewDelayedCore(
+				DebugLevel,
+				NewJSONEncoder(testEncoderConfig()),
+				sink,
+				WarnLevel,
+				time.Minute*10,
+				time.Minute*10,
+			)
+			if errCore != nil {
+				t.Errorf("unable to initialize delayed core: %s", errCore)
+				return
+			}
+			core.SetBanners(true)
+
+			_ = core.Write(Entry{Level: WarnLevel, Message: "priority"}, nil)
+			_ = core.Write(Entry{Level: InfoLevel, Message: "standard"}, nil)
+
+			errSync := core.Sync()
+			if (errSync != nil) != tt.wantErr {
+				t.Errorf("Sync() error = %v, wantErr %v", errSync, tt.wantErr)
+				return
+			}
+			if errSync != nil {
+				return
+			}
+
+			// The message must have arrived completely and in order
+			got := sink.String()
+			if !strings.HasPrefix(got, "=== Priority Log ===\n") ||
+				!strings.Contains(got, `"msg":"priority"`) ||
+				!strings.HasSuffix(got, `"msg":"standard"}`+"\n") {
+				t.Errorf("Sync() wrote %q, want the complete message", got)
+			}
+			if !sink.Called() {
+				t.Errorf("Sync() did not sync the underlying writer")
+			}
+		})
+	}
+}
+
+func TestDelayedCore_SetBatchMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		entries  []Entry
+		priority int
+		standard int
+	}{
+		{"mixed", true, []Entry{{Level: InfoLevel}, {Level: ErrorLevel}, {Level: InfoLevel}, {Level: InfoLevel}}, 1, 3},
+		{"standard-only", true, []Entry{{Level: InfoLevel}}, 0, 1},
+		{"disabled", false, []Entry{{Level: InfoLevel}}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			core, errCore := NewDelayedCore(
+				InfoLevel,
+				NewJSONEncoder(testEncoderConfig()),
+				AddSync(buf),
+				ErrorLevel,
+				time.Minute*10, // Very long delay, the test syncs manually
+				time.Minute*10, // Very long delay, the test syncs manually
+			)
+			if errCore != nil {
+				t.Errorf("unable to initialize delayed core: %s", errCore)
+				return
+			}
+			core.SetBatchMetadata(tt.enabled)
+
+			for _, entry := range tt.entries {
+				_ = core.Write(entry, nil)
+			}
+			if errSync := core.Sync(); errSync != nil {
+				t.Errorf("unable to sync: %s", errSync)
+				return
+			}
+
+			// Parse the first line of the message
+			first := strings.SplitN(buf.String(), "\n", 2)[0]
+			if !tt.enabled {
+				if strings.Contains(first, "zapsmtp_batch") {
+					t.Errorf("expected no metadata, got: %s", first)
+				}
+				return
+			}
+			var meta struct {
+				Type      string    `json:"type"`
+				Priority  int       `json:"priority"`
+				Standard  int       `json:"standard"`
+				Generated time.Time `json:"generated"`
+			}
+			if errJson := json.Unmarshal([]byte(first), &meta); errJson != nil {
+				t.Errorf("first line is not a JSON object: %s (%s)", first, errJson)
+				return
+			}
+			if meta.Type != "zapsmtp_batch" || meta.Priority != tt.priority || meta.Standard != tt.standard {
+				t.Errorf("metadata = %+v, want priority %d and standard %d", meta, tt.priority, tt.standard)
+			}
+			if time.Since(meta.Generated) > time.Minute {
+				t.Errorf("metadata generated = %s, want current time", meta.Generated)
+			}
+		})
+	}
+}
+
+func TestDelayedCore_SetSuppression(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     SuppressionPolicy
+		wantReport string
+		wantMsgs   []string
+		unwanted   []string
+	}{
+		{"drop", SuppressDrop, `{"type":"zapsmtp_suppressed","dropped":2}` + "\n", []string{"after"}, []string{"during 1", "during 2"}},
+		{"retain", SuppressRetain, `{"type":"zapsmtp_suppressed","retained":2}` + "\n", []string{"during 1", "during 2", "after"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := zapsmtptest.NewMemorySyncer()
+			core, errCore := NewDelayedCore(
+				DebugLevel,
+				NewJSONEncoder(testEncoderConfig()),
+				sink,
+				WarnLevel,
+				time.Millisecond*50,
+				time.Millisecond*50,
+			)
+			if errCore != nil {
+				t.Errorf("unable to initialize delayed core: %s", errCore)
+				return
+			}
+
+			var mutex sync.Mutex
+			maintenance := true
+			core.SetSuppression(func(now time.Time) bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return maintenance
+			}, tt.policy)
+
+			// Nothing must be sent during the maintenance window
+			_ = core.Write(Entry{Level: InfoLevel, Message: "during 1"}, nil)
+			_ = core.Write(Entry{Level: InfoLevel, Message: "during 2"}, nil)
+			time.Sleep(time.Millisecond * 150)
+			if got := sink.String(); sink.Syncs() > 0 || got != "" {
+				t.Errorf("expected no message during suppression, got: %s", got)
+				return
+			}
+
+			// Lift the suppression and wait for the next flush
+			mutex.Lock()
+			maintenance = false
+			mutex.Unlock()
+			_ = core.Write(Entry{Level: InfoLevel, Message: "after"}, nil)
+			time.Sleep(time.Millisecond * 150)
+
+			got := sink.String()
+			if !strings.HasPrefix(got, tt.wantReport) {
+				t.Errorf("expected message to start with report '%s', got: %s", tt.wantReport, got)
+			}
+			for _, msg := range tt.wantMsgs {
+				if !strings.Contains(got, `"msg":"`+msg+`"`) {
+					t.Errorf("expected entry '%s' in message, got: %s", msg, got)
+				}
+			}
+			for _, msg := range tt.unwanted {
+				if strings.Contains(got, `"msg":"`+msg+`"`) {
+					t.Errorf("expected entry '%s' to be dropped, got: %s", msg, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDelayedCore_SetRateLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     SuppressionPolicy
+		wantReport string
+		wantMsgs   []string
+		unwanted   []string
+	}{
+		{"drop", SuppressDrop, `{"type":"zapsmtp_rate_limited","dropped":2}` + "\n", []string{"critical"}, []string{"limited 1", "limited 2"}},
+		{"retain", SuppressRetain, `{"type":"zapsmtp_rate_limited","retained":2}` + "\n", []string{"limited 1", "limited 2", "critical"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := zapsmtptest.NewMemorySyncer()
+			core, errCore := NewDelayedCore(
+				DebugLevel,
+				NewJSONEncoder(testEncoderConfig()),
+				sink,
+				WarnLevel,
+				time.Hour,
+				time.Hour,
+			)
+			if errCore != nil {
+				t.Errorf("unable to initialize delayed core: %s", errCore)
+				return
+			}
+			core.SetRateLimit(1, time.Minute, tt.policy)
+
+			// Only the first of several sends within the window must go out
+			_ = core.Write(Entry{Level: InfoLevel, Message: "first"}, nil)
+			_ = core.Sync()
+			_ = core.Write(Entry{Level: InfoLevel, Message: "limited 1"}, nil)
+			_ = core.Sync()
+			_ = core.Write(Entry{Level: InfoLevel, Message: "limited 2"}, nil)
+			_ = core.Sync()
+			if batches := sink.Batches(); len(batches) != 1 || string(batches[0]) != `{"level":"info","msg":"first"}`+"\n" {
+				t.Errorf("expected only the first message to be sent, got: %q", batches)
+				return
+			}
+
+			// An entry which may crash the program must be sent nevertheless, reporting the affected entries
+			_ = core.Write(Entry{Level: DPanicLevel, Message: "critical"}, nil)
+			batches := sink.Batches()
+			if len(batches) != 2 {
+				t.Errorf("expected the critical entry to be sent, got: %q", batches)
+				return
+			}
+			got := string(batches[1])
+			if !strings.HasPrefix(got, tt.wantReport) {
+				t.Errorf("expected message to start with report '%s', got: %s", tt.wantReport, got)
+			}
+			for _, msg := range tt.wantMsgs {
+				if !strings.Contains(got, `"msg":"`+msg+`"`) {
+					t.Errorf("expected entry '%s' in message, got: %s", msg, got)
+				}
+			}
+			for _, msg := range tt.unwanted {
+				if strings.Contains(got, `"msg":"`+msg+`"`) {
+					t.Errorf("expected entry '%s' to be dropped, got: %s", msg, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDelayedCore_WriteBlank(t *testing.T) {
+	sink := zapsmtptest.NewMemorySyncer()
+
+	// A console encoder without any keys encodes entries without fields to a line break only
+	core, errCore := NewDelayedCore(
+		DebugLevel,
+		NewConsoleEncoder(EncoderConfig{}),
+		sink,
+		WarnLevel,
+		time.Hour,
+		time.Hour,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	// A batch of blank entries must not result in a message of banners only
+	_ = core.Write(Entry{Level: InfoLevel, Message: "standard"}, nil)
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "priority"}, nil)
+	if err := core.Sync(); err != nil {
+		t.Errorf("Sync() error = %v", err)
+		return
+	}
+	if batches := sink.Batches(); len(batches) != 0 {
+		t.Errorf("expected no message for blank entries, got: %q", batches)
+		return
+	}
+
+	// Blank critical entries must not flush the output, as nothing was written to it
+	sink.Reset()
+	_ = core.Write(Entry{Level: DPanicLevel, Message: "critical"}, nil)
+	if batches := sink.Batches(); len(batches) != 0 || sink.Syncs() != 0 {
+		t.Errorf("expected neither message nor sync for blank critical entry, got %d syncs of: %q", sink.Syncs(), batches)
+		return
+	}
+
+	// Entries with content must still be sent, without the blank ones
+	_ = core.Write(Entry{Level: InfoLevel, Message: "blank"}, nil)
+	_ = core.Write(Entry{Level: InfoLevel, Message: "content"}, []Field{{Key: "k", Type: StringType, String: "v"}})
+	if err := core.Sync(); err != nil {
+		t.Errorf("Sync() error = %v", err)
+		return
+	}
+	want := "=== Standard Log ===\n{\"k\": \"v\"}\n"
+	if got := sink.String(); got != want {
+		t.Errorf("expected %q, got: %q", want, got)
+	}
+}
+
+func TestDelayedCore_SetPriorityEncoder(t *testing.T) {
+	sink := zapsmtptest.NewMemorySyncer()
+
+	// Render standard entries compactly, without the stack trace
+	compact := NewJSONEncoder(EncoderConfig{MessageKey: "msg", LevelKey: "level", EncodeLevel: LowercaseLevelEncoder})
+	core, errCore := NewDelayedCore(
+		DebugLevel,
+		compact,
+		sink,
+		ErrorLevel,
+		time.Hour,
+		time.Hour,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetPriorityEncoder(NewJSONEncoder(testEncoderConfig()))
+
+	// Fields added via With must reach both encoders
+	logger := core.With([]Field{{Key: "service", Type: StringType, String: "billing"}})
+	_ = logger.Write(Entry{Level: InfoLevel, Message: "standard", Stack: "main.standard()"}, nil)
+	_ = logger.Write(Entry{Level: ErrorLevel, Message: "priority", Stack: "main.priority()"}, nil)
+	if err := logger.Sync(); err != nil {
+		t.Errorf("Sync() error = %v", err)
+		return
+	}
+
+	want := `{"level":"error","msg":"priority","service":"billing","stacktrace":"main.priority()"}` + "\n" +
+		`{"level":"info","msg":"standard","service":"billing"}` + "\n"
+	if got := sink.String(); got != want {
+		t.Errorf("expected %q, got: %q", want, got)
+	}
+}
+
+func TestDelayedCore_SetBanners(t *testing.T) {
+	tests := []struct {
+		name        string
+		enc         Encoder
+		set         bool // Whether to call SetBanners, otherwise the default applies
+		banners     bool
+		wantBanners bool
+		wantNdjson  bool
+	}{
+		{"json-default", NewJSONEncoder(testEncoderConfig()), false, false, false, true},
+		{"json-enabled", NewJSONEncoder(testEncoderConfig()), true, true, true, false},
+		{"console-default", NewConsoleEncoder(testEncoderConfig()), false, false, true, false},
+		{"console-disabled", NewConsoleEncoder(testEncoderConfig()), true, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			core, errCore := NewDelayedCore(
+				InfoLevel,
+				tt.enc,
+				AddSync(buf),
+				ErrorLevel,
+				time.Minute*10, // Very long delay, the test syncs manually
+				time.Minute*10, // Very long delay, the test syncs manually
+			)
+			if errCore != nil {
+				t.Errorf("unable to initialize delayed core: %s", errCore)
+				return
+			}
+			if tt.set {
+				core.SetBanners(tt.banners)
+			}
+
+			_ = core.Write(Entry{Level: InfoLevel, Message: "standard"}, []Field{makeInt64Field("k", 1)})
+			_ = core.Write(Entry{Level: ErrorLevel, Message: "priority"}, nil)
+			if errSync := core.Sync(); errSync != nil {
+				t.Errorf("unable to sync: %s", errSync)
+				return
+			}
+
+			logged := buf.String()
+			if got := strings.Contains(logged, "=== Priority Log ==="); got != tt.wantBanners {
+				t.Errorf("message contains banners = %v, want %v: %s", got, tt.wantBanners, logged)
+			}
+
+			// Every line must be a JSON object, if the message is expected to be newline delimited JSON
+			if !tt.wantNdjson {
+				return
+			}
+			lines := strings.Split(strings.TrimSuffix(logged, "\n"), "\n")
+			if len(lines) != 2 {
+				t.Errorf("message has %d lines, want 2: %s", len(lines), logged)
+			}
+			for _, line := range lines {
+				var obj map[string]interface{}
+				if errJson := json.Unmarshal([]byte(line), &obj); errJson != nil {
+					t.Errorf("line is not a JSON object: %s (%s)", line, errJson)
+				}
+			}
+		})
+	}
+}
+
+func TestDelayedCore_Drain(t *testing.T) {
+	sink := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Millisecond*50,
+		time.Millisecond*50,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	_ = core.Write(Entry{Level: InfoLevel, Message: "standard 1"}, nil)
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "priority"}, nil)
+	_ = core.Write(Entry{Level: InfoLevel, Message: "standard 2"}, nil)
+
+	// The entries must be returned in the order they would have been sent
+	entries := core.Drain()
+	want := []string{
+		`{"level":"error","msg":"priority"}` + "\n",
+		`{"level":"info","msg":"standard 1"}` + "\n",
+		`{"level":"info","msg":"standard 2"}` + "\n",
+	}
+	if len(entries) != len(want) {
+		t.Errorf("Drain() returned %d entries, want %d", len(entries), len(want))
+		return
+	}
+	for i := range want {
+		if string(entries[i]) != want[i] {
+			t.Errorf("Drain() entry %d = %q, want %q", i, entries[i], want[i])
+		}
+	}
+
+	// The queue must be empty and the delayed write canceled
+	if again := core.Drain(); len(again) != 0 {
+		t.Errorf("Drain() returned %d entries after draining, want 0", len(again))
+	}
+	time.Sleep(time.Millisecond * 150)
+	if got := sink.String(); sink.Syncs() > 0 || got != "" {
+		t.Errorf("expected no write after draining, got: %s", got)
+		return
+	}
+
+	// New entries must be sent after the delay as usual
+	_ = core.Write(Entry{Level: InfoLevel, Message: "later"}, nil)
+	time.Sleep(time.Millisecond * 150)
+	if got := sink.String(); got != `{"level":"info","msg":"later"}`+"\n" {
+		t.Errorf("expected only the new entry to be written, got: %s", got)
+	}
+}
+
+func TestDelayedCore_SetPriorityFunc(t *testing.T) {
+	// Drop timestamps for simpler assertions
+	cfg := testEncoderConfig()
+	cfg.TimeKey = ""
+
+	sink := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(
+		DebugLevel,
+		NewJSONEncoder(cfg),
+		sink,
+		ErrorLevel,
+		time.Minute*10,      // Very long delay, only priority entries are sent in time
+		time.Millisecond*50, // Short priority delay
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetBanners(true)
+
+	// Escalate entries carrying the corresponding flag
+	core.SetPriorityFunc(func(ent Entry, fields []Field) bool {
+		for _, f := range fields {
+			if f.Key == "escalate" && f.Type == BoolType && f.Integer == 1 {
+				return true
+			}
+		}
+		return false
+	})
+
+	logger := zap.New(core)
+	logger.Info("routine")
+	logger.Debug("escalated", zap.Bool("escalate", true))
+
+	// The escalated debug entry must have shortened the delay and be listed in the priority section
+	time.Sleep(time.Millisecond * 150)
+	got := sink.String()
+	want := "=== Priority Log ===\n" + `{"level":"debug","msg":"escalated","escalate":true}` + "\n"
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("expected message to start with priority section %q, got: %q", want, got)
+	}
+	if !strings.Contains(got, "=== Standard Log ===\n"+`{"level":"info","msg":"routine"}`) {
+		t.Errorf("expected routine entry in standard section, got: %q", got)
+	}
+}
+
+func TestDelayedCore_With(t *testing.T) {
+
+	// Drop timestamps for simpler assertions
+	cfg := testEncoderConfig()
+	cfg.TimeKey = ""
+
+	sink := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(cfg),
+		sink,
+		ErrorLevel,
+		time.Millisecond*100,
+		time.Millisecond*50,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	// The clone must keep the delays of the original core
+	clone, ok := core.With([]Field{makeInt64Field("k", 1)}).(*DelayedCore)
+	if !ok {
+		t.Errorf("With() did not return a delayed core")
+		return
+	}
+	if clone.delay != core.delay || clone.delayPriority != core.delayPriority {
+		t.Errorf("With() delays = %s/%s, want %s/%s", clone.delay, clone.delayPriority, core.delay, core.delayPriority)
+	}
+
+	// Entries logged via the clone must be delayed instead of sent immediately
+	_ = clone.Write(Entry{Level: InfoLevel, Message: "cloned"}, nil)
+	time.Sleep(time.Millisecond * 20)
+	if got := sink.String(); got != "" {
+		t.Errorf("expected entry to be delayed, got: %s", got)
+	}
+	if !sink.WaitForBatches(1, time.Second) {
+		t.Errorf("expected entry to be sent after the delay")
+		return
+	}
+	if got := sink.String(); got != `{"level":"info","msg":"cloned","k":1}`+"\n" {
+		t.Errorf("unexpected output of clone: %s", got)
+	}
+}
+
+func TestDelayedCore_SetSyncFailureHandler(t *testing.T) {
+	sink := zapsmtptest.NewMemorySyncer()
+	sink.SetWriteError(fmt.Errorf("relay unreachable"))
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Minute*10, // Very long delays, only the immediate write may reach the sink
+		time.Minute*5,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	var gotEnt []Entry
+	var gotErr []error
+	core.SetSyncFailureHandler(func(ent Entry, err error) {
+		gotEnt = append(gotEnt, ent)
+		gotErr = append(gotErr, err)
+	})
+
+	// Regular entries are not written immediately, so there is nothing to report
+	if err := core.Write(Entry{Level: ErrorLevel, Message: "error"}, nil); err != nil {
+		t.Errorf("unexpected error writing error entry: %s", err)
+		return
+	}
+	if len(gotErr) != 0 {
+		t.Errorf("expected no call of the handler, got: %v", gotErr)
+		return
+	}
+
+	// The failed immediate write of a fatal entry must be reported to the handler and returned
+	err := core.Write(Entry{Level: FatalLevel, Message: "fatal"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "relay unreachable") {
+		t.Errorf("expected write error, got: %v", err)
+	}
+	if len(gotErr) != 1 || gotErr[0] != err || gotEnt[0].Message != "fatal" {
+		t.Errorf("expected one call of the handler with the fatal entry and %v, got: %v %v", err, gotEnt, gotErr)
+	}
+}
+
+func TestDelayedCore_SetPriorityOutput(t *testing.T) {
+
+	// Drop timestamps for simpler assertions
+	cfg := testEncoderConfig()
+	cfg.TimeKey = ""
+
+	digest := zapsmtptest.NewMemorySyncer()
+	pager := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(cfg),
+		digest,
+		ErrorLevel,
+		time.Minute*10,
+		time.Minute*5,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetPriorityOutput(pager)
+
+	// A mixed batch must be split into a message per output
+	_ = core.Write(Entry{Level: InfoLevel, Message: "routine"}, nil)
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "alert"}, nil)
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+	if got := pager.Batches(); len(got) != 1 || string(got[0]) != `{"level":"error","msg":"alert"}`+"\n" {
+		t.Errorf("expected priority entry sent to pager, got: %q", got)
+	}
+	if got := digest.Batches(); len(got) != 1 || string(got[0]) != `{"level":"info","msg":"routine"}`+"\n" {
+		t.Errorf("expected standard entry sent to digest, got: %q", got)
+	}
+
+	// Without priority entries, nothing must be sent to the pager
+	pager.Reset()
+	digest.Reset()
+	_ = core.Write(Entry{Level: InfoLevel, Message: "routine"}, nil)
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+	if got := pager.Batches(); len(got) != 0 {
+		t.Errorf("expected no message to pager, got: %q", got)
+	}
+	if got := digest.Batches(); len(got) != 1 {
+		t.Errorf("expected one message to digest, got: %q", got)
+	}
+
+	// A failing pager must not keep the standard entries from being sent
+	digest.Reset()
+	pager.SetWriteError(fmt.Errorf("gateway down"))
+	_ = core.Write(Entry{Level: InfoLevel, Message: "routine"}, nil)
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "alert"}, nil)
+	if err := core.Sync(); err == nil || !strings.Contains(err.Error(), "gateway down") {
+		t.Errorf("expected pager error, got: %v", err)
+	}
+	if got := digest.Batches(); len(got) != 1 {
+		t.Errorf("expected one message to digest, got: %q", got)
+	}
+}
+
+func TestDelayedCore_SetEntrySpacing(t *testing.T) {
+
+	// Drop timestamps for simpler assertions and use a line ending deviating from the spacing
+	cfg := testEncoderConfig()
+	cfg.TimeKey = ""
+	cfg.LineEnding = "\r\n"
+
+	a, b, c := `{"level":"info","msg":"a"}`, `{"level":"info","msg":"b"}`, `{"level":"info","msg":"c"}`
+	tests := []struct {
+		name    string
+		spacing EntrySpacing
+		want    string
+	}{
+		{"encoder", EntrySpacingEncoder, a + "\r\n" + b + "\r\n" + c + "\r\n"},
+		{"none", EntrySpacingNone, a + b + c},
+		{"line", EntrySpacingLine, a + "\n" + b + "\n" + c + "\n"},
+		{"blank-line", EntrySpacingBlankLine, a + "\n\n" + b + "\n\n" + c + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := zapsmtptest.NewMemorySyncer()
+			core, errCore := NewDelayedCore(
+				InfoLevel,
+				NewJSONEncoder(cfg),
+				sink,
+				ErrorLevel,
+				time.Minute*10,
+				time.Minute*5,
+			)
+			if errCore != nil {
+				t.Errorf("unable to initialize delayed core: %s", errCore)
+				return
+			}
+			core.SetEntrySpacing(tt.spacing)
+
+			for _, msg := range []string{"a", "b", "c"} {
+				_ = core.Write(Entry{Level: InfoLevel, Message: msg}, nil)
+			}
+			if err := core.Sync(); err != nil {
+				t.Errorf("unexpected error syncing: %s", err)
+				return
+			}
+			if got := sink.String(); got != tt.want {
+				t.Errorf("expected %q, got: %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDelayedCore_SetMaxEntries(t *testing.T) {
+
+	// Drop timestamps for simpler assertions
+	cfg := testEncoderConfig()
+	cfg.TimeKey = ""
+
+	tests := []struct {
+		name        string
+		maxEntries  int
+		entries     int
+		wantBatches int // Batches expected right after writing, before the delay expired
+	}{
+		{"default", defaultMaxEntries, defaultMaxEntries + 1, 1},
+		{"custom", 5, 6, 1},
+		{"disabled", 0, 2000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := zapsmtptest.NewMemorySyncer()
+			core, errCore := NewDelayedCore(
+				InfoLevel,
+				NewJSONEncoder(cfg),
+				sink,
+				ErrorLevel,
+				time.Millisecond*300,
+				time.Millisecond*100,
+			)
+			if errCore != nil {
+				t.Errorf("unable to initialize delayed core: %s", errCore)
+				return
+			}
+			core.SetMaxEntries(tt.maxEntries)
+
+			for i := 0; i < tt.entries; i++ {
+				_ = core.Write(Entry{Level: InfoLevel, Message: "entry"}, nil)
+			}
+
+			// Only an exceeded limit may trigger an immediate write
+			time.Sleep(time.Millisecond * 50)
+			if got := len(sink.Batches()); got != tt.wantBatches {
+				t.Errorf("expected %d batches before the delay, got: %d", tt.wantBatches, got)
+				return
+			}
+
+			// All entries must have been sent after the delay
+			if !sink.WaitForBatches(1, time.Second) {
+				t.Errorf("expected entries to be sent after the delay")
+				return
+			}
+			time.Sleep(time.Millisecond * 400)
+			if got := strings.Count(sink.String(), "\n"); got != tt.entries {
+				t.Errorf("expected %d entries to be sent, got: %d", tt.entries, got)
+			}
+		})
+	}
+}
+
+func TestDelayedCore_SetPriorityThreshold(t *testing.T) {
+	sink := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Minute*10,      // Very long delay, only an escalated batch is sent in time
+		time.Millisecond*50, // Short priority delay
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetPriorityThreshold(3)
+
+	// The first two priority entries must not shorten the delay
+	for i := 0; i < 2; i++ {
+		_ = core.Write(Entry{Level: ErrorLevel, Message: "transient"}, nil)
+	}
+	time.Sleep(time.Millisecond * 150)
+	if got := sink.String(); got != "" {
+		t.Errorf("expected no write before the threshold was reached, got: %s", got)
+		return
+	}
+
+	// The third one must shorten the delay, sending all of them
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "persistent"}, nil)
+	if !sink.WaitForBatches(1, time.Second) {
+		t.Errorf("expected entries to be sent after the threshold was reached")
+		return
+	}
+	if got := strings.Count(sink.String(), "\n"); got != 3 {
+		t.Errorf("expected 3 entries to be sent, got: %s", sink.String())
+	}
+}
+
+// PanicEncoder is an Encoder panicking on every entry, like a buggy custom implementation
+type PanicEncoder struct {
+	Encoder
+}
+
+// Clone implements Encoder.
+func (e PanicEncoder) Clone() Encoder {
+	return e
+}
+
+// EncodeEntry implements Encoder.
+func (e PanicEncoder) EncodeEntry(Entry, []Field) (*buffer.Buffer, error) {
+	panic("broken encoder")
+}
+
+func TestDelayedCore_EncoderPanic(t *testing.T) {
+	sink := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		PanicEncoder{NewJSONEncoder(testEncoderConfig())},
+		sink,
+		ErrorLevel,
+		time.Minute*10,
+		time.Minute*5,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetBanners(false) // The type of the encoder can't be detected, as it panics
+
+	// The core must survive the panic and report it
+	err := core.Write(Entry{Level: InfoLevel, Message: "lost"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "broken encoder") {
+		t.Errorf("expected error reporting the panic, got: %v", err)
+	}
+
+	// A placeholder must be sent instead of the entry
+	if errSync := core.Sync(); errSync != nil {
+		t.Errorf("unexpected error syncing: %s", errSync)
+		return
+	}
+	var placeholder map[string]interface{}
+	if errJson := json.Unmarshal(sink.Batches()[0], &placeholder); errJson != nil {
+		t.Errorf("expected placeholder to be JSON, got: %s", sink.String())
+		return
+	}
+	if placeholder["msg"] != "lost" || placeholder["encoderPanic"] != "broken encoder" {
+		t.Errorf("expected placeholder with message and panic, got: %s", sink.String())
+	}
+}
+
+// BatchRecorder is a WriteSyncer implementing BatchWriter, recording the details handed to it
+type BatchRecorder struct {
+	*zapsmtptest.MemorySyncer
+	levels []Level
+	counts []int
+}
+
+// WriteBatch implements BatchWriter.
+func (r *BatchRecorder) WriteBatch(p []byte, level Level, count int) (int, error) {
+	r.levels = append(r.levels, level)
+	r.counts = append(r.counts, count)
+	return r.Write(p)
+}
+
+func TestDelayedCore_BatchWriter(t *testing.T) {
+	digest := &BatchRecorder{MemorySyncer: zapsmtptest.NewMemorySyncer()}
+	pager := &BatchRecorder{MemorySyncer: zapsmtptest.NewMemorySyncer()}
+	core, errCore := NewDelayedCore(
+		DebugLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		digest,
+		ErrorLevel,
+		time.Minute*10,
+		time.Minute*5,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	// The details must describe the whole message
+	_ = core.Write(Entry{Level: WarnLevel, Message: "warn"}, nil)
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "error"}, nil)
+	_ = core.Write(Entry{Level: DebugLevel, Message: "debug"}, nil)
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+	if len(digest.levels) != 1 || digest.levels[0] != ErrorLevel || digest.counts[0] != 3 {
+		t.Errorf("expected one batch with 3 entries up to error level, got: %v %v", digest.levels, digest.counts)
+	}
+
+	// With a separate priority output, the details must describe each section
+	digest.levels, digest.counts = nil, nil
+	core.SetPriorityOutput(pager)
+	_ = core.Write(Entry{Level: InfoLevel, Message: "info"}, nil)
+	_ = core.Write(Entry{Level: DebugLevel, Message: "debug"}, nil)
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "error"}, nil)
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+	if len(digest.levels) != 1 || digest.levels[0] != InfoLevel || digest.counts[0] != 2 {
+		t.Errorf("expected one standard batch with 2 entries up to info level, got: %v %v", digest.levels, digest.counts)
+	}
+	if len(pager.levels) != 1 || pager.levels[0] != ErrorLevel || pager.counts[0] != 1 {
+		t.Errorf("expected one priority batch with 1 entry at error level, got: %v %v", pager.levels, pager.counts)
+	}
+}
+
+func TestDelayedCore_StartHeartbeat(t *testing.T) {
+	sink := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Millisecond*20,
+		time.Millisecond*10,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	// A heartbeat must be sent without any log entries
+	stop := core.StartHeartbeat(time.Millisecond * 100)
+	if !sink.WaitForBatches(1, time.Second) {
+		stop()
+		t.Errorf("expected a heartbeat to be sent")
+		return
+	}
+	var heartbeat map[string]interface{}
+	if errJson := json.Unmarshal(sink.Batches()[0], &heartbeat); errJson != nil || heartbeat["type"] != "zapsmtp_heartbeat" {
+		stop()
+		t.Errorf("expected heartbeat, got: %s", sink.String())
+		return
+	}
+
+	// Regular messages must postpone the next heartbeat
+	sink.Reset()
+	_ = core.Write(Entry{Level: InfoLevel, Message: "alive"}, nil)
+	time.Sleep(time.Millisecond * 80)
+	if got := sink.Batches(); len(got) != 1 || !strings.Contains(string(got[0]), "alive") {
+		stop()
+		t.Errorf("expected only the log entry to be sent, got: %q", got)
+		return
+	}
+
+	// No heartbeats must be sent after stopping them
+	stop()
+	stop()
+	sink.Reset()
+	time.Sleep(time.Millisecond * 250)
+	if got := sink.Batches(); len(got) != 0 {
+		t.Errorf("expected no heartbeat after stopping, got: %q", got)
+	}
+}
+
+// OverlapRecorder is a slow WriteSyncer recording whether writes were ever executed concurrently
+type OverlapRecorder struct {
+	*zapsmtptest.MemorySyncer
+	mutex   sync.Mutex
+	active  int
+	overlap bool
+}
+
+// Write implements io.Writer.
+func (r *OverlapRecorder) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	r.active++
+	r.overlap = r.overlap || r.active > 1
+	r.mutex.Unlock()
+
+	time.Sleep(time.Millisecond * 20)
+
+	r.mutex.Lock()
+	r.active--
+	r.mutex.Unlock()
+	return r.MemorySyncer.Write(p)
+}
+
+func TestDelayedCore_StartHeartbeat_Serialized(t *testing.T) {
+	sink := &OverlapRecorder{MemorySyncer: zapsmtptest.NewMemorySyncer()}
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Minute*10, // Very long delays, only explicit syncs may reach the sink
+		time.Minute*5,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	// Heartbeats must wait for running syncs instead of writing concurrently
+	stop := core.StartHeartbeat(time.Millisecond * 5)
+	for i := 0; i < 10; i++ {
+		_ = core.Write(Entry{Level: InfoLevel, Message: fmt.Sprintf("entry %d", i)}, nil)
+		_ = core.Sync()
+		time.Sleep(time.Millisecond * 5)
+	}
+	stop()
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.overlap {
+		t.Errorf("expected heartbeats and batches to be written one after another")
+	}
+}
+
+// AttachmentRecorder is a WriteSyncer implementing AttachmentWriter, recording the attachments handed to it
+type AttachmentRecorder struct {
+	*zapsmtptest.MemorySyncer
+	attachments [][]Attachment
+}
+
+// WriteAttachments implements AttachmentWriter.
+func (r *AttachmentRecorder) WriteAttachments(p []byte, _ Level, _ int, attachments []Attachment) (int, error) {
+	r.attachments = append(r.attachments, attachments)
+	return r.Write(p)
+}
+
+func TestDelayedCore_SetGoroutineDump(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		level    Level
+		wantDump bool
+	}{
+		{"fatal", true, FatalLevel, true},
+		{"panic", true, PanicLevel, true},
+		{"error", true, ErrorLevel, false},
+		{"disabled", false, FatalLevel, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &AttachmentRecorder{MemorySyncer: zapsmtptest.NewMemorySyncer()}
+			core, errCore := NewDelayedCore(
+				InfoLevel,
+				NewJSONEncoder(testEncoderConfig()),
+				sink,
+				ErrorLevel,
+				time.Minute*10, // Very long delays, only the immediate write may reach the sink
+				time.Minute*5,
+			)
+			if errCore != nil {
+				t.Errorf("unable to initialize delayed core: %s", errCore)
+				return
+			}
+			core.SetGoroutineDump(tt.enabled)
+
+			_ = core.Write(Entry{Level: InfoLevel, Message: "info"}, nil)
+			if err := core.Write(Entry{Level: tt.level, Message: "crash"}, nil); err != nil {
+				t.Errorf("unexpected error writing entry: %s", err)
+				return
+			}
+
+			// Only the immediate write of a critical entry comes with the dump, which must include this goroutine
+			if !tt.wantDump {
+				if len(sink.attachments) != 0 {
+					t.Errorf("expected no attachments, got: %v", sink.attachments)
+				}
+				return
+			}
+			if len(sink.attachments) != 1 || len(sink.attachments[0]) != 1 {
+				t.Errorf("expected one message with one attachment, got: %v", sink.attachments)
+				return
+			}
+			dump := sink.attachments[0][0]
+			if dump.Name != "goroutines.txt" || !bytes.Contains(dump.Data, []byte("TestDelayedCore_SetGoroutineDump")) {
+				t.Errorf("expected goroutine dump, got: %s %q", dump.Name, dump.Data)
+			}
+			if batches := sink.Batches(); len(batches) != 1 || !strings.Contains(string(batches[0]), "crash") {
+				t.Errorf("expected the message along with the dump, got: %q", batches)
+			}
+		})
+	}
+}
+
+func TestDelayedCore_SetNDJSONAttachment(t *testing.T) {
+	sink := &AttachmentRecorder{MemorySyncer: zapsmtptest.NewMemorySyncer()}
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Minute*10,
+		time.Minute*10,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	if err := core.SetNDJSONAttachment(true); err != nil {
+		t.Errorf("SetNDJSONAttachment() error = %v", err)
+		return
+	}
+	core.SetBatchMetadata(true)
+	core.SetEntrySpacing(EntrySpacingBlankLine)
+
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "disk full"}, []Field{zap.String("disk", "/dev/sda")})
+	_ = core.Write(Entry{Level: InfoLevel, Message: "started"}, nil)
+	_ = core.Write(Entry{Level: InfoLevel, Message: "stopped"}, nil)
+	if err := core.Sync(); err != nil {
+		t.Errorf("unable to sync: %s", err)
+		return
+	}
+
+	// The body must summarize the entries in plain text
+	batches := sink.Batches()
+	if len(batches) != 1 {
+		t.Errorf("expected one message, got: %q", batches)
+		return
+	}
+	body := string(batches[0])
+	if !strings.HasPrefix(body, "3 log entries (1 priority, 2 standard), highest level error") ||
+		strings.Contains(body, "{") {
+		t.Errorf("expected a summary of the entries, got: %q", body)
+	}
+
+	// The attachment must hold the metadata and the entries, one JSON object per line
+	if len(sink.attachments) != 1 || len(sink.attachments[0]) != 1 {
+		t.Errorf("expected one message with one attachment, got: %v", sink.attachments)
+		return
+	}
+	events := sink.attachments[0][0]
+	if events.Name != "events.ndjson" || events.ContentType != "application/x-ndjson" {
+		t.Errorf("unexpected attachment: %s %s", events.Name, events.ContentType)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(events.Data), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Errorf("expected metadata and three entries, got: %q", events.Data)
+		return
+	}
+	for i, want := range []string{"", "disk full", "started", "stopped"} {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i]), &event); err != nil {
+			t.Errorf("line %d is not valid JSON: %s", i, err)
+			continue
+		}
+		if i == 0 && event["type"] != "zapsmtp_batch" {
+			t.Errorf("expected the batch metadata first, got: %v", event)
+		} else if i > 0 && event["msg"] != want {
+			t.Errorf("expected entry '%s' on line %d, got: %v", want, i, event)
+		}
+	}
+
+	// Outputs unable to receive attachments must keep receiving the entries in the body
+	plain := zapsmtptest.NewMemorySyncer()
+	corePlain, _ := NewDelayedCore(InfoLevel, NewJSONEncoder(testEncoderConfig()), plain, ErrorLevel, time.Minute, 0)
+	_ = corePlain.SetNDJSONAttachment(true)
+	_ = corePlain.Write(Entry{Level: InfoLevel, Message: "inline"}, nil)
+	if err := corePlain.Sync(); err != nil {
+		t.Errorf("unable to sync: %s", err)
+		return
+	}
+	if got := plain.String(); !strings.Contains(got, `"msg":"inline"`) {
+		t.Errorf("expected the entry in the body, got: %q", got)
+	}
+
+	// Other encoders can't be attached as NDJSON
+	coreConsole, _ := NewDelayedCore(InfoLevel, NewConsoleEncoder(testEncoderConfig()), sink, ErrorLevel, time.Minute, 0)
+	if err := coreConsole.SetNDJSONAttachment(true); err == nil {
+		t.Errorf("SetNDJSONAttachment() accepted a console encoder")
+	}
+}
+
+func TestDelayedCore_ImmediatePriority(t *testing.T) {
+	sink := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Millisecond*300,
+		0,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	// The priority entry must be written before Write returns
+	if err := core.Write(Entry{Level: ErrorLevel, Message: "error"}, nil); err != nil {
+		t.Errorf("unexpected error writing error entry: %s", err)
+		return
+	}
+	if batches := sink.Batches(); len(batches) != 1 || !strings.Contains(string(batches[0]), `"msg":"error"`) {
+		t.Errorf("expected the priority entry to be written immediately, got: %q", batches)
+		return
+	}
+
+	// A standard entry must wait for the standard delay
+	if err := core.Write(Entry{Level: InfoLevel, Message: "info"}, nil); err != nil {
+		t.Errorf("unexpected error writing info entry: %s", err)
+		return
+	}
+	time.Sleep(time.Millisecond * 100)
+	if batches := sink.Batches(); len(batches) != 1 {
+		t.Errorf("expected the standard entry to wait for the delay, got: %q", batches)
+		return
+	}
+	if !sink.WaitForBatches(2, time.Second) {
+		t.Errorf("expected the standard entry to be written after the delay, got: %q", sink.Batches())
+		return
+	}
+	if batches := sink.Batches(); !strings.Contains(string(batches[1]), `"msg":"info"`) {
+		t.Errorf("expected the standard entry in the second batch, got: %q", batches[1])
+	}
+
+	// A priority delay exceeding the standard one must be refused, naming both values
+	_, err := NewDelayedCore(InfoLevel, NewJSONEncoder(testEncoderConfig()), sink, ErrorLevel, time.Second, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "1m0s") || !strings.Contains(err.Error(), "1s") {
+		t.Errorf("expected error naming both delays, got: %v", err)
+	}
+}
+
+func TestDelayedCore_SetDiskQueue(t *testing.T) {
+
+	// Create a new temporary directory receiving the spill file
+	dir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// Drop timestamps for simpler assertions
+	cfg := testEncoderConfig()
+	cfg.TimeKey = ""
+	sink := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(InfoLevel, NewJSONEncoder(cfg), sink, ErrorLevel, time.Minute*10, time.Minute*5)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetMaxEntries(0)
+	if err := core.SetDiskQueue(100, dir); err != nil {
+		t.Errorf("SetDiskQueue() error = %v", err)
+		return
+	}
+
+	// Each entry takes about 40 bytes, so most of them must exceed the budget and spill to disk
+	var want string
+	for i := 0; i < 10; i++ {
+		_ = core.Write(Entry{Level: InfoLevel, Message: fmt.Sprintf("info %d", i)}, nil)
+		want += fmt.Sprintf("{\"level\":\"info\",\"msg\":\"info %d\"}\n", i)
+	}
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "error"}, nil)
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || core.spilled < 7 || len(core.entriesBuf) > 3 {
+		t.Errorf("expected entries to spill to a single file, got %d files, %d spilled and %d in memory",
+			len(files), core.spilled, len(core.entriesBuf))
+		return
+	}
+
+	// The message must contain all entries in their original order, and the file must be gone
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+	want = "{\"level\":\"error\",\"msg\":\"error\"}\n" + want
+	if got := sink.String(); got != want {
+		t.Errorf("expected reassembled message %q, got %q", want, got)
+	}
+	if files, _ = ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected spill file to be removed after sync, got %d files", len(files))
+	}
+
+	// Draining must return the spilled entries as well and remove the file
+	for i := 0; i < 5; i++ {
+		_ = core.Write(Entry{Level: InfoLevel, Message: fmt.Sprintf("info %d", i)}, nil)
+	}
+	if entries := core.Drain(); len(entries) != 5 || !strings.Contains(string(entries[4]), "info 4") {
+		t.Errorf("expected 5 drained entries in order, got %q", entries)
+	}
+	if files, _ = ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected spill file to be removed after drain, got %d files", len(files))
+	}
+
+	// Small entries following spilled ones would still fit into memory, but must keep their order nonetheless
+	want = ""
+	for i, msg := range []string{"small 0", "large 0", "small 1", "large 1", "small 2"} {
+		if strings.HasPrefix(msg, "large") {
+			msg += strings.Repeat("x", 60)
+		}
+		_ = core.Write(Entry{Level: InfoLevel, Message: msg}, nil)
+		want += fmt.Sprintf("{\"level\":\"info\",\"msg\":\"%s\"}\n", msg)
+		if i == 2 && core.spilled != 2 {
+			t.Errorf("expected small entry to follow the spilled one, got %d spilled", core.spilled)
+		}
+	}
+	sink.Reset()
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+	if got := sink.String(); got != want {
+		t.Errorf("expected entries in their original order %q, got %q", want, got)
+	}
+}
+
+// GroupRecorder is a WriteSyncer implementing GroupWriter, recording the groups handed to it
+type GroupRecorder struct {
+	*zapsmtptest.MemorySyncer
+	groups []string
+	counts []int
+}
+
+// WriteGroup implements GroupWriter.
+func (r *GroupRecorder) WriteGroup(p []byte, _ Level, count int, group string) (int, error) {
+	r.groups = append(r.groups, group)
+	r.counts = append(r.counts, count)
+	return r.Write(p)
+}
+
+func TestDelayedCore_SetGroupBy(t *testing.T) {
+	sink := &GroupRecorder{MemorySyncer: zapsmtptest.NewMemorySyncer()}
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Minute*10, // Very long delays, only the explicit sync may reach the sink
+		time.Minute*5,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetGroupBy(func(ent Entry, fields []Field) string {
+		for _, f := range fields {
+			if f.Key == "component" {
+				return f.String
+			}
+		}
+		return ""
+	})
+
+	// Entries of both components are interleaved, priority entries of the second component come first
+	_ = core.Write(Entry{Level: InfoLevel, Message: "db-1"}, []Field{zap.String("component", "db")})
+	_ = core.Write(Entry{Level: InfoLevel, Message: "api-1"}, []Field{zap.String("component", "api")})
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "api-2"}, []Field{zap.String("component", "api")})
+	_ = core.Write(Entry{Level: WarnLevel, Message: "db-2"}, []Field{zap.String("component", "db")})
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+
+	// Each group must have been written separately, with its own entries only
+	batches := sink.Batches()
+	if len(batches) != 2 || strings.Join(sink.groups, ",") != "api,db" || sink.counts[0] != 2 || sink.counts[1] != 2 {
+		t.Errorf("expected two batches for groups api and db, got: %v %v %q", sink.groups, sink.counts, batches)
+		return
+	}
+	for i, group := range sink.groups {
+		other := "db"
+		if group == "db" {
+			other = "api"
+		}
+		if !strings.Contains(string(batches[i]), group+"-1") || !strings.Contains(string(batches[i]), group+"-2") ||
+			strings.Contains(string(batches[i]), other+"-") {
+			t.Errorf("expected batch of group %s to contain only its entries, got: %s", group, batches[i])
+		}
+	}
+
+	// Entries without a group must be written as a regular message
+	sink.Reset()
+	sink.groups, sink.counts = nil, nil
+	_ = core.Write(Entry{Level: InfoLevel, Message: "other"}, nil)
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+	if len(sink.Batches()) != 1 || len(sink.groups) != 0 {
+		t.Errorf("expected one batch without group, got: %v %q", sink.groups, sink.Batches())
+	}
+}
+
+func TestDelayedCore_SetDigestOutput(t *testing.T) {
+	sink := zapsmtptest.NewMemorySyncer()
+	digest := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(
+		ErrorLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		DPanicLevel,
+		time.Millisecond*50,
+		time.Millisecond*50,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetDigestOutput(digest, DebugLevel)
+	core.SetFilter(func(ent Entry, fields []Field) bool {
+		return ent.Message != "filtered"
+	})
+	logger := zap.New(core)
+
+	// Entries below the level of the core must reach the digest only, also without an explicit sync
+	logger.Warn("below-level")
+	if !digest.WaitForBatches(1, time.Second) {
+		t.Errorf("expected the digest to receive the entry after the delay")
+		return
+	}
+	if !strings.Contains(digest.String(), "below-level") {
+		t.Errorf("expected the digest to contain the entry, got: %s", digest.String())
+	}
+	if got := sink.String(); got != "" {
+		t.Errorf("expected the level check to suppress the entry, got: %s", got)
+		return
+	}
+
+	// Entries passing the level check must reach both, filtered ones the digest only
+	digest.Reset()
+	logger.Error("both")
+	logger.Error("filtered")
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+	if got := sink.String(); !strings.Contains(got, "both") || strings.Contains(got, "filtered") {
+		t.Errorf("expected the output to contain the unfiltered entry only, got: %s", got)
+	}
+	if got := digest.String(); len(digest.Batches()) != 1 || !strings.Contains(got, "both") ||
+		!strings.Contains(got, "filtered") {
+		t.Errorf("expected the digest to contain all entries in one batch, got: %q", digest.Batches())
+	}
+
+	// The core must report the levels of the digest as enabled
+	if !core.Enabled(DebugLevel) || LevelOf(core) != DebugLevel {
+		t.Errorf("expected the core to be enabled for the levels of the digest")
+	}
+}
+
+func TestDelayedCore_SetBodyTemplates(t *testing.T) {
+	sink := zapsmtptest.NewMemorySyncer()
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Minute*10, // Very long delays, only the explicit sync may reach the sink
+		time.Minute*5,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	// Invalid templates must be refused
+	if err := core.SetBodyTemplates("{{.Count", ""); err == nil {
+		t.Errorf("expected invalid template to be refused")
+		return
+	}
+	err := core.SetBodyTemplates(
+		"covers {{.Count}} events ({{.Priority}} priority, {{.Standard}} standard) up to {{.Level}} "+
+			"from {{.Start.UnixNano}} to {{.End.UnixNano}}\n",
+		"end of {{.Count}} events\n",
+	)
+	if err != nil {
+		t.Errorf("unexpected error setting templates: %s", err)
+		return
+	}
+
+	// Collect entries of both sections
+	before := time.Now()
+	_ = core.Write(Entry{Level: InfoLevel, Message: "first"}, nil)
+	_ = core.Write(Entry{Level: WarnLevel, Message: "second"}, nil)
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "third"}, nil)
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+	after := time.Now()
+
+	// The prefix must lead the message with the correct values, the suffix must end it
+	got := sink.String()
+	var count, priority, standard int
+	var level string
+	var start, end int64
+	_, errScan := fmt.Sscanf(got, "covers %d events (%d priority, %d standard) up to %s from %d to %d\n",
+		&count, &priority, &standard, &level, &start, &end)
+	if errScan != nil {
+		t.Errorf("expected message to start with the rendered prefix, got: %s (%s)", got, errScan)
+		return
+	}
+	if count != 3 || priority != 1 || standard != 2 || level != "error" {
+		t.Errorf("expected 3 events, 1 priority, 2 standard up to error, got: %s", got)
+	}
+	if start < before.UnixNano() || end < start || end > after.UnixNano() {
+		t.Errorf("expected times between %d and %d in order, got %d and %d", before.UnixNano(), after.UnixNano(),
+			start, end)
+	}
+	if !strings.HasSuffix(got, "}\nend of 3 events\n") {
+		t.Errorf("expected message to end with the rendered suffix, got: %s", got)
+	}
+
+	// Messages without entries must not be decorated, failing templates must be left out and reported
+	sink.Reset()
+	if err := core.Sync(); err != nil || sink.String() != "" {
+		t.Errorf("expected no message without entries, got: %q %v", sink.String(), err)
+		return
+	}
+	if err := core.SetBodyTemplates("{{.Count.Missing}}", ""); err != nil {
+		t.Errorf("unexpected error setting templates: %s", err)
+		return
+	}
+	_ = core.Write(Entry{Level: InfoLevel, Message: "fourth"}, nil)
+	if err := core.Sync(); err != nil {
+		t.Errorf("unexpected error syncing: %s", err)
+		return
+	}
+	if got := sink.String(); !strings.HasPrefix(got, "{") || !strings.Contains(got, "fourth") {
+		t.Errorf("expected message without prefix, got: %s", got)
+	}
+	if err := core.Write(Entry{Level: InfoLevel, Message: "fifth"}, nil); err == nil ||
+		!strings.Contains(err.Error(), "body template") {
+		t.Errorf("expected the template failure to be reported, got: %v", err)
+	}
+}
+
+// CloseRecorder is a WriteSyncer implementing io.Closer, recording how often it was closed. Writes block until the
+// release channel is closed, if set.
+type CloseRecorder struct {
+	*zapsmtptest.MemorySyncer
+	release chan struct{}
+	closed  int
+}
+
+// Write implements io.Writer.
+func (r *CloseRecorder) Write(p []byte) (int, error) {
+	if r.release != nil {
+		<-r.release
+	}
+	return r.MemorySyncer.Write(p)
+}
+
+// Close implements io.Closer.
+func (r *CloseRecorder) Close() error {
+	r.closed++
+	return nil
+}
+
+func TestDelayedCore_FlushAndClose(t *testing.T) {
+	sink := &CloseRecorder{MemorySyncer: zapsmtptest.NewMemorySyncer()}
+	pager := &CloseRecorder{MemorySyncer: zapsmtptest.NewMemorySyncer()}
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Minute*10, // Very long delays, only the final flush may reach the sinks
+		time.Minute*5,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetPriorityOutput(pager)
+
+	// The queued entries must be written and the outputs closed by a single call
+	_ = core.Write(Entry{Level: InfoLevel, Message: "info"}, nil)
+	_ = core.Write(Entry{Level: ErrorLevel, Message: "error"}, nil)
+	if err := core.FlushAndClose(context.Background()); err != nil {
+		t.Errorf("unexpected error flushing: %s", err)
+		return
+	}
+	if !strings.Contains(sink.String(), "info") || !strings.Contains(pager.String(), "error") {
+		t.Errorf("expected queued entries to be written, got: %q and %q", sink.String(), pager.String())
+	}
+	if sink.closed != 1 || pager.closed != 1 {
+		t.Errorf("expected outputs to be closed once, got: %d and %d", sink.closed, pager.closed)
+	}
+}
+
+func TestDelayedCore_FlushAndCloseWaits(t *testing.T) {
+	sink := &CloseRecorder{MemorySyncer: zapsmtptest.NewMemorySyncer(), release: make(chan struct{})}
+	core, errCore := NewDelayedCore(
+		InfoLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		sink,
+		ErrorLevel,
+		time.Millisecond*10,
+		time.Millisecond*5,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	// Let the delayed write get stuck in the output
+	_ = core.Write(Entry{Level: InfoLevel, Message: "first"}, nil)
+	time.Sleep(time.Millisecond * 50)
+	_ = core.Write(Entry{Level: InfoLevel, Message: "second"}, nil)
+
+	// The outputs must stay open while the write is still in progress
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := core.FlushAndClose(ctx); err == nil {
+		t.Errorf("expected error while write is stuck")
+		return
+	}
+	if sink.closed != 0 {
+		t.Errorf("expected output to stay open, got closed %d times", sink.closed)
+	}
+
+	// Once the write went through, the final flush must follow it
+	close(sink.release)
+	if err := core.FlushAndClose(context.Background()); err != nil {
+		t.Errorf("unexpected error flushing: %s", err)
+		return
+	}
+	batches := sink.Batches()
+	if len(batches) != 2 || !strings.Contains(string(batches[0]), "first") ||
+		!strings.Contains(string(batches[1]), "second") || sink.closed != 1 {
+		t.Errorf("expected both entries in order and output closed once, got: %q, closed %d", batches, sink.closed)
+	}
+}
+
+func TestDelayedCore_Describe(t *testing.T) {
+	core, errCore := NewDelayedCore(
+		WarnLevel,
+		NewJSONEncoder(testEncoderConfig()),
+		zapsmtptest.NewMemorySyncer(),
+		ErrorLevel,
+		time.Minute*10,
+		0,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetPriorityThreshold(3)
+	core.SetRateLimit(5, time.Hour, SuppressRetain)
+	core.SetFilter(func(Entry, []Field) bool { return true })
+
+	got := core.Describe()
+	for _, want := range []string{
+		"Level: warn and above\n",
+		"Priority level: error and above\n",
+		"Delay: 10m0s\n",
+		"Priority delay: none, written immediately\n",
+		"Priority threshold: 3 entries\n",
+		"Max entries: 20\n",
+		"Filter: set\n",
+		"Grouping: not set\n",
+		"Rate limit: 5 per 1h0m0s, retain entries\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Describe() = %q, want it to contain %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package cores
+
+import (
+	"fmt"
+	"go.uber.org/zap/zapcore"
+	"time"
+)
+
+// DelaySchedule holds the delays of a DelayedCore, which can only be created valid, i.e. with a priority delay not
+// exceeding the standard delay. Use NewDelaySchedule or one of the presets. The zero value writes all entries
+// immediately, like Immediate.
+type DelaySchedule struct {
+	delay         time.Duration
+	delayPriority time.Duration
+}
+
+// Presets covering common use cases
+var (
+	// Immediate writes every entry right away, e.g. for tests or low-volume services
+	Immediate = DelaySchedule{}
+
+	// FiveMinutePriority collects standard entries for an hour, priority entries are written after five minutes
+	FiveMinutePriority = DelaySchedule{delay: time.Hour, delayPriority: time.Minute * 5}
+
+	// DailyDigest collects standard entries for a day, priority entries are written after five minutes. Consider
+	// raising the maximum number of entries via SetMaxEntries, as it triggers a write before the day is over.
+	DailyDigest = DelaySchedule{delay: time.Hour * 24, delayPriority: time.Minute * 5}
+)
+
+// NewDelaySchedule returns a schedule with the given delays of standard and priority entries, or an error if a delay
+// is negative or the priority delay exceeds the standard delay. A priority delay of zero writes priority entries
+// immediately.
+func NewDelaySchedule(delay time.Duration, delayPriority time.Duration) (DelaySchedule, error) {
+	if delay < 0 {
+		return DelaySchedule{}, fmt.Errorf("delay (%s) must not be negative", delay)
+	}
+	if delayPriority < 0 {
+		return DelaySchedule{}, fmt.Errorf("priority delay (%s) must not be negative", delayPriority)
+	}
+	if err := validateDelays(delay, delayPriority); err != nil {
+		return DelaySchedule{}, err
+	}
+	return DelaySchedule{delay: delay, delayPriority: delayPriority}, nil
+}
+
+// Delay returns the delay of standard entries
+func (s DelaySchedule) Delay() time.Duration {
+	return s.delay
+}
+
+// PriorityDelay returns the delay of priority entries
+func (s DelaySchedule) PriorityDelay() time.Duration {
+	return s.delayPriority
+}
+
+// String returns the delays in a human-readable form, e.g. for logging the configuration
+func (s DelaySchedule) String() string {
+	return fmt.Sprintf("standard after %s, priority after %s", s.delay, s.delayPriority)
+}
+
+// NewDelayedCoreFromSchedule creates a DelayedCore like NewDelayedCore, with the delays taken from the schedule, which
+// is valid by construction.
+func NewDelayedCoreFromSchedule(
+	enab zapcore.LevelEnabler,
+	enc zapcore.Encoder,
+	out zapcore.WriteSyncer,
+
+	priority zapcore.LevelEnabler,
+	schedule DelaySchedule,
+) (*DelayedCore, error) {
+	return NewDelayedCore(enab, enc, out, priority, schedule.delay, schedule.delayPriority)
+}
@@ -0,0 +1,93 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package cores
+
+import (
+	"github.com/siemens/ZapSmtp/zapsmtptest"
+	. "go.uber.org/zap/zapcore"
+	"testing"
+	"time"
+)
+
+func TestNewDelaySchedule(t *testing.T) {
+	tests := []struct {
+		name          string
+		delay         time.Duration
+		delayPriority time.Duration
+		wantErr       bool
+	}{
+		{"valid", time.Minute, time.Second, false},
+		{"valid-equal", time.Minute, time.Minute, false},
+		{"valid-immediate-priority", time.Minute, 0, false},
+		{"valid-zero", 0, 0, false},
+		{"invalid-inverted", time.Second, time.Minute, true},
+		{"invalid-negative-delay", -time.Second, 0, true},
+		{"invalid-negative-priority", time.Minute, -time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewDelaySchedule(tt.delay, tt.delayPriority)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewDelaySchedule() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				if got != (DelaySchedule{}) {
+					t.Errorf("NewDelaySchedule() = %v, want zero value on error", got)
+				}
+				return
+			}
+			if got.Delay() != tt.delay || got.PriorityDelay() != tt.delayPriority {
+				t.Errorf("NewDelaySchedule() = %v, want delays %s and %s", got, tt.delay, tt.delayPriority)
+			}
+		})
+	}
+}
+
+func TestDelaySchedule_presets(t *testing.T) {
+	tests := []struct {
+		name          string
+		schedule      DelaySchedule
+		delay         time.Duration
+		delayPriority time.Duration
+	}{
+		{"immediate", Immediate, 0, 0},
+		{"five-minute-priority", FiveMinutePriority, time.Hour, time.Minute * 5},
+		{"daily-digest", DailyDigest, time.Hour * 24, time.Minute * 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.schedule.Delay() != tt.delay || tt.schedule.PriorityDelay() != tt.delayPriority {
+				t.Errorf("preset = %v, want delays %s and %s", tt.schedule, tt.delay, tt.delayPriority)
+			}
+
+			// Every preset must be accepted by the validation and the core
+			if _, err := NewDelaySchedule(tt.schedule.Delay(), tt.schedule.PriorityDelay()); err != nil {
+				t.Errorf("NewDelaySchedule() rejected preset: %s", err)
+			}
+			core, err := NewDelayedCoreFromSchedule(
+				InfoLevel,
+				NewJSONEncoder(testEncoderConfig()),
+				zapsmtptest.NewMemorySyncer(),
+				ErrorLevel,
+				tt.schedule,
+			)
+			if err != nil {
+				t.Errorf("NewDelayedCoreFromSchedule() error = %v", err)
+				return
+			}
+			if core.delay != tt.delay || core.delayPriority != tt.delayPriority {
+				t.Errorf("NewDelayedCoreFromSchedule() delays = %s and %s, want %s and %s",
+					core.delay, core.delayPriority, tt.delay, tt.delayPriority)
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@
 package example
 
 import (
+	"context"
 	"fmt"
 	"github.com/siemens/ZapSmtp/cores"
 	"github.com/siemens/ZapSmtp/smtp"
@@ -90,6 +91,6 @@ func initSmtpCore(
 		return nil, nil, errCore
 	}
 
-	// Return initialized core and associated close function
-	return core, sink.Close, nil
+	// Return initialized core and associated close function, which sends the queued entries before removing the files
+	return core, func() error { return core.FlushAndClose(context.Background()) }, nil
 }
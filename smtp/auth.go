@@ -0,0 +1,141 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// authMechanisms are the supported authentication mechanisms, in the order of preference during negotiation
+var authMechanisms = []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+
+// SetAuthMechanism pins the mechanism used for authentication, e.g. because the negotiation picks one the server
+// implements incorrectly. Supported are "PLAIN", "LOGIN" and "CRAM-MD5". By default, the first of these offered by the
+// server is chosen. If the server doesn't offer the pinned mechanism, sending fails with an error listing the offered
+// ones. To debug authentication failures, the mechanism actually chosen is reported in SendStats.AuthMechanism to the
+// handler set by SetStatsHandler, also if the authentication fails. Passing an empty mechanism restores the
+// negotiation. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetAuthMechanism(mechanism string) error {
+	mechanism = strings.ToUpper(strings.TrimSpace(mechanism))
+	if mechanism != "" && !containsString(authMechanisms, mechanism) {
+		return fmt.Errorf(
+			"unsupported authentication mechanism '%s', supported are %s", mechanism, strings.Join(authMechanisms, ", "),
+		)
+	}
+
+	s.authMechanism = mechanism
+	return nil
+}
+
+// negotiatedAuth authenticates with the preferred mechanism offered by the server, or the pinned one. The chosen
+// mechanism is remembered, so it can be reported.
+type negotiatedAuth struct {
+	username string
+	password string
+	host     string
+	pinned   string // Mechanism to use regardless of the preference, negotiated if empty
+
+	mechanism string    // Mechanism chosen when the authentication started
+	auth      smtp.Auth // Implementation of the chosen mechanism
+}
+
+func (a *negotiatedAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+
+	// Choose the mechanism among the ones offered by the server
+	offered := make([]string, len(server.Auth))
+	for i, m := range server.Auth {
+		offered[i] = strings.ToUpper(m)
+	}
+	candidates := authMechanisms
+	if a.pinned != "" {
+		candidates = []string{a.pinned}
+	}
+	for _, m := range candidates {
+		if containsString(offered, m) {
+			a.mechanism = m
+			break
+		}
+	}
+	if a.mechanism == "" {
+		if a.pinned != "" {
+			return "", nil, fmt.Errorf(
+				"server offers authentication mechanisms %s, but not '%s'", strings.Join(offered, ", "), a.pinned,
+			)
+		}
+		return "", nil, fmt.Errorf(
+			"server offers no supported authentication mechanism, only %s", strings.Join(offered, ", "),
+		)
+	}
+
+	// Hand over to the implementation of the mechanism
+	switch a.mechanism {
+	case "PLAIN":
+		a.auth = smtp.PlainAuth("", a.username, a.password, a.host)
+	case "LOGIN":
+		a.auth = &loginAuth{username: a.username, password: a.password, host: a.host}
+	case "CRAM-MD5":
+		a.auth = smtp.CRAMMD5Auth(a.username, a.password)
+	}
+	return a.auth.Start(server)
+}
+
+func (a *negotiatedAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.auth.Next(fromServer, more)
+}
+
+// loginAuth implements the LOGIN mechanism, which is not standardized but still required by some servers. Like the
+// PLAIN mechanism of the standard library, it refuses to send the credentials over an unencrypted connection, unless
+// the server runs on the local host.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, fmt.Errorf("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, fmt.Errorf("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	// The server prompts for the values, usually "Username:" and "Password:"
+	prompt := bytes.ToLower(bytes.TrimSpace(fromServer))
+	switch {
+	case bytes.HasPrefix(prompt, []byte("user")):
+		return []byte(a.username), nil
+	case bytes.HasPrefix(prompt, []byte("pass")):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN prompt '%s'", fromServer)
+	}
+}
+
+// containsString reports whether the slice contains the given string
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
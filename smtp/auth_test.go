@@ -0,0 +1,129 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestWriteSyncer_SetAuthMechanism(t *testing.T) {
+	tests := []struct {
+		name          string
+		mechanism     string
+		wantCommand   string // Prefix of the AUTH command sent
+		wantMechanism string // Mechanism reported to the stats handler
+		wantErr       string // Part of the error, empty if valid
+	}{
+		{"valid-negotiated", "", "AUTH PLAIN ", "PLAIN", ""},
+		{"valid-pinned", "login", "AUTH LOGIN", "LOGIN", ""},
+		{"invalid-not-offered", "CRAM-MD5", "", "", "server offers authentication mechanisms PLAIN, LOGIN, but not 'CRAM-MD5'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Plain authentication is refused over unencrypted connections, except to the local host
+			ws, errWs := NewWriteSyncer(
+				"localhost",
+				25,
+				"user",
+				"password",
+				"auth test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{extensions: []string{"AUTH PLAIN LOGIN"}}}
+			ws.SetDialer(dialer)
+			if err := ws.SetAuthMechanism(tt.mechanism); err != nil {
+				t.Errorf("SetAuthMechanism() error = %v", err)
+				return
+			}
+			var gotStats SendStats
+			var gotErr error
+			ws.SetStatsHandler(func(stats SendStats, err error) { gotStats, gotErr = stats, err })
+
+			_, err := ws.Write([]byte("some message"))
+			if (err != nil) != (tt.wantErr != "") {
+				t.Errorf("Write() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			// The chosen mechanism must be reported to the stats handler along with the outcome
+			if gotStats.AuthMechanism != tt.wantMechanism {
+				t.Errorf("reported mechanism = %q, want %q", gotStats.AuthMechanism, tt.wantMechanism)
+			}
+			if gotErr != err {
+				t.Errorf("reported error = %v, want %v", gotErr, err)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Write() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			// The chosen mechanism must be used
+			commands, _ := dialer.server.received()
+			var gotCommand string
+			for _, cmd := range commands {
+				if strings.HasPrefix(cmd, "AUTH") {
+					gotCommand = cmd
+				}
+			}
+			if !strings.HasPrefix(gotCommand, tt.wantCommand) {
+				t.Errorf("AUTH command = %q, want prefix %q", gotCommand, tt.wantCommand)
+			}
+		})
+	}
+
+	// Unknown mechanisms must be refused
+	ws := &WriteSyncer{}
+	if err := ws.SetAuthMechanism("XOAUTH2"); err == nil {
+		t.Errorf("SetAuthMechanism() accepted unsupported mechanism")
+	}
+}
+
+func Test_loginAuth(t *testing.T) {
+	auth := &loginAuth{username: "user", password: "password", host: "mail.domain.tld"}
+
+	tests := []struct {
+		name    string
+		prompt  string
+		want    string
+		wantErr bool
+	}{
+		{"valid-username", "Username:", "user", false},
+		{"valid-password", "Password:", "password", false},
+		{"invalid-prompt", "Token:", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := auth.Next([]byte(tt.prompt), true)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Next() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("Next() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
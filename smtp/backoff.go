@@ -0,0 +1,113 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// SetRetry retries sending a mail up to the given number of times if it failed temporarily, i.e. the connection could
+// not be established or the server replied with a transient (4xx) error, e.g. because of greylisting. Mails accepted
+// for some of the recipients are not retried, so no recipient receives them twice. The delays between the attempts
+// are taken from the backoff, starting over for every mail, during which the write blocks. The stats handler is called
+// after every attempt. Zero or below disables retrying, which is the default. Must be called before the WriteSyncer is
+// used.
+func (s *WriteSyncer) SetRetry(retries int, backoff Backoff) {
+	if retries < 0 {
+		retries = 0
+	}
+	backoff.Reset()
+	s.retries = retries
+	s.backoff = backoff
+}
+
+// retryable decides whether a failed attempt to send a mail may be repeated. Only failures to connect and transient
+// replies of the server qualify, if no recipient accepted the mail yet.
+func retryable(resp Response, err error) bool {
+	if resp.Text != "" || len(resp.Recipients) > 0 {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var smtpErr *SMTPError
+	return errors.As(err, &smtpErr) && !smtpErr.Permanent
+}
+
+// Backoff computes exponentially growing delays with random jitter for retrying mails which failed temporarily, see
+// SetRetry, without all instances of a service hammering the server at the same time. The source of randomness can be
+// injected, so the delays become reproducible in tests. A Backoff keeps track of the attempts and must not be used
+// concurrently.
+type Backoff struct {
+	Initial time.Duration  // Delay before the first retry
+	Max     time.Duration  // Upper bound of the delays, unbounded if zero
+	Factor  float64        // Growth of the delay per attempt, defaults to 2 if not above 1
+	Jitter  float64        // Fraction by which a delay is randomly shortened or extended, e.g. 0.2 for ±20%
+	Random  func() float64 // Returns random numbers in [0, 1), defaults to a source seeded at startup if nil
+
+	attempt int
+}
+
+// backoffRandom is the default source of randomness of a Backoff, seeded once at startup. Unlike the global source of
+// math/rand it is independent of seeds set by the application.
+var (
+	backoffRandomLock sync.Mutex
+	backoffRandom     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// defaultRandom returns a random number in [0, 1) from the default source, which is safe for concurrent use
+func defaultRandom() float64 {
+	backoffRandomLock.Lock()
+	defer backoffRandomLock.Unlock()
+	return backoffRandom.Float64()
+}
+
+// Next returns the delay before the next attempt and advances to it. The delay grows by the factor with every attempt
+// and is randomized by the jitter, but never exceeds the maximum.
+func (b *Backoff) Next() time.Duration {
+	factor := b.Factor
+	if factor <= 1 {
+		factor = 2
+	}
+	jitter := math.Max(0, math.Min(1, b.Jitter))
+	random := b.Random
+	if random == nil {
+		random = defaultRandom
+	}
+
+	// Calculate the delay in floating point, as it may overflow a duration after many attempts
+	delay := float64(b.Initial) * math.Pow(factor, float64(b.attempt))
+	if b.Max > 0 {
+		delay = math.Min(delay, float64(b.Max))
+	}
+	b.attempt++
+
+	// Spread the delay evenly around its nominal value
+	delay *= 1 - jitter + 2*jitter*random()
+	if b.Max > 0 {
+		delay = math.Min(delay, float64(b.Max))
+	}
+	if delay >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// Reset starts over with the initial delay, e.g. after an attempt succeeded
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
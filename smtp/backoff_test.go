@@ -0,0 +1,160 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/mail"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackoff_Next(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff Backoff
+		want    []time.Duration
+	}{
+		{"no-jitter", Backoff{Initial: time.Second, Max: time.Second * 10}, []time.Duration{
+			time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 10, time.Second * 10,
+		}},
+		{"factor", Backoff{Initial: time.Second, Factor: 3}, []time.Duration{
+			time.Second, time.Second * 3, time.Second * 9, time.Second * 27, time.Second * 81, time.Second * 243,
+		}},
+		{"jitter-min", Backoff{Initial: time.Second, Max: time.Second * 10, Jitter: 0.5, Random: func() float64 { return 0 }}, []time.Duration{
+			time.Millisecond * 500, time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5,
+		}},
+		{"jitter-capped", Backoff{Initial: time.Second, Max: time.Second * 10, Jitter: 0.5, Random: func() float64 { return 0.99 }}, []time.Duration{
+			time.Millisecond * 1490, time.Millisecond * 2980, time.Millisecond * 5960, time.Second * 10, time.Second * 10, time.Second * 10,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]time.Duration, len(tt.want))
+			for i := range got {
+				got[i] = tt.backoff.Next()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+
+			// Starting over must yield the initial delay again
+			tt.backoff.Reset()
+			if got := tt.backoff.Next(); got != tt.want[0] {
+				t.Errorf("Next() after Reset() = %v, want %v", got, tt.want[0])
+			}
+		})
+	}
+}
+
+func TestBackoff_reproducible(t *testing.T) {
+
+	// Two backoffs with equally seeded sources must produce the same jittered sequence
+	sequence := func(seed int64) []time.Duration {
+		b := Backoff{Initial: time.Second, Max: time.Minute, Jitter: 0.3, Random: rand.New(rand.NewSource(seed)).Float64}
+		delays := make([]time.Duration, 10)
+		for i := range delays {
+			delays[i] = b.Next()
+		}
+		return delays
+	}
+	first, second := sequence(42), sequence(42)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Next() = %v and %v, want identical sequences", first, second)
+	}
+
+	// Every delay must be within the jitter around its nominal value
+	nominal := time.Second
+	for i, delay := range first {
+		if delay < time.Duration(float64(nominal)*0.7) || delay > time.Duration(float64(nominal)*1.3) || delay > time.Minute {
+			t.Errorf("Next() delay %d = %v, want within 30%% of %v", i, delay, nominal)
+		}
+		if nominal *= 2; nominal > time.Minute {
+			nominal = time.Minute
+		}
+	}
+}
+
+// flakyDialer fails to connect for the given number of times, before connecting to the fake server
+type flakyDialer struct {
+	failures int
+	server   *fakeServer
+}
+
+func (d *flakyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.failures > 0 {
+		d.failures--
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	return (&pipeDialer{server: d.server}).DialContext(ctx, network, addr)
+}
+
+func TestWriteSyncer_SetRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      int
+		failures     int    // Failed connection attempts
+		dataResponse string // Reply to the transmitted message
+		wantAttempts int    // Number of attempts reported to the stats handler
+		wantMessages int    // Number of messages transmitted
+		wantErr      bool
+	}{
+		{"disabled", 0, 1, "", 1, 0, true},
+		{"dial-recovers", 2, 2, "", 3, 1, false},
+		{"dial-exhausted", 2, 3, "", 3, 0, true},
+		{"transient-reply", 2, 0, "451 4.7.1 Greylisted, try again later", 3, 3, true},
+		{"permanent-reply", 2, 0, "550 5.1.1 User unknown", 1, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Prepare a plain write syncer, which does not need OpenSSL
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"retry test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			server := &fakeServer{dataResponse: tt.dataResponse}
+			ws.SetDialer(&flakyDialer{failures: tt.failures, server: server})
+			ws.SetRetry(tt.retries, Backoff{Initial: time.Millisecond, Max: time.Millisecond * 5})
+			attempts := 0
+			ws.SetStatsHandler(func(SendStats, error) { attempts++ })
+
+			_, err := ws.Write([]byte("some message"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if _, messages := server.received(); len(messages) != tt.wantMessages {
+				t.Errorf("transmitted %d messages, want %d", len(messages), tt.wantMessages)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"fmt"
+	"github.com/siemens/ZapSmtp/cores"
+	"go.uber.org/multierr"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Environment variables read by LoadConfigFromEnv. Lists of recipient certificates are separated by the operating
+// system's path list separator, e.g. ":" on Linux.
+const (
+	EnvServer         = "ZAPSMTP_SERVER"
+	EnvPort           = "ZAPSMTP_PORT"
+	EnvUsername       = "ZAPSMTP_USERNAME"
+	EnvPassword       = "ZAPSMTP_PASSWORD"
+	EnvSubject        = "ZAPSMTP_SUBJECT"
+	EnvSender         = "ZAPSMTP_SENDER"
+	EnvRecipients     = "ZAPSMTP_RECIPIENTS" // Comma separated list of addresses
+	EnvOpensslPath    = "ZAPSMTP_OPENSSL_PATH"
+	EnvSenderCert     = "ZAPSMTP_SENDER_CERT"
+	EnvSenderKey      = "ZAPSMTP_SENDER_KEY"
+	EnvRecipientCerts = "ZAPSMTP_RECIPIENT_CERTS"
+	EnvTempDir        = "ZAPSMTP_TEMP_DIR"
+	EnvDelay          = "ZAPSMTP_DELAY"          // Duration like "1m"
+	EnvDelayPriority  = "ZAPSMTP_DELAY_PRIORITY" // Duration like "5s"
+)
+
+// Config bundles the settings needed to mail log messages, e.g. as loaded from a configuration file or the
+// environment. The delays are not used by the WriteSyncCloser itself, but are meant to be handed to a DelayedCore.
+// Optional settings like DANE or a custom dialer still need to be applied via the setters.
+type Config struct {
+	Server   string
+	Port     uint16
+	Username string // Leave empty to skip authentication
+	Password string // Leave empty to skip authentication
+	Subject  string
+
+	Sender     mail.Address
+	Recipients []mail.Address
+
+	OpensslPath    string   // Can be omitted if neither signature nor encryption is desired
+	SenderCert     string   // Can be omitted if no signature is desired
+	SenderKey      string   // Can be omitted if no signature is desired
+	RecipientCerts []string // Can be omitted if no encryption is desired
+	TempDir        string   // Can be omitted if neither signature nor encryption is desired
+
+	Delay         time.Duration // Delay of standard log messages
+	DelayPriority time.Duration // Delay of priority log messages, must not exceed the standard delay
+}
+
+// Validate checks the configuration as a whole and returns an error listing every invalid field, rather than just
+// the first one encountered.
+func (c Config) Validate() error {
+	var errs error
+	invalid := func(field string, format string, args ...interface{}) {
+		errs = multierr.Append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	// Check the server
+	if c.Server == "" {
+		invalid("Server", "must be set")
+	}
+	if c.Port == 0 {
+		invalid("Port", "must be set")
+	}
+	if (c.Username == "") != (c.Password == "") {
+		invalid("Username", "must be set together with Password")
+	}
+
+	// Check the addresses
+	if c.Sender.Address == "" {
+		invalid("Sender", "must be set")
+	} else if _, err := mail.ParseAddress(c.Sender.Address); err != nil {
+		invalid("Sender", "invalid address '%s': %s", c.Sender.Address, err)
+	}
+	if len(c.Recipients) == 0 {
+		invalid("Recipients", "must contain at least one address")
+	}
+	for _, r := range c.Recipients {
+		if _, err := mail.ParseAddress(r.Address); err != nil {
+			invalid("Recipients", "invalid address '%s': %s", r.Address, err)
+		}
+	}
+
+	// Check signature and encryption settings
+	if (c.SenderCert == "") != (c.SenderKey == "") {
+		invalid("SenderCert", "must be set together with SenderKey")
+	}
+	if (c.SenderCert != "" || len(c.RecipientCerts) > 0) && c.OpensslPath == "" {
+		invalid("OpensslPath", "must be set for signature or encryption")
+	}
+	if len(c.RecipientCerts) > 0 && len(c.RecipientCerts) != len(c.Recipients) {
+		invalid("RecipientCerts", "must match the number of recipients")
+	}
+
+	// Check the delays
+	if c.Delay < 0 {
+		invalid("Delay", "must not be negative")
+	}
+	if c.DelayPriority < 0 {
+		invalid("DelayPriority", "must not be negative")
+	}
+	if c.DelayPriority > c.Delay {
+		invalid("DelayPriority", "must not exceed Delay")
+	}
+
+	return errs
+}
+
+// Schedule returns the delays as a schedule to be handed to a DelayedCore, or an error if they are invalid
+func (c Config) Schedule() (cores.DelaySchedule, error) {
+	return cores.NewDelaySchedule(c.Delay, c.DelayPriority)
+}
+
+// NewWriteSyncCloserFromConfig validates the configuration and returns a WriteSyncCloser created from it. For more
+// information on the settings take a look at NewWriteSyncer.
+func NewWriteSyncCloserFromConfig(cfg Config) (*WriteSyncCloser, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %s", err)
+	}
+
+	return NewWriteSyncCloser(
+		cfg.Server,
+		cfg.Port,
+		cfg.Username,
+		cfg.Password,
+		cfg.Subject,
+		cfg.Sender,
+		cfg.Recipients,
+		cfg.OpensslPath,
+		cfg.SenderCert,
+		cfg.SenderKey,
+		cfg.RecipientCerts,
+		cfg.TempDir,
+	)
+}
+
+// LoadConfigFromEnv reads the configuration from the environment variables listed above and validates it. The error
+// lists every variable which could not be parsed, or the fields which are invalid.
+func LoadConfigFromEnv() (Config, error) {
+	var cfg Config
+	var errs error
+	invalid := func(name string, err error) {
+		errs = multierr.Append(errs, fmt.Errorf("%s: %s", name, err))
+	}
+
+	// Read the plain values
+	cfg.Server = os.Getenv(EnvServer)
+	cfg.Username = os.Getenv(EnvUsername)
+	cfg.Password = os.Getenv(EnvPassword)
+	cfg.Subject = os.Getenv(EnvSubject)
+	cfg.OpensslPath = os.Getenv(EnvOpensslPath)
+	cfg.SenderCert = os.Getenv(EnvSenderCert)
+	cfg.SenderKey = os.Getenv(EnvSenderKey)
+	cfg.TempDir = os.Getenv(EnvTempDir)
+	if v := os.Getenv(EnvRecipientCerts); v != "" {
+		cfg.RecipientCerts = filepath.SplitList(v)
+	}
+
+	// Parse the remaining values
+	if v := os.Getenv(EnvPort); v != "" {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			invalid(EnvPort, err)
+		}
+		cfg.Port = uint16(port)
+	}
+	if v := os.Getenv(EnvSender); v != "" {
+		sender, err := mail.ParseAddress(v)
+		if err != nil {
+			invalid(EnvSender, err)
+		} else {
+			cfg.Sender = *sender
+		}
+	}
+	if v := os.Getenv(EnvRecipients); v != "" {
+		recipients, err := mail.ParseAddressList(v)
+		if err != nil {
+			invalid(EnvRecipients, err)
+		}
+		for _, r := range recipients {
+			cfg.Recipients = append(cfg.Recipients, *r)
+		}
+	}
+	if v := os.Getenv(EnvDelay); v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil {
+			invalid(EnvDelay, err)
+		}
+		cfg.Delay = delay
+	}
+	if v := os.Getenv(EnvDelayPriority); v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil {
+			invalid(EnvDelayPriority, err)
+		}
+		cfg.DelayPriority = delay
+	}
+	if errs != nil {
+		return Config{}, errs
+	}
+
+	// Validate the result as a whole
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
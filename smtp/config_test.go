@@ -0,0 +1,215 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"github.com/siemens/ZapSmtp/_test"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig returns a fully populated configuration, with the certificates and key taken from the given directory
+func testConfig(root string, opensslPath string) Config {
+	return Config{
+		Server:   "mail.domain.tld",
+		Port:     587,
+		Username: "user",
+		Password: "password",
+		Subject:  "config test",
+		Sender:   mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		Recipients: []mail.Address{
+			{Name: "Alice", Address: "alice@domain.tld"},
+			{Name: "Bob", Address: "bob@domain.tld"},
+		},
+		OpensslPath:    opensslPath,
+		SenderCert:     filepath.Join(root, "cert1.pem"),
+		SenderKey:      filepath.Join(root, "key1.pem"),
+		RecipientCerts: []string{filepath.Join(root, "cert1.pem"), filepath.Join(root, "cert2.pem")},
+		TempDir:        os.TempDir(),
+		Delay:          time.Minute,
+		DelayPriority:  time.Second * 5,
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name       string
+		modify     func(cfg *Config)
+		wantFields []string // Fields which must be named by the error, none if valid
+	}{
+		{"valid-full", func(cfg *Config) {}, nil},
+		{"valid-minimal", func(cfg *Config) {
+			*cfg = Config{Server: cfg.Server, Port: cfg.Port, Sender: cfg.Sender, Recipients: cfg.Recipients}
+		}, nil},
+		{"invalid-missing-server", func(cfg *Config) { cfg.Server = "" }, []string{"Server"}},
+		{"invalid-multiple", func(cfg *Config) {
+			cfg.Port = 0
+			cfg.Sender = mail.Address{}
+			cfg.SenderKey = ""
+		}, []string{"Port", "Sender", "SenderCert"}},
+		{"invalid-recipient", func(cfg *Config) { cfg.Recipients[1].Address = "bob" }, []string{"Recipients"}},
+		{"invalid-recipient-certs", func(cfg *Config) { cfg.RecipientCerts = cfg.RecipientCerts[:1] }, []string{"RecipientCerts"}},
+		{"invalid-openssl", func(cfg *Config) { cfg.OpensslPath = "" }, []string{"OpensslPath"}},
+		{"invalid-credentials", func(cfg *Config) { cfg.Password = "" }, []string{"Username"}},
+		{"invalid-delays", func(cfg *Config) { cfg.DelayPriority = time.Hour }, []string{"DelayPriority"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig("certs", "openssl")
+			tt.modify(&cfg)
+
+			err := cfg.Validate()
+			if (err != nil) != (len(tt.wantFields) > 0) {
+				t.Errorf("Validate() error = %v, want errors for %v", err, tt.wantFields)
+				return
+			}
+			for _, field := range tt.wantFields {
+				if !strings.Contains(err.Error(), field+": ") {
+					t.Errorf("Validate() error = %v, want it to name '%s'", err, field)
+				}
+			}
+		})
+	}
+}
+
+func TestConfig_Schedule(t *testing.T) {
+	cfg := testConfig("certs", "openssl")
+	got, err := cfg.Schedule()
+	if err != nil || got.Delay() != cfg.Delay || got.PriorityDelay() != cfg.DelayPriority {
+		t.Errorf("Schedule() = %v, %v, want delays %s and %s", got, err, cfg.Delay, cfg.DelayPriority)
+	}
+
+	// Inverted delays must be rejected
+	cfg.DelayPriority = cfg.Delay * 2
+	if _, err := cfg.Schedule(); err == nil {
+		t.Errorf("Schedule() accepted inverted delays")
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	vars := map[string]string{
+		EnvServer:         "mail.domain.tld",
+		EnvPort:           "587",
+		EnvUsername:       "user",
+		EnvPassword:       "password",
+		EnvSubject:        "config test",
+		EnvSender:         "Sender <sender@domain.tld>",
+		EnvRecipients:     "Alice <alice@domain.tld>, Bob <bob@domain.tld>",
+		EnvOpensslPath:    "openssl",
+		EnvSenderCert:     filepath.Join("certs", "cert1.pem"),
+		EnvSenderKey:      filepath.Join("certs", "key1.pem"),
+		EnvRecipientCerts: filepath.Join("certs", "cert1.pem") + string(os.PathListSeparator) + filepath.Join("certs", "cert2.pem"),
+		EnvTempDir:        os.TempDir(),
+		EnvDelay:          "1m",
+		EnvDelayPriority:  "5s",
+	}
+
+	tests := []struct {
+		name     string
+		override map[string]string // Values replacing the ones above, empty ones are unset
+		want     Config
+		wantErr  string
+	}{
+		{"valid-full", nil, testConfig("certs", "openssl"), ""},
+		{"invalid-missing-server", map[string]string{EnvServer: ""}, Config{}, "Server: must be set"},
+		{"invalid-port", map[string]string{EnvPort: "65536"}, Config{}, EnvPort},
+		{"invalid-delay", map[string]string{EnvDelay: "soon"}, Config{}, EnvDelay},
+		{"invalid-recipients", map[string]string{EnvRecipients: "alice, bob"}, Config{}, EnvRecipients},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Prepare the environment
+			for name, value := range vars {
+				if override, ok := tt.override[name]; ok {
+					value = override
+				}
+				if value == "" {
+					_ = os.Unsetenv(name)
+				} else {
+					_ = os.Setenv(name, value)
+				}
+				defer func(name string) { _ = os.Unsetenv(name) }(name)
+			}
+
+			got, err := LoadConfigFromEnv()
+			if (err != nil) != (tt.wantErr != "") {
+				t.Errorf("LoadConfigFromEnv() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfigFromEnv() error = %v, want it to contain '%s'", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadConfigFromEnv() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewWriteSyncCloserFromConfig(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	opensslPath := stubOpenssl(t, tempDir, stubSignScript)
+
+	tests := []struct {
+		name    string
+		modify  func(cfg *Config)
+		wantErr bool
+	}{
+		{"valid-full", func(cfg *Config) {}, false},
+		{"invalid-missing-server", func(cfg *Config) { cfg.Server = "" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(root, opensslPath)
+			cfg.TempDir = tempDir
+			tt.modify(&cfg)
+
+			got, err := NewWriteSyncCloserFromConfig(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewWriteSyncCloserFromConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			defer func() { _ = got.Close() }()
+
+			if got.server != cfg.Server || got.port != cfg.Port || got.subject != cfg.Subject ||
+				!reflect.DeepEqual(got.to, cfg.Recipients) || len(got.toCerts) != len(cfg.RecipientCerts) {
+				t.Errorf("NewWriteSyncCloserFromConfig() = %+v, want it to match %+v", got, cfg)
+			}
+		})
+	}
+}
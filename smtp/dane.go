@@ -0,0 +1,154 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// TLSA certificate usages, selectors and matching types as defined by RFC 6698. Only the DANE-TA and DANE-EE usages
+// are applicable to SMTP (RFC 7672), records with other usages are ignored.
+const (
+	TLSAUsageDaneTA uint8 = 2
+	TLSAUsageDaneEE uint8 = 3
+
+	TLSASelectorCert uint8 = 0
+	TLSASelectorSPKI uint8 = 1
+
+	TLSAMatchingFull   uint8 = 0
+	TLSAMatchingSHA256 uint8 = 1
+	TLSAMatchingSHA512 uint8 = 2
+)
+
+// TLSARecord is a DNS TLSA record as defined by RFC 6698
+type TLSARecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte // Certificate association data
+}
+
+// TLSAResolver looks up the TLSA records of a name, e.g. "_25._tcp.mail.domain.tld". The resolver of the standard
+// library does not support TLSA records, so a DNSSEC validating implementation needs to be supplied. Records not
+// secured by DNSSEC must not be returned.
+type TLSAResolver interface {
+	LookupTLSA(ctx context.Context, name string) ([]TLSARecord, error)
+}
+
+// daneConfig returns a TLS configuration verifying the server's certificate chain against the given TLSA records
+// instead of the system's certificate authorities.
+func daneConfig(server string, records []TLSARecord) (*tls.Config, error) {
+
+	// Only keep the records applicable to SMTP
+	usable := make([]TLSARecord, 0, len(records))
+	for _, r := range records {
+		if r.Usage == TLSAUsageDaneTA || r.Usage == TLSAUsageDaneEE {
+			usable = append(usable, r)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("no usable TLSA records for '%s'", server)
+	}
+
+	return &tls.Config{
+		ServerName: server,
+
+		// The default verification against the system's certificate authorities is replaced by the TLSA check
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("invalid server certificate: %s", err)
+				}
+				certs = append(certs, cert)
+			}
+			return verifyTLSA(server, certs, usable)
+		},
+	}, nil
+}
+
+// verifyTLSA checks whether the certificate chain presented by the server matches any of the TLSA records. A
+// DANE-EE record has to match the leaf certificate, no further checks are applied. A DANE-TA record has to match a
+// certificate of the chain, which the leaf certificate must be issued by and valid for the server's name.
+func verifyTLSA(server string, chain []*x509.Certificate, records []TLSARecord) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("server did not present a certificate")
+	}
+	leaf := chain[0]
+
+	for _, r := range records {
+		switch r.Usage {
+		case TLSAUsageDaneEE:
+			if matchTLSA(leaf, r) {
+				return nil
+			}
+		case TLSAUsageDaneTA:
+			for _, anchor := range chain[1:] {
+				if !matchTLSA(anchor, r) {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(anchor)
+				intermediates := x509.NewCertPool()
+				for _, c := range chain[1:] {
+					intermediates.AddCert(c)
+				}
+				_, err := leaf.Verify(x509.VerifyOptions{
+					DNSName:       server,
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				if err == nil {
+					return nil
+				}
+			}
+		}
+	}
+
+	return fmt.Errorf("server certificate does not match any TLSA record")
+}
+
+// matchTLSA checks whether the certificate matches the certificate association data of a TLSA record
+func matchTLSA(cert *x509.Certificate, record TLSARecord) bool {
+
+	// Select the relevant data of the certificate
+	var data []byte
+	switch record.Selector {
+	case TLSASelectorCert:
+		data = cert.Raw
+	case TLSASelectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	// Compare it according to the matching type
+	switch record.MatchingType {
+	case TLSAMatchingFull:
+		return bytes.Equal(data, record.Data)
+	case TLSAMatchingSHA256:
+		sum := sha256.Sum256(data)
+		return bytes.Equal(sum[:], record.Data)
+	case TLSAMatchingSHA512:
+		sum := sha512.Sum512(data)
+		return bytes.Equal(sum[:], record.Data)
+	default:
+		return false
+	}
+}
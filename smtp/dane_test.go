@@ -0,0 +1,74 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"testing"
+)
+
+// stubTLSAResolver returns the TLSA records stored for a name
+type stubTLSAResolver map[string][]TLSARecord
+
+func (r stubTLSAResolver) LookupTLSA(_ context.Context, name string) ([]TLSARecord, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("lookup %s: no such host", name)
+	}
+	return records, nil
+}
+
+func Test_deliverDANE(t *testing.T) {
+
+	// Prepare the server's certificate chain and the matching TLSA data
+	cert, ca := testCertificateChain(t, "mail.domain.tld")
+	leaf, errParse := x509.ParseCertificate(cert.Certificate[0])
+	if errParse != nil {
+		t.Errorf("could not parse certificate: %s", errParse)
+		return
+	}
+	spkiSum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	serverTls := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	const name = "_25._tcp.mail.domain.tld"
+	tests := []struct {
+		name      string
+		server    *fakeServer
+		resolver  TLSAResolver
+		wantErr   bool
+		wantFinal bool // Whether the message must have been transmitted
+	}{
+		{"valid-dane-ee", &fakeServer{tlsConfig: serverTls}, stubTLSAResolver{name: {{TLSAUsageDaneEE, TLSASelectorSPKI, TLSAMatchingSHA256, spkiSum[:]}}}, false, true},
+		{"valid-dane-ta", &fakeServer{tlsConfig: serverTls}, stubTLSAResolver{name: {{TLSAUsageDaneTA, TLSASelectorCert, TLSAMatchingFull, ca.Raw}}}, false, true},
+		{"valid-one-matching", &fakeServer{tlsConfig: serverTls}, stubTLSAResolver{name: {{TLSAUsageDaneEE, TLSASelectorSPKI, TLSAMatchingSHA256, []byte("other")}, {TLSAUsageDaneEE, TLSASelectorCert, TLSAMatchingFull, leaf.Raw}}}, false, true},
+		{"invalid-mismatch", &fakeServer{tlsConfig: serverTls}, stubTLSAResolver{name: {{TLSAUsageDaneEE, TLSASelectorSPKI, TLSAMatchingSHA256, []byte("other")}}}, true, false},
+		{"invalid-leaf-as-anchor", &fakeServer{tlsConfig: serverTls}, stubTLSAResolver{name: {{TLSAUsageDaneTA, TLSASelectorCert, TLSAMatchingFull, leaf.Raw}}}, true, false},
+		{"invalid-unusable-usage", &fakeServer{tlsConfig: serverTls}, stubTLSAResolver{name: {{1, TLSASelectorSPKI, TLSAMatchingSHA256, spkiSum[:]}}}, true, false},
+		{"invalid-no-records", &fakeServer{tlsConfig: serverTls}, stubTLSAResolver{}, true, false},
+		{"invalid-no-starttls", &fakeServer{}, stubTLSAResolver{name: {{TLSAUsageDaneEE, TLSASelectorSPKI, TLSAMatchingSHA256, spkiSum[:]}}}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := options{dialer: &pipeDialer{server: tt.server}, tlsaResolver: tt.resolver}
+			_, err := deliver(opts, "mail.domain.tld", 25, nil, "sender@domain.tld", []string{"a@domain.tld"}, []byte("message\r\n"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deliver() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, messages := tt.server.received(); (len(messages) == 1) != tt.wantFinal {
+				t.Errorf("deliver() transmitted %d messages, want transmission %v", len(messages), tt.wantFinal)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Describe returns a human-readable summary of the effective configuration, one setting per line, e.g. to be logged on
+// startup or attached to a support ticket. Secrets are masked, the password is only stated to be set. The content of
+// keys and certificates is omitted as well.
+func (s *WriteSyncer) Describe() string {
+	var b strings.Builder
+	line := func(name string, format string, args ...interface{}) {
+		_, _ = fmt.Fprintf(&b, "%s: %s\n", name, fmt.Sprintf(format, args...))
+	}
+
+	// Describe the connection
+	line("Server", "%s:%d", s.server, s.port)
+	switch {
+	case s.lmtp:
+		line("Protocol", "LMTP")
+		line("TLS", "none")
+	case s.tlsaResolver != nil:
+		line("Protocol", "SMTP")
+		line("TLS", "STARTTLS required, certificate verified via DANE")
+	case s.tlsMode == TLSRequired:
+		line("Protocol", "SMTP")
+		line("TLS", "STARTTLS required")
+	default:
+		line("Protocol", "SMTP")
+		line("TLS", "STARTTLS if offered")
+	}
+	if s.tlsConfig != nil && s.tlsaResolver == nil && !s.lmtp {
+		line("TLS configuration", "custom")
+	}
+	if s.dialTimeout > 0 {
+		line("Dial timeout", "%s", s.dialTimeout)
+	}
+	if s.username == "" || s.password == "" {
+		line("Authentication", "none")
+	} else {
+		mechanism := s.authMechanism
+		if mechanism == "" {
+			mechanism = "negotiated"
+		}
+		line("Authentication", "user '%s', password %s, mechanism %s", s.username, maskSecret(s.password), mechanism)
+	}
+
+	// Describe the addresses
+	line("Sender", "%s", s.from.String())
+	if s.envelopeFrom != "" {
+		line("Envelope sender", "%s", s.envelopeFrom)
+	}
+
+	// Read the recipient groups under their lock, as they may be replaced while mails are sent
+	s.groupMutex.Lock()
+	groups, random := len(s.groups), s.rotation == RotateRandom
+	s.groupMutex.Unlock()
+	if groups > 0 {
+		rotation := "round robin"
+		if random {
+			rotation = "random"
+		}
+		line("Recipients", "%d groups, rotating %s", groups, rotation)
+	} else {
+		line("Recipients", "%d", len(s.to))
+	}
+	if len(s.envelopeTo) > 0 {
+		line("Envelope recipients", "%d", len(s.envelopeTo))
+	}
+	if len(s.allowedDomains) > 0 {
+		policy := "reject"
+		if s.allowlistPolicy == AllowlistDrop {
+			policy = "drop"
+		}
+		line("Allowed domains", "%s (%s others)", strings.Join(s.allowedDomains, ", "), policy)
+	}
+	if s.maxRecipients > 0 {
+		line("Recipients per transaction", "%d", s.maxRecipients)
+	}
+	if s.chunkSize > 0 {
+		line("Chunking", "BDAT in chunks of %d bytes if supported", s.chunkSize)
+	}
+	if s.subjectTemplate != nil {
+		line("Subject", "template, falling back to '%s'", s.subject)
+	} else {
+		line("Subject", "'%s'", s.subject)
+	}
+
+	// Describe signature and encryption
+	if len(s.fromCert) > 0 {
+		line("Signing", "enabled, via %s", opensslFor(s.opensslSign, s.opensslPath))
+	} else {
+		line("Signing", "disabled")
+	}
+	switch {
+	case s.mustEncrypt != nil:
+		line("Encryption", "decided per mail, %d recipient certificates, via %s",
+			len(s.toCerts), opensslFor(s.opensslEncrypt, s.opensslPath))
+	case len(s.toCerts) > 0:
+		line("Encryption", "enabled, %d recipient certificates, via %s",
+			len(s.toCerts), opensslFor(s.opensslEncrypt, s.opensslPath))
+	default:
+		line("Encryption", "disabled")
+	}
+	switch s.keyTransport {
+	case KeyTransportPKCS1v15:
+		line("Key transport", "RSA PKCS #1 v1.5")
+	case KeyTransportOAEP:
+		line("Key transport", "RSA-OAEP")
+	}
+	if s.retries > 0 {
+		line("Retries", "%d after transient failures, starting after %s", s.retries, s.backoff.Initial)
+	}
+	if s.nestedMessage {
+		line("Nested message", "enabled")
+	}
+	if len(s.attachmentFuncs) > 0 {
+		names := make([]string, len(s.attachmentFuncs))
+		for i, a := range s.attachmentFuncs {
+			names[i] = a.name
+		}
+		line("Attachments per mail", "%s", strings.Join(names, ", "))
+	}
+	if s.attachmentNames == AttachmentReject {
+		line("Duplicate attachment names", "rejected")
+	}
+	if s.debugDir != "" {
+		line("Debug dump", "%s", s.debugDir)
+	}
+
+	return b.String()
+}
+
+// maskSecret returns a placeholder stating whether the secret is set, without revealing any part of it
+func maskSecret(secret string) string {
+	if secret == "" {
+		return "not set"
+	}
+	return "set (masked)"
+}
@@ -0,0 +1,102 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteSyncer_Describe(t *testing.T) {
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		587,
+		"user",
+		"top-secret-password",
+		"describe test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Alice", Address: "alice@domain.tld"}, {Name: "Bob", Address: "bob@domain.tld"}},
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	if err := ws.SetAuthMechanism("LOGIN"); err != nil {
+		t.Errorf("SetAuthMechanism() error = %v", err)
+		return
+	}
+
+	got := ws.Describe()
+	for _, want := range []string{
+		"Server: mail.domain.tld:587\n",
+		"TLS: STARTTLS if offered\n",
+		"Authentication: user 'user', password set (masked), mechanism LOGIN\n",
+		"Recipients: 2\n",
+		"Signing: disabled\n",
+		"Encryption: disabled\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Describe() = %q, want it to contain %q", got, want)
+		}
+	}
+
+	// No part of the password must be revealed
+	if strings.Contains(got, "top-secret") || strings.Contains(got, "password\n") {
+		t.Errorf("Describe() = %q, want the password to be masked", got)
+	}
+}
+
+func TestWriteSyncer_Describe_groups(t *testing.T) {
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"describe test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Alice", Address: "alice@domain.tld"}},
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	groups := [][]mail.Address{{{Address: "alice@domain.tld"}}, {{Address: "bob@domain.tld"}}}
+
+	// Describe the write syncer while the recipient groups are replaced, which must not race under -race
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = ws.SetRecipientGroups(groups, RotateRandom)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_ = ws.Describe()
+	}
+	wg.Wait()
+
+	if got := ws.Describe(); !strings.Contains(got, "Recipients: 2 groups, rotating random\n") {
+		t.Errorf("Describe() = %q, want it to list the recipient groups", got)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// DomainPolicy decides how an unresolvable sender domain is handled, see VerifySenderDomain
+type DomainPolicy int
+
+const (
+	DomainCheckSkip DomainPolicy = iota // The domain is not checked, e.g. in offline environments
+	DomainCheckWarn                     // A problem is reported to the warning handler, but not returned
+	DomainCheckFail                     // A problem is returned as an error
+)
+
+// domainCheckTimeout limits the time spent on the DNS lookups of a domain check
+const domainCheckTimeout = time.Second * 10
+
+// DomainResolver looks up the DNS records needed to check the sender domain. It is satisfied by net.Resolver, but
+// allows to inject stubs for testing.
+type DomainResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// VerifySenderDomain checks whether the domain of the sender resolves, i.e. has MX or A/AAAA records, which many relays
+// require to accept a mail. The envelope sender is checked if set, the header sender otherwise. The policy decides
+// whether a problem is returned as an error or passed to the warning handler, which may be nil. Meant to be called
+// once on startup, the resolver defaults to the system's resolver if nil.
+func (s *WriteSyncer) VerifySenderDomain(resolver DomainResolver, policy DomainPolicy, warn func(err error)) error {
+	if policy == DomainCheckSkip {
+		return nil
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	// Determine the domain of the address used as sender
+	sender := s.from.Address
+	if s.envelopeFrom != "" {
+		sender = s.envelopeFrom
+	}
+	domain := sender[strings.LastIndex(sender, "@")+1:]
+
+	// Look up the domain
+	ctx, cancel := context.WithTimeout(context.Background(), domainCheckTimeout)
+	defer cancel()
+	err := checkDomain(ctx, resolver, domain)
+	if err == nil {
+		return nil
+	}
+
+	// Handle the problem according to the policy
+	err = fmt.Errorf("sender domain '%s' does not resolve: %s", domain, err)
+	if policy == DomainCheckWarn {
+		if warn != nil {
+			warn(err)
+		}
+		return nil
+	}
+	return err
+}
+
+// checkDomain returns an error if the domain has neither MX nor A/AAAA records. A null MX record (RFC 7505), which
+// states that the domain does not accept mails, doesn't count.
+func checkDomain(ctx context.Context, resolver DomainResolver, domain string) error {
+	mxs, errMx := resolver.LookupMX(ctx, domain)
+	for _, mx := range mxs {
+		if mx.Host != "." && mx.Host != "" {
+			return nil
+		}
+	}
+	hosts, errHost := resolver.LookupHost(ctx, domain)
+	if errHost == nil && len(hosts) > 0 {
+		return nil
+	}
+
+	// Report the more telling error
+	if errHost != nil {
+		return errHost
+	}
+	if errMx != nil {
+		return errMx
+	}
+	return fmt.Errorf("no MX or A records")
+}
+
+// AllowlistPolicy decides how recipients outside the allowed domains are handled, see SetAllowedRecipientDomains
+type AllowlistPolicy int
+
+const (
+	AllowlistReject AllowlistPolicy = iota // The mail is not sent at all
+	AllowlistDrop                          // The mail is sent to the allowed recipients only
+)
+
+// SetAllowedRecipientDomains restricts the recipients to the given domains, guarding against misconfigurations leaking
+// internal log messages to external addresses. Subdomains of an allowed domain are accepted too. The check is done
+// whenever a mail is sent, against the recipients actually used for delivery, including envelope recipients and
+// recipient groups. The policy decides whether a recipient outside the allowed domains fails the mail or is dropped.
+// If all recipients are dropped, the mail fails. The To header is not changed by dropping recipients. Passing no
+// domains disables the check. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetAllowedRecipientDomains(domains []string, policy AllowlistPolicy) error {
+	if policy != AllowlistReject && policy != AllowlistDrop {
+		return fmt.Errorf("invalid allowlist policy")
+	}
+
+	// Normalize the domains, so they can be compared directly
+	allowed := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+		if domain == "" || strings.Contains(domain, "@") {
+			return fmt.Errorf("invalid recipient domain '%s'", domain)
+		}
+		allowed = append(allowed, domain)
+	}
+
+	s.allowedDomains = allowed
+	s.allowlistPolicy = policy
+	return nil
+}
+
+// filterRecipients returns the recipient addresses within the allowed domains, or an error if a recipient is outside
+// and the policy rejects the mail. All addresses are returned if no domains are set.
+func filterRecipients(addrs []string, allowed []string, policy AllowlistPolicy) ([]string, error) {
+	if len(allowed) == 0 {
+		return addrs, nil
+	}
+
+	filtered := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if domainAllowed(addr[strings.LastIndex(addr, "@")+1:], allowed) {
+			filtered = append(filtered, addr)
+			continue
+		}
+		if policy == AllowlistReject {
+			return nil, fmt.Errorf("recipient '%s' is outside the allowed domains", addr)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("no recipient within the allowed domains")
+	}
+	return filtered, nil
+}
+
+// domainAllowed returns whether the domain equals or is a subdomain of one of the allowed domains
+func domainAllowed(domain string, allowed []string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, a := range allowed {
+		if domain == a || strings.HasSuffix(domain, "."+a) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressKey returns the form in which two addresses are compared, the domain is case-insensitive unlike the local part
+func addressKey(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	return addr[:at+1] + strings.ToLower(addr[at+1:])
+}
+
+// uniqueAddresses returns the addresses without duplicates, keeping the first occurrence of each
+func uniqueAddresses(addrs []string) []string {
+	seen := make(map[string]bool, len(addrs))
+	unique := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if key := addressKey(addr); !seen[key] {
+			seen[key] = true
+			unique = append(unique, addr)
+		}
+	}
+	return unique
+}
+
+// uniqueRecipients returns the recipients without duplicate addresses, keeping the first occurrence of each
+func uniqueRecipients(recipients []mail.Address) []mail.Address {
+	seen := make(map[string]bool, len(recipients))
+	unique := make([]mail.Address, 0, len(recipients))
+	for _, r := range recipients {
+		if key := addressKey(r.Address); !seen[key] {
+			seen[key] = true
+			unique = append(unique, r)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,249 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stubDomainResolver answers lookups from its records, reporting NXDOMAIN for unknown domains
+type stubDomainResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (r stubDomainResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if mxs, ok := r.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r stubDomainResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if hosts, ok := r.hosts[host]; ok {
+		return hosts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestWriteSyncer_VerifySenderDomain(t *testing.T) {
+	resolver := stubDomainResolver{
+		mx: map[string][]*net.MX{
+			"mx.tld":      {{Host: "mail.mx.tld", Pref: 10}},
+			"null-mx.tld": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"a.tld": {"192.0.2.1"},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		sender       string
+		envelopeFrom mail.Address
+		policy       DomainPolicy
+		wantErr      bool
+		wantWarn     bool
+	}{
+		{"valid-mx", "sender@mx.tld", mail.Address{}, DomainCheckFail, false, false},
+		{"valid-a", "sender@a.tld", mail.Address{}, DomainCheckFail, false, false},
+		{"valid-envelope", "sender@nxdomain.tld", mail.Address{Address: "bounce@mx.tld"}, DomainCheckFail, false, false},
+		{"valid-skip", "sender@nxdomain.tld", mail.Address{}, DomainCheckSkip, false, false},
+		{"invalid-nxdomain-warn", "sender@nxdomain.tld", mail.Address{}, DomainCheckWarn, false, true},
+		{"invalid-nxdomain-fail", "sender@nxdomain.tld", mail.Address{}, DomainCheckFail, true, false},
+		{"invalid-null-mx", "sender@null-mx.tld", mail.Address{}, DomainCheckFail, true, false},
+		{"invalid-envelope", "sender@mx.tld", mail.Address{Address: "bounce@nxdomain.tld"}, DomainCheckFail, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"domain test",
+				mail.Address{Name: "Sender", Address: tt.sender},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			if err := ws.SetEnvelopeSender(tt.envelopeFrom); err != nil {
+				t.Errorf("SetEnvelopeSender() error = %v", err)
+				return
+			}
+
+			var warnings []error
+			err := ws.VerifySenderDomain(resolver, tt.policy, func(err error) { warnings = append(warnings, err) })
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifySenderDomain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (len(warnings) > 0) != tt.wantWarn {
+				t.Errorf("VerifySenderDomain() warnings = %v, wantWarn %v", warnings, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetAllowedRecipientDomains(t *testing.T) {
+	recipients := []mail.Address{
+		{Name: "Alice", Address: "alice@internal.corp"},
+		{Name: "Bob", Address: "bob@eu.INTERNAL.corp"},
+		{Name: "Mallory", Address: "mallory@external.tld"},
+	}
+
+	tests := []struct {
+		name       string
+		recipients []mail.Address
+		domains    []string
+		policy     AllowlistPolicy
+		wantRcpts  []string
+		wantErr    bool
+	}{
+		{"valid-no-allowlist", recipients, nil, AllowlistReject, []string{"alice@internal.corp", "bob@eu.INTERNAL.corp", "mallory@external.tld"}, false},
+		{"valid-internal-only", recipients[:2], []string{"internal.corp"}, AllowlistReject, []string{"alice@internal.corp", "bob@eu.INTERNAL.corp"}, false},
+		{"valid-drop", recipients, []string{"internal.corp"}, AllowlistDrop, []string{"alice@internal.corp", "bob@eu.INTERNAL.corp"}, false},
+		{"invalid-reject", recipients, []string{"internal.corp"}, AllowlistReject, nil, true},
+		{"invalid-all-dropped", recipients[2:], []string{"internal.corp"}, AllowlistDrop, nil, true},
+		{"invalid-suffix-only", []mail.Address{{Address: "eve@notinternal.corp"}}, []string{"internal.corp"}, AllowlistReject, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"allowlist test",
+				mail.Address{Name: "Sender", Address: "sender@internal.corp"},
+				tt.recipients,
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			if err := ws.SetAllowedRecipientDomains(tt.domains, tt.policy); err != nil {
+				t.Errorf("SetAllowedRecipientDomains() error = %v", err)
+				return
+			}
+
+			_, err := ws.Write([]byte("some message"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Write() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			// Check that only the allowed recipients were delivered to, and nothing at all on error
+			commands, _ := dialer.server.received()
+			var gotRcpts []string
+			for _, cmd := range commands {
+				if strings.HasPrefix(cmd, "RCPT TO:") {
+					gotRcpts = append(gotRcpts, strings.Trim(strings.TrimPrefix(cmd, "RCPT TO:"), "<>"))
+				}
+			}
+			if !reflect.DeepEqual(gotRcpts, tt.wantRcpts) {
+				t.Errorf("delivered to %v, want %v", gotRcpts, tt.wantRcpts)
+			}
+		})
+	}
+
+	// Invalid settings must be refused
+	ws := &WriteSyncer{}
+	if err := ws.SetAllowedRecipientDomains([]string{"internal.corp"}, AllowlistPolicy(7)); err == nil {
+		t.Errorf("SetAllowedRecipientDomains() accepted invalid policy")
+	}
+	if err := ws.SetAllowedRecipientDomains([]string{"user@internal.corp"}, AllowlistReject); err == nil {
+		t.Errorf("SetAllowedRecipientDomains() accepted address as domain")
+	}
+}
+
+func TestWriteSyncer_SetKeepDuplicateRecipients(t *testing.T) {
+	recipients := []mail.Address{
+		{Name: "Alice", Address: "alice@domain.tld"},
+		{Name: "Bob", Address: "bob@domain.tld"},
+		{Name: "Alice Again", Address: "alice@DOMAIN.tld"},
+		{Name: "Other Alice", Address: "Alice@domain.tld"},
+	}
+
+	tests := []struct {
+		name       string
+		keep       bool
+		wantRcpts  []string
+		wantHeader string
+	}{
+		{"remove", false, []string{"alice@domain.tld", "bob@domain.tld", "Alice@domain.tld"}, "To: \"Alice\" <alice@domain.tld>, \"Bob\" <bob@domain.tld>, \"Other Alice\" <Alice@domain.tld>\n"},
+		{"keep", true, []string{"alice@domain.tld", "bob@domain.tld", "Alice@domain.tld"}, "To: \"Alice\" <alice@domain.tld>, \"Bob\" <bob@domain.tld>, \"Alice Again\" <alice@DOMAIN.tld>, \"Other Alice\" <Alice@domain.tld>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"duplicate test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				recipients,
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetKeepDuplicateRecipients(tt.keep)
+
+			if _, err := ws.Write([]byte("some message")); err != nil {
+				t.Errorf("Write() error = %v", err)
+				return
+			}
+
+			// Each recipient must be issued only once, regardless of the header
+			commands, messages := dialer.server.received()
+			var gotRcpts []string
+			for _, cmd := range commands {
+				if strings.HasPrefix(cmd, "RCPT TO:") {
+					gotRcpts = append(gotRcpts, strings.Trim(strings.TrimPrefix(cmd, "RCPT TO:"), "<>"))
+				}
+			}
+			if !reflect.DeepEqual(gotRcpts, tt.wantRcpts) {
+				t.Errorf("delivered to %v, want %v", gotRcpts, tt.wantRcpts)
+			}
+			// The header may be folded, compare it unfolded
+			if len(messages) != 1 || !strings.Contains(strings.Replace(string(messages[0]), "\n ", " ", -1), tt.wantHeader) {
+				t.Errorf("messages = %q, want exactly one with header %q", messages, tt.wantHeader)
+			}
+		})
+	}
+}
@@ -12,19 +12,82 @@ package smtp
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"github.com/siemens/ZapSmtp/cores"
+	"go.uber.org/multierr"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+)
+
+// opensslSlots limits the number of concurrently running OpenSSL processes. It is nil if there is no limit.
+var (
+	opensslMutex sync.Mutex
+	opensslSlots chan struct{}
+)
+
+// SetMaxOpensslProcesses limits the number of OpenSSL processes running concurrently within this package, e.g. to
+// avoid exhausting file descriptors and CPU, if a burst of urgent log messages triggers many signed or encrypted
+// mails at once. Further invocations wait until a running process has finished. A value of zero or below removes the
+// limit, which is the default.
+func SetMaxOpensslProcesses(n int) {
+	opensslMutex.Lock()
+	defer opensslMutex.Unlock()
+
+	if n <= 0 {
+		opensslSlots = nil
+		return
+	}
+	opensslSlots = make(chan struct{}, n)
+}
+
+// runOpenssl runs the given OpenSSL command, after waiting for a free slot if the number of concurrent processes is
+// limited. A zero exit code is success, regardless of the output on stderr, e.g. deprecation or configuration
+// warnings. Such output of a successful command is passed to the warning handler, if set and stderr was captured.
+func runOpenssl(cmd *exec.Cmd, warn func(err error)) error {
+
+	// Retrieve the current limit. Processes started before a change of the limit keep the slot they acquired.
+	opensslMutex.Lock()
+	slots := opensslSlots
+	opensslMutex.Unlock()
+
+	if slots != nil {
+		slots <- struct{}{}
+		defer func() { <-slots }()
+	}
+
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if errs, ok := cmd.Stderr.(*bytes.Buffer); ok && warn != nil && len(bytes.TrimSpace(errs.Bytes())) > 0 {
+		warn(fmt.Errorf("OpenSSL %s succeeded with warnings:\n %s", cmd.Args[1], bytes.TrimSpace(errs.Bytes())))
+	}
+	return nil
+}
+
+// ErrCertKeySwapped is returned if the sender's certificate and key appear to have been passed in reverse order
+var ErrCertKeySwapped = errors.New(
+	"sender certificate and key appear to be swapped, pass the certificate (\"CERTIFICATE\" block) first and the " +
+		"private key (\"PRIVATE KEY\" block) second",
 )
 
 // PrepareSignatureKeys converts the sender's key pair to PEM if necessary and verifies that they are a matching
-// key pair.
+// key pair. ErrCertKeySwapped is returned if the certificate and key were passed in reverse order.
 func PrepareSignatureKeys(
 	openSslPath string,
 	signatureCert []byte,
@@ -34,6 +97,11 @@ func PrepareSignatureKeys(
 	// Prepare memory
 	var err error
 
+	// Detect a swapped key pair upfront, OpenSSL would fail with a confusing message otherwise
+	if isPrivateKey(signatureCert) && isCertificate(signatureKey) {
+		return nil, nil, ErrCertKeySwapped
+	}
+
 	// Check whether the certificate and key are already in PEM format, and try to convert them if not
 	if block, _ := pem.Decode(signatureCert); block == nil {
 		signatureCert, err = certToPem(openSslPath, signatureCert)
@@ -59,7 +127,7 @@ func PrepareSignatureKeys(
 	errsPriv := &bytes.Buffer{}
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, outPriv, errsPriv
 
-	if err := cmd.Run(); err != nil {
+	if err := runOpenssl(cmd, nil); err != nil {
 		if len(errsPriv.Bytes()) > 0 {
 			return nil, nil, fmt.Errorf("error checking sender's private key (%s):\n %v", err, errsPriv.String())
 		}
@@ -77,7 +145,7 @@ func PrepareSignatureKeys(
 	errsPub := &bytes.Buffer{}
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = inCert, outPub, errsPub
 
-	if errRun := cmd.Run(); errRun != nil {
+	if errRun := runOpenssl(cmd, nil); errRun != nil {
 		if len(errsPub.Bytes()) > 0 {
 			return nil, nil, fmt.Errorf("error checking sender's certificate (%s):\n %v", errRun, errsPub.String())
 		}
@@ -93,9 +161,85 @@ func PrepareSignatureKeys(
 	return signatureCert, signatureKey, nil
 }
 
+// PreparePEMSignatureKeys verifies that the sender's certificate and key are PEM encoded and a matching key pair,
+// like PrepareSignatureKeys, but without running OpenSSL. Input not in PEM format is refused instead of converted, as
+// are key types unknown to Go's standard library. ErrCertKeySwapped is returned if the certificate and key were
+// passed in reverse order.
+func PreparePEMSignatureKeys(signatureCert []byte, signatureKey []byte) ([]byte, []byte, error) {
+
+	// Refuse anything requiring a conversion
+	if block, _ := pem.Decode(signatureCert); block == nil {
+		return nil, nil, fmt.Errorf("sender certificate: not in PEM format")
+	}
+	if block, _ := pem.Decode(signatureKey); block == nil {
+		return nil, nil, fmt.Errorf("sender key: not in PEM format")
+	}
+
+	// Detect a swapped key pair, the check below would fail with a confusing message otherwise
+	if isPrivateKey(signatureCert) && isCertificate(signatureKey) {
+		return nil, nil, ErrCertKeySwapped
+	}
+
+	// Check whether the private key and the public key match. Otherwise any validation of the signature would fail.
+	if _, err := tls.X509KeyPair(signatureCert, signatureKey); err != nil {
+		return nil, nil, fmt.Errorf("private key and certificate of sender do not match: %s", err)
+	}
+
+	// Return signing certificate and key
+	return signatureCert, signatureKey, nil
+}
+
+// isCertificate reports whether the data holds an X.509 certificate, either in PEM or DER format
+func isCertificate(data []byte) bool {
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Type == "CERTIFICATE"
+	}
+	_, err := x509.ParseCertificate(data)
+	return err == nil
+}
+
+// oidEmailAddress identifies the legacy emailAddress attribute of a certificate's subject (PKCS #9)
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// certificateEmails returns the email addresses of an X.509 certificate, either in PEM or DER format. The addresses of
+// the subject alternative names come first, followed by the ones of the subject's legacy emailAddress attribute.
+func certificateEmails(data []byte) ([]string, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := append([]string{}, cert.EmailAddresses...)
+	for _, name := range cert.Subject.Names {
+		if email, ok := name.Value.(string); ok && name.Type.Equal(oidEmailAddress) {
+			emails = append(emails, email)
+		}
+	}
+	return emails, nil
+}
+
+// isPrivateKey reports whether the data holds a private key, either in PEM or DER format
+func isPrivateKey(data []byte) bool {
+	if block, _ := pem.Decode(data); block != nil {
+		return strings.HasSuffix(block.Type, "PRIVATE KEY")
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+		return true
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(data); err == nil {
+		return true
+	}
+	_, err := x509.ParseECPrivateKey(data)
+	return err == nil
+}
+
 // PrepareEncryptionKeys converts a list of encryption keys to PEM if necessary. The order of the recipients and
 // their certificates does not have to match and no check is performed, that the certificates actually belong to
-// later recipients.
+// later recipients. A PEM key may be a bundle including the certificate chain, the recipient's own certificate is
+// moved to the front to be used for encryption.
 func PrepareEncryptionKeys(
 	openSslPath string,
 	encryptionKeys [][]byte,
@@ -115,6 +259,12 @@ func PrepareEncryptionKeys(
 				return nil, fmt.Errorf("recipient certificate: %s", err)
 			}
 		}
+
+		// OpenSSL encrypts for the first certificate of a file, so make sure it is the recipient's own certificate
+		encryptionKey, err = orderCertificateBundle(encryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("recipient certificate: %s", err)
+		}
 		keys = append(keys, encryptionKey)
 	}
 
@@ -122,6 +272,114 @@ func PrepareEncryptionKeys(
 	return keys, nil
 }
 
+// PreparePEMEncryptionKeys verifies that the encryption keys are PEM encoded certificates, like PrepareEncryptionKeys,
+// but without running OpenSSL. Input not in PEM format is refused instead of converted. Bundles are ordered the same
+// way.
+func PreparePEMEncryptionKeys(encryptionKeys [][]byte) ([][]byte, error) {
+
+	// Prepare memory
+	keys := make([][]byte, 0, len(encryptionKeys))
+
+	// Go through the recipient certificates, refusing anything requiring a conversion
+	for _, encryptionKey := range encryptionKeys {
+		if block, _ := pem.Decode(encryptionKey); block == nil {
+			return nil, fmt.Errorf("recipient certificate: not in PEM format")
+		}
+
+		// OpenSSL encrypts for the first certificate of a file, so make sure it is the recipient's own certificate
+		encryptionKey, err := orderCertificateBundle(encryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("recipient certificate: %s", err)
+		}
+		if !isCertificate(encryptionKey) {
+			return nil, fmt.Errorf("recipient certificate: no certificate in PEM data")
+		}
+		keys = append(keys, encryptionKey)
+	}
+
+	return keys, nil
+}
+
+// orderCertificateBundle moves the end-entity certificate of a PEM bundle, e.g. a certificate followed by its chain,
+// to the front. The end-entity certificate is the first one not belonging to a certificate authority. The remaining
+// certificates keep their order. Bundles with a single certificate or only certificate authorities are returned
+// unchanged, as are blocks other than certificates.
+func orderCertificateBundle(bundle []byte) ([]byte, error) {
+
+	// Collect the certificates of the bundle
+	var blocks []*pem.Block
+	leaf := -1
+	for rest := bundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in bundle: %s", err)
+		}
+		if leaf < 0 && !cert.IsCA {
+			leaf = len(blocks)
+		}
+		blocks = append(blocks, block)
+	}
+
+	// Keep the bundle if there is nothing to reorder
+	if len(blocks) < 2 || leaf <= 0 {
+		return bundle, nil
+	}
+
+	// Re-encode the bundle with the end-entity certificate first
+	ordered := pem.EncodeToMemory(blocks[leaf])
+	for i, block := range blocks {
+		if i != leaf {
+			ordered = append(ordered, pem.EncodeToMemory(block)...)
+		}
+	}
+
+	return ordered, nil
+}
+
+// SplitPEMBundle extracts the first certificate and the first private key of a combined PEM file, as emitted by many
+// tools, and returns them PEM encoded. An error is returned if either is missing, the key is encrypted or the key does
+// not belong to the certificate.
+func SplitPEMBundle(data []byte) (cert []byte, key []byte, err error) {
+
+	// Go through the blocks, picking the first certificate and key
+	for rest := data; cert == nil || key == nil; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE" && cert == nil:
+			cert = pem.EncodeToMemory(block)
+		case block.Type == "ENCRYPTED PRIVATE KEY" && key == nil:
+			return nil, nil, fmt.Errorf("private key must not be password protected")
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && key == nil:
+			key = pem.EncodeToMemory(block)
+		}
+	}
+	if cert == nil {
+		return nil, nil, fmt.Errorf("no certificate in bundle")
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("no private key in bundle")
+	}
+
+	// Make sure the key belongs to the certificate
+	if _, errPair := tls.X509KeyPair(cert, key); errPair != nil {
+		return nil, nil, fmt.Errorf("certificate and key do not match: %s", errPair)
+	}
+
+	return cert, key, nil
+}
+
 // SendMail prepares the email message, signs it if possible, encrypts it if possible and sends it out via SMTP to
 // a list of recipients.
 func SendMail(
@@ -138,71 +396,483 @@ func SendMail(
 	fromKeyPath string, // Path to the signing key
 	toCertPaths []string, // List of paths to encryption certificates of recipients
 ) error {
+	_, err := sendMail(
+		options{},
+		server,
+		port,
+		username,
+		password,
+		from,
+		to,
+		subject,
+		nil,
+		message,
+		nil,
+		opensslPath,
+		fromCertPath,
+		fromKeyPath,
+		toCertPaths,
+	)
+	return err
+}
+
+// sendMail is the actual implementation of SendMail, additionally applying the optional settings of a WriteSyncer. It
+// returns the server's reply to the transmitted message.
+func sendMail(
+	opts options,
+	server string,
+	port uint16,
+	username string, // Leave empty to skip authentication
+	password string, // Leave empty to skip authentication
+	from mail.Address,
+	to []mail.Address,
+	subject string,
+	headers []string, // Additional header lines, e.g. "X-ZapSmtp-Entry-Count: 3"
+	message []byte,
+	attachments []cores.Attachment, // Files sent along with the message, e.g. a goroutine dump
+	opensslPath string,
+	fromCertPath string, // Path to the signing certificate
+	fromKeyPath string, // Path to the signing key
+	toCertPaths []string, // List of paths to encryption certificates of recipients
+) (Response, error) {
 
 	// Check if right amount of certificates was passed
 	if len(toCertPaths) > 0 && len(toCertPaths) != len(to) {
-		return fmt.Errorf("list of certificates does not match recipients")
+		return Response{}, fmt.Errorf("list of certificates does not match recipients")
 	}
 
-	// Prepare some header values
-	toStrs := make([]string, len(to))
+	// Decide whether to encrypt the message, refusing to send a message in plain text which must be encrypted
+	encrypt := len(toCertPaths) > 0
+	if opts.mustEncrypt != nil {
+		encrypt = opts.mustEncrypt(message)
+		if encrypt && len(toCertPaths) == 0 {
+			return Response{}, fmt.Errorf("message must be encrypted, but no recipient certificates are configured")
+		}
+	}
+
+	// Refuse hiding the recipients of an encrypted message, regardless of the order the options were set in
+	if opts.undisclosed && encrypt {
+		return Response{}, fmt.Errorf("recipients can not be hidden with encryption")
+	}
+
+	// Prepare recipient addresses
 	toAddrs := make([]string, len(to))
 	for i, r := range to {
-		toStrs[i] = r.String()
 		toAddrs[i] = r.Address
 	}
 
-	// Prepare e-mail headers including the base64 encoded message body
-	header := fmt.Sprintf("From: %s\r\n", from.String())
-	header += fmt.Sprintf("To: %s\r\n", strings.Join(toStrs, ", "))
-	header += fmt.Sprintf("Subject: %s\r\n", subject)
-	header += "MIME-Version: 1.0\r\n"
-	header += "Content-Type: text/plain; charset=\"utf-8\"\r\n"
-	header += "Content-Transfer-Encoding: base64\r\n"
-	header += "\r\n"
+	// Prepare envelope recipients, which default to the header recipients
+	rcptAddrs := toAddrs
+	if len(opts.envelopeTo) > 0 {
+		rcptAddrs = make([]string, len(opts.envelopeTo))
+		for i, r := range opts.envelopeTo {
+			rcptAddrs[i] = r.Address
+		}
+	}
 
-	// Prepare message bytes for [signing, encrypting and] sending
-	messageRaw := make([]byte, len(header)+base64.StdEncoding.EncodedLen(len(message)))
-	copy(messageRaw, header)
-	base64.StdEncoding.Encode(messageRaw[len(header):], message)
+	// Enforce the allowed recipient domains on the actual delivery addresses, each of which is only used once
+	rcptAddrs, errRcpt := filterRecipients(rcptAddrs, opts.allowedDomains, opts.allowlistPolicy)
+	if errRcpt != nil {
+		return Response{}, errRcpt
+	}
+	rcptAddrs = uniqueAddresses(rcptAddrs)
+
+	// Prepare envelope sender, which defaults to the header sender
+	mailFrom := from.Address
+	if opts.envelopeFrom != "" {
+		mailFrom = opts.envelopeFrom
+	}
+
+	// Prepare the recipients shown in the header
+	headerTo := to
+	if opts.undisclosed {
+		headerTo = nil
+	} else if !opts.keepDuplicates {
+		headerTo = uniqueRecipients(to)
+	}
+
+	// Append the footer on a new line, without modifying the caller's message
+	if len(opts.footer) > 0 {
+		body := make([]byte, 0, len(message)+1+len(opts.footer))
+		body = append(body, message...)
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			body = append(body, '\n')
+		}
+		message = append(body, opts.footer...)
+	}
+
+	// Date the message in the configured time zone, UTC by default
+	loc := opts.dateLocation
+	if loc == nil {
+		loc = time.UTC
+	}
+	headers = append([]string{"Date: " + time.Now().In(loc).Format(time.RFC1123Z)}, headers...)
+
+	// Wrap the message as a nested mail if desired, leading the attachments of the outer mail holding a note only
+	if opts.nestedMessage {
+		nested := cores.Attachment{
+			Name:        "log.eml",
+			ContentType: "message/rfc822",
+			Data:        buildMessage(from, headerTo, subject, headers, message, opts.plainEncoding),
+		}
+		attachments = append([]cores.Attachment{nested}, attachments...)
+		message = []byte(nestedMessageNote)
+	}
+
+	// Prepare message bytes for [signing, encrypting and] sending. Messages with attachments are always base64 encoded.
+	var messageRaw []byte
+	if len(attachments) > 0 {
+		messageRaw = buildMixedMessage(from, headerTo, subject, headers, message, attachments)
+	} else {
+		messageRaw = buildMessage(from, headerTo, subject, headers, message, opts.plainEncoding)
+	}
 
 	// Sign message if desired, indicated by input parameters
-	if len(fromCertPath) > 0 || len(fromKeyPath) > 0 {
+	sign := len(fromCertPath) > 0 || len(fromKeyPath) > 0
+	if sign {
+		signArgs := opts.signArgs
+		if opts.noSignedAttrs {
+			signArgs = append([]string{"-noattr"}, signArgs...)
+		}
 		var errSign error
-		messageRaw, errSign = signMessage(opensslPath, fromCertPath, fromKeyPath, messageRaw)
+		messageRaw, errSign = signMessage(
+			opensslFor(opts.opensslSign, opensslPath), fromCertPath, fromKeyPath, messageRaw, opts.opensslWarn, signArgs...,
+		)
 		if errSign != nil {
-			return fmt.Errorf("could not sign message: %s", errSign)
+			return Response{}, fmt.Errorf("could not sign message: %s", errSign)
 		}
+		messageRaw = relabelPkcs7(messageRaw, opts.legacyPkcs7)
 	}
 
-	// Encrypt message if desired, indicated by input parameters
-	if len(toCertPaths) > 0 {
+	// Encrypt message if desired, indicated by input parameters or the encryption predicate
+	if encrypt {
 		var errEnc error
-		messageRaw, errEnc = encryptMessage(opensslPath, from.Address, toAddrs, toCertPaths, subject, messageRaw)
+		messageRaw, errEnc = encryptMessage(
+			opensslFor(opts.opensslEncrypt, opensslPath), from.Address, toAddrs, toCertPaths, subject, messageRaw,
+			opts.keyTransport, opts.opensslWarn, opts.encryptArgs...,
+		)
 		if errEnc != nil {
-			return fmt.Errorf("could not encrypt message: %s", errEnc)
+			return Response{}, fmt.Errorf("could not encrypt message: %s", errEnc)
 		}
+		messageRaw = relabelPkcs7(messageRaw, opts.legacyPkcs7)
+	}
+
+	// Repeat the date and the additional headers in the header of the signed or encrypted message, the inner part is
+	// hidden from the recipient's mail client and filters
+	if sign || encrypt {
+		messageRaw = prependHeaders(messageRaw, headers)
+	}
+
+	// Bring the complete message into the canonical form required on the wire, as OpenSSL terminates the lines it
+	// adds with LF only. Signed content already is in this form and remains unchanged.
+	if !opts.keepLineEndings {
+		messageRaw = normalizeLineEndings(messageRaw)
+	}
+
+	// Keep a copy of the final message for debugging if desired, a failure must not keep the alert from being sent
+	if opts.debugDir != "" {
+		_ = dumpMessage(opts.debugDir, messageRaw)
 	}
 
 	// Set authentication if desired
 	var auth smtp.Auth
 	if len(username) > 0 && len(password) > 0 {
-		auth = smtp.PlainAuth("", username, password, server)
+		auth = &negotiatedAuth{username: username, password: password, host: server, pinned: opts.authMechanism}
 	}
 
 	// Connect to the server, authenticate, set the sender and recipient and send the email all in one step.
-	errSend := smtp.SendMail(
-		fmt.Sprintf("%s:%d", server, port),
+	resp, errSend := deliver(
+		opts,
+		server,
+		port,
 		auth,
-		from.Address,
-		toAddrs,
+		mailFrom,
+		rcptAddrs,
 		messageRaw,
 	)
 	if errSend != nil {
-		return fmt.Errorf("could not send mail: %s", errSend)
+		// The response may still list the recipients the message was delivered to
+		return resp, fmt.Errorf("could not send mail: %w", errSend)
 	}
 
-	return nil
+	return resp, nil
+}
+
+// opensslFor returns the OpenSSL binary dedicated to an operation, falling back to the general one if none is set
+func opensslFor(dedicated string, fallback string) string {
+	if dedicated != "" {
+		return dedicated
+	}
+	return fallback
+}
+
+// buildMessage assembles the complete MIME message, consisting of the header block (including the Content-Type) and
+// the base64 encoded body. If allowed, ASCII bodies are appended verbatim instead. The line endings of the body are
+// normalized to CRLF before encoding, so the decoded text matches the headers and is independent of the encoder's line
+// ending setting. This is the canonical content handed to OpenSSL for signing, regardless of whether the certificates
+// are supplied as files (SendMail) or held in memory (SendMail2). Without recipients, the To header holds the
+// placeholder for undisclosed recipients.
+func buildMessage(
+	from mail.Address,
+	to []mail.Address,
+	subject string,
+	headers []string,
+	message []byte,
+	allow7bit bool,
+) []byte {
+
+	// Prepare e-mail headers including the base64 encoded message body
+	header := buildHeader(from, to, subject, headers)
+	header += "Content-Type: text/plain; charset=\"utf-8\"\r\n"
+
+	// Bring the body into the canonical form of text, as it would otherwise mix the encoder's line feeds with the
+	// CRLF used by the headers and SMTP
+	message = normalizeLineEndings(message)
+
+	// Append the body verbatim if desired and possible, keeping it readable in the raw message
+	if allow7bit && is7bit(message) {
+		header += "Content-Transfer-Encoding: 7bit\r\n"
+		header += "\r\n"
+		messageRaw := make([]byte, 0, len(header)+len(message))
+		messageRaw = append(messageRaw, header...)
+		return append(messageRaw, message...)
+	}
+	header += "Content-Transfer-Encoding: base64\r\n"
+	header += "\r\n"
+
+	// Append the encoded message body
+	messageRaw := make([]byte, 0, len(header)+encodedBase64Len(len(message)))
+	messageRaw = append(messageRaw, header...)
+	messageRaw = appendBase64Lines(messageRaw, message)
+
+	return messageRaw
+}
+
+// buildHeader returns the header lines common to all messages, up to the MIME version. Lines which may grow long, like
+// the list of recipients, are folded.
+func buildHeader(from mail.Address, to []mail.Address, subject string, headers []string) string {
+
+	// Prepare some header values
+	toStrs := make([]string, len(to))
+	for i, r := range to {
+		toStrs[i] = r.String()
+	}
+
+	header := foldHeader(fmt.Sprintf("From: %s", from.String())) + "\r\n"
+	if len(toStrs) > 0 {
+		header += foldHeader(fmt.Sprintf("To: %s", strings.Join(toStrs, ", "))) + "\r\n"
+	} else {
+		header += "To: undisclosed-recipients:;\r\n"
+	}
+	header += foldHeader(fmt.Sprintf("Subject: %s", subject)) + "\r\n"
+	for _, h := range headers {
+		header += foldHeader(h) + "\r\n"
+	}
+	header += "MIME-Version: 1.0\r\n"
+	return header
+}
+
+// nestedMessageNote is the body of a mail holding the log entries as nested message, see SetNestedMessage
+const nestedMessageNote = "The log entries are attached as a nested message.\r\n"
+
+// buildMixedMessage assembles a multipart MIME message consisting of the body, followed by the attachments. Like
+// within buildMessage, the line endings of the body are normalized to CRLF. All parts are base64 encoded, so the
+// attachments are transferred unaltered. Nested messages are the exception, as RFC 2046 forbids encoding them. They
+// are sent verbatim with normalized line endings if possible.
+func buildMixedMessage(
+	from mail.Address,
+	to []mail.Address,
+	subject string,
+	headers []string,
+	message []byte,
+	attachments []cores.Attachment,
+) []byte {
+
+	// Writing the parts to a buffer can't fail
+	parts := &bytes.Buffer{}
+	w := multipart.NewWriter(parts)
+	body, _ := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=\"utf-8\""},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	_, _ = body.Write(appendBase64Lines(nil, normalizeLineEndings(message)))
+	for _, a := range attachments {
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(a.Name))
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		if contentType == "message/rfc822" {
+			if nested := normalizeLineEndings(a.Data); is7bit(nested) {
+				part, _ := w.CreatePart(textproto.MIMEHeader{
+					"Content-Type":              {contentType},
+					"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+					"Content-Transfer-Encoding": {"7bit"},
+				})
+				_, _ = part.Write(nested)
+				continue
+			}
+		}
+		part, _ := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		_, _ = part.Write(appendBase64Lines(nil, a.Data))
+	}
+	_ = w.Close()
+
+	// Prepare e-mail headers announcing the parts
+	header := buildHeader(from, to, subject, headers)
+	header += "Content-Type: " + mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()})
+	header += "\r\n\r\n"
+
+	messageRaw := make([]byte, 0, len(header)+parts.Len())
+	messageRaw = append(messageRaw, header...)
+	return append(messageRaw, parts.Bytes()...)
+}
+
+// maxLineLength is the maximum length of a line of a message, excluding the CRLF (RFC 5322)
+const maxLineLength = 998
+
+// headerLineLength is the length header lines are folded to if possible, excluding the CRLF (RFC 5322)
+const headerLineLength = 78
+
+// foldHeader folds a header line at the spaces between its words (RFC 5322, section 2.2.3), so its lines don't exceed
+// the recommended length where possible. Folding after a comma is preferred, keeping the addresses of a list intact.
+// The value is never folded right after the field name, and a single word exceeding the length is kept intact.
+// Unfolding, i.e. removing the inserted CRLFs, restores the original line.
+func foldHeader(line string) string {
+	if len(line) <= headerLineLength {
+		return line
+	}
+
+	// Distribute the words onto lines, the first line keeps at least the field name and one word
+	words := strings.Split(line, " ")
+	lines := [][]string{{words[0]}}
+	length := len(words[0])
+	for _, word := range words[1:] {
+		current := lines[len(lines)-1]
+		keep := 1
+		if len(lines) == 1 {
+			keep = 2
+		}
+		if word != "" && length+1+len(word) > headerLineLength && len(current) >= keep {
+
+			// Move the words after the last comma to the next line, or just the new word if there is none
+			cut := len(current)
+			for j := len(current) - 1; j >= keep; j-- {
+				if strings.HasSuffix(current[j-1], ",") && current[j] != "" {
+					cut = j
+					break
+				}
+			}
+			lines[len(lines)-1] = current[:cut]
+			next := append(append([]string{}, current[cut:]...), word)
+			lines = append(lines, next)
+
+			// Continuation lines start with the space they were folded at
+			length = 1 + len(strings.Join(next, " "))
+			continue
+		}
+		lines[len(lines)-1] = append(current, word)
+		length += 1 + len(word)
+	}
+
+	// Join the lines, the space a line was folded at starts the continuation line
+	folded := make([]string, len(lines))
+	for i, l := range lines {
+		folded[i] = strings.Join(l, " ")
+	}
+	return strings.Join(folded, "\r\n ")
+}
+
+// is7bit reports whether the body can be sent without encoding (RFC 2045), i.e. it only consists of ASCII characters
+// other than NUL and does not exceed the maximum line length. The line endings must already be normalized.
+func is7bit(body []byte) bool {
+	lineLength := 0
+	for _, b := range body {
+		if b == 0 || b >= 0x80 {
+			return false
+		}
+		if b == '\n' {
+			lineLength = 0
+			continue
+		}
+		if b != '\r' {
+			lineLength++
+		}
+		if lineLength > maxLineLength {
+			return false
+		}
+	}
+	return true
+}
+
+// base64LineLength is the maximum length of a line of base64 encoded content (RFC 2045). Long log lines would otherwise
+// exceed the line length limit of 998 characters (RFC 5322), which some relays enforce by rejecting the message.
+const base64LineLength = 76
+
+// encodedBase64Len returns the length of n bytes encoded by appendBase64Lines
+func encodedBase64Len(n int) int {
+	l := base64.StdEncoding.EncodedLen(n)
+	if l == 0 {
+		return 0
+	}
+	return l + (l-1)/base64LineLength*2
+}
+
+// appendBase64Lines appends the base64 encoding of src to dst, broken into lines of base64LineLength characters
+// separated by CRLF. Decoders ignore the line breaks, so the content is restored unaltered.
+func appendBase64Lines(dst []byte, src []byte) []byte {
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(src)))
+	base64.StdEncoding.Encode(encoded, src)
+	for len(encoded) > base64LineLength {
+		dst = append(dst, encoded[:base64LineLength]...)
+		dst = append(dst, '\r', '\n')
+		encoded = encoded[base64LineLength:]
+	}
+	return append(dst, encoded...)
+}
+
+// prependHeaders inserts the header lines at the top of the message's header block, terminating them like the
+// message's first line. The input is not modified.
+func prependHeaders(message []byte, lines []string) []byte {
+	if len(lines) == 0 {
+		return message
+	}
+	eol := "\n"
+	if i := bytes.IndexByte(message, '\n'); i > 0 && message[i-1] == '\r' {
+		eol = "\r\n"
+	}
+	out := make([]byte, 0, len(message)+len(lines)*64)
+	for _, line := range lines {
+		out = append(out, line...)
+		out = append(out, eol...)
+	}
+	return append(out, message...)
+}
+
+// normalizeLineEndings converts all line endings, whether LF, CR or CRLF, to CRLF as required for text on the wire
+// (RFC 5322, RFC 2049). The input is not modified.
+func normalizeLineEndings(b []byte) []byte {
+	out := make([]byte, 0, len(b)+bytes.Count(b, []byte{'\n'}))
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\r':
+			out = append(out, '\r', '\n')
+			if i+1 < len(b) && b[i+1] == '\n' {
+				i++
+			}
+		case '\n':
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, b[i])
+		}
+	}
+	return out
 }
 
 // SendMail2 is a wrapper function of the actual SendMail function and allows to supply certificates held in memory,
@@ -222,6 +892,47 @@ func SendMail2(
 	toCerts [][]byte,
 	tempDir string, // Keys and certificates must be written to the disk for OpenSSL to use them
 ) error {
+	_, err := sendMail2(
+		options{},
+		server,
+		port,
+		username,
+		password,
+		from,
+		to,
+		subject,
+		nil,
+		message,
+		nil,
+		opensslPath,
+		fromCert,
+		fromKey,
+		toCerts,
+		tempDir,
+	)
+	return err
+}
+
+// sendMail2 is the actual implementation of SendMail2, additionally applying the optional settings of a WriteSyncer.
+// It returns the server's reply to the transmitted message.
+func sendMail2(
+	opts options,
+	server string,
+	port uint16,
+	username string, // Leave empty to skip authentication
+	password string, // Leave empty to skip authentication
+	from mail.Address,
+	to []mail.Address,
+	subject string,
+	headers []string, // Additional header lines, e.g. "X-ZapSmtp-Entry-Count: 3"
+	message []byte,
+	attachments []cores.Attachment, // Files sent along with the message, e.g. a goroutine dump
+	opensslPath string,
+	fromCert []byte,
+	fromKey []byte,
+	toCerts [][]byte,
+	tempDir string, // Keys and certificates must be written to the disk for OpenSSL to use them
+) (Response, error) {
 
 	// Prepare memory
 	var fromCertPath, fromKeyPath string
@@ -230,23 +941,25 @@ func SendMail2(
 	// Prepare signature certificate and key
 	if len(fromCert) > 0 && len(fromKey) > 0 {
 
-		// Convert signature certificate and key if necessary
-		fromCert, fromKey, err = PrepareSignatureKeys(opensslPath, fromCert, fromKey)
-		if err != nil {
-			return fmt.Errorf("unable to prepare signature key: %s", err)
+		// Convert signature certificate and key if necessary, unless they were verified upfront
+		if !opts.signaturePEM {
+			fromCert, fromKey, err = PrepareSignatureKeys(opensslPath, fromCert, fromKey)
+			if err != nil {
+				return Response{}, fmt.Errorf("unable to prepare signature key: %w", err)
+			}
 		}
 
 		// Write signing certificate to disk, where it can be used by OpenSSL
 		fromCertPath, err = saveToTemp(fromCert, tempDir)
 		if err != nil {
-			return fmt.Errorf("error with sender certificate: %s", err)
+			return Response{}, fmt.Errorf("error with sender certificate: %s", err)
 		}
 		defer func() { _ = os.Remove(fromCertPath) }()
 
 		// Write signing key to disk, where it can be used by OpenSSL
 		fromKeyPath, err = saveToTemp(fromKey, tempDir)
 		if err != nil {
-			return fmt.Errorf("error with sender key: %s", err)
+			return Response{}, fmt.Errorf("error with sender key: %s", err)
 		}
 		defer func() { _ = os.Remove(fromKeyPath) }()
 	}
@@ -255,17 +968,19 @@ func SendMail2(
 	toCertPaths := make([]string, 0, len(toCerts))
 	if len(toCerts) > 0 {
 
-		// Convert encryption certificates if necessary
-		toCerts, err = PrepareEncryptionKeys(opensslPath, toCerts)
-		if err != nil {
-			return fmt.Errorf("unable to prepare encryption key: %s", err)
+		// Convert encryption certificates if necessary, unless they were verified upfront
+		if !opts.encryptionPEM {
+			toCerts, err = PrepareEncryptionKeys(opensslPath, toCerts)
+			if err != nil {
+				return Response{}, fmt.Errorf("unable to prepare encryption key: %s", err)
+			}
 		}
 
 		// Write encryption keys to disk, where it can be used by OpenSSL
 		for _, toCert := range toCerts {
 			cert, errSave := saveToTemp(toCert, tempDir)
 			if errSave != nil {
-				return fmt.Errorf("error with recipient certificate: %s", errSave)
+				return Response{}, fmt.Errorf("error with recipient certificate: %s", errSave)
 			}
 			defer func() { _ = os.Remove(cert) }()
 			toCertPaths = append(toCertPaths, cert)
@@ -273,7 +988,8 @@ func SendMail2(
 	}
 
 	// Call and return result of actual send mail function
-	return SendMail(
+	return sendMail(
+		opts,
 		server,
 		port,
 		username,
@@ -281,7 +997,9 @@ func SendMail2(
 		from,
 		to,
 		subject,
+		headers,
 		message,
+		attachments,
 		opensslPath,
 		fromCertPath,
 		fromKeyPath,
@@ -342,7 +1060,7 @@ func certToPem(openSslPath string, cert []byte) ([]byte, error) {
 	errs := &bytes.Buffer{}
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, out, errs
 
-	if err := cmd.Run(); err != nil {
+	if err := runOpenssl(cmd, nil); err != nil {
 		if len(errs.Bytes()) > 0 {
 			return nil, fmt.Errorf("error converting certificate to PEM format (%s):\n %v", err, errs.String())
 		}
@@ -369,7 +1087,7 @@ func keyToPem(openSslPath string, key []byte) ([]byte, error) {
 	errs := &bytes.Buffer{}
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, out, errs
 
-	if err := cmd.Run(); err != nil {
+	if err := runOpenssl(cmd, nil); err != nil {
 		if len(errs.Bytes()) > 0 {
 			return nil, fmt.Errorf("error converting key to PEM format (%s):\n %v", err, errs.String())
 		}
@@ -384,6 +1102,8 @@ func signMessage(
 	fromCert string, // Path to certificate
 	fromKey string, // Path to key
 	message []byte,
+	warn func(err error), // Receives warnings of OpenSSL, may be nil
+	extraArgs ...string, // Additional arguments appended to the command
 ) ([]byte, error) {
 
 	// Sanity checks
@@ -396,6 +1116,7 @@ func signMessage(
 
 	// Create the command for signing the message
 	argsSign := []string{"smime", "-sign", "-signer", fromCert, "-inkey", fromKey}
+	argsSign = append(argsSign, extraArgs...)
 	cmdSign := exec.Command(openSslPath, argsSign...)
 
 	// Set the correct i/o buffers. Stream the message to stdin rather than saving it to a file.
@@ -405,7 +1126,7 @@ func signMessage(
 	cmdSign.Stdin, cmdSign.Stdout, cmdSign.Stderr = in, out, errs
 
 	// Actually run the signing
-	errSign := cmdSign.Run()
+	errSign := runOpenssl(cmdSign, warn)
 	if errSign != nil {
 		if len(errs.Bytes()) > 0 {
 			return nil, fmt.Errorf("error signing message (%s):\n %v", errSign, errs.String())
@@ -423,6 +1144,9 @@ func encryptMessage(
 	recipientCertPaths []string, // Paths to certificates
 	subject string,
 	message []byte,
+	transport KeyTransport,
+	warn func(err error), // Receives warnings of OpenSSL, may be nil
+	extraArgs ...string, // Additional arguments inserted before the certificates
 ) ([]byte, error) {
 
 	// Sanity checks
@@ -442,9 +1166,14 @@ func encryptMessage(
 		)
 	}
 
-	// Create the command for encrypting the (signed) message
+	// Create the command for encrypting the (signed) message. Choosing the key transport requires the cms command, as
+	// the smime command lacks the per-recipient key options.
+	command := "smime"
+	if transport != KeyTransportDefault {
+		command = "cms"
+	}
 	argsEnc := []string{
-		"smime",
+		command,
 		"-encrypt",
 		"-from",
 		sender,
@@ -454,7 +1183,8 @@ func encryptMessage(
 		subject,
 		"-aes256",
 	}
-	argsEnc = append(argsEnc, recipientCertPaths...)
+	argsEnc = append(argsEnc, extraArgs...)
+	argsEnc = append(argsEnc, recipientArgs(recipientCertPaths, transport)...)
 	cmdEnc := exec.Command(openSslPath, argsEnc...)
 
 	// Set the correct i/o buffers. Stream the message to stdin rather than saving it to a file.
@@ -464,7 +1194,7 @@ func encryptMessage(
 	cmdEnc.Stdin, cmdEnc.Stdout, cmdEnc.Stderr = inEnc, outEnc, errsEnc
 
 	// Actually run the encryption
-	errEnc := cmdEnc.Run()
+	errEnc := runOpenssl(cmdEnc, warn)
 	if errEnc != nil {
 		if len(errsEnc.Bytes()) > 0 {
 			return nil, fmt.Errorf("error encrypting message (%s):\n %v", errEnc, errsEnc.String())
@@ -475,10 +1205,344 @@ func encryptMessage(
 	return outEnc.Bytes(), nil
 }
 
+// KeyTransport selects the algorithm used to encrypt the content key for each recipient, see SetKeyTransport
+type KeyTransport int
+
+const (
+	KeyTransportDefault  KeyTransport = iota // OpenSSL's default, which varies by version
+	KeyTransportPKCS1v15                     // RSA with PKCS #1 v1.5 padding
+	KeyTransportOAEP                         // RSA-OAEP (RFC 3560)
+)
+
+// recipientArgs returns the OpenSSL arguments naming the recipient certificates. A key transport other than the default
+// is requested via a key option following each certificate, which applies to that recipient only.
+func recipientArgs(certPaths []string, transport KeyTransport) []string {
+	var mode string
+	switch transport {
+	case KeyTransportPKCS1v15:
+		mode = "rsa_padding_mode:pkcs1"
+	case KeyTransportOAEP:
+		mode = "rsa_padding_mode:oaep"
+	default:
+		return certPaths
+	}
+
+	args := make([]string, 0, len(certPaths)*4)
+	for _, certPath := range certPaths {
+		args = append(args, "-recip", certPath, "-keyopt", mode)
+	}
+	return args
+}
+
+// checkKeyTransport returns an error if the OpenSSL binary can't select the key transport, i.e. its cms command lacks
+// key options
+func checkKeyTransport(opensslPath string) error {
+
+	// The help is printed to stderr and exits with an error code by some versions, so only the output counts. It is
+	// run like any other OpenSSL call, so the process limit applies.
+	out := &bytes.Buffer{}
+	cmd := exec.Command(opensslPath, "cms", "-help")
+	cmd.Stdout, cmd.Stderr = out, out
+	_ = runOpenssl(cmd, nil)
+	if !bytes.Contains(out.Bytes(), []byte("-keyopt")) {
+		return fmt.Errorf("OpenSSL at '%s' does not support selecting the key transport", opensslPath)
+	}
+	return nil
+}
+
+// SignBytes signs arbitrary data with the given certificate and key files and returns the result as an S/MIME entity
+// of type "application/pkcs7-mime; smime-type=signed-data". It is a general-purpose helper, independent of mails, e.g.
+// for signing log archives. The data is embedded in the signature unaltered, binary content and line endings are
+// preserved, so the signed bytes can be extracted again by verifying the result. Key and certificate MUST BE in PEM
+// format and MUST NOT be password protected.
+func SignBytes(opensslPath string, certPath string, keyPath string, data []byte) ([]byte, error) {
+	return signMessage(opensslPath, certPath, keyPath, data, nil, "-nodetach", "-binary")
+}
+
+// EncryptBytes encrypts arbitrary data for the given recipient certificate files with AES-256 and returns the result
+// as an S/MIME entity of type "application/pkcs7-mime; smime-type=enveloped-data". It is a general-purpose helper,
+// independent of mails. The data is encrypted unaltered, binary content and line endings are preserved. Certificates
+// MUST BE in PEM format.
+func EncryptBytes(opensslPath string, certPaths []string, data []byte) ([]byte, error) {
+
+	// Sanity checks
+	if len(opensslPath) == 0 {
+		return nil, fmt.Errorf("invalid OpenSSL path")
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("data is empty")
+	}
+	if len(certPaths) == 0 {
+		return nil, fmt.Errorf("no certificates defined")
+	}
+
+	// Create the command for encrypting the data
+	args := append([]string{"smime", "-encrypt", "-binary", "-aes256"}, certPaths...)
+	cmd := exec.Command(opensslPath, args...)
+
+	// Set the correct i/o buffers. Stream the data to stdin rather than saving it to a file.
+	in := bytes.NewReader(data)
+	out := &bytes.Buffer{}
+	errs := &bytes.Buffer{}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, out, errs
+
+	// Actually run the encryption
+	if err := runOpenssl(cmd, nil); err != nil {
+		if len(errs.Bytes()) > 0 {
+			return nil, fmt.Errorf("error encrypting data (%s):\n %v", err, errs.String())
+		}
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// Verify verifies an S/MIME signed message, either with a detached signature ("multipart/signed") or an opaque one
+// ("application/pkcs7-mime; smime-type=signed-data"), and returns the signed content, e.g. to check the mails sent by
+// this package. The signature is checked by OpenSSL. The signer's certificate is verified against the given roots
+// afterward, as they can't be handed to OpenSSL. Intermediate certificates are not taken from the message, they need
+// to be part of the roots. If roots is nil, the signer's certificate is not verified, e.g. for self-signed test
+// certificates. The message may use LF or CRLF line endings, the line endings of the returned content are unified to
+// LF. Binary content, e.g. signed via SignBytes, should therefore be verified with OpenSSL's "-binary" option instead.
+func Verify(opensslPath string, signed []byte, roots *x509.CertPool) ([]byte, error) {
+
+	// Sanity checks
+	if len(opensslPath) == 0 {
+		return nil, fmt.Errorf("invalid OpenSSL path")
+	}
+	if len(signed) == 0 {
+		return nil, fmt.Errorf("message is empty")
+	}
+
+	// Create the command for verifying the signature. The chain is verified below, if desired, so OpenSSL only checks
+	// the signature itself. OpenSSL canonicalizes the line endings of the content while verifying.
+	args := []string{"smime", "-verify", "-noverify"}
+	var signerPath string
+	if roots != nil {
+		f, errFile := ioutil.TempFile("", tempFilePattern)
+		if errFile != nil {
+			return nil, fmt.Errorf("could not create file: %s", errFile)
+		}
+		signerPath = f.Name()
+		_ = f.Close()
+		defer func() { _ = os.Remove(signerPath) }()
+		args = append(args, "-signer", signerPath)
+	}
+	cmd := exec.Command(opensslPath, args...)
+
+	// Set the correct i/o buffers. Stream the message to stdin rather than saving it to a file.
+	in := bytes.NewReader(signed)
+	out := &bytes.Buffer{}
+	errs := &bytes.Buffer{}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, out, errs
+
+	// Actually run the verification
+	if err := runOpenssl(cmd, nil); err != nil {
+		if len(errs.Bytes()) > 0 {
+			return nil, fmt.Errorf("error verifying message (%s):\n %v", err, errs.String())
+		}
+		return nil, err
+	}
+
+	// Verify the signer's certificate against the roots
+	if roots != nil {
+		signer, errRead := ioutil.ReadFile(signerPath)
+		if errRead != nil {
+			return nil, fmt.Errorf("could not read signer certificate: %s", errRead)
+		}
+		block, _ := pem.Decode(signer)
+		if block == nil {
+			return nil, fmt.Errorf("no signer certificate in message")
+		}
+		cert, errParse := x509.ParseCertificate(block.Bytes)
+		if errParse != nil {
+			return nil, fmt.Errorf("invalid signer certificate: %s", errParse)
+		}
+		opts := x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+		if _, errVerify := cert.Verify(opts); errVerify != nil {
+			return nil, fmt.Errorf("untrusted signer certificate: %s", errVerify)
+		}
+	}
+
+	// Unify the line endings, OpenSSL keeps the canonical ones of the signed content and adds its own on Windows
+	return bytes.ReplaceAll(out.Bytes(), []byte{13, 10}, []byte{10}), nil
+}
+
+// reservedOpensslArgs are the OpenSSL arguments controlled by this package, which must not be overridden
+var reservedOpensslArgs = []string{"in", "out", "signer", "inkey"}
+
+// checkOpensslArgs returns an error if any of the arguments is reserved. OpenSSL accepts options with one or two
+// leading dashes and, in recent versions, values attached via "=", so these variants are rejected as well.
+func checkOpensslArgs(args []string) error {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+		for _, reserved := range reservedOpensslArgs {
+			if strings.EqualFold(name, reserved) {
+				return fmt.Errorf("argument '%s' is controlled by this package", arg)
+			}
+		}
+	}
+	return nil
+}
+
+// relabelPkcs7 rewrites the PKCS#7 media types in the Content-Type headers of OpenSSL's output. Depending on the
+// version, OpenSSL uses the legacy "application/x-pkcs7-*" labels, while RFC 5751 mandates "application/pkcs7-*".
+// Only the Content-Type headers of the top-level header block and of the signature part are touched, so signed
+// content is never altered, even if it contains such header lines itself, e.g. with plain text encoding.
+func relabelPkcs7(message []byte, legacy bool) []byte {
+
+	// Decide on the direction of the rewrite
+	from, to := []byte("application/x-pkcs7-"), []byte("application/pkcs7-")
+	if legacy {
+		from, to = to, from
+	}
+
+	// Go through the lines, keeping their original line endings
+	lines := bytes.SplitAfter(message, []byte("\n"))
+
+	// Relabel the top-level header block, learning the boundary of a signed message from it
+	n, contentType := relabelHeaders(lines, from, to)
+	_, params, errParse := mime.ParseMediaType(contentType)
+	if errParse != nil || params["boundary"] == "" {
+		return bytes.Join(lines, nil)
+	}
+
+	// Relabel the header block of the signature, which is the last part of the signed message
+	delimiter := []byte("--" + params["boundary"])
+	last := -1
+	for i := n; i < len(lines); i++ {
+		if bytes.Equal(bytes.TrimRight(lines[i], " \t\r\n"), delimiter) {
+			last = i
+		}
+	}
+	if last >= 0 {
+		relabelHeaders(lines[last+1:], from, to)
+	}
+
+	return bytes.Join(lines, nil)
+}
+
+// relabelHeaders rewrites the PKCS#7 media types in the Content-Type header, including its folded lines, of the
+// header block at the beginning of the given lines. It returns the number of lines of the header block, including
+// the empty line ending it, and the unfolded value of the Content-Type header.
+func relabelHeaders(lines [][]byte, from []byte, to []byte) (int, string) {
+	var contentType []byte
+	inContentType := false
+	for i, line := range lines {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			return i + 1, string(contentType)
+		}
+
+		// Keep track of whether the line belongs to the Content-Type header, which may be folded
+		if trimmed[0] != ' ' && trimmed[0] != '\t' {
+			inContentType = len(trimmed) >= len("content-type:") &&
+				bytes.EqualFold(trimmed[:len("content-type:")], []byte("content-type:"))
+			if inContentType {
+				trimmed = trimmed[len("content-type:"):]
+			}
+		}
+		if inContentType {
+			lines[i] = bytes.ReplaceAll(line, from, to)
+			contentType = append(contentType, trimmed...)
+		}
+	}
+	return len(lines), string(contentType)
+}
+
+// tempFilePattern is the name pattern of the temporary files holding keys and certificates for OpenSSL. The prefix
+// tells them apart from the files of other programs, see CleanupOrphanedTempFiles.
+const tempFilePattern = "zapsmtp-*.pem"
+
+// CleanupOrphanedTempFiles removes the temporary key and certificate files left behind in the given directory, which
+// is the system's default temporary directory if empty, e.g. by a crashed process. Only files matching the name
+// pattern of this package and last modified longer than the given age ago are removed, so the ones of running
+// processes are spared. Beware that a WriteSyncCloser keeps its files until it is closed, so the age must exceed the
+// lifetime of the ones sharing the directory. It is meant to be called on startup and returns the number of removed
+// files. Files which could not be removed are reported, without keeping the others from being removed.
+func CleanupOrphanedTempFiles(tempDir string, olderThan time.Duration) (int, error) {
+	dir := tempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	// Collect the files matching the pattern, which is valid and can't cause an error
+	paths, _ := filepath.Glob(filepath.Join(dir, tempFilePattern))
+
+	// Remove the files old enough, but never directories or links
+	removed := 0
+	var errs error
+	deadline := time.Now().Add(-olderThan)
+	for _, path := range paths {
+		info, errStat := os.Lstat(path)
+		if errStat != nil {
+			if !os.IsNotExist(errStat) {
+				errs = multierr.Append(errs, errStat)
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() || !info.ModTime().Before(deadline) {
+			continue
+		}
+		if errRemove := os.Remove(path); errRemove != nil {
+			if !os.IsNotExist(errRemove) {
+				errs = multierr.Append(errs, errRemove)
+			}
+			continue
+		}
+		removed++
+	}
+
+	return removed, errs
+}
+
+// checkTempDir verifies that temporary files can be created in the given directory, which is the system's default
+// temporary directory if empty. The error names the directory, as read-only file systems are common in hardened
+// containers and the failure would otherwise only surface once a mail is sent.
+func checkTempDir(tempDir string) error {
+	dir := tempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	f, errFile := ioutil.TempFile(tempDir, tempFilePattern)
+	if errFile != nil {
+		return fmt.Errorf(
+			"temporary directory '%s' is not writable, configure a writable one for signing and encryption: %s",
+			dir, errFile,
+		)
+	}
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+
+	return nil
+}
+
+// dumpMessage writes the message to a new file in the directory, named after the current time
+func dumpMessage(dir string, message []byte) error {
+	prefix := "zapsmtp-" + time.Now().UTC().Format("20060102T150405.000000000Z") + "-"
+	f, errFile := ioutil.TempFile(dir, prefix+"*.eml")
+	if errFile != nil {
+		return fmt.Errorf("could not create file: %s", errFile)
+	}
+	_, errWrite := f.Write(message)
+	errClose := f.Close()
+	if errWrite != nil {
+		return fmt.Errorf("could not write: %s", errWrite)
+	}
+	return errClose
+}
+
 func saveToTemp(data []byte, tempDir string) (string, error) {
 
 	// Create a temporary file and write the certificate to it
-	f, errFile := ioutil.TempFile(tempDir, "*.pem")
+	f, errFile := ioutil.TempFile(tempDir, tempFilePattern)
 	if errFile != nil {
 		return "", fmt.Errorf("could not create file: %s", errFile)
 	}
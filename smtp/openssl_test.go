@@ -12,15 +12,28 @@ package smtp
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"github.com/siemens/ZapSmtp/_test"
+	"io/ioutil"
+	"math/big"
 	"net/mail"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test_convertSignatureParameters(t *testing.T) {
@@ -128,6 +141,101 @@ func Test_convertSignatureParameters(t *testing.T) {
 	}
 }
 
+func TestPrepareSignatureKeys_swapped(t *testing.T) {
+
+	// Retrieve the project root and load the test certificates and keys
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+	load := func(name string) []byte {
+		data, errRead := os.ReadFile(filepath.Join(root, name))
+		if errRead != nil {
+			t.Fatalf("could not read %s: %s", name, errRead)
+		}
+		return data
+	}
+
+	// No OpenSSL binary is given, so the swap must be detected before OpenSSL is run
+	tests := []struct {
+		name        string
+		cert        []byte
+		key         []byte
+		wantSwapped bool
+	}{
+		{"swapped-pem", load("key1.pem"), load("cert1.pem"), true},
+		{"swapped-der", load("key1.der"), load("cert1.der"), true},
+		{"swapped-mixed", load("key1.der"), load("cert1.pem"), true},
+		{"correct-pem", load("cert1.pem"), load("key1.pem"), false},
+		{"two-keys", load("key1.pem"), load("key2.pem"), false},
+		{"two-certs", load("cert1.pem"), load("cert2.pem"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := PrepareSignatureKeys("notexisting", tt.cert, tt.key)
+			if err == nil {
+				t.Errorf("PrepareSignatureKeys() succeeded without OpenSSL")
+				return
+			}
+			if errors.Is(err, ErrCertKeySwapped) != tt.wantSwapped {
+				t.Errorf("PrepareSignatureKeys() error = %v, want ErrCertKeySwapped %v", err, tt.wantSwapped)
+			}
+		})
+	}
+}
+
+func TestPreparePEMSignatureKeys(t *testing.T) {
+
+	// Retrieve the project root and load the test certificates and keys
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+	load := func(name string) []byte {
+		data, errRead := os.ReadFile(filepath.Join(root, name))
+		if errRead != nil {
+			t.Fatalf("could not read %s: %s", name, errRead)
+		}
+		return data
+	}
+
+	// No OpenSSL binary is involved, so everything must be decided natively
+	tests := []struct {
+		name        string
+		cert        []byte
+		key         []byte
+		wantErr     bool
+		wantSwapped bool
+	}{
+		{"valid", load("cert1.pem"), load("key1.pem"), false, false},
+		{"valid-2", load("cert2.pem"), load("key2.pem"), false, false},
+		{"der", load("cert1.der"), load("key1.der"), true, false},
+		{"der-key", load("cert1.pem"), load("key1.der"), true, false},
+		{"mismatch", load("cert1.pem"), load("key2.pem"), true, false},
+		{"swapped", load("key1.pem"), load("cert1.pem"), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, key, err := PreparePEMSignatureKeys(tt.cert, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("PreparePEMSignatureKeys() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if errors.Is(err, ErrCertKeySwapped) != tt.wantSwapped {
+				t.Errorf("PreparePEMSignatureKeys() error = %v, want ErrCertKeySwapped %v", err, tt.wantSwapped)
+				return
+			}
+			if err == nil && (!bytes.Equal(cert, tt.cert) || !bytes.Equal(key, tt.key)) {
+				t.Errorf("PreparePEMSignatureKeys() altered the key pair")
+			}
+		})
+	}
+}
+
 func Test_convertEncryptionParameters(t *testing.T) {
 
 	// Make sure all the variables needed for the tests are set
@@ -409,7 +517,7 @@ func Test_signMessage(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			signed, err := signMessage(tt.args.openSslPath, tt.args.senderCertPath, tt.args.senderKeyPath, tt.args.message)
+			signed, err := signMessage(tt.args.openSslPath, tt.args.senderCertPath, tt.args.senderKeyPath, tt.args.message, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("sign() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -516,7 +624,7 @@ func Test_encryptMessage(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			enc, err := encryptMessage(tt.args.openSslPath, tt.args.from, tt.args.to, tt.args.toCerts, tt.args.subject, tt.args.message)
+			enc, err := encryptMessage(tt.args.openSslPath, tt.args.from, tt.args.to, tt.args.toCerts, tt.args.subject, tt.args.message, KeyTransportDefault, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("encrypt() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -641,3 +749,944 @@ func Test_sendMail(t *testing.T) {
 		})
 	}
 }
+
+// stubOpenssl writes an executable shell script to the given directory, which can be used in place of the OpenSSL
+// binary. The script runs the given shell code with the OpenSSL arguments available as "$@".
+func stubOpenssl(t *testing.T, dir string, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("stubbing OpenSSL requires a POSIX shell")
+	}
+	path := filepath.Join(dir, "openssl-stub.sh")
+	errWrite := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700)
+	if errWrite != nil {
+		t.Fatalf("could not write OpenSSL stub: %s", errWrite)
+	}
+	return path
+}
+
+// stubSignScript records the input of the signing step next to the script and returns it wrapped into a fake
+// multipart/signed structure. Key pair checks always succeed.
+const stubSignScript = `case "$1" in
+smime)
+	cat > "$0.in"
+	printf 'MIME-Version: 1.0\r\nContent-Type: multipart/signed; protocol="application/pkcs7-signature"\r\n\r\n'
+	cat "$0.in"
+	;;
+*)
+	cat > /dev/null
+	echo "-----BEGIN PUBLIC KEY-----"
+	;;
+esac
+`
+
+func TestSendMail_canonicalSignatureInput(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+	cert := filepath.Join(root, "cert1.pem")
+	key := filepath.Join(root, "key1.pem")
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	opensslPath := stubOpenssl(t, tempDir, stubSignScript)
+	sender := mail.Address{Name: "Sender", Address: "sender@domain.tld"}
+	recipients := []mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}}
+	message := []byte("some message to sign")
+
+	// Send the same message via both syncers, capturing the signing input and the delivered message
+	ws, errWs := NewWriteSyncer("mail.domain.tld", 25, "", "", "subject", sender, recipients, opensslPath, cert, key, nil, tempDir)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	wsc, errWsc := NewWriteSyncCloser("mail.domain.tld", 25, "", "", "subject", sender, recipients, opensslPath, cert, key, nil, tempDir)
+	if errWsc != nil {
+		t.Errorf("unable to initialize write sync closer: %s", errWsc)
+		return
+	}
+	defer func() { _ = wsc.Close() }()
+
+	syncers := []struct {
+		name string
+		ws   *WriteSyncer
+		w    func([]byte) (int, error)
+	}{
+		{"WriteSyncer", ws, ws.Write},
+		{"WriteSyncCloser", wsc.WriteSyncer, wsc.Write},
+	}
+	var signInputs, delivered [][]byte
+	for _, s := range syncers {
+		dialer := &pipeDialer{server: &fakeServer{}}
+		s.ws.SetDialer(dialer)
+		if _, err := s.w(message); err != nil {
+			t.Errorf("%s Write() error = %v", s.name, err)
+			return
+		}
+		signInput, errRead := os.ReadFile(opensslPath + ".in")
+		if errRead != nil {
+			t.Errorf("%s did not sign the message: %s", s.name, errRead)
+			return
+		}
+		_, messages := dialer.server.received()
+		if len(messages) != 1 {
+			t.Errorf("%s delivered %d messages, want 1", s.name, len(messages))
+			return
+		}
+		signInputs = append(signInputs, signInput)
+		delivered = append(delivered, messages[0])
+	}
+
+	// The signed content must be the complete MIME message, including headers and Content-Type
+	if !bytes.HasPrefix(signInputs[0], []byte("From: ")) ||
+		!bytes.Contains(signInputs[0], []byte("Content-Type: text/plain; charset=\"utf-8\"\r\n")) {
+		t.Errorf("signing input = %q, want complete MIME message", signInputs[0])
+	}
+
+	// Both syncers must produce identical results
+	if !bytes.Equal(signInputs[0], signInputs[1]) {
+		t.Errorf("signing input differs between syncers:\n%q\n%q", signInputs[0], signInputs[1])
+	}
+	if !bytes.Equal(delivered[0], delivered[1]) {
+		t.Errorf("delivered message differs between syncers:\n%q\n%q", delivered[0], delivered[1])
+	}
+}
+
+func TestSetMaxOpensslProcesses(t *testing.T) {
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// The stub registers itself as running, logs the number of processes running at the same time and takes a moment
+	// to finish.
+	running := filepath.Join(tempDir, "running")
+	if errMk := os.Mkdir(running, 0700); errMk != nil {
+		t.Errorf("could not create directory: %s", errMk)
+		return
+	}
+	opensslPath := stubOpenssl(t, tempDir, `dir="$(dirname "$0")"
+touch "$dir/running/$$"
+ls "$dir/running" | wc -l >> "$dir/concurrency.log"
+sleep 0.1
+rm "$dir/running/$$"
+cat
+`)
+
+	const limit = 2
+	SetMaxOpensslProcesses(limit)
+	defer SetMaxOpensslProcesses(0)
+
+	// Sign many messages at once, while checking the supported key transport options, which the limit applies to as
+	// well. The stub does not support them.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 1 {
+				_ = checkKeyTransport(opensslPath)
+				return
+			}
+			_, err := signMessage(opensslPath, "cert.pem", "key.pem", []byte("some message"), nil)
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("signMessage() error = %v", err)
+	}
+
+	// Make sure the limit was never exceeded
+	log, errRead := os.ReadFile(filepath.Join(tempDir, "concurrency.log"))
+	if errRead != nil {
+		t.Errorf("could not read concurrency log: %s", errRead)
+		return
+	}
+	counts := strings.Fields(string(log))
+	if len(counts) != 8 {
+		t.Errorf("OpenSSL invocations = %d, want 8", len(counts))
+	}
+	for _, c := range counts {
+		n, errConv := strconv.Atoi(c)
+		if errConv != nil {
+			t.Errorf("invalid concurrency log entry '%s'", c)
+			continue
+		}
+		if n > limit {
+			t.Errorf("concurrent OpenSSL processes = %d, want at most %d", n, limit)
+		}
+	}
+}
+
+func Test_relabelPkcs7(t *testing.T) {
+
+	signedLegacy := "MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/x-pkcs7-signature\"; micalg=\"sha-256\"; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Subject: about application/x-pkcs7-signature\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"application/x-pkcs7-signature\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/x-pkcs7-signature; name=\"smime.p7s\"\r\n"
+	signedModern := "MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=\"sha-256\"; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Subject: about application/x-pkcs7-signature\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"application/x-pkcs7-signature\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n"
+	signedBodyLegacy := "Content-Type: multipart/signed; protocol=\"application/x-pkcs7-signature\";\n" +
+		"\tmicalg=\"sha-256\"; boundary=\"b\"\n" +
+		"\n" +
+		"--b\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Content-Type: application/x-pkcs7-signature\n" +
+		"--b\n" +
+		"Content-Type: application/x-pkcs7-signature; name=\"smime.p7s\"\n" +
+		"\n" +
+		"MIAGCSqGSIb3\n" +
+		"--b--\n"
+	signedBodyModern := "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\";\n" +
+		"\tmicalg=\"sha-256\"; boundary=\"b\"\n" +
+		"\n" +
+		"--b\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Content-Type: application/x-pkcs7-signature\n" +
+		"--b\n" +
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\n" +
+		"\n" +
+		"MIAGCSqGSIb3\n" +
+		"--b--\n"
+	encryptedLegacy := "content-type: application/x-pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\n\nMIAGCSqGSIb3"
+	encryptedModern := "content-type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\n\nMIAGCSqGSIb3"
+
+	tests := []struct {
+		name    string
+		message string
+		legacy  bool
+		want    string
+	}{
+		{"signed-to-modern", signedLegacy, false, signedModern},
+		{"signed-to-legacy", signedModern, true, signedLegacy},
+		{"signed-modern-unchanged", signedModern, false, signedModern},
+		{"signed-body-to-modern", signedBodyLegacy, false, signedBodyModern},
+		{"encrypted-to-modern", encryptedLegacy, false, encryptedModern},
+		{"encrypted-to-legacy", encryptedModern, true, encryptedLegacy},
+		{"encrypted-legacy-unchanged", encryptedLegacy, true, encryptedLegacy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relabelPkcs7([]byte(tt.message), tt.legacy); string(got) != tt.want {
+				t.Errorf("relabelPkcs7() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildMessageLineEndings(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"lf", "{\"msg\":\"a\"}\n{\"msg\":\"b\"}\n", "{\"msg\":\"a\"}\r\n{\"msg\":\"b\"}\r\n"},
+		{"crlf", "line 1\r\nline 2\r\n", "line 1\r\nline 2\r\n"},
+		{"mixed", "line 1\nline 2\r\nline 3\rline 4", "line 1\r\nline 2\r\nline 3\r\nline 4"},
+		{"blank-lines", "\n\r\n\r", "\r\n\r\n\r\n"},
+		{"none", "line", "line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildMessage(
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"subject",
+				nil,
+				[]byte(tt.message),
+				false,
+			)
+
+			// Every line feed in the complete message must be preceded by a carriage return and vice versa
+			if bytes.Count(got, []byte("\n")) != bytes.Count(got, []byte("\r\n")) ||
+				bytes.Count(got, []byte("\r")) != bytes.Count(got, []byte("\r\n")) {
+				t.Errorf("buildMessage() = %q, want CRLF line endings throughout", got)
+				return
+			}
+
+			// The body must have been normalized before it was encoded
+			parts := bytes.SplitN(got, []byte("\r\n\r\n"), 2)
+			if len(parts) != 2 {
+				t.Errorf("buildMessage() = %q, want header and body", got)
+				return
+			}
+			body, errDecode := base64.StdEncoding.DecodeString(string(parts[1]))
+			if errDecode != nil {
+				t.Errorf("could not decode body: %s", errDecode)
+				return
+			}
+			if string(body) != tt.want {
+				t.Errorf("buildMessage() body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildMessageLineLength(t *testing.T) {
+
+	// Prepare a single JSON log line, as long as a large stack trace
+	message := []byte(`{"level":"error","msg":"` + strings.Repeat("x", 2000) + `"}` + "\n")
+
+	got := buildMessage(
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		"subject",
+		nil,
+		message,
+		false,
+	)
+	if len(got) != cap(got) {
+		t.Errorf("buildMessage() length = %d, want it to match the allocated capacity %d", len(got), cap(got))
+	}
+
+	// No line on the wire may exceed the length permitted for base64 encoded content
+	for _, line := range strings.Split(string(got), "\r\n") {
+		if len(line) > base64LineLength {
+			t.Errorf("buildMessage() line = %q, want at most %d characters", line, base64LineLength)
+			return
+		}
+	}
+
+	// The body must decode to the normalized log line
+	parts := bytes.SplitN(got, []byte("\r\n\r\n"), 2)
+	if len(parts) != 2 {
+		t.Errorf("buildMessage() = %q, want header and body", got)
+		return
+	}
+	body, errDecode := base64.StdEncoding.DecodeString(string(parts[1]))
+	if errDecode != nil {
+		t.Errorf("could not decode body: %s", errDecode)
+		return
+	}
+	if want := bytes.ReplaceAll(message, []byte("\n"), []byte("\r\n")); !bytes.Equal(body, want) {
+		t.Errorf("buildMessage() body = %q, want %q", body, want)
+	}
+}
+
+func Test_buildMessageFolding(t *testing.T) {
+
+	// Prepare enough recipients to exceed the line length by far
+	to := make([]mail.Address, 0, 50)
+	for i := 0; i < 50; i++ {
+		to = append(to, mail.Address{Name: fmt.Sprintf("Recipient %d", i), Address: fmt.Sprintf("recipient%d@domain.tld", i)})
+	}
+
+	got := buildMessage(mail.Address{Name: "Sender", Address: "sender@domain.tld"}, to, "subject", nil, []byte("message"), false)
+
+	// The To header must be folded into multiple lines, each within the limit
+	lines := strings.Split(string(got), "\r\n")
+	var toLines []string
+	for i, line := range lines {
+		if strings.HasPrefix(line, "To: ") {
+			toLines = append(toLines, line)
+			for _, cont := range lines[i+1:] {
+				if !strings.HasPrefix(cont, " ") {
+					break
+				}
+				toLines = append(toLines, cont)
+			}
+			break
+		}
+	}
+	if len(toLines) < 2 {
+		t.Errorf("buildMessage() To header = %q, want it folded into multiple lines", toLines)
+		return
+	}
+	for _, line := range toLines {
+		if len(line) > headerLineLength {
+			t.Errorf("buildMessage() To line = %q, want at most %d characters", line, headerLineLength)
+		}
+	}
+
+	// The folded header must still parse to all recipients
+	msg, errRead := mail.ReadMessage(bytes.NewReader(got))
+	if errRead != nil {
+		t.Errorf("could not parse message: %s", errRead)
+		return
+	}
+	addrs, errAddrs := msg.Header.AddressList("To")
+	if errAddrs != nil {
+		t.Errorf("could not parse To header: %s", errAddrs)
+		return
+	}
+	if len(addrs) != len(to) {
+		t.Errorf("To header contains %d addresses, want %d", len(addrs), len(to))
+		return
+	}
+	for i, addr := range addrs {
+		if *addr != to[i] {
+			t.Errorf("To header address %d = %v, want %v", i, *addr, to[i])
+		}
+	}
+}
+
+func Test_foldHeader(t *testing.T) {
+	long := "Subject: " + strings.Repeat("x", 100)
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"short", "Subject: short", "Subject: short"},
+		{"unbreakable", long, long},
+		{"words", "Subject:" + strings.Repeat(" word", 20), "Subject:" + strings.Repeat(" word", 14) + "\r\n" + strings.Repeat(" word", 6)},
+		{"comma", "To: " + strings.Repeat("x", 30) + ", a b " + strings.Repeat("y", 40), "To: " + strings.Repeat("x", 30) + ",\r\n a b " + strings.Repeat("y", 40)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := foldHeader(tt.line); got != tt.want {
+				t.Errorf("foldHeader() = %q, want %q", got, tt.want)
+			}
+			if got := strings.Replace(foldHeader(tt.line), "\r\n", "", -1); got != tt.line {
+				t.Errorf("unfolded foldHeader() = %q, want %q", got, tt.line)
+			}
+		})
+	}
+}
+
+// testRecipientBundle creates a certificate authority and a recipient certificate issued by it. It returns the PEM
+// encoded authority and recipient certificate, as well as the recipient's PEM encoded key.
+func testRecipientBundle(t *testing.T, email string) ([]byte, []byte, []byte) {
+
+	// Create the certificate authority
+	caKey, errKey := rsa.GenerateKey(rand.Reader, 2048)
+	if errKey != nil {
+		t.Fatalf("could not generate key: %s", errKey)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ZapSmtp Test Intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, errCa := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if errCa != nil {
+		t.Fatalf("could not create certificate: %s", errCa)
+	}
+
+	// Create the recipient certificate
+	key, errKey := rsa.GenerateKey(rand.Reader, 2048)
+	if errKey != nil {
+		t.Fatalf("could not generate key: %s", errKey)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: email},
+		EmailAddresses:        []string{email},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		BasicConstraintsValid: true,
+	}
+	der, errCert := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if errCert != nil {
+		t.Fatalf("could not create certificate: %s", errCert)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func TestPrepareEncryptionKeys_bundle(t *testing.T) {
+
+	ca, leaf, leafKey := testRecipientBundle(t, "recipient@domain.tld")
+
+	tests := []struct {
+		name   string
+		bundle []byte
+		want   []byte
+	}{
+		{"single", leaf, leaf},
+		{"leaf-first", append(append([]byte{}, leaf...), ca...), append(append([]byte{}, leaf...), ca...)},
+		{"leaf-last", append(append([]byte{}, ca...), leaf...), append(append([]byte{}, leaf...), ca...)},
+		{"ca-only", ca, ca},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PrepareEncryptionKeys("", [][]byte{tt.bundle})
+			if err != nil {
+				t.Errorf("PrepareEncryptionKeys() error = %v", err)
+				return
+			}
+			if len(got) != 1 || !bytes.Equal(got[0], tt.want) {
+				t.Errorf("PrepareEncryptionKeys() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// Verify with a real OpenSSL binary, if available, that the recipient can decrypt a message encrypted for the
+	// bundle with the leaf last
+	opensslPath := _test.OpensslPath
+	if opensslPath == "" {
+		var errLook error
+		opensslPath, errLook = exec.LookPath("openssl")
+		if errLook != nil {
+			t.Skip("OpenSSL not configured and not found in PATH")
+		}
+	}
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	keys, errPrepare := PrepareEncryptionKeys(opensslPath, [][]byte{append(append([]byte{}, ca...), leaf...)})
+	if errPrepare != nil {
+		t.Errorf("PrepareEncryptionKeys() error = %v", errPrepare)
+		return
+	}
+	bundlePath, errSave := saveToTemp(keys[0], tempDir)
+	if errSave != nil {
+		t.Errorf("could not save bundle: %s", errSave)
+		return
+	}
+	encrypted, errEnc := encryptMessage(
+		opensslPath, "sender@domain.tld", []string{"recipient@domain.tld"}, []string{bundlePath}, "subject",
+		[]byte("Content-Type: text/plain\r\n\r\nsecret\r\n"), KeyTransportDefault, nil,
+	)
+	if errEnc != nil {
+		t.Errorf("encryptMessage() error = %v", errEnc)
+		return
+	}
+
+	leafPath, _ := saveToTemp(leaf, tempDir)
+	keyPath, _ := saveToTemp(leafKey, tempDir)
+	cmd := exec.Command(opensslPath, "smime", "-decrypt", "-recip", leafPath, "-inkey", keyPath)
+	cmd.Stdin = bytes.NewReader(encrypted)
+	decrypted, errDec := cmd.Output()
+	if errDec != nil {
+		t.Errorf("recipient could not decrypt message: %s", errDec)
+		return
+	}
+	if !bytes.Contains(decrypted, []byte("secret")) {
+		t.Errorf("decrypted message = %q, want it to contain the secret", decrypted)
+	}
+}
+
+func TestSignBytes(t *testing.T) {
+	opensslPath := _test.OpensslPath
+	if opensslPath == "" {
+		var errLook error
+		opensslPath, errLook = exec.LookPath("openssl")
+		if errLook != nil {
+			t.Skip("OpenSSL not configured and not found in PATH")
+		}
+	}
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Binary data, including bytes which would be altered by a conversion of line endings
+	data := []byte{0x00, 0xff, '\n', 0x1f, 0x8b, '\r', '\n', 0x7f, '\r', 0x00}
+
+	signed, errSign := SignBytes(opensslPath, filepath.Join(root, "cert1.pem"), filepath.Join(root, "key1.pem"), data)
+	if errSign != nil {
+		t.Errorf("SignBytes() error = %v", errSign)
+		return
+	}
+	if !bytes.Contains(signed, []byte("smime-type=signed-data")) {
+		t.Errorf("SignBytes() = %q, want opaque S/MIME signed data", signed)
+	}
+
+	// The signature must be valid and contain the data unaltered
+	cmd := exec.Command(opensslPath, "smime", "-verify", "-noverify", "-binary")
+	cmd.Stdin = bytes.NewReader(signed)
+	verified, errVerify := cmd.Output()
+	if errVerify != nil {
+		t.Errorf("could not verify signed data: %s", errVerify)
+		return
+	}
+	if !bytes.Equal(verified, data) {
+		t.Errorf("verified data = %q, want %q", verified, data)
+	}
+
+	// Empty data must be refused
+	if _, err := SignBytes(opensslPath, filepath.Join(root, "cert1.pem"), filepath.Join(root, "key1.pem"), nil); err == nil {
+		t.Errorf("SignBytes() accepted empty data")
+	}
+}
+
+func TestEncryptBytes(t *testing.T) {
+	opensslPath := _test.OpensslPath
+	if opensslPath == "" {
+		var errLook error
+		opensslPath, errLook = exec.LookPath("openssl")
+		if errLook != nil {
+			t.Skip("OpenSSL not configured and not found in PATH")
+		}
+	}
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Binary data, including bytes which would be altered by a conversion of line endings
+	data := []byte{0x00, 0xff, '\n', 0x1f, 0x8b, '\r', '\n', 0x7f, '\r', 0x00}
+
+	tests := []struct {
+		name      string
+		certPaths []string
+		data      []byte
+		wantErr   bool
+	}{
+		{"valid", []string{filepath.Join(root, "cert2.pem")}, data, false},
+		{"invalid-no-certificates", nil, data, true},
+		{"invalid-empty-data", []string{filepath.Join(root, "cert2.pem")}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, err := EncryptBytes(opensslPath, tt.certPaths, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("EncryptBytes() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			// The recipient must be able to restore the data unaltered
+			cmd := exec.Command(
+				opensslPath, "smime", "-decrypt", "-binary",
+				"-recip", filepath.Join(root, "cert2.pem"), "-inkey", filepath.Join(root, "key2.pem"),
+			)
+			cmd.Stdin = bytes.NewReader(encrypted)
+			decrypted, errDec := cmd.Output()
+			if errDec != nil {
+				t.Errorf("could not decrypt data: %s", errDec)
+				return
+			}
+			if !bytes.Equal(decrypted, tt.data) {
+				t.Errorf("decrypted data = %q, want %q", decrypted, tt.data)
+			}
+		})
+	}
+}
+
+func Test_encryptMessageKeyTransport(t *testing.T) {
+	opensslPath := _test.OpensslPath
+	if opensslPath == "" {
+		var errLook error
+		opensslPath, errLook = exec.LookPath("openssl")
+		if errLook != nil {
+			t.Skip("OpenSSL not configured and not found in PATH")
+		}
+	}
+	if err := checkKeyTransport(opensslPath); err != nil {
+		t.Skipf("OpenSSL does not support selecting the key transport: %s", err)
+	}
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	tests := []struct {
+		name      string
+		transport KeyTransport
+		want      string // Key transport algorithm as named by asn1parse
+	}{
+		{"pkcs1v15", KeyTransportPKCS1v15, ":rsaEncryption"},
+		{"oaep", KeyTransportOAEP, ":rsaesOaep"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, errEnc := encryptMessage(
+				opensslPath, "sender@domain.tld", []string{"recipient@domain.tld"},
+				[]string{filepath.Join(root, "cert1.pem")}, "subject",
+				[]byte("Content-Type: text/plain\r\n\r\nsecret\r\n"), tt.transport, nil,
+			)
+			if errEnc != nil {
+				t.Errorf("encryptMessage() error = %v", errEnc)
+				return
+			}
+
+			// Extract the EnvelopedData from the S/MIME entity and check the algorithm it names
+			parts := bytes.SplitN(normalizeLineEndings(encrypted), []byte("\r\n\r\n"), 2)
+			if len(parts) != 2 {
+				t.Errorf("encryptMessage() = %q, want header and body", encrypted)
+				return
+			}
+			der, errDecode := base64.StdEncoding.DecodeString(strings.Replace(string(parts[1]), "\r\n", "", -1))
+			if errDecode != nil {
+				t.Errorf("could not decode body: %s", errDecode)
+				return
+			}
+			cmd := exec.Command(opensslPath, "asn1parse", "-inform", "DER")
+			cmd.Stdin = bytes.NewReader(der)
+			parsed, errParse := cmd.Output()
+			if errParse != nil {
+				t.Errorf("could not parse EnvelopedData: %s", errParse)
+				return
+			}
+			if !bytes.Contains(parsed, []byte(tt.want)) {
+				t.Errorf("EnvelopedData = %s, want key transport '%s'", parsed, tt.want)
+			}
+
+			// The recipient must still be able to decrypt the message
+			cmd = exec.Command(
+				opensslPath, "cms", "-decrypt", "-recip", filepath.Join(root, "cert1.pem"), "-inkey",
+				filepath.Join(root, "key1.pem"),
+			)
+			cmd.Stdin = bytes.NewReader(encrypted)
+			decrypted, errDec := cmd.Output()
+			if errDec != nil {
+				t.Errorf("recipient could not decrypt message: %s", errDec)
+				return
+			}
+			if !bytes.Contains(decrypted, []byte("secret")) {
+				t.Errorf("decrypted message = %q, want it to contain the secret", decrypted)
+			}
+		})
+	}
+}
+
+func TestSplitPEMBundle(t *testing.T) {
+
+	// Retrieve the project root and load the test certificates and keys
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+	load := func(name string) []byte {
+		data, errRead := os.ReadFile(filepath.Join(root, name))
+		if errRead != nil {
+			t.Fatalf("could not read %s: %s", name, errRead)
+		}
+		return data
+	}
+	cert1, key1, cert2, key2 := load("cert1.pem"), load("key1.pem"), load("cert2.pem"), load("key2.pem")
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantCert []byte
+		wantKey  []byte
+		wantErr  bool
+	}{
+		{"valid-cert-first", join(cert1, key1), cert1, key1, false},
+		{"valid-key-first", join(key1, cert1), cert1, key1, false},
+		{"valid-first-blocks", join(cert1, key1, cert2, key2), cert1, key1, false},
+		{"invalid-mismatch", join(cert1, key2), nil, nil, true},
+		{"invalid-missing-key", cert1, nil, nil, true},
+		{"invalid-missing-cert", key1, nil, nil, true},
+		{"invalid-encrypted-key", join(cert1, pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte{1}})), nil, nil, true},
+		{"invalid-empty", nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotCert, gotKey, err := SplitPEMBundle(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SplitPEMBundle() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !bytes.Equal(gotCert, tt.wantCert) {
+				t.Errorf("SplitPEMBundle() cert = %s, want %s", gotCert, tt.wantCert)
+			}
+			if !bytes.Equal(gotKey, tt.wantKey) {
+				t.Errorf("SplitPEMBundle() key = %s, want %s", gotKey, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestCleanupOrphanedTempFiles(t *testing.T) {
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// The files created by this package must match the pattern
+	saved, errSave := saveToTemp([]byte("fresh"), tempDir)
+	if errSave != nil {
+		t.Errorf("could not save file: %s", errSave)
+		return
+	}
+	if matched, _ := filepath.Match(tempFilePattern, filepath.Base(saved)); !matched {
+		t.Errorf("saveToTemp() created %s, want it to match %s", saved, tempFilePattern)
+	}
+
+	// Create stale files, only one of them matching the pattern
+	stale := time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		name       string
+		old        bool
+		dir        bool
+		wantRemove bool
+	}{
+		{"zapsmtp-stale.pem", true, false, true},
+		{"zapsmtp-fresh.pem", false, false, false},
+		{"stale.pem", true, false, false},
+		{"zapsmtp-stale.txt", true, false, false},
+		{"zapsmtp-dir.pem", true, true, false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(tempDir, tt.name)
+		var errCreate error
+		if tt.dir {
+			errCreate = os.Mkdir(path, 0700)
+		} else {
+			errCreate = os.WriteFile(path, []byte("data"), 0600)
+		}
+		if errCreate != nil {
+			t.Errorf("could not create %s: %s", tt.name, errCreate)
+			return
+		}
+		if tt.old {
+			if err := os.Chtimes(path, stale, stale); err != nil {
+				t.Errorf("could not change time of %s: %s", tt.name, err)
+				return
+			}
+		}
+	}
+
+	// Only the stale file matching the pattern must be removed
+	removed, err := CleanupOrphanedTempFiles(tempDir, time.Hour)
+	if err != nil || removed != 1 {
+		t.Errorf("CleanupOrphanedTempFiles() = %d, %v, want 1, nil", removed, err)
+	}
+	for _, tt := range tests {
+		_, errStat := os.Stat(filepath.Join(tempDir, tt.name))
+		if os.IsNotExist(errStat) != tt.wantRemove {
+			t.Errorf("CleanupOrphanedTempFiles() removed %s = %v, want %v", tt.name, os.IsNotExist(errStat), tt.wantRemove)
+		}
+	}
+	if _, errStat := os.Stat(saved); errStat != nil {
+		t.Errorf("CleanupOrphanedTempFiles() removed fresh file of this package")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	opensslPath := _test.OpensslPath
+	if opensslPath == "" {
+		var errLook error
+		opensslPath, errLook = exec.LookPath("openssl")
+		if errLook != nil {
+			t.Skip("OpenSSL not configured and not found in PATH")
+		}
+	}
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+	certPath, keyPath := filepath.Join(root, "cert1.pem"), filepath.Join(root, "key1.pem")
+
+	// Prepare the roots, the test certificates are self-signed
+	pool := func(name string) *x509.CertPool {
+		data, errRead := os.ReadFile(filepath.Join(root, name))
+		if errRead != nil {
+			t.Fatalf("could not read %s: %s", name, errRead)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			t.Fatalf("could not parse %s", name)
+		}
+		return roots
+	}
+
+	// Sign a MIME entity with CRLF line endings, as composed for mails
+	body := []byte("Content-Type: text/plain; charset=utf-8\r\n\r\nline 1\r\nline 2\r\n")
+	want := []byte("Content-Type: text/plain; charset=utf-8\n\nline 1\nline 2\n")
+	detached, errDetached := signMessage(opensslPath, certPath, keyPath, body, nil)
+	if errDetached != nil {
+		t.Errorf("could not sign message: %s", errDetached)
+		return
+	}
+	opaque, errOpaque := signMessage(opensslPath, certPath, keyPath, body, nil, "-nodetach")
+	if errOpaque != nil {
+		t.Errorf("could not sign message: %s", errOpaque)
+		return
+	}
+
+	tests := []struct {
+		name    string
+		signed  []byte
+		roots   *x509.CertPool
+		wantErr bool
+	}{
+		{"detached", detached, nil, false},
+		{"detached-lf", bytes.ReplaceAll(detached, []byte{13, 10}, []byte{10}), nil, false},
+		{"detached-trusted", detached, pool("cert1.pem"), false},
+		{"opaque", opaque, nil, false},
+		{"opaque-trusted", opaque, pool("cert1.pem"), false},
+		{"invalid-untrusted", detached, pool("cert2.pem"), true},
+		{"invalid-tampered", bytes.Replace(detached, []byte("line 2"), []byte("line 3"), 1), nil, true},
+		{"invalid-unsigned", body, nil, true},
+		{"invalid-empty", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Verify(opensslPath, tt.signed, tt.roots)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && !bytes.Equal(got, want) {
+				t.Errorf("Verify() = %q, want %q", got, want)
+			}
+		})
+	}
+}
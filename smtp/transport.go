@@ -0,0 +1,501 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go.uber.org/multierr"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// reEnhancedCode matches the enhanced status code (RFC 3463) at the start of a reply line, e.g. "5.1.1 "
+var reEnhancedCode = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})(?:\s+|$)`)
+
+// reQueueID matches the queue ID in the most common formats of final DATA responses, e.g. Postfix's
+// "Ok: queued as 4F1C52003D" or Exim's "OK id=1kXyzA-0001Ab-Cd".
+var reQueueID = regexp.MustCompile(`(?i)(?:queued as|\bid=)\s*([A-Za-z0-9._-]+)`)
+
+// Response is the final reply of the SMTP server after it accepted a message
+type Response struct {
+	Text       string            // Response text without the status code, e.g. "2.0.0 Ok: queued as 4F1C52003D"
+	QueueID    string            // Queue ID reported by the server, empty if none could be recognized
+	Recipients []RecipientStatus // Replies for the individual recipients, only reported via LMTP
+	Stats      SendStats         // Durations of the individual stages of the delivery
+}
+
+// SendStats holds the durations of the stages of a delivery, helpful to diagnose slow alerting. Stages which were not
+// reached or did not apply, e.g. the TLS handshake if STARTTLS is not offered, are zero. The authentication mechanism
+// is reported as well, helpful to diagnose authentication failures.
+type SendStats struct {
+	Connect      time.Duration // Establishing the connection, including the server's greeting
+	TLSHandshake time.Duration // Upgrading the connection via STARTTLS
+	Auth         time.Duration // Authenticating
+	Data         time.Duration // Setting the envelope and transmitting the message, until the server's final reply
+	Total        time.Duration // The whole delivery, including the TLSA lookup if DANE is enabled
+
+	AuthMechanism string // Mechanism chosen for authentication, e.g. "PLAIN", empty if none was chosen
+
+	// TLS is the state of the encrypted connection, whether upgraded via STARTTLS or established by a TLS dialer, e.g.
+	// to record the negotiated version and cipher suite as compliance evidence. It is nil if the connection was not
+	// encrypted.
+	TLS *tls.ConnectionState
+}
+
+// ErrStartTLSNotOffered is returned if STARTTLS is required, see SetTLSMode, but not offered by the server
+var ErrStartTLSNotOffered = errors.New("server does not offer STARTTLS, which is required by the TLS mode")
+
+// RecipientStatus is the reply of an LMTP server regarding the delivery to a single recipient
+type RecipientStatus struct {
+	Recipient string
+	Code      int    // Status code, e.g. 250 if the message was delivered
+	Text      string // Response text without the status code
+}
+
+// SMTPError is a negative reply of the SMTP server, e.g. rejecting a recipient or the message. It is returned, possibly
+// wrapped, by the functions sending mails, so it can be retrieved via errors.As, e.g. to decide whether to retry.
+type SMTPError struct {
+	Code         int    // Status code, e.g. 550
+	EnhancedCode string // Enhanced status code (RFC 3463), e.g. "5.1.1", empty if not reported by the server
+	Message      string // Response text without the status codes, multiple lines are joined by "\n"
+	Permanent    bool   // Whether the failure is permanent (5xx), rather than transient (4xx)
+}
+
+func (e *SMTPError) Error() string {
+	if e.EnhancedCode != "" {
+		return fmt.Sprintf("%d %s %s", e.Code, e.EnhancedCode, e.Message)
+	}
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// parseSMTPError creates an SMTPError from a reply's status code and text, as returned by textproto. The text holds
+// one line per reply line, with the status code already removed. The enhanced status code is taken from the first
+// line and removed from every line repeating it.
+func parseSMTPError(code int, text string) *SMTPError {
+	e := &SMTPError{Code: code, Permanent: code >= 500}
+
+	lines := strings.Split(text, "\n")
+	if m := reEnhancedCode.FindStringSubmatch(lines[0]); m != nil {
+		e.EnhancedCode = m[1]
+		for i, line := range lines {
+			if m := reEnhancedCode.FindStringSubmatch(line); m != nil && m[1] == e.EnhancedCode {
+				lines[i] = line[len(m[0]):]
+			}
+		}
+	}
+	e.Message = strings.Join(lines, "\n")
+	return e
+}
+
+// asSMTPError converts an error reply of the text protocol into an SMTPError, other errors are returned unchanged
+func asSMTPError(err error) error {
+	if protoErr, ok := err.(*textproto.Error); ok {
+		return parseSMTPError(protoErr.Code, protoErr.Msg)
+	}
+	return err
+}
+
+// parseResponse creates a Response from the text of the server's final DATA reply
+func parseResponse(text string) Response {
+	resp := Response{Text: text}
+	if m := reQueueID.FindStringSubmatch(text); m != nil {
+		resp.QueueID = m[1]
+	}
+	return resp
+}
+
+// ContextDialer is used to establish the connection to the SMTP server. It is satisfied by net.Dialer and
+// tls.Dialer, but also allows to inject proxies or test harnesses.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// deliver connects to the server via the given dialer, upgrades the connection if STARTTLS is offered, authenticates,
+// sets the sender and recipients and sends the message. It behaves like smtp.SendMail of the standard library, but
+// gives control over how the connection is established and returns the server's reply to the transmitted message.
+func deliver(
+	opts options,
+	server string,
+	port uint16,
+	auth smtp.Auth, // Nil to skip authentication
+	from string,
+	to []string,
+	message []byte,
+) (Response, error) {
+
+	// Measure the stages of the delivery, also reporting them if it fails
+	var stats SendStats
+	start := time.Now()
+	fail := func(err error) (Response, error) {
+		stats.Total = time.Since(start)
+		return Response{Stats: stats}, asSMTPError(err)
+	}
+
+	// Fall back to a plain dialer if none was set
+	var dialer ContextDialer = &net.Dialer{}
+	if opts.dialer != nil {
+		dialer = opts.dialer
+	}
+
+	// Bound the connection setup, if desired
+	ctx := context.Background()
+	if opts.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.dialTimeout)
+		defer cancel()
+	}
+
+	// Prepare the TLS configuration, verifying the server's certificate against its TLSA records if DANE is enabled
+	tlsConfig := &tls.Config{ServerName: server}
+	if opts.tlsConfig != nil {
+		tlsConfig = opts.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = server
+		}
+	}
+	var records []TLSARecord
+	if opts.tlsaResolver != nil {
+		var errLookup error
+		records, errLookup = opts.tlsaResolver.LookupTLSA(
+			ctx,
+			fmt.Sprintf("_%d._tcp.%s", port, server),
+		)
+		if errLookup != nil {
+			return fail(fmt.Errorf("could not look up TLSA records: %s", errLookup))
+		}
+		var errDane error
+		tlsConfig, errDane = daneConfig(server, records)
+		if errDane != nil {
+			return fail(errDane)
+		}
+	}
+
+	// LMTP is meant for local delivery, the session is neither encrypted nor authenticated
+	if opts.lmtp && (auth != nil || opts.tlsaResolver != nil || opts.tlsMode == TLSRequired) {
+		return fail(fmt.Errorf("authentication, DANE and mandatory STARTTLS are not supported with LMTP"))
+	}
+
+	// Connect to the server
+	conn, errDial := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", server, port))
+	if errDial != nil {
+		return fail(errDial)
+	}
+	if opts.lmtp {
+		stats.Connect = time.Since(start)
+		resp, err := deliverLMTP(conn, from, to, message, opts.maxRecipients)
+		stats.Data = resp.Stats.Data
+		stats.Total = time.Since(start)
+		resp.Stats = stats
+		return resp, asSMTPError(err)
+	}
+
+	// Initialize the SMTP client, which reads the server's greeting. The client takes ownership of the connection.
+	c, errClient := smtp.NewClient(conn, server)
+	if errClient != nil {
+		_ = conn.Close()
+		return fail(errClient)
+	}
+	defer func() { _ = c.Close() }()
+	stats.Connect = time.Since(start)
+
+	// Upgrade the connection if the server supports it, unless the dialer encrypted it already, e.g. a tls.Dialer.
+	// DANE and the required TLS mode demand an encrypted connection, the certificates presented for an existing one
+	// must match the TLSA records as well.
+	if state, ok := c.TLSConnectionState(); ok {
+		if opts.tlsaResolver != nil {
+			if err := verifyTLSA(server, state.PeerCertificates, records); err != nil {
+				return fail(err)
+			}
+		}
+	} else if ok, _ := c.Extension("STARTTLS"); ok {
+		startTls := time.Now()
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fail(err)
+		}
+		stats.TLSHandshake = time.Since(startTls)
+	} else if opts.tlsaResolver != nil {
+		return fail(fmt.Errorf("server does not offer STARTTLS, which is required for DANE"))
+	} else if opts.tlsMode == TLSRequired {
+		return fail(ErrStartTLSNotOffered)
+	}
+	if state, ok := c.TLSConnectionState(); ok {
+		stats.TLS = &state
+	}
+
+	// Authenticate if desired
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fail(fmt.Errorf("server doesn't support AUTH"))
+		}
+		startAuth := time.Now()
+		errAuth := c.Auth(auth)
+		if a, ok := auth.(*negotiatedAuth); ok {
+			stats.AuthMechanism = a.mechanism
+		}
+		if errAuth != nil {
+			return fail(errAuth)
+		}
+		stats.Auth = time.Since(startAuth)
+	}
+
+	// Transmit the message in as many transactions as needed to stay within the recipient limit. A rejected
+	// transaction doesn't keep the remaining ones from being attempted, unless the session broke down.
+	startData := time.Now()
+	var resp Response
+	var errs error
+	for _, chunk := range chunkRecipients(to, opts.maxRecipients) {
+		text, err := transmit(c, from, chunk, message, opts.chunkSize)
+		if err != nil {
+			errs = multierr.Append(errs, asSMTPError(err))
+			if _, ok := err.(*textproto.Error); !ok {
+				break
+			}
+			if errReset := c.Reset(); errReset != nil {
+				break
+			}
+			continue
+		}
+		if resp.Text == "" {
+			// Report the reply to the first transaction as the overall one
+			resp = parseResponse(text)
+		}
+	}
+	stats.Data = time.Since(startData)
+	if errs != nil {
+		stats.Total = time.Since(start)
+		resp.Stats = stats
+		return resp, errs
+	}
+
+	// Quitting is a courtesy at this point, the message has already been accepted
+	_ = c.Quit()
+
+	stats.Total = time.Since(start)
+	resp.Stats = stats
+	return resp, nil
+}
+
+// transmit runs a single mail transaction on the session, setting the sender and the recipients and sending the
+// message. The message is sent via BDAT in chunks of the given size if it is positive and the server supports it, via
+// DATA otherwise. It returns the text of the server's final reply.
+func transmit(c *smtp.Client, from string, to []string, message []byte, chunkSize int) (string, error) {
+	if err := mailFrom(c, from, len(message)); err != nil {
+		return "", err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return "", err
+		}
+	}
+
+	// Transmit the message. This is done on the text protocol level, because the data writer of the SMTP client
+	// discards the server's final reply.
+	if ok, _ := c.Extension("CHUNKING"); ok && chunkSize > 0 {
+		return writeChunks(c.Text, message, chunkSize)
+	}
+	id, errData := c.Text.Cmd("DATA")
+	if errData != nil {
+		return "", errData
+	}
+	c.Text.StartResponse(id)
+	_, _, errData = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if errData != nil {
+		return "", errData
+	}
+	if err := writeData(c.Text, message); err != nil {
+		return "", err
+	}
+	_, text, errResp := c.Text.ReadResponse(250)
+	return text, errResp
+}
+
+// writeData transmits the message after the server accepted the DATA command, terminated by a line consisting of a
+// single dot. Lines starting with a dot are dot-stuffed (RFC 5321, section 4.5.2), so e.g. a lone "." line of the body
+// can't end the transmission prematurely. This is the only place applying it, exactly once, as the message must not be
+// altered before, e.g. because the signature covers the content as is.
+func writeData(text *textproto.Conn, message []byte) error {
+	w := text.DotWriter()
+	if _, err := w.Write(message); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// writeChunks transmits the message via BDAT commands (RFC 3030), each followed by a chunk of at most the given size,
+// the last one marked as such. The chunks are sent as is, without dot-stuffing or a terminating line. It returns the
+// text of the server's reply to the last chunk, which concludes the transaction.
+func writeChunks(text *textproto.Conn, message []byte, size int) (string, error) {
+	for {
+		n, last := len(message), len(message) <= size
+		cmd := fmt.Sprintf("BDAT %d LAST", n)
+		if !last {
+			n = size
+			cmd = fmt.Sprintf("BDAT %d", n)
+		}
+
+		// Send the command and the chunk at once, the server replies after having read the chunk
+		id := text.Next()
+		text.StartRequest(id)
+		_, _ = fmt.Fprintf(text.W, "%s\r\n", cmd)
+		_, _ = text.W.Write(message[:n])
+		err := text.W.Flush()
+		text.EndRequest(id)
+		if err != nil {
+			return "", err
+		}
+
+		text.StartResponse(id)
+		_, reply, errResp := text.ReadResponse(250)
+		text.EndResponse(id)
+		if errResp != nil || last {
+			return reply, errResp
+		}
+		message = message[n:]
+	}
+}
+
+// mailFrom starts a mail transaction like the Mail method of the SMTP client, but additionally declares the size of
+// the message if the server supports it (RFC 1870). This allows the server to reject an oversized message right away,
+// instead of after it was transmitted.
+func mailFrom(c *smtp.Client, from string, size int) error {
+	if strings.ContainsAny(from, "\r\n") {
+		return fmt.Errorf("address must not contain CR or LF")
+	}
+
+	// Add the same parameters as the SMTP client, the extensions are known after the greeting
+	cmd := "MAIL FROM:<%s>"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	if ok, _ := c.Extension("SIZE"); ok {
+		cmd += fmt.Sprintf(" SIZE=%d", size)
+	}
+
+	id, err := c.Text.Cmd(cmd, from)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	return err
+}
+
+// chunkRecipients splits the recipients into groups of at most limit addresses, or a single group if the limit is not
+// positive
+func chunkRecipients(to []string, limit int) [][]string {
+	if limit <= 0 || len(to) <= limit {
+		return [][]string{to}
+	}
+	chunks := make([][]string, 0, (len(to)+limit-1)/limit)
+	for len(to) > limit {
+		chunks = append(chunks, to[:limit])
+		to = to[limit:]
+	}
+	return append(chunks, to)
+}
+
+// deliverLMTP runs an LMTP session (RFC 2033) on the given connection, which it takes ownership of. Unlike SMTP, the
+// server replies separately for every recipient after the message was transmitted. An error is returned if the
+// delivery failed for any recipient, the response lists the individual results nevertheless.
+func deliverLMTP(conn net.Conn, from string, to []string, message []byte, maxRecipients int) (Response, error) {
+	text := textproto.NewConn(conn)
+	defer func() { _ = text.Close() }()
+
+	// Refuse line breaks, which would allow to inject further commands
+	for _, addr := range append([]string{from}, to...) {
+		if strings.ContainsAny(addr, "\r\n") {
+			return Response{}, fmt.Errorf("address must not contain CR or LF")
+		}
+	}
+
+	// cmd sends a command and reads the server's reply
+	cmd := func(expectCode int, format string, args ...interface{}) error {
+		id, err := text.Cmd(format, args...)
+		if err != nil {
+			return err
+		}
+		text.StartResponse(id)
+		defer text.EndResponse(id)
+		_, _, err = text.ReadResponse(expectCode)
+		return err
+	}
+
+	// Read the greeting and introduce ourselves
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return Response{}, err
+	}
+	if err := cmd(250, "LHLO localhost"); err != nil {
+		return Response{}, err
+	}
+
+	// Transmit the message in as many transactions as needed to stay within the recipient limit, collecting the
+	// replies for the individual recipients in the order they were given
+	startData := time.Now()
+	var resp Response
+	var failed []string
+	for _, chunk := range chunkRecipients(to, maxRecipients) {
+
+		// Set the sender and the recipients
+		if err := cmd(250, "MAIL FROM:<%s>", from); err != nil {
+			return resp, err
+		}
+		for _, addr := range chunk {
+			if err := cmd(25, "RCPT TO:<%s>", addr); err != nil {
+				return resp, err
+			}
+		}
+
+		// Transmit the message
+		if err := cmd(354, "DATA"); err != nil {
+			return resp, err
+		}
+		if err := writeData(text, message); err != nil {
+			return resp, err
+		}
+
+		// Collect the replies
+		for _, addr := range chunk {
+			code, msg, err := text.ReadResponse(250)
+			if err != nil {
+				if _, ok := err.(*textproto.Error); !ok {
+					return resp, err
+				}
+				failed = append(failed, fmt.Sprintf("%s (%d %s)", addr, code, msg))
+			} else if resp.Text == "" {
+				// Report the first successful reply as the overall one
+				resp.Text, resp.QueueID = msg, parseResponse(msg).QueueID
+			}
+			resp.Recipients = append(resp.Recipients, RecipientStatus{Recipient: addr, Code: code, Text: msg})
+		}
+	}
+	resp.Stats.Data = time.Since(startData)
+
+	// Quitting is a courtesy at this point, the message has already been handled
+	_ = cmd(221, "QUIT")
+
+	if len(failed) > 0 {
+		return resp, fmt.Errorf("delivery failed for %s", strings.Join(failed, ", "))
+	}
+	return resp, nil
+}
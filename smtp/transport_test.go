@@ -0,0 +1,916 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"go.uber.org/multierr"
+	"io"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal SMTP server for testing the transport. It records all received commands and messages.
+// Messages transmitted via BDAT are recorded as is, unlike the ones transmitted via DATA.
+type fakeServer struct {
+	extensions   []string    // Extensions advertised in response to EHLO
+	dataResponse string      // Reply to a transmitted message, defaults to "250 OK"
+	tlsConfig    *tls.Config // STARTTLS is offered if set
+
+	delay         time.Duration     // Delay before the greeting and the final reply to a transmitted message
+	lmtp          bool              // Whether to speak LMTP instead of SMTP
+	lmtpResponses map[string]string // LMTP replies per recipient after DATA, default to "250 OK"
+
+	mutex    sync.Mutex
+	commands []string
+	messages [][]byte
+	tlsState *tls.ConnectionState // State of the last connection upgraded via STARTTLS
+}
+
+// serve handles a single SMTP session on the given connection
+func (f *fakeServer) serve(conn net.Conn) {
+
+	// Close the raw connection, a TLS close notification would block on the unbuffered pipe
+	raw := conn
+	defer func() { _ = raw.Close() }()
+
+	tp := textproto.NewConn(conn)
+	time.Sleep(f.delay)
+	_ = tp.PrintfLine("220 fake.smtp ESMTP ready")
+
+	var rcpts []string
+	var chunks []byte
+	for {
+		line, errRead := tp.ReadLine()
+		if errRead != nil {
+			return
+		}
+
+		f.mutex.Lock()
+		f.commands = append(f.commands, line)
+		f.mutex.Unlock()
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		if f.lmtp && (verb == "EHLO" || verb == "HELO") || !f.lmtp && verb == "LHLO" {
+			_ = tp.PrintfLine("500 Command not recognized")
+			continue
+		}
+		switch verb {
+		case "EHLO", "LHLO":
+			extensions := f.extensions
+			if f.tlsConfig != nil {
+				if _, ok := conn.(*tls.Conn); !ok {
+					extensions = append([]string{"STARTTLS"}, extensions...)
+				}
+			}
+			if len(extensions) == 0 {
+				_ = tp.PrintfLine("250 fake.smtp")
+				continue
+			}
+			_ = tp.PrintfLine("250-fake.smtp")
+			for i, ext := range extensions {
+				if i == len(extensions)-1 {
+					_ = tp.PrintfLine("250 %s", ext)
+				} else {
+					_ = tp.PrintfLine("250-%s", ext)
+				}
+			}
+		case "STARTTLS":
+			if f.tlsConfig == nil {
+				_ = tp.PrintfLine("502 Command not implemented")
+				continue
+			}
+			_ = tp.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if errHandshake := tlsConn.Handshake(); errHandshake != nil {
+				return
+			}
+			state := tlsConn.ConnectionState()
+			f.mutex.Lock()
+			f.tlsState = &state
+			f.mutex.Unlock()
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+		case "RCPT":
+			rcpts = append(rcpts, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			_ = tp.PrintfLine("250 OK")
+		case "RSET":
+			rcpts = nil
+			_ = tp.PrintfLine("250 OK")
+		case "HELO", "MAIL", "NOOP":
+			_ = tp.PrintfLine("250 OK")
+		case "AUTH":
+			_ = tp.PrintfLine("235 Authentication successful")
+		case "DATA":
+			_ = tp.PrintfLine("354 Start mail input")
+			data, errData := tp.ReadDotBytes()
+			if errData != nil {
+				return
+			}
+			f.mutex.Lock()
+			f.messages = append(f.messages, data)
+			f.mutex.Unlock()
+			time.Sleep(f.delay)
+			if f.lmtp {
+				for _, rcpt := range rcpts {
+					if resp, ok := f.lmtpResponses[rcpt]; ok {
+						_ = tp.PrintfLine("%s", resp)
+					} else {
+						_ = tp.PrintfLine("250 OK")
+					}
+				}
+				rcpts = nil
+			} else if f.dataResponse != "" {
+				_ = tp.PrintfLine("%s", f.dataResponse)
+			} else {
+				_ = tp.PrintfLine("250 OK")
+			}
+		case "BDAT":
+			var size int
+			_, _ = fmt.Sscanf(line, "BDAT %d", &size)
+			chunk := make([]byte, size)
+			if _, errChunk := io.ReadFull(tp.R, chunk); errChunk != nil {
+				return
+			}
+			chunks = append(chunks, chunk...)
+			if !strings.HasSuffix(line, " LAST") {
+				_ = tp.PrintfLine("250 OK")
+				continue
+			}
+			f.mutex.Lock()
+			f.messages = append(f.messages, chunks)
+			f.mutex.Unlock()
+			chunks = nil
+			if f.dataResponse != "" {
+				_ = tp.PrintfLine("%s", f.dataResponse)
+			} else {
+				_ = tp.PrintfLine("250 OK")
+			}
+		case "QUIT":
+			_ = tp.PrintfLine("221 Bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// received returns a copy of the commands and messages received so far
+func (f *fakeServer) received() ([]string, [][]byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.commands...), append([][]byte{}, f.messages...)
+}
+
+// pipeDialer connects to a fakeServer via an in-memory pipe and records the dialed addresses
+type pipeDialer struct {
+	server *fakeServer
+	mutex  sync.Mutex
+	addrs  []string
+}
+
+func (d *pipeDialer) DialContext(_ context.Context, _, addr string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mutex.Unlock()
+
+	client, server := net.Pipe()
+	go d.server.serve(server)
+	return client, nil
+}
+
+// recordingDialer connects to a fakeServer via an in-memory pipe like pipeDialer, recording the raw bytes sent by the
+// client
+type recordingDialer struct {
+	server *fakeServer
+	mutex  sync.Mutex
+	raw    bytes.Buffer
+}
+
+func (d *recordingDialer) DialContext(_ context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go d.server.serve(&recordingConn{Conn: server, dialer: d})
+	return client, nil
+}
+
+// sent returns a copy of the raw bytes sent by the client so far
+func (d *recordingDialer) sent() []byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]byte{}, d.raw.Bytes()...)
+}
+
+// recordingConn is the server side of a connection established by a recordingDialer
+type recordingConn struct {
+	net.Conn
+	dialer *recordingDialer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.dialer.mutex.Lock()
+	c.dialer.raw.Write(b[:n])
+	c.dialer.mutex.Unlock()
+	return n, err
+}
+
+// failDialer refuses every connection attempt
+type failDialer struct{}
+
+func (failDialer) DialContext(_ context.Context, _, addr string) (net.Conn, error) {
+	return nil, fmt.Errorf("connection to %s refused", addr)
+}
+
+func Test_deliver(t *testing.T) {
+
+	message := []byte("Subject: test\r\n\r\nsome message\r\n")
+
+	tests := []struct {
+		name     string
+		dialer   ContextDialer
+		to       []string
+		wantRcpt []string
+		wantErr  bool
+	}{
+		{"valid", &pipeDialer{server: &fakeServer{}}, []string{"a@domain.tld"}, []string{"RCPT TO:<a@domain.tld>"}, false},
+		{"valid-multiple-recipients", &pipeDialer{server: &fakeServer{extensions: []string{"8BITMIME"}}}, []string{"a@domain.tld", "b@domain.tld"}, []string{"RCPT TO:<a@domain.tld>", "RCPT TO:<b@domain.tld>"}, false},
+		{"invalid-dial", failDialer{}, []string{"a@domain.tld"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := deliver(options{dialer: tt.dialer}, "mail.domain.tld", 25, nil, "sender@domain.tld", tt.to, message)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deliver() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			commands, messages := tt.dialer.(*pipeDialer).server.received()
+
+			// Check that the envelope was set as expected
+			var rcpts []string
+			for _, cmd := range commands {
+				if strings.HasPrefix(cmd, "RCPT") {
+					rcpts = append(rcpts, cmd)
+				}
+			}
+			if strings.Join(rcpts, "\n") != strings.Join(tt.wantRcpt, "\n") {
+				t.Errorf("deliver() rcpt = %v, want %v", rcpts, tt.wantRcpt)
+			}
+
+			// Check that the message arrived unaltered. The dot reader of the server unifies the line feeds.
+			want := bytes.ReplaceAll(message, []byte{13, 10}, []byte{10})
+			if len(messages) != 1 || !bytes.Equal(messages[0], want) {
+				t.Errorf("deliver() messages = %q, want exactly one message %q", messages, want)
+			}
+		})
+	}
+}
+
+func Test_deliverLMTP(t *testing.T) {
+
+	message := []byte("Subject: test\r\n\r\nsome message\r\n")
+	to := []string{"a@domain.tld", "b@domain.tld", "c@domain.tld"}
+
+	tests := []struct {
+		name     string
+		server   *fakeServer
+		auth     smtp.Auth
+		want     Response
+		wantErr  bool
+		wantLhlo bool
+		wantData bool // Whether the message must have been transmitted
+	}{
+		{
+			"valid",
+			&fakeServer{lmtp: true, lmtpResponses: map[string]string{"a@domain.tld": "250 2.0.0 <a@domain.tld> Ok: queued as 7A1B"}},
+			nil,
+			Response{Text: "2.0.0 <a@domain.tld> Ok: queued as 7A1B", QueueID: "7A1B", Recipients: []RecipientStatus{
+				{"a@domain.tld", 250, "2.0.0 <a@domain.tld> Ok: queued as 7A1B"},
+				{"b@domain.tld", 250, "OK"},
+				{"c@domain.tld", 250, "OK"},
+			}},
+			false,
+			true,
+			true,
+		},
+		{
+			"invalid-partial",
+			&fakeServer{lmtp: true, lmtpResponses: map[string]string{
+				"a@domain.tld": "452 4.2.2 Mailbox full",
+				"c@domain.tld": "550 5.1.1 User unknown",
+			}},
+			nil,
+			Response{Text: "OK", Recipients: []RecipientStatus{
+				{"a@domain.tld", 452, "4.2.2 Mailbox full"},
+				{"b@domain.tld", 250, "OK"},
+				{"c@domain.tld", 550, "5.1.1 User unknown"},
+			}},
+			true,
+			true,
+			true,
+		},
+		{"invalid-smtp-server", &fakeServer{}, nil, Response{}, true, true, false},
+		{"invalid-auth", &fakeServer{lmtp: true}, smtp.PlainAuth("", "user", "password", "mail.domain.tld"), Response{}, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := options{dialer: &pipeDialer{server: tt.server}, lmtp: true}
+			got, err := deliver(opts, "mail.domain.tld", 24, tt.auth, "sender@domain.tld", to, message)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deliver() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got.Stats = SendStats{} // Durations are covered by Test_deliverStats
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("deliver() = %+v, want %+v", got, tt.want)
+			}
+
+			commands, messages := tt.server.received()
+			if containsString(commands, "LHLO localhost") != tt.wantLhlo {
+				t.Errorf("deliver() commands = %v, want LHLO %v", commands, tt.wantLhlo)
+			}
+			if (len(messages) == 1) != tt.wantData {
+				t.Errorf("deliver() transmitted %d messages, want transmission %v", len(messages), tt.wantData)
+			}
+		})
+	}
+}
+
+func Test_deliverDotStuffing(t *testing.T) {
+
+	// A lone dot would end the transmission prematurely, if not dot-stuffed
+	message := []byte("Subject: test\r\n\r\nbefore\r\n.\r\n..\r\nafter\r\n")
+
+	tests := []struct {
+		name   string
+		server *fakeServer
+		lmtp   bool
+	}{
+		{"valid-smtp", &fakeServer{}, false},
+		{"valid-lmtp", &fakeServer{lmtp: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := &recordingDialer{server: tt.server}
+			opts := options{dialer: dialer, lmtp: tt.lmtp}
+			if _, err := deliver(opts, "mail.domain.tld", 25, nil, "sender@domain.tld", []string{"a@domain.tld"}, message); err != nil {
+				t.Errorf("deliver() error = %v", err)
+				return
+			}
+
+			// Check that the lines were stuffed exactly once
+			if raw := dialer.sent(); !bytes.Contains(raw, []byte("\r\nbefore\r\n..\r\n...\r\nafter\r\n.\r\n")) {
+				t.Errorf("deliver() sent %q, want dot-stuffed message", raw)
+			}
+
+			// Check that the message arrived intact and not truncated. The dot reader of the server unifies the line feeds.
+			_, messages := tt.server.received()
+			want := bytes.ReplaceAll(message, []byte{13, 10}, []byte{10})
+			if len(messages) != 1 || !bytes.Equal(messages[0], want) {
+				t.Errorf("deliver() messages = %q, want exactly one message %q", messages, want)
+			}
+		})
+	}
+}
+
+func Test_deliverChunking(t *testing.T) {
+
+	// 42 bytes, including a lone dot, which must not be stuffed when transmitted via BDAT
+	message := []byte("Subject: test\r\n\r\nbefore\r\n.\r\nsome message\r\n")
+
+	tests := []struct {
+		name      string
+		server    *fakeServer
+		chunkSize int
+		wantCmds  []string
+	}{
+		{"chunks", &fakeServer{extensions: []string{"CHUNKING"}}, 20, []string{"BDAT 20", "BDAT 20", "BDAT 2 LAST"}},
+		{"chunks-exact", &fakeServer{extensions: []string{"CHUNKING"}}, 14, []string{"BDAT 14", "BDAT 14", "BDAT 14 LAST"}},
+		{"single-chunk", &fakeServer{extensions: []string{"CHUNKING"}}, 1024, []string{"BDAT 42 LAST"}},
+		{"disabled", &fakeServer{extensions: []string{"CHUNKING"}}, 0, []string{"DATA"}},
+		{"not-supported", &fakeServer{}, 20, []string{"DATA"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := options{dialer: &pipeDialer{server: tt.server}, chunkSize: tt.chunkSize}
+			if _, err := deliver(opts, "mail.domain.tld", 25, nil, "sender@domain.tld", []string{"a@domain.tld"}, message); err != nil {
+				t.Errorf("deliver() error = %v", err)
+				return
+			}
+
+			// Check the transmission commands and their sizes
+			commands, messages := tt.server.received()
+			var cmds []string
+			for _, cmd := range commands {
+				if cmd == "DATA" || strings.HasPrefix(cmd, "BDAT") {
+					cmds = append(cmds, cmd)
+				}
+			}
+			if !reflect.DeepEqual(cmds, tt.wantCmds) {
+				t.Errorf("deliver() commands = %v, want %v", cmds, tt.wantCmds)
+				return
+			}
+
+			// Check that the message arrived intact. The dot reader of the server unifies the line feeds of DATA.
+			want := message
+			if tt.wantCmds[0] == "DATA" {
+				want = bytes.ReplaceAll(message, []byte{13, 10}, []byte{10})
+			}
+			if len(messages) != 1 || !bytes.Equal(messages[0], want) {
+				t.Errorf("deliver() messages = %q, want exactly one message %q", messages, want)
+			}
+		})
+	}
+}
+
+func Test_deliverSize(t *testing.T) {
+
+	message := []byte("Subject: test\r\n\r\nsome message\r\n")
+
+	tests := []struct {
+		name     string
+		server   *fakeServer
+		wantMail string
+	}{
+		{"size", &fakeServer{extensions: []string{"SIZE 10240000"}}, fmt.Sprintf("MAIL FROM:<sender@domain.tld> SIZE=%d", len(message))},
+		{"size-8bitmime", &fakeServer{extensions: []string{"8BITMIME", "SIZE"}}, fmt.Sprintf("MAIL FROM:<sender@domain.tld> BODY=8BITMIME SIZE=%d", len(message))},
+		{"no-size", &fakeServer{}, "MAIL FROM:<sender@domain.tld>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := deliver(options{dialer: &pipeDialer{server: tt.server}}, "mail.domain.tld", 25, nil, "sender@domain.tld", []string{"a@domain.tld"}, message)
+			if err != nil {
+				t.Errorf("deliver() error = %v", err)
+				return
+			}
+
+			// The declared size must match the length of the transmitted message
+			commands, _ := tt.server.received()
+			var mail []string
+			for _, cmd := range commands {
+				if strings.HasPrefix(cmd, "MAIL") {
+					mail = append(mail, cmd)
+				}
+			}
+			if len(mail) != 1 || mail[0] != tt.wantMail {
+				t.Errorf("deliver() commands = %v, want %s", mail, tt.wantMail)
+			}
+		})
+	}
+}
+
+func Test_deliverMaxRecipients(t *testing.T) {
+
+	message := []byte("Subject: test\r\n\r\nsome message\r\n")
+	to := make([]string, 250)
+	for i := range to {
+		to[i] = fmt.Sprintf("r%d@domain.tld", i)
+	}
+
+	tests := []struct {
+		name         string
+		server       *fakeServer
+		lmtp         bool
+		limit        int
+		wantChunks   []int // Number of recipients per transaction
+		wantFailures int
+	}{
+		{"valid-unlimited", &fakeServer{}, false, 0, []int{250}, 0},
+		{"valid-limited", &fakeServer{}, false, 100, []int{100, 100, 50}, 0},
+		{"valid-limited-lmtp", &fakeServer{lmtp: true}, true, 100, []int{100, 100, 50}, 0},
+		{"invalid-rejected", &fakeServer{dataResponse: "554 5.6.0 Rejected"}, false, 100, []int{100, 100, 50}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := options{dialer: &pipeDialer{server: tt.server}, lmtp: tt.lmtp, maxRecipients: tt.limit}
+			_, err := deliver(opts, "mail.domain.tld", 25, nil, "sender@domain.tld", to, message)
+			if (err != nil) != (tt.wantFailures > 0) {
+				t.Errorf("deliver() error = %v, want %d failures", err, tt.wantFailures)
+				return
+			}
+
+			// Every transaction must have been attempted, even after a rejection
+			if got := len(multierr.Errors(err)); got != tt.wantFailures {
+				t.Errorf("deliver() error = %v, want %d failures, got %d", err, tt.wantFailures, got)
+			}
+			var smtpErr *SMTPError
+			if err != nil && !errors.As(err, &smtpErr) {
+				t.Errorf("deliver() error = %v, want SMTPError", err)
+			}
+
+			// Check the split of the recipients into transactions
+			commands, messages := tt.server.received()
+			var chunks []int
+			for _, cmd := range commands {
+				if strings.HasPrefix(cmd, "MAIL") {
+					chunks = append(chunks, 0)
+				} else if strings.HasPrefix(cmd, "RCPT") {
+					chunks[len(chunks)-1]++
+				}
+			}
+			if !reflect.DeepEqual(chunks, tt.wantChunks) || len(messages) != len(tt.wantChunks) {
+				t.Errorf("deliver() transactions = %v with %d messages, want %v", chunks, len(messages), tt.wantChunks)
+			}
+		})
+	}
+}
+
+func Test_deliverStats(t *testing.T) {
+
+	// Prepare a slow server offering STARTTLS, trusted via DANE, and authentication
+	cert, _ := testCertificateChain(t, "mail.domain.tld")
+	leaf, errParse := x509.ParseCertificate(cert.Certificate[0])
+	if errParse != nil {
+		t.Errorf("could not parse certificate: %s", errParse)
+		return
+	}
+	const delay = time.Millisecond * 30
+	server := &fakeServer{
+		extensions: []string{"AUTH PLAIN"},
+		tlsConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+		delay:      delay,
+	}
+	opts := options{
+		dialer:       &pipeDialer{server: server},
+		tlsaResolver: stubTLSAResolver{"_25._tcp.mail.domain.tld": {{TLSAUsageDaneEE, TLSASelectorCert, TLSAMatchingFull, leaf.Raw}}},
+	}
+	auth := smtp.PlainAuth("", "user", "password", "mail.domain.tld")
+
+	resp, err := deliver(opts, "mail.domain.tld", 25, auth, "sender@domain.tld", []string{"a@domain.tld"}, []byte("message\r\n"))
+	if err != nil {
+		t.Errorf("deliver() error = %v", err)
+		return
+	}
+
+	// The slow stages must reflect the server's delay, all stages must have been measured and fit into the total
+	stats := resp.Stats
+	if stats.Connect < delay || stats.Data < delay {
+		t.Errorf("deliver() stats = %+v, want connect and data to take at least %s", stats, delay)
+	}
+	if stats.TLSHandshake <= 0 || stats.Auth <= 0 {
+		t.Errorf("deliver() stats = %+v, want TLS handshake and authentication to be measured", stats)
+	}
+	if sum := stats.Connect + stats.TLSHandshake + stats.Auth + stats.Data; stats.Total < sum {
+		t.Errorf("deliver() stats = %+v, want total of at least %s", stats, sum)
+	}
+
+	// A failed delivery must still report the stages reached
+	resp, err = deliver(options{dialer: failDialer{}}, "mail.domain.tld", 25, nil, "sender@domain.tld", []string{"a@domain.tld"}, []byte("message\r\n"))
+	if err == nil {
+		t.Errorf("deliver() succeeded with failing dialer")
+		return
+	}
+	if resp.Stats.Total <= 0 || resp.Stats.Connect != 0 {
+		t.Errorf("deliver() stats = %+v, want only total to be measured", resp.Stats)
+	}
+}
+
+func Test_deliverTLSState(t *testing.T) {
+
+	// Prepare servers offering STARTTLS, trusted via DANE
+	cert, _ := testCertificateChain(t, "mail.domain.tld")
+	leaf, errParse := x509.ParseCertificate(cert.Certificate[0])
+	if errParse != nil {
+		t.Errorf("could not parse certificate: %s", errParse)
+		return
+	}
+	resolver := stubTLSAResolver{"_25._tcp.mail.domain.tld": {{TLSAUsageDaneEE, TLSASelectorCert, TLSAMatchingFull, leaf.Raw}}}
+
+	tests := []struct {
+		name       string
+		tlsConfig  *tls.Config
+		wantTLS    bool
+		wantCipher uint16
+	}{
+		{"tls12", &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305},
+		}, true, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305},
+		{"tls13", &tls.Config{Certificates: []tls.Certificate{cert}}, true, 0},
+		{"plain", nil, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &fakeServer{tlsConfig: tt.tlsConfig}
+			opts := options{dialer: &pipeDialer{server: server}}
+			if tt.wantTLS {
+				opts.tlsaResolver = resolver
+			}
+			resp, err := deliver(opts, "mail.domain.tld", 25, nil, "sender@domain.tld", []string{"a@domain.tld"}, []byte("message\r\n"))
+			if err != nil {
+				t.Errorf("deliver() error = %v", err)
+				return
+			}
+			if (resp.Stats.TLS != nil) != tt.wantTLS {
+				t.Errorf("deliver() TLS state = %+v, want TLS %v", resp.Stats.TLS, tt.wantTLS)
+				return
+			}
+			if !tt.wantTLS {
+				return
+			}
+
+			// The reported state must match the one negotiated by the server
+			server.mutex.Lock()
+			negotiated := server.tlsState
+			server.mutex.Unlock()
+			got := resp.Stats.TLS
+			if got.Version != negotiated.Version || got.CipherSuite != negotiated.CipherSuite || !got.HandshakeComplete {
+				t.Errorf("deliver() TLS version %x, cipher %x, want version %x, cipher %x",
+					got.Version, got.CipherSuite, negotiated.Version, negotiated.CipherSuite)
+			}
+			if tt.wantCipher != 0 && (got.Version != tls.VersionTLS12 || got.CipherSuite != tt.wantCipher) {
+				t.Errorf("deliver() TLS version %x, cipher %x, want TLS 1.2 with cipher %x",
+					got.Version, got.CipherSuite, tt.wantCipher)
+			}
+		})
+	}
+}
+
+func Test_deliverTLSMode(t *testing.T) {
+
+	// Prepare a server certificate issued by a private certificate authority, like the ones of corporate relays
+	cert, ca := testCertificateChain(t, "mail.domain.tld")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	serverTls := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientTls := &tls.Config{RootCAs: roots}
+
+	tests := []struct {
+		name      string
+		server    *fakeServer
+		mode      TLSMode
+		lmtp      bool
+		wantTLS   bool
+		wantErr   error // Expected error, checked via errors.Is if not nil
+		wantFinal bool  // Whether the message must have been transmitted
+	}{
+		{"required-upgrade", &fakeServer{extensions: []string{"AUTH PLAIN"}, tlsConfig: serverTls}, TLSRequired, false, true, nil, true},
+		{"required-not-offered", &fakeServer{extensions: []string{"AUTH PLAIN"}}, TLSRequired, false, false, ErrStartTLSNotOffered, false},
+		{"opportunistic-upgrade", &fakeServer{extensions: []string{"AUTH PLAIN"}, tlsConfig: serverTls}, TLSOpportunistic, false, true, nil, true},
+		{"opportunistic-not-offered", &fakeServer{extensions: []string{"AUTH PLAIN"}}, TLSOpportunistic, false, false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := options{dialer: &pipeDialer{server: tt.server}, tlsMode: tt.mode, tlsConfig: clientTls}
+			auth := smtp.PlainAuth("", "user", "password", "mail.domain.tld")
+			if !tt.wantTLS && tt.wantErr == nil {
+				// The standard library refuses plain authentication on unencrypted connections to other hosts
+				auth = nil
+			}
+			resp, err := deliver(opts, "mail.domain.tld", 25, auth, "sender@domain.tld", []string{"a@domain.tld"}, []byte("message\r\n"))
+			if (err != nil) != (tt.wantErr != nil) || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("deliver() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if (resp.Stats.TLS != nil) != tt.wantTLS {
+				t.Errorf("deliver() TLS state = %+v, want TLS %v", resp.Stats.TLS, tt.wantTLS)
+			}
+
+			// Neither credentials nor the message must be sent after refusing the unencrypted connection
+			commands, messages := tt.server.received()
+			if (len(messages) == 1) != tt.wantFinal {
+				t.Errorf("deliver() transmitted %d messages, want transmission %v", len(messages), tt.wantFinal)
+			}
+			if tt.wantErr != nil && len(commands) != 1 {
+				t.Errorf("deliver() commands = %v, want only EHLO", commands)
+			}
+		})
+	}
+
+	// LMTP sessions can't be encrypted
+	opts := options{dialer: &pipeDialer{server: &fakeServer{lmtp: true}}, lmtp: true, tlsMode: TLSRequired}
+	if _, err := deliver(opts, "mail.domain.tld", 24, nil, "sender@domain.tld", []string{"a@domain.tld"}, []byte("message\r\n")); err == nil {
+		t.Errorf("deliver() succeeded via LMTP with mandatory STARTTLS")
+	}
+}
+
+// listenTLS serves sessions of the fake server with implicit TLS on a local port, like a submission server on port
+// 465, and returns the port and a function stopping the listener
+func listenTLS(t *testing.T, server *fakeServer, config *tls.Config) (uint16, func()) {
+	l, errListen := tls.Listen("tcp", "localhost:0", config)
+	if errListen != nil {
+		t.Fatalf("could not listen: %s", errListen)
+	}
+	go func() {
+		for {
+			conn, errAccept := l.Accept()
+			if errAccept != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return uint16(l.Addr().(*net.TCPAddr).Port), func() { _ = l.Close() }
+}
+
+func Test_deliverImplicitTLS(t *testing.T) {
+
+	// Prepare a server encrypting the connection right away, trusted via a private certificate authority
+	cert, ca := testCertificateChain(t, "localhost")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	leaf, errParse := x509.ParseCertificate(cert.Certificate[0])
+	if errParse != nil {
+		t.Errorf("could not parse certificate: %s", errParse)
+		return
+	}
+	server := &fakeServer{}
+	port, stop := listenTLS(t, server, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer stop()
+	name := fmt.Sprintf("_%d._tcp.localhost", port)
+
+	tests := []struct {
+		name     string
+		mode     TLSMode
+		resolver TLSAResolver
+		wantErr  bool
+	}{
+		{"opportunistic", TLSOpportunistic, nil, false},
+		{"required", TLSRequired, nil, false},
+		{"dane-match", TLSOpportunistic, stubTLSAResolver{name: {{TLSAUsageDaneEE, TLSASelectorCert, TLSAMatchingFull, leaf.Raw}}}, false},
+		{"dane-mismatch", TLSOpportunistic, stubTLSAResolver{name: {{TLSAUsageDaneEE, TLSASelectorCert, TLSAMatchingFull, ca.Raw}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// The connection established by the dialer must satisfy the requirements and its state must be reported,
+			// although STARTTLS was not used
+			_, before := server.received()
+			opts := options{dialer: &tls.Dialer{Config: &tls.Config{RootCAs: roots}}, tlsMode: tt.mode, tlsaResolver: tt.resolver}
+			resp, err := deliver(opts, "localhost", port, nil, "sender@domain.tld", []string{"a@domain.tld"}, []byte("message\r\n"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deliver() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			_, after := server.received()
+			if tt.wantErr {
+				if len(after) != len(before) {
+					t.Errorf("deliver() transmitted the message to a server not matching the TLSA records")
+				}
+				return
+			}
+			if resp.Stats.TLS == nil || !resp.Stats.TLS.HandshakeComplete {
+				t.Errorf("deliver() TLS state = %+v, want completed handshake", resp.Stats.TLS)
+			}
+			if len(after) != len(before)+1 {
+				t.Errorf("deliver() transmitted %d messages, want 1", len(after)-len(before))
+			}
+		})
+	}
+}
+
+func Test_parseResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want Response
+	}{
+		{"postfix", "2.0.0 Ok: queued as 4F1C52003D", Response{Text: "2.0.0 Ok: queued as 4F1C52003D", QueueID: "4F1C52003D"}},
+		{"exim", "OK id=1kXyzA-0001Ab-Cd", Response{Text: "OK id=1kXyzA-0001Ab-Cd", QueueID: "1kXyzA-0001Ab-Cd"}},
+		{"no-id", "2.0.0 OK", Response{Text: "2.0.0 OK", QueueID: ""}},
+		{"no-id-internal", "2.6.0 Queued mail for delivery [InternalId=123]", Response{Text: "2.6.0 Queued mail for delivery [InternalId=123]", QueueID: ""}},
+		{"empty", "", Response{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseResponse(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseResponse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseSMTPError(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		text string
+		want *SMTPError
+	}{
+		{"enhanced", 550, "5.1.1 User unknown", &SMTPError{Code: 550, EnhancedCode: "5.1.1", Message: "User unknown", Permanent: true}},
+		{"plain", 554, "Transaction failed", &SMTPError{Code: 554, Message: "Transaction failed", Permanent: true}},
+		{"transient", 451, "4.7.1 Greylisted, try again later", &SMTPError{Code: 451, EnhancedCode: "4.7.1", Message: "Greylisted, try again later"}},
+		{"multiline", 550, "5.7.1 Message rejected\n5.7.1 See https://domain.tld/policy", &SMTPError{Code: 550, EnhancedCode: "5.7.1", Message: "Message rejected\nSee https://domain.tld/policy", Permanent: true}},
+		{"multiline-partial", 421, "4.3.2 Shutting down\nBye", &SMTPError{Code: 421, EnhancedCode: "4.3.2", Message: "Shutting down\nBye"}},
+		{"code-only", 550, "5.1.1", &SMTPError{Code: 550, EnhancedCode: "5.1.1", Message: "", Permanent: true}},
+		{"version-like", 550, "5.1 is not an enhanced code", &SMTPError{Code: 550, Message: "5.1 is not an enhanced code", Permanent: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSMTPError(tt.code, tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSMTPError() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_deliverSMTPError(t *testing.T) {
+
+	message := []byte("Subject: test\r\n\r\nsome message\r\n")
+	server := &fakeServer{dataResponse: "550-5.7.1 Message rejected\r\n550 5.7.1 See https://domain.tld/policy"}
+
+	_, err := sendMail(
+		options{dialer: &pipeDialer{server: server}},
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		mail.Address{Address: "sender@domain.tld"},
+		[]mail.Address{{Address: "a@domain.tld"}},
+		"test",
+		nil,
+		message,
+		nil,
+		"",
+		"",
+		"",
+		nil,
+	)
+
+	// The reply must be retrievable from the wrapped error
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Errorf("sendMail() error = %v, want SMTPError", err)
+		return
+	}
+	want := &SMTPError{Code: 550, EnhancedCode: "5.7.1", Message: "Message rejected\nSee https://domain.tld/policy", Permanent: true}
+	if !reflect.DeepEqual(smtpErr, want) {
+		t.Errorf("sendMail() error = %+v, want %+v", smtpErr, want)
+	}
+}
+
+// testCertificateChain creates a certificate authority and a server certificate for the given host issued by it
+func testCertificateChain(t *testing.T, host string) (tls.Certificate, *x509.Certificate) {
+
+	// Create the certificate authority
+	caKey, errKey := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errKey != nil {
+		t.Fatalf("could not generate key: %s", errKey)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ZapSmtp Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, errCa := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if errCa != nil {
+		t.Fatalf("could not create certificate: %s", errCa)
+	}
+	ca, errParse := x509.ParseCertificate(caDer)
+	if errParse != nil {
+		t.Fatalf("could not parse certificate: %s", errParse)
+	}
+
+	// Create the server certificate
+	key, errKey := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errKey != nil {
+		t.Fatalf("could not generate key: %s", errKey)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, errCert := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if errCert != nil {
+		t.Fatalf("could not create certificate: %s", errCert)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der, caDer}, PrivateKey: key}, ca
+}
@@ -12,20 +12,22 @@ package smtp
 
 import (
 	"fmt"
+	"github.com/siemens/ZapSmtp/cores"
 	"go.uber.org/multierr"
-	"go.uber.org/zap"
 	"net/mail"
 	"os"
 )
 
-type writeSyncCloser struct {
-	*writeSyncer
+// WriteSyncCloser is a WriteSyncer keeping the certificate and key files on disk until Close is called. It satisfies
+// zap's Sink interface.
+type WriteSyncCloser struct {
+	*WriteSyncer
 	fromCert string
 	fromKey  string
 	toCerts  []string
 }
 
-// NewWriteSyncCloser wraps a smtp.writeSyncer. It will safe the needed certificate and key files at initialization
+// NewWriteSyncCloser wraps a WriteSyncer. It will safe the needed certificate and key files at initialization
 // instead of creating it every time a mail is sent out. The files will be removed by calling Close. If an error occurs
 // the files will be automatically removed again. For more information on the parameters take a look at NewWriteSyncer.
 func NewWriteSyncCloser(
@@ -41,7 +43,7 @@ func NewWriteSyncCloser(
 	senderKey string,
 	recipientCerts []string,
 	tempDir string,
-) (zap.Sink, error) {
+) (*WriteSyncCloser, error) {
 
 	ws, err := NewWriteSyncer(
 		host,
@@ -60,28 +62,27 @@ func NewWriteSyncCloser(
 	if err != nil {
 		return nil, err
 	}
-	sws := ws.(*writeSyncer)
-
-	sink := &writeSyncCloser{writeSyncer: sws}
+	sink := &WriteSyncCloser{WriteSyncer: ws}
+	ws.send = sink.sendFiles
 
 	// Create temporary files for all the certificates and the key. Use Anonymous function so we can handle errors
 	// and subsequent clean-up better
 	err = func() error {
-		if len(sws.fromCert) > 0 {
-			sink.fromCert, err = saveToTemp(sws.fromCert, tempDir)
+		if len(ws.fromCert) > 0 {
+			sink.fromCert, err = saveToTemp(ws.fromCert, tempDir)
 			if err != nil {
 				return fmt.Errorf("sender certificate: %s", err)
 			}
 		}
 
-		if len(sws.fromKey) > 0 {
-			sink.fromKey, err = saveToTemp(sws.fromKey, tempDir)
+		if len(ws.fromKey) > 0 {
+			sink.fromKey, err = saveToTemp(ws.fromKey, tempDir)
 			if err != nil {
 				return fmt.Errorf("sender key: %s", err)
 			}
 		}
 
-		for _, toCert := range sws.toCerts {
+		for _, toCert := range ws.toCerts {
 			cert, err := saveToTemp(toCert, tempDir)
 			if err != nil {
 				return fmt.Errorf("recipient certificate: %s", err)
@@ -102,37 +103,116 @@ func NewWriteSyncCloser(
 	return sink, nil
 }
 
-func (s *writeSyncCloser) Write(p []byte) (int, error) {
-
-	// Don't send out a mail if the message is empty
-	if len(p) == 0 {
-		return 0, nil
-	}
-
-	// Send log messages by mail
-	err := SendMail(
+// sendFiles sends a mail like the WriteSyncer, but supplies the certificate and key files kept on disk instead of the
+// ones held in memory
+func (s *WriteSyncCloser) sendFiles(
+	to []mail.Address,
+	subject string,
+	headers []string,
+	message []byte,
+	attachments []cores.Attachment,
+) (Response, error) {
+	return sendMail(
+		s.options,
 		s.server,
 		s.port,
 		s.username,
 		s.password,
 		s.from,
-		s.to,
-		s.subject,
-		p,
+		to,
+		subject,
+		headers,
+		message,
+		attachments,
 		s.opensslPath,
 		s.fromCert,
 		s.fromKey,
 		s.toCerts,
 	)
-	if err != nil {
-		return 0, err
+}
+
+// SetSignaturePEMBundle sets the certificate and key used for signing from a combined PEM file, like the method of
+// the WriteSyncer, and saves them to temporary files replacing the previous ones. Must be called before the
+// WriteSyncCloser is used.
+func (s *WriteSyncCloser) SetSignaturePEMBundle(data []byte) error {
+	if err := s.WriteSyncer.SetSignaturePEMBundle(data); err != nil {
+		return err
+	}
+	return s.saveSignature()
+}
+
+// SetSignaturePEM sets the PEM encoded certificate and key used for signing without running OpenSSL, like the method
+// of the WriteSyncer, and saves them to temporary files replacing the previous ones. Must be called before the
+// WriteSyncCloser is used.
+func (s *WriteSyncCloser) SetSignaturePEM(cert []byte, key []byte) error {
+	if err := s.WriteSyncer.SetSignaturePEM(cert, key); err != nil {
+		return err
+	}
+	return s.saveSignature()
+}
+
+// SetEncryptionPEM sets the PEM encoded certificates used for encryption without running OpenSSL, like the method of
+// the WriteSyncer, and saves them to temporary files replacing the previous ones. Must be called before the
+// WriteSyncCloser is used.
+func (s *WriteSyncCloser) SetEncryptionPEM(certs [][]byte) error {
+	if err := s.WriteSyncer.SetEncryptionPEM(certs); err != nil {
+		return err
+	}
+
+	// Save the new files first, so the previous ones are kept in case of an error
+	paths := make([]string, 0, len(s.WriteSyncer.toCerts))
+	for _, toCert := range s.WriteSyncer.toCerts {
+		path, errSave := saveToTemp(toCert, s.tempDir)
+		if errSave != nil {
+			for _, saved := range paths {
+				_ = os.Remove(saved)
+			}
+			return fmt.Errorf("recipient certificate: %s", errSave)
+		}
+		paths = append(paths, path)
 	}
 
-	// Return length of payload
-	return len(p), nil
+	// Replace the previous files
+	var errs error
+	for _, path := range s.toCerts {
+		if path != "" {
+			if err := os.Remove(path); err != nil {
+				errs = multierr.Append(errs, err)
+			}
+		}
+	}
+	s.toCerts = paths
+	return errs
+}
+
+// saveSignature saves the certificate and key used for signing to temporary files, replacing the previous ones
+func (s *WriteSyncCloser) saveSignature() error {
+
+	// Save the new files first, so the previous ones are kept in case of an error
+	certPath, errCert := saveToTemp(s.WriteSyncer.fromCert, s.tempDir)
+	if errCert != nil {
+		return fmt.Errorf("sender certificate: %s", errCert)
+	}
+	keyPath, errKey := saveToTemp(s.WriteSyncer.fromKey, s.tempDir)
+	if errKey != nil {
+		_ = os.Remove(certPath)
+		return fmt.Errorf("sender key: %s", errKey)
+	}
+
+	// Replace the previous files
+	var errs error
+	for _, path := range []string{s.fromCert, s.fromKey} {
+		if path != "" {
+			if err := os.Remove(path); err != nil {
+				errs = multierr.Append(errs, err)
+			}
+		}
+	}
+	s.fromCert, s.fromKey = certPath, keyPath
+	return errs
 }
 
-func (s *writeSyncCloser) Close() error {
+func (s *WriteSyncCloser) Close() error {
 	var errs error
 
 	// Remove the previously created files
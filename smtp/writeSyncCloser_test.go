@@ -11,13 +11,18 @@
 package smtp
 
 import (
+	"context"
 	"github.com/siemens/ZapSmtp/_test"
+	"github.com/siemens/ZapSmtp/cores"
+	"go.uber.org/zap/zapcore"
 	"io/ioutil"
 	"net/mail"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Basically the same test as TestNewSmtpWriteSyncer but it will also check for the correct creation and removal of the
@@ -153,3 +158,159 @@ func TestNewWriteSyncCloser(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteSyncCloser_SetSignaturePEMBundle(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	opensslPath := stubOpenssl(t, tempDir, stubSignScript)
+	cert, _ := os.ReadFile(filepath.Join(root, "cert1.pem"))
+	key, _ := os.ReadFile(filepath.Join(root, "key1.pem"))
+
+	// Create an unsigning sink, which only knows the OpenSSL path
+	sink, errSink := NewWriteSyncCloser(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"bundle test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		opensslPath,
+		"",
+		"",
+		nil,
+		tempDir,
+	)
+	if errSink != nil {
+		t.Errorf("unable to initialize write sync closer: %s", errSink)
+		return
+	}
+	dialer := &pipeDialer{server: &fakeServer{}}
+	sink.SetDialer(dialer)
+
+	// Invalid bundles must be refused
+	if err := sink.SetSignaturePEMBundle(cert); err == nil {
+		t.Errorf("SetSignaturePEMBundle() accepted bundle without key")
+	}
+
+	// The bundle must be saved to files and used for signing
+	if err := sink.SetSignaturePEMBundle(append(append([]byte{}, cert...), key...)); err != nil {
+		t.Errorf("SetSignaturePEMBundle() error = %v", err)
+		return
+	}
+	certPath, keyPath := sink.fromCert, sink.fromKey
+	if gotCert, _ := os.ReadFile(certPath); string(gotCert) != string(cert) {
+		t.Errorf("certificate file = %s, want %s", gotCert, cert)
+	}
+	if _, errWrite := sink.Write([]byte("some message")); errWrite != nil {
+		t.Errorf("Write() error = %v", errWrite)
+		return
+	}
+	_, messages := dialer.server.received()
+	if len(messages) != 1 || !strings.Contains(string(messages[0]), "multipart/signed") {
+		t.Errorf("messages = %q, want exactly one signed message", messages)
+	}
+
+	// Replacing the bundle must remove the previous files, closing the current ones
+	if err := sink.SetSignaturePEMBundle(append(append([]byte{}, key...), cert...)); err != nil {
+		t.Errorf("SetSignaturePEMBundle() error = %v", err)
+		return
+	}
+	if _, err := os.Stat(certPath); !os.IsNotExist(err) {
+		t.Errorf("previous certificate file still exists")
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	for _, path := range []string{sink.fromCert, sink.fromKey, keyPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("file %s still exists", path)
+		}
+	}
+}
+
+func TestWriteSyncCloser_FlushAndClose(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	opensslPath := stubOpenssl(t, tempDir, stubSignScript)
+	sink, errSink := NewWriteSyncCloser(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"flush test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		opensslPath,
+		filepath.Join(root, "cert1.pem"),
+		filepath.Join(root, "key1.pem"),
+		nil,
+		tempDir,
+	)
+	if errSink != nil {
+		t.Errorf("unable to initialize write sync closer: %s", errSink)
+		return
+	}
+	dialer := &pipeDialer{server: &fakeServer{}}
+	sink.SetDialer(dialer)
+
+	core, errCore := cores.NewDelayedCore(
+		zapcore.InfoLevel,
+		zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}),
+		sink,
+		zapcore.ErrorLevel,
+		time.Hour,
+		time.Hour,
+	)
+	if errCore != nil {
+		_ = sink.Close()
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+
+	// A single call must send the queued batch and remove the temporary files
+	_ = core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: "queued"}, nil)
+	if err := core.FlushAndClose(context.Background()); err != nil {
+		t.Errorf("FlushAndClose() error = %v", err)
+		return
+	}
+	_, messages := dialer.server.received()
+	if len(messages) != 1 || !strings.Contains(string(messages[0]), "\nX-ZapSmtp-Entry-Count: 1\n") {
+		t.Errorf("messages = %q, want exactly one with the queued entry", messages)
+	}
+	for _, path := range []string{sink.fromCert, sink.fromKey} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("file %s still exists", path)
+		}
+	}
+}
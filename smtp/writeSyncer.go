@@ -11,13 +11,135 @@
 package smtp
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
+	"github.com/siemens/ZapSmtp/cores"
 	"go.uber.org/zap/zapcore"
+	"math/rand"
 	"net/mail"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 )
 
-type writeSyncer struct {
+// options holds the optional settings of a WriteSyncer, which are applied whenever a mail is sent out
+type options struct {
+	dialer       ContextDialer  // Defaults to a net.Dialer if nil
+	dialTimeout  time.Duration  // Bounds the TLSA lookup and the dial, unbounded if zero
+	tlsaResolver TLSAResolver   // DANE verification is enabled if set
+	tlsMode      TLSMode        // Whether STARTTLS is required
+	tlsConfig    *tls.Config    // Configuration of STARTTLS, verifying against the system's roots if nil
+	envelopeTo   []mail.Address // Defaults to the header recipients if empty
+	envelopeFrom string         // Defaults to the header sender if empty
+
+	undisclosed    bool // Whether to hide the recipients behind a placeholder in the To header
+	keepDuplicates bool // Whether to list duplicate recipients in the To header, they are never delivered twice
+
+	allowedDomains  []string        // Domains the recipients must belong to, unrestricted if empty
+	allowlistPolicy AllowlistPolicy // How recipients outside the allowed domains are handled
+
+	statsHandler func(stats SendStats, err error) // Called after every delivery attempt if set
+
+	footer string // Text appended to every mail body
+
+	subjectTemplate *template.Template // Renders the subject if set, see SetSubjectTemplate
+	subjectData     SubjectData        // Fixed values handed to the subject template
+
+	plainEncoding   bool // Whether ASCII bodies are sent without encoding
+	nestedMessage   bool // Whether the body is wrapped as a message/rfc822 attachment, see SetNestedMessage
+	keepLineEndings bool // Whether the final message is handed to the transport without normalizing its line endings
+
+	legacyPkcs7 bool     // Whether to label S/MIME parts as "application/x-pkcs7-*" instead of "application/pkcs7-*"
+	signArgs    []string // Additional arguments for the OpenSSL signing command
+	encryptArgs []string // Additional arguments for the OpenSSL encryption command
+
+	keyTransport KeyTransport // Algorithm encrypting the content key for the recipients
+
+	mustEncrypt func(message []byte) bool // Decides per mail whether to encrypt it, if set
+
+	opensslSign    string // OpenSSL binary used for signing, defaults to the one given to the constructor if empty
+	opensslEncrypt string // OpenSSL binary used for encryption, defaults to the one given to the constructor if empty
+
+	opensslWarn func(err error) // Receives the warnings of successful OpenSSL commands if set
+
+	signaturePEM  bool // Whether the signature key pair was verified by SetSignaturePEM, skipping the checks per mail
+	encryptionPEM bool // Whether the encryption keys were verified by SetEncryptionPEM, skipping the checks per mail
+
+	lmtp bool // Whether to speak LMTP instead of SMTP
+
+	authMechanism string // Mechanism used for authentication, negotiated if empty
+
+	debugDir string // Directory receiving a copy of every final message, disabled if empty
+
+	dateLocation *time.Location // Time zone of the Date header, defaults to UTC if nil
+
+	maxRecipients int // Number of recipients per transaction, unlimited if zero
+
+	chunkSize int // Size of the chunks sent via BDAT if the server supports it, DATA is used if zero
+
+	noSignedAttrs bool // Whether to omit the signed attributes, including the signing time, from signatures
+
+	retries int     // Number of further attempts after a transient failure, none if zero
+	backoff Backoff // Delays between the attempts, copied for every mail
+
+	attachmentNames AttachmentNamePolicy // How attachments sharing a file name are handled
+	attachmentFuncs []attachmentFunc     // Produce attachments of every mail when it is sent
+}
+
+// attachmentFunc produces the content of an attachment when a mail is sent, see SetAttachmentFunc
+type attachmentFunc struct {
+	name string
+	fn   func() ([]byte, error)
+}
+
+// OpensslOperation identifies an operation carried out by OpenSSL when sending a mail, see SetOpensslFor
+type OpensslOperation int
+
+const (
+	OpensslSign    OpensslOperation = iota // Signing the mail
+	OpensslEncrypt                         // Encrypting the mail
+)
+
+// TLSMode decides whether the connection to the SMTP server must be upgraded via STARTTLS, see SetTLSMode
+type TLSMode int
+
+const (
+	TLSOpportunistic TLSMode = iota // The connection is upgraded if the server offers STARTTLS
+	TLSRequired                     // The mail is not sent if the connection can't be encrypted
+)
+
+// SubjectData holds the values available to a subject template, see SetSubjectTemplate
+type SubjectData struct {
+	Hostname string // Name of the host as reported by the operating system
+	Service  string // Name of the service, as configured
+	Level    string // Highest level of the log entries in the mail, e.g. "error", empty if unknown
+	Count    int    // Number of log entries in the mail, zero if unknown
+	Group    string // Group of the log entries in the mail, empty if not grouped
+}
+
+// RotationPolicy decides which recipient group receives the next mail, see SetRecipientGroups
+type RotationPolicy int
+
+const (
+	RotateRoundRobin RotationPolicy = iota // Groups take turns in the order they were given
+	RotateRandom                           // Each mail goes to a randomly chosen group
+)
+
+// AttachmentNamePolicy decides how attachments sharing a file name are handled, see SetAttachmentNamePolicy
+type AttachmentNamePolicy int
+
+const (
+	AttachmentRename AttachmentNamePolicy = iota // Later attachments are renamed, e.g. to "log (1).txt"
+	AttachmentReject                             // The mail is not sent at all
+)
+
+// WriteSyncer is a zapcore.WriteSyncer sending every write as a separate mail via SMTP
+type WriteSyncer struct {
 	server      string
 	port        uint16
 	username    string // Leave empty to skip authentication
@@ -30,10 +152,28 @@ type writeSyncer struct {
 	fromKey     []byte
 	toCerts     [][]byte
 	tempDir     string
+	options
+
+	groups     [][]mail.Address // Recipients alternating between mails, replacing the ones above if set
+	rotation   RotationPolicy
+	groupMutex sync.Mutex
+	groupIndex int
+
+	send sendFunc // Hands a mail over for delivery, sendMail2 with the key material held in memory is used if nil
 }
 
-// NewWriteSyncer returns a zap.WriteSyncer. It will save the needed certificate and key files every time a mail
-// is sent out and remove them again immediately afterward. Some remarks for the parameters:
+// sendFunc delivers a mail to the given recipients, see sendMail
+type sendFunc func(
+	to []mail.Address,
+	subject string,
+	headers []string,
+	message []byte,
+	attachments []cores.Attachment,
+) (Response, error)
+
+// NewWriteSyncer returns a WriteSyncer, satisfying zap's WriteSyncer interface. It will save the needed certificate
+// and key files every time a mail is sent out and remove them again immediately afterward. Some remarks for the
+// parameters:
 //   - The first five parameters must always be set.
 //   - All the key and certificate files MUST NOT be password protected.
 //   - All the key and certificate files MUST BE in either PEM or DER format.
@@ -55,7 +195,7 @@ func NewWriteSyncer(
 	recipientCerts []string, // Can be omitted if no encryption is desired
 	tempDir string, // Can be omitted if neither signature nor encryption is desired
 
-) (zapcore.WriteSyncer, error) {
+) (*WriteSyncer, error) {
 
 	// Simple checks of the input parameters so the logger is less likely to fail during operation
 
@@ -98,9 +238,16 @@ func NewWriteSyncer(
 		return nil, fmt.Errorf("number of recipient certificates must match number of recipients")
 	}
 
-	if tempDir != "" && (len(recipientCerts) > 0 || (len(senderCert) > 0 && len(senderKey) > 0)) {
-		if stat, err := os.Stat(tempDir); err != nil || !stat.IsDir() {
-			return nil, fmt.Errorf("temporary directory does not exist")
+	if len(recipientCerts) > 0 || (len(senderCert) > 0 && len(senderKey) > 0) {
+		if tempDir != "" {
+			if stat, err := os.Stat(tempDir); err != nil || !stat.IsDir() {
+				return nil, fmt.Errorf("temporary directory does not exist")
+			}
+		}
+
+		// Detect read-only locations now, rather than failing on every mail later on
+		if err := checkTempDir(tempDir); err != nil {
+			return nil, err
 		}
 	}
 
@@ -126,7 +273,7 @@ func NewWriteSyncer(
 		// Convert signature certificate and key if necessary
 		fromCert, fromKey, err = PrepareSignatureKeys(opensslPath, fromCert, fromKey)
 		if err != nil {
-			return nil, fmt.Errorf("unable to convert signature key: %s", err)
+			return nil, fmt.Errorf("unable to convert signature key: %w", err)
 		}
 	}
 
@@ -150,7 +297,7 @@ func NewWriteSyncer(
 	}
 
 	// Return initialized write syncer
-	return &writeSyncer{
+	return &WriteSyncer{
 		server:      host,
 		port:        port,
 		username:    username,
@@ -166,37 +313,849 @@ func NewWriteSyncer(
 	}, nil
 }
 
-func (s *writeSyncer) Write(p []byte) (int, error) {
+// Write sends the payload as a single mail. Delivery is all-or-nothing, as the SMTP server either accepts the complete
+// message or rejects it, so either len(p) is returned, or zero together with an error.
+func (s *WriteSyncer) Write(p []byte) (int, error) {
+
+	// Don't send out a mail if the message is empty or blank, e.g. only consists of line breaks
+	if len(bytes.TrimSpace(p)) == 0 {
+		return len(p), nil
+	}
+
+	// Send log messages by mail
+	_, err := s.SendMessage(p)
+	if err != nil {
+		return 0, err
+	}
+
+	// Return length of payload
+	return len(p), nil
+}
+
+// WriteBatch sends the payload as a single mail like Write, with the level and number of the contained log entries
+// being available to the subject template. They are also stated by the headers "X-ZapSmtp-Max-Level" and
+// "X-ZapSmtp-Entry-Count", allowing inbox rules to sort the mails. It is called by a DelayedCore instead of Write.
+func (s *WriteSyncer) WriteBatch(p []byte, level zapcore.Level, count int) (int, error) {
+
+	// Don't send out a mail if the message is empty or blank, e.g. only consists of line breaks
+	if len(bytes.TrimSpace(p)) == 0 {
+		return len(p), nil
+	}
+
+	// Send log messages by mail
+	_, err := s.sendMessage(p, s.subjectFor(level.String(), count, ""), batchHeaders(level, count), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Return length of payload
+	return len(p), nil
+}
+
+// WriteAttachments sends the payload as a single mail like WriteBatch, with the attachments added as files, e.g. a
+// goroutine dump. The mail becomes a multipart message, with the payload as its first part. It is called by a
+// DelayedCore instead of WriteBatch for messages with attachments.
+func (s *WriteSyncer) WriteAttachments(
+	p []byte,
+	level zapcore.Level,
+	count int,
+	attachments []cores.Attachment,
+) (int, error) {
+
+	// Don't send out a mail if the message is empty or blank, e.g. only consists of line breaks
+	if len(bytes.TrimSpace(p)) == 0 {
+		return len(p), nil
+	}
+
+	// Send log messages by mail
+	_, err := s.sendMessage(p, s.subjectFor(level.String(), count, ""), batchHeaders(level, count), attachments)
+	if err != nil {
+		return 0, err
+	}
+
+	// Return length of payload
+	return len(p), nil
+}
+
+// WriteGroup sends the payload as a single mail like WriteBatch, with the group of the contained log entries being
+// available to the subject template. Without template, the group is appended to the subject in brackets. It is also
+// stated by the header "X-ZapSmtp-Group". It is called by a DelayedCore instead of WriteBatch if grouping entries.
+func (s *WriteSyncer) WriteGroup(p []byte, level zapcore.Level, count int, group string) (int, error) {
 
-	// Don't send out a mail if the message is empty
-	if len(p) == 0 {
-		return 0, nil
+	// Don't send out a mail if the message is empty or blank, e.g. only consists of line breaks
+	if len(bytes.TrimSpace(p)) == 0 {
+		return len(p), nil
 	}
 
 	// Send log messages by mail
-	err := SendMail2(
+	_, err := s.sendMessage(p, s.subjectFor(level.String(), count, group), groupHeaders(level, count, group), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Return length of payload
+	return len(p), nil
+}
+
+// batchHeaders returns the header lines describing a batch of log entries, using zap's canonical level names
+func batchHeaders(level zapcore.Level, count int) []string {
+	return []string{
+		fmt.Sprintf("X-ZapSmtp-Max-Level: %s", level.String()),
+		fmt.Sprintf("X-ZapSmtp-Entry-Count: %d", count),
+	}
+}
+
+// groupHeaders returns the header lines describing a batch of log entries belonging to a group
+func groupHeaders(level zapcore.Level, count int, group string) []string {
+	return append(batchHeaders(level, count), fmt.Sprintf("X-ZapSmtp-Group: %s", singleLine(group)))
+}
+
+// singleLine collapses line breaks and other runs of white space, which would end a header
+func singleLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// SendMessage sends the message as a mail and returns the server's reply, which may contain a queue ID helpful for
+// tracing the delivery.
+func (s *WriteSyncer) SendMessage(message []byte) (Response, error) {
+	return s.sendMessage(message, s.subjectFor("", 0, ""), nil, nil)
+}
+
+// estimatedHeaderAllowance covers the header lines not known before a mail is sent, like the date, the lines
+// describing the batch of log entries and a subject rendered from a template
+const estimatedHeaderAllowance = 1024
+
+// estimatedPartAllowance covers the delimiter and header lines of a part of a multipart message, besides the file name
+// and content type of an attachment
+const estimatedPartAllowance = 256
+
+// EstimatedSize returns an upper bound of the size of the mail sent for the message and attachments, without
+// building it, e.g. to decide on compressing or splitting the content beforehand. The estimate covers the headers, the
+// body including the footer and the attachments, each with the overhead of its transfer encoding. It excludes the
+// overhead of signing and encrypting, which grows the mail considerably. Header lines not known in advance, like the
+// ones describing the batch of log entries, are estimated generously. Attachments produced via SetAttachmentFunc are
+// not included, as their content is only known when the mail is sent.
+func (s *WriteSyncer) EstimatedSize(message []byte, attachments []cores.Attachment) int64 {
+
+	// Estimate the headers with the recipients resulting in the longest header, as they may rotate
+	s.groupMutex.Lock()
+	candidates := append([][]mail.Address{s.to}, s.groups...)
+	s.groupMutex.Unlock()
+	header := 0
+	for _, to := range candidates {
+		if n := len(buildHeader(s.from, to, s.subjectFor("", 0, ""), nil)); n > header {
+			header = n
+		}
+	}
+
+	// Estimate the body, which grows by at most one byte per line ending when normalizing them. Base64 encoding is
+	// never shorter than sending the body verbatim.
+	body := len(message) + bytes.Count(message, []byte{'\n'}) + bytes.Count(message, []byte{'\r'})
+	if s.footer != "" {
+		body += 2 + len(s.footer) + strings.Count(s.footer, "\n") + strings.Count(s.footer, "\r")
+	}
+	size := header + estimatedHeaderAllowance + encodedBase64Len(body)
+
+	// Wrap a nested message into the outer mail, which may need to encode it
+	if s.nestedMessage {
+		size = encodedBase64Len(size) + header + estimatedHeaderAllowance + encodedBase64Len(len(nestedMessageNote)) +
+			estimatedPartAllowance
+	}
+
+	// Add the parts of the attachments, as well as the headers of the part holding the body. File names may need to
+	// be percent-encoded.
+	if len(attachments) > 0 || s.nestedMessage {
+		size += estimatedPartAllowance
+	}
+	for _, a := range attachments {
+		size += estimatedPartAllowance + 3*len(a.Name) + len(a.ContentType) + encodedBase64Len(len(a.Data))
+	}
+
+	return int64(size)
+}
+
+// sendMessage sends the message as a mail with the given subject, additional header lines and attachments
+func (s *WriteSyncer) sendMessage(
+	message []byte,
+	subject string,
+	headers []string,
+	attachments []cores.Attachment,
+) (Response, error) {
+
+	// Refuse a message without content before spending an OpenSSL call on it
+	if len(bytes.TrimSpace(message)) == 0 {
+		return Response{}, fmt.Errorf("message is empty")
+	}
+
+	// Produce the attachments of every mail, so their content is up to date. The given slice must not be modified.
+	if len(s.attachmentFuncs) > 0 {
+		attachments = append([]cores.Attachment{}, attachments...)
+		for _, a := range s.attachmentFuncs {
+			data, err := a.fn()
+			if err != nil {
+				return Response{}, fmt.Errorf("could not produce attachment '%s': %s", a.name, err)
+			}
+			attachments = append(attachments, cores.Attachment{Name: a.name, Data: data})
+		}
+	}
+
+	// Keep mail clients from overwriting attachments sharing a file name when saving them
+	attachments, errNames := uniqueAttachmentNames(attachments, s.attachmentNames)
+	if errNames != nil {
+		return Response{}, errNames
+	}
+
+	to, errTo := s.recipients()
+	if errTo != nil {
+		if s.statsHandler != nil {
+			s.statsHandler(SendStats{}, errTo)
+		}
+		return Response{}, errTo
+	}
+	send := s.send
+	if send == nil {
+		send = s.sendMemory
+	}
+
+	// Send the mail, retrying after transient failures if desired
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := send(to, subject, headers, message, attachments)
+		if s.statsHandler != nil {
+			s.statsHandler(resp.Stats, err)
+		}
+		if err == nil || attempt >= s.retries || !retryable(resp, err) {
+			return resp, err
+		}
+		time.Sleep(backoff.Next())
+	}
+}
+
+// sendMemory sends a mail, saving the certificate and key held in memory to temporary files for the time being
+func (s *WriteSyncer) sendMemory(
+	to []mail.Address,
+	subject string,
+	headers []string,
+	message []byte,
+	attachments []cores.Attachment,
+) (Response, error) {
+	return sendMail2(
+		s.options,
 		s.server,
 		s.port,
 		s.username,
 		s.password,
 		s.from,
-		s.to,
-		s.subject,
-		p,
+		to,
+		subject,
+		headers,
+		message,
+		attachments,
 		s.opensslPath,
 		s.fromCert,
 		s.fromKey,
 		s.toCerts,
 		s.tempDir,
 	)
+}
+
+func (s *WriteSyncer) Sync() error {
+	return nil
+}
+
+// SetDialer sets the dialer used to establish the connection to the SMTP server. This allows to inject mutual TLS,
+// proxies or test harnesses. STARTTLS is still negotiated on top of the returned connection, if offered by the
+// server. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetDialer(dialer ContextDialer) {
+	s.dialer = dialer
+}
+
+// SetDialTimeout bounds the time spent on establishing the connection to the SMTP server, including the lookup of the
+// TLSA records if DANE is enabled, so a hanging resolver or server doesn't block the logger indefinitely. The timeout
+// is handed to the dialer via the context. Zero or below removes the bound, which is the default. Must be called before
+// the WriteSyncer is used.
+func (s *WriteSyncer) SetDialTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	s.dialTimeout = timeout
+}
+
+// SetSubjectTemplate sets a text/template rendering the subject of every mail, e.g. "[{{.Service}}@{{.Hostname}}]
+// {{.Count}} {{.Level}} entries", see SubjectData for the available values. The level and count are only known if the
+// WriteSyncer is the output of a DelayedCore, they are empty otherwise, the group only if the core groups the entries.
+// If rendering fails, the subject given to the constructor is used. Passing an empty template restores the
+// constructor's subject. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetSubjectTemplate(text string, service string) error {
+	if text == "" {
+		s.subjectTemplate = nil
+		return nil
+	}
+
+	tmpl, errParse := template.New("subject").Parse(text)
+	if errParse != nil {
+		return fmt.Errorf("invalid subject template: %s", errParse)
+	}
+	hostname, errHost := os.Hostname()
+	if errHost != nil {
+		return fmt.Errorf("could not determine hostname: %s", errHost)
+	}
+
+	s.subjectTemplate = tmpl
+	s.subjectData = SubjectData{Hostname: hostname, Service: service}
+	return nil
+}
+
+// subjectFor returns the subject of a mail containing count log entries up to the given level, of the given group
+func (s *WriteSyncer) subjectFor(level string, count int, group string) string {
+	if s.subjectTemplate == nil {
+		if group != "" {
+			return fmt.Sprintf("%s [%s]", s.subject, singleLine(group))
+		}
+		return s.subject
+	}
+
+	data := s.subjectData
+	data.Level, data.Count, data.Group = level, count, group
+	var b strings.Builder
+	if err := s.subjectTemplate.Execute(&b, data); err != nil {
+		return s.subject
+	}
+
+	// Line breaks would end the header
+	return singleLine(b.String())
+}
+
+// SetAttachmentNamePolicy decides how attachments sharing a file name are handled, e.g. two log files attached from
+// different directories. Names are compared case-insensitively, as mail clients may save the attachments on such file
+// systems. By default, later attachments are renamed by adding a number, e.g. "log (1).txt". Must be called before the
+// WriteSyncer is used.
+func (s *WriteSyncer) SetAttachmentNamePolicy(policy AttachmentNamePolicy) error {
+	if policy != AttachmentRename && policy != AttachmentReject {
+		return fmt.Errorf("invalid attachment name policy")
+	}
+
+	s.attachmentNames = policy
+	return nil
+}
+
+// SetAttachmentFunc attaches the content returned by the function to every mail under the given file name, e.g. a
+// snapshot of current metrics. The function is called whenever a mail is sent, rather than when the WriteSyncer is
+// set up, so the content is up to date. It is called once per mail, even if the delivery is retried. An error
+// returned by the function fails the mail. Setting a function for a name again replaces it, passing nil removes it.
+// The attachments follow the ones handed to WriteAttachments. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetAttachmentFunc(name string, fn func() ([]byte, error)) error {
+	if name == "" {
+		return fmt.Errorf("attachment name must not be empty")
+	}
+
+	// Replace or remove a function set for the name before, keeping the order of the others
+	for i, a := range s.attachmentFuncs {
+		if a.name != name {
+			continue
+		}
+		if fn == nil {
+			s.attachmentFuncs = append(s.attachmentFuncs[:i:i], s.attachmentFuncs[i+1:]...)
+		} else {
+			s.attachmentFuncs[i].fn = fn
+		}
+		return nil
+	}
+	if fn != nil {
+		s.attachmentFuncs = append(s.attachmentFuncs, attachmentFunc{name: name, fn: fn})
+	}
+	return nil
+}
+
+// uniqueAttachmentNames returns the attachments with unique file names according to the policy. Renamed attachments
+// are copies, the given ones are not modified.
+func uniqueAttachmentNames(attachments []cores.Attachment, policy AttachmentNamePolicy) ([]cores.Attachment, error) {
+	taken := make(map[string]bool, len(attachments))
+	for _, a := range attachments {
+		taken[strings.ToLower(a.Name)] = false
+	}
+
+	var unique []cores.Attachment
+	for i, a := range attachments {
+		if !taken[strings.ToLower(a.Name)] {
+			taken[strings.ToLower(a.Name)] = true
+			continue
+		}
+		if policy == AttachmentReject {
+			return nil, fmt.Errorf("attachment name '%s' is used more than once", a.Name)
+		}
+
+		// Copy the attachments before renaming the first one, and find the first number not taken by any attachment
+		if unique == nil {
+			unique = append([]cores.Attachment{}, attachments...)
+		}
+		ext := filepath.Ext(a.Name)
+		for n := 1; ; n++ {
+			name := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(a.Name, ext), n, ext)
+			if _, ok := taken[strings.ToLower(name)]; !ok {
+				taken[strings.ToLower(name)] = true
+				unique[i].Name = name
+				break
+			}
+		}
+	}
+
+	if unique == nil {
+		return attachments, nil
+	}
+	return unique, nil
+}
+
+// SetFooter sets a text appended to the body of every mail, e.g. a confidentiality notice. The footer is added before
+// the mail is signed, so it is covered by the signature. It starts on a new line, its line endings are normalized
+// like the rest of the body. Passing an empty string removes the footer. Must be called before the WriteSyncer is
+// used.
+func (s *WriteSyncer) SetFooter(footer string) {
+	s.footer = footer
+}
+
+// SetStatsHandler sets a function called after every attempt to send a mail, with the durations of the individual
+// stages and the error, if the attempt failed. As Write discards the server's response, this allows to monitor the
+// delivery when used as a log sink. The handler is called synchronously and should return quickly. Must be called
+// before the WriteSyncer is used.
+func (s *WriteSyncer) SetStatsHandler(handler func(stats SendStats, err error)) {
+	s.statsHandler = handler
+}
+
+// SetDANE enables the verification of the SMTP server's certificate against its DNS TLSA records (RFC 7672), instead
+// of the system's certificate authorities. The records are looked up via the given resolver, which needs to validate
+// DNSSEC. The mail is not sent if the server does not offer STARTTLS, unless the dialer encrypted the connection
+// already, or its certificate does not match any usable record. Passing nil disables the verification. Must be called
+// before the WriteSyncer is used.
+func (s *WriteSyncer) SetDANE(resolver TLSAResolver) {
+	s.tlsaResolver = resolver
+}
+
+// SetTLSMode decides whether the connection to the SMTP server must be upgraded via STARTTLS, e.g. for relays on
+// port 587 mandating encryption. By default, the connection is upgraded only if the server offers STARTTLS. If
+// required, the mail is not sent and ErrStartTLSNotOffered is returned if the server does not, before any credentials
+// are transmitted. Connections encrypted by the dialer, e.g. a tls.Dialer for port 465, satisfy the requirement
+// without STARTTLS. DANE always requires encryption, regardless of the mode. Must be called before the WriteSyncer is
+// used.
+func (s *WriteSyncer) SetTLSMode(mode TLSMode) {
+	s.tlsMode = mode
+}
+
+// SetTLSConfig sets the TLS configuration used for STARTTLS, e.g. to trust the certificate authority of a corporate
+// relay via RootCAs or to demand a minimum version. The configuration is cloned for every connection, with the server
+// name defaulting to the host given to the constructor. It is ignored if DANE is enabled, as the server's certificate
+// is verified against its TLSA records then. Passing nil verifies against the system's certificate authorities again.
+// Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
+// SetOmitSignedAttributes decides whether signatures are created without signed attributes (OpenSSL's "-noattr"),
+// most notably without the signing time and the S/MIME capabilities. This makes the signatures of identical messages
+// reproducible, e.g. for archival. However, the signature then no longer states when it was made, so a recipient can't
+// tell an old signed message from a current one. Defaults to including the attributes. Must be called before the
+// WriteSyncer is used.
+func (s *WriteSyncer) SetOmitSignedAttributes(omit bool) {
+	s.noSignedAttrs = omit
+}
+
+// SetLMTP decides whether the mails are handed over via LMTP (RFC 2033) instead of SMTP, as spoken by local delivery
+// agents like Dovecot. The LMTP server reports the delivery status for every recipient, which is included in the
+// response of SendMessage. LMTP sessions are neither encrypted nor authenticated, so sending fails if credentials or
+// DANE are configured. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetLMTP(enabled bool) {
+	s.lmtp = enabled
+}
+
+// SetChunking decides whether the mails are transmitted via BDAT (RFC 3030) in chunks of the given size, if the server
+// advertises CHUNKING. Unlike DATA, BDAT needs neither dot-stuffing nor scanning for the terminating line, which some
+// relays prefer for large messages. Servers without CHUNKING still receive the mails via DATA. LMTP sessions always
+// use DATA. Passing a non-positive size disables chunking, which is the default. Must be called before the WriteSyncer
+// is used.
+func (s *WriteSyncer) SetChunking(size int) {
+	if size < 0 {
+		size = 0
+	}
+	s.chunkSize = size
+}
+
+// SetMaxRecipients limits the number of recipients per mail transaction, as relays commonly reject the whole message
+// if there are too many, e.g. more than 100. If there are more recipients, the mail is sent in several transactions
+// within the same session, each with at most n recipients. A rejected transaction doesn't keep the remaining ones
+// from being attempted, the returned error then lists all failures. The reply of the first accepted transaction is
+// reported as the server's response. Passing a non-positive n removes the limit. Must be called before the
+// WriteSyncer is used.
+func (s *WriteSyncer) SetMaxRecipients(n int) {
+	if n < 0 {
+		n = 0
+	}
+	s.maxRecipients = n
+}
+
+// SetUndisclosedRecipients decides whether the recipients are hidden from each other, like with Bcc. The To header
+// then only shows the placeholder "undisclosed-recipients:;", while the mail is still delivered to all recipients.
+// Hiding the recipients is not possible with encryption, as the encrypted message refers to all the recipients'
+// certificates. Mails which are going to be encrypted are refused, e.g. if encryption certificates are set afterward.
+// Mails the encryption predicate leaves in plain text are sent with hidden recipients. Must be called before the
+// WriteSyncer is used.
+func (s *WriteSyncer) SetUndisclosedRecipients(hide bool) error {
+	if hide && len(s.toCerts) > 0 && s.mustEncrypt == nil {
+		return fmt.Errorf("recipients can not be hidden with encryption")
+	}
+
+	s.undisclosed = hide
+	return nil
+}
+
+// SetKeepDuplicateRecipients decides whether recipients listed several times are kept in the To header, e.g. if the
+// list mirrors a configuration file. Duplicates are always removed from the envelope, so each recipient receives the
+// mail only once. Addresses are compared case-insensitively on the domain. Defaults to removing duplicates from the
+// header as well. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetKeepDuplicateRecipients(keep bool) {
+	s.keepDuplicates = keep
+}
+
+// SetEnvelopeSender sets the sender used in the SMTP envelope (MAIL FROM), independently of the From header. SPF
+// checks the envelope sender's domain, so it can be set to a bounce address of the domain the relay is authorized for,
+// while the From header keeps the human-friendly address. Bounces are delivered to the envelope sender. DKIM alignment
+// is unaffected, it depends on the From header and the signing domain of the relay. Passing an empty address restores
+// the default of using the header sender. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetEnvelopeSender(sender mail.Address) error {
+	if sender.Address != "" {
+		if _, err := mail.ParseAddress(sender.Address); err != nil {
+			return fmt.Errorf("invalid envelope sender '%s': %s", sender.Address, err)
+		}
+	}
+
+	s.envelopeFrom = sender.Address
+	return nil
+}
+
+// SetEnvelopeRecipients sets the recipients used in the SMTP envelope (RCPT TO), independently of the recipients
+// listed in the To header. This allows to e.g. deliver to a monitoring address while showing a generic header. Passing
+// an empty list restores the default of delivering to the header recipients. If encryption is configured, the
+// message is still encrypted for the header recipients. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetEnvelopeRecipients(recipients []mail.Address) error {
+
+	// Validate the addresses, as they are not checked by the constructor
+	for _, r := range recipients {
+		if _, err := mail.ParseAddress(r.Address); err != nil {
+			return fmt.Errorf("invalid envelope recipient '%s': %s", r.Address, err)
+		}
+	}
+
+	s.envelopeTo = recipients
+	return nil
+}
+
+// SetNestedMessage decides whether the log entries are sent as a nested message, i.e. a "message/rfc822" attachment
+// named "log.eml" holding a mail with the entries as its body, like a forwarded mail. Some ingestors of security
+// information and event management systems expect this form. The nested mail carries the same headers as the outer
+// one, which only holds a short note in its body, followed by any further attachments. Signing and encryption apply to
+// the outer mail. Disabled by default. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetNestedMessage(enabled bool) {
+	s.nestedMessage = enabled
+}
+
+// SetPlainTextEncoding decides whether bodies consisting of ASCII characters only, without overly long lines, are sent
+// verbatim ("7bit") instead of base64 encoded. This keeps short log messages readable in the raw message and in
+// primitive clients. Any other body is still base64 encoded. Defaults to always encoding the body. Must be called
+// before the WriteSyncer is used.
+func (s *WriteSyncer) SetPlainTextEncoding(enabled bool) {
+	s.plainEncoding = enabled
+}
+
+// SetKeepLineEndings decides whether the final message, including the parts added by OpenSSL, is handed to the
+// transport as is, instead of normalizing all line endings to CRLF as required by SMTP. Lone line feeds are still
+// converted when the message is transmitted, but lone carriage returns may confuse strict servers. Keeping the line
+// endings is only advisable for transports normalizing them on their own. Defaults to normalizing the line endings.
+// Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetKeepLineEndings(keep bool) {
+	s.keepLineEndings = keep
+}
+
+// SetLegacyContentTypes decides whether signed and encrypted mails are labeled with the legacy
+// "application/x-pkcs7-*" media types instead of the "application/pkcs7-*" ones defined by RFC 5751. Some strict
+// gateways only accept the legacy labels. Defaults to the modern labels. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetLegacyContentTypes(legacy bool) {
+	s.legacyPkcs7 = legacy
+}
+
+// SetOpensslExtraArgs sets additional raw arguments passed to the OpenSSL commands signing and encrypting the mail,
+// e.g. "-md", "sha512" or an engine selection. The arguments "-in", "-out", "-signer" and "-inkey" are controlled by
+// this package and rejected. Beware that the arguments are handed to OpenSSL unchecked otherwise, so they must never
+// be derived from untrusted input, as they may e.g. weaken the algorithms or write files. Must be called before the
+// WriteSyncer is used.
+func (s *WriteSyncer) SetOpensslExtraArgs(sign []string, encrypt []string) error {
+	if err := checkOpensslArgs(sign); err != nil {
+		return fmt.Errorf("invalid signing arguments: %s", err)
+	}
+	if err := checkOpensslArgs(encrypt); err != nil {
+		return fmt.Errorf("invalid encryption arguments: %s", err)
+	}
+
+	s.signArgs = sign
+	s.encryptArgs = encrypt
+	return nil
+}
+
+// SetOpensslWarningHandler sets a function receiving the output OpenSSL writes to stderr while signing or encrypting a
+// mail successfully, e.g. deprecation or configuration warnings, which may hint at problems after an upgrade. A zero
+// exit code is treated as success regardless of such output, it is discarded if no handler is set. The handler may be
+// called concurrently if mails are sent concurrently. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetOpensslWarningHandler(handler func(err error)) {
+	s.opensslWarn = handler
+}
+
+// SetKeyTransport selects the algorithm encrypting the content key for each recipient, as some gateways require
+// RSA-OAEP while others reject it, and OpenSSL's default varies by version. The installed OpenSSL is checked for
+// support, so a dedicated encryption binary must be set via SetOpensslFor beforehand. Must be called before the
+// WriteSyncer is used.
+func (s *WriteSyncer) SetKeyTransport(transport KeyTransport) error {
+	if transport < KeyTransportDefault || transport > KeyTransportOAEP {
+		return fmt.Errorf("invalid key transport")
+	}
+	if transport != KeyTransportDefault {
+		opensslPath := opensslFor(s.opensslEncrypt, s.opensslPath)
+		if opensslPath == "" {
+			return fmt.Errorf("path to Openssl required")
+		}
+		if err := checkKeyTransport(opensslPath); err != nil {
+			return err
+		}
+	}
+
+	s.keyTransport = transport
+	return nil
+}
+
+// SetSignaturePEMBundle sets the certificate and key used for signing from a combined PEM file, see SplitPEMBundle, as
+// a convenience over passing separate files to the constructor. Signing requires the OpenSSL path to be given to the
+// constructor. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetSignaturePEMBundle(data []byte) error {
+	if s.opensslPath == "" {
+		return fmt.Errorf("path to Openssl required")
+	}
+	cert, key, err := SplitPEMBundle(data)
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("invalid signature bundle: %s", err)
+	}
+	if err := checkTempDir(s.tempDir); err != nil {
+		return err
 	}
 
-	// Return length of payload
-	return len(p), nil
+	s.fromCert = cert
+	s.fromKey = key
+	return nil
 }
 
-func (s *writeSyncer) Sync() error {
+// SetSignaturePEM sets the PEM encoded certificate and key used for signing, replacing the ones given to the
+// constructor. Unlike the constructor, it never runs OpenSSL, see PreparePEMSignatureKeys, which also skips the
+// conversion and key pair check otherwise repeated for every mail. Input not in PEM format is refused. Signing requires
+// the OpenSSL path to be given to the constructor. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetSignaturePEM(cert []byte, key []byte) error {
+	if s.opensslPath == "" {
+		return fmt.Errorf("path to Openssl required")
+	}
+	cert, key, err := PreparePEMSignatureKeys(cert, key)
+	if err != nil {
+		return fmt.Errorf("invalid signature key: %w", err)
+	}
+	if err := checkTempDir(s.tempDir); err != nil {
+		return err
+	}
+
+	s.fromCert = cert
+	s.fromKey = key
+	s.signaturePEM = true
 	return nil
 }
+
+// SetEncryptionPEM sets the PEM encoded certificates used for encryption, one per recipient in any order, replacing
+// the ones given to the constructor. Unlike the constructor, it never runs OpenSSL, see PreparePEMEncryptionKeys, which
+// also skips the conversion otherwise repeated for every mail. Input not in PEM format is refused. Encryption requires
+// the OpenSSL path to be given to the constructor. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetEncryptionPEM(certs [][]byte) error {
+	if s.opensslPath == "" {
+		return fmt.Errorf("path to Openssl required")
+	}
+	if len(certs) != len(s.to) {
+		return fmt.Errorf("number of recipient certificates must match number of recipients")
+	}
+	certs, err := PreparePEMEncryptionKeys(certs)
+	if err != nil {
+		return fmt.Errorf("invalid encryption key: %s", err)
+	}
+	if err := checkTempDir(s.tempDir); err != nil {
+		return err
+	}
+
+	s.toCerts = certs
+	s.encryptionPEM = true
+	return nil
+}
+
+// SenderAlignment decides how a sender differing from the email address of the signing certificate is handled, see
+// AlignSender
+type SenderAlignment int
+
+const (
+	SenderAlignWarn  SenderAlignment = iota // The mismatch is reported to the warning handler, the sender is kept
+	SenderAlignAdopt                        // The sender's address is replaced by the certificate's, keeping the name
+)
+
+// AlignSender checks whether the sender matches an email address of the signing certificate, as some mail clients
+// show a security warning for signatures by a different address. The policy decides whether a mismatch is passed to
+// the warning handler, which may be nil, or resolved by sending from the certificate's address instead, e.g. from
+// "signer@corp" instead of "alerts@corp". A signing certificate must be configured. Meant to be called once on
+// startup, before the WriteSyncer is used.
+func (s *WriteSyncer) AlignSender(policy SenderAlignment, warn func(err error)) error {
+	if policy != SenderAlignWarn && policy != SenderAlignAdopt {
+		return fmt.Errorf("invalid sender alignment")
+	}
+	if len(s.fromCert) == 0 {
+		return fmt.Errorf("no signing certificate configured")
+	}
+
+	// Compare the sender with the certificate's addresses, the domain is case-insensitive
+	emails, err := certificateEmails(s.fromCert)
+	if err != nil {
+		return fmt.Errorf("could not parse signing certificate: %s", err)
+	}
+	for _, email := range emails {
+		if addressKey(email) == addressKey(s.from.Address) {
+			return nil
+		}
+	}
+
+	// Handle the mismatch according to the policy, a certificate without address leaves nothing to adopt
+	if policy == SenderAlignAdopt && len(emails) > 0 {
+		s.from.Address = emails[0]
+		return nil
+	}
+	if len(emails) == 0 {
+		err = fmt.Errorf("signing certificate holds no email address to match sender '%s'", s.from.Address)
+	} else {
+		err = fmt.Errorf("sender '%s' does not match signing certificate address '%s'", s.from.Address, emails[0])
+	}
+	if policy == SenderAlignAdopt {
+		return err
+	}
+	if warn != nil {
+		warn(err)
+	}
+	return nil
+}
+
+// SetEncryptionPredicate decides per mail whether it is encrypted, based on the log entries it contains. This allows
+// to e.g. encrypt only batches containing personal data, which might be marked by a field, while routine batches are
+// sent in plain text, readable by recipients lacking certificates. A mail which must be encrypted fails if no recipient
+// certificates are configured, rather than leaking its content. Passing nil restores the default of encrypting every
+// mail if recipient certificates are configured. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetEncryptionPredicate(mustEncrypt func(message []byte) bool) {
+	s.mustEncrypt = mustEncrypt
+}
+
+// SetDateLocation sets the time zone used for the Date header, e.g. time.Local to match the local log timestamps.
+// Defaults to UTC, so mails sent by deployments across several time zones can be correlated easily. Passing nil
+// restores the default. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetDateLocation(loc *time.Location) {
+	s.dateLocation = loc
+}
+
+// SetDebugDump writes a copy of every final message, exactly as it is handed to the transport, to a file in the given
+// directory, e.g. to diagnose rendering issues. The files are named after the current time and end with ".eml", so
+// they can be opened by common mail clients. They only contain the message, not the SMTP credentials, but are not
+// encrypted unless the message is. A failure to write the copy does not keep the mail from being sent. Passing an
+// empty directory disables the dump. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetDebugDump(dir string) error {
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("invalid debug directory: %s", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("invalid debug directory: '%s' is not a directory", dir)
+		}
+	}
+
+	s.debugDir = dir
+	return nil
+}
+
+// SetOpensslFor sets the OpenSSL binary used for an operation, e.g. because only one of the installed binaries provides
+// the engine required for signing. Operations without a dedicated binary use the one given to the constructor, which
+// is also used to convert the certificates and keys when the WriteSyncer is created. Passing an empty path restores
+// the default. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetOpensslFor(op OpensslOperation, path string) error {
+
+	// Verify the binary now, rather than failing on every mail later on
+	if path != "" {
+		if _, err := exec.LookPath(path); err != nil {
+			return fmt.Errorf("invalid OpenSSL path '%s': %s", path, err)
+		}
+	}
+
+	switch op {
+	case OpensslSign:
+		s.opensslSign = path
+	case OpensslEncrypt:
+		s.opensslEncrypt = path
+	default:
+		return fmt.Errorf("invalid OpenSSL operation")
+	}
+	return nil
+}
+
+// SetRecipientGroups spreads the mails across several groups of recipients, e.g. a pool of alias addresses, instead of
+// sending each one to all recipients. Each mail goes to exactly one group, chosen according to the rotation policy.
+// Passing no groups restores the recipients given to the constructor. Groups can't be combined with encryption, as
+// the recipient certificates are bound to the constructor's recipients, mails are refused if encryption certificates
+// are set afterward. Must be called before the WriteSyncer is used.
+func (s *WriteSyncer) SetRecipientGroups(groups [][]mail.Address, rotation RotationPolicy) error {
+
+	// Validate the groups, as they are not checked by the constructor
+	if len(groups) > 0 && len(s.toCerts) > 0 {
+		return fmt.Errorf("recipient groups can not be used with encryption")
+	}
+	if rotation != RotateRoundRobin && rotation != RotateRandom {
+		return fmt.Errorf("invalid rotation policy")
+	}
+	for i, group := range groups {
+		if len(group) == 0 {
+			return fmt.Errorf("recipient group %d is empty", i)
+		}
+		for _, r := range group {
+			if _, err := mail.ParseAddress(r.Address); err != nil {
+				return fmt.Errorf("invalid recipient '%s' in group %d: %s", r.Address, i, err)
+			}
+		}
+	}
+
+	s.groupMutex.Lock()
+	defer s.groupMutex.Unlock()
+	s.groups = groups
+	s.rotation = rotation
+	s.groupIndex = 0
+	return nil
+}
+
+// recipients returns the recipients of the next mail, advancing the rotation if recipient groups are set. Groups are
+// refused with encryption, regardless of the order the options were set in.
+func (s *WriteSyncer) recipients() ([]mail.Address, error) {
+	s.groupMutex.Lock()
+	defer s.groupMutex.Unlock()
+
+	if len(s.groups) == 0 {
+		return s.to, nil
+	}
+	if len(s.toCerts) > 0 {
+		return nil, fmt.Errorf("recipient groups can not be used with encryption")
+	}
+	if s.rotation == RotateRandom {
+		return s.groups[rand.Intn(len(s.groups))], nil
+	}
+	group := s.groups[s.groupIndex]
+	s.groupIndex = (s.groupIndex + 1) % len(s.groups)
+	return group, nil
+}
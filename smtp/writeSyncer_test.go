@@ -11,13 +11,26 @@
 package smtp
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
 	"github.com/siemens/ZapSmtp/_test"
+	"github.com/siemens/ZapSmtp/cores"
+	"go.uber.org/zap/zapcore"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/mail"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Unfortunately testing the correct sending of mails is not that easy and relies on manual labor. The correctness can
@@ -138,7 +151,7 @@ func TestSmtpWriteSyncer_Write(t *testing.T) {
 	}()
 
 	// We don't really care whether SendMail succeeds, we only want to test whether all files are cleaned up again
-	ws := writeSyncer{
+	ws := WriteSyncer{
 		to:          []mail.Address{},
 		opensslPath: "some/path",
 		fromCert:    []byte("some-from-cert"),
@@ -162,3 +175,2806 @@ func TestSmtpWriteSyncer_Write(t *testing.T) {
 	}
 
 }
+
+func TestWriteSyncer_SetDialer(t *testing.T) {
+
+	// Prepare a plain write syncer, which does not need OpenSSL
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		587,
+		"",
+		"",
+		"dialer test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+
+	// Inject a dialer connecting to a fake server via an in-memory pipe
+	dialer := &pipeDialer{server: &fakeServer{}}
+	ws.SetDialer(dialer)
+
+	n, errWrite := ws.Write([]byte("some message"))
+	if errWrite != nil {
+		t.Errorf("Write() error = %v", errWrite)
+		return
+	}
+	if n != len("some message") {
+		t.Errorf("Write() n = %d, want %d", n, len("some message"))
+	}
+
+	// Make sure the dialer was used with the configured address
+	if len(dialer.addrs) != 1 || dialer.addrs[0] != "mail.domain.tld:587" {
+		t.Errorf("dialed addresses = %v, want [mail.domain.tld:587]", dialer.addrs)
+	}
+
+	// Make sure the mail arrived at the fake server
+	commands, messages := dialer.server.received()
+	if len(messages) != 1 || !strings.Contains(string(messages[0]), "Subject: dialer test") {
+		t.Errorf("received messages = %q, want exactly one message with the configured subject", messages)
+	}
+	if !containsString(commands, "MAIL FROM:<sender@domain.tld>") ||
+		!containsString(commands, "RCPT TO:<recipient@domain.tld>") {
+		t.Errorf("received commands = %v, want envelope of sender and recipient", commands)
+	}
+}
+
+// hangingDialer blocks until the context of the dial expires, like a connection attempt to an unresponsive host
+type hangingDialer struct{}
+
+func (hangingDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// hangingResolver blocks until the context of the lookup expires, like an unresponsive DNS server
+type hangingResolver struct{}
+
+func (hangingResolver) LookupTLSA(ctx context.Context, _ string) ([]TLSARecord, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestWriteSyncer_SetDialTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver TLSAResolver
+	}{
+		{"dial", nil},
+		{"tlsa-lookup", hangingResolver{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Prepare a plain write syncer, which does not need OpenSSL
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"timeout test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			ws.SetDialer(hangingDialer{})
+			ws.SetDANE(tt.resolver)
+			ws.SetDialTimeout(time.Millisecond * 50)
+
+			// The connection attempt must be given up after the timeout
+			start := time.Now()
+			if _, err := ws.Write([]byte("some message")); err == nil {
+				t.Errorf("Write() succeeded without a connection")
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("Write() took %s, want it to give up after the timeout", d)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SendMessage(t *testing.T) {
+
+	// Prepare a plain write syncer, which does not need OpenSSL
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"response test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	ws.SetDialer(&pipeDialer{server: &fakeServer{dataResponse: "250 2.0.0 Ok: queued as 4F1C52003D"}})
+
+	resp, errSend := ws.SendMessage([]byte("some message"))
+	if errSend != nil {
+		t.Errorf("SendMessage() error = %v", errSend)
+		return
+	}
+	if resp.Text != "2.0.0 Ok: queued as 4F1C52003D" {
+		t.Errorf("SendMessage() response text = '%s', want '2.0.0 Ok: queued as 4F1C52003D'", resp.Text)
+	}
+	if resp.QueueID != "4F1C52003D" {
+		t.Errorf("SendMessage() queue ID = '%s', want '4F1C52003D'", resp.QueueID)
+	}
+}
+
+func TestWriteSyncer_SetEnvelopeRecipients(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope []mail.Address
+		wantRcpt []string
+		wantErr  bool
+	}{
+		{"valid-default", nil, []string{"RCPT TO:<team@domain.tld>"}, false},
+		{"valid-different", []mail.Address{{Address: "monitoring@domain.tld"}}, []string{"RCPT TO:<monitoring@domain.tld>"}, false},
+		{"valid-multiple", []mail.Address{{Address: "monitoring@domain.tld"}, {Name: "Archive", Address: "archive@domain.tld"}}, []string{"RCPT TO:<monitoring@domain.tld>", "RCPT TO:<archive@domain.tld>"}, false},
+		{"invalid-address", []mail.Address{{Address: "not an address"}}, nil, true},
+		{"invalid-empty-address", []mail.Address{{Name: "Nobody"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Prepare a plain write syncer, which does not need OpenSSL
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"envelope test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Team", Address: "team@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+
+			err := ws.SetEnvelopeRecipients(tt.envelope)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetEnvelopeRecipients() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			if _, errWrite := ws.Write([]byte("some message")); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+
+			// The envelope must use the configured recipients, while the header keeps showing the team
+			commands, messages := dialer.server.received()
+			var rcpts []string
+			for _, cmd := range commands {
+				if strings.HasPrefix(cmd, "RCPT") {
+					rcpts = append(rcpts, cmd)
+				}
+			}
+			if strings.Join(rcpts, "\n") != strings.Join(tt.wantRcpt, "\n") {
+				t.Errorf("rcpt = %v, want %v", rcpts, tt.wantRcpt)
+			}
+			if len(messages) != 1 || !strings.Contains(string(messages[0]), "To: \"Team\" <team@domain.tld>\n") {
+				t.Errorf("messages = %q, want exactly one message with the team in the To header", messages)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetLegacyContentTypes(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	opensslPath := stubOpenssl(t, tempDir, stubSignScript)
+
+	tests := []struct {
+		name   string
+		legacy bool
+		want   string
+	}{
+		{"modern", false, `protocol="application/pkcs7-signature"`},
+		{"legacy", true, `protocol="application/x-pkcs7-signature"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"label test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				opensslPath,
+				filepath.Join(root, "cert1.pem"),
+				filepath.Join(root, "key1.pem"),
+				nil,
+				tempDir,
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetLegacyContentTypes(tt.legacy)
+
+			if _, errWrite := ws.Write([]byte("some message")); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+
+			_, messages := dialer.server.received()
+			if len(messages) != 1 || !strings.Contains(string(messages[0]), tt.want) {
+				t.Errorf("messages = %q, want exactly one message containing '%s'", messages, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetLegacyContentTypes_signedBody(t *testing.T) {
+
+	// This test needs a real OpenSSL binary to create and verify the signatures
+	opensslPath := _test.OpensslPath
+	if opensslPath == "" {
+		var errLook error
+		opensslPath, errLook = exec.LookPath("openssl")
+		if errLook != nil {
+			t.Skip("OpenSSL not configured and not found in PATH")
+		}
+	}
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// A plain text body looking like the headers of the signature part must not be relabeled
+	message := "Content-Type: application/x-pkcs7-signature\nContent-Type: application/pkcs7-signature\n"
+
+	tests := []struct {
+		name   string
+		legacy bool
+	}{
+		{"modern", false},
+		{"legacy", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"label test",
+				mail.Address{Name: "Sender", Address: "zap@testing.com"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				opensslPath,
+				filepath.Join(root, "cert1.pem"),
+				filepath.Join(root, "key1.pem"),
+				nil,
+				tempDir,
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetPlainTextEncoding(true)
+			ws.SetLegacyContentTypes(tt.legacy)
+
+			if _, errWrite := ws.Write([]byte(message)); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+			_, messages := dialer.server.received()
+			if len(messages) != 1 {
+				t.Errorf("received %d messages, want 1", len(messages))
+				return
+			}
+
+			// Check that the signature still matches the body
+			body, errVerify := Verify(opensslPath, messages[0], nil)
+			if errVerify != nil {
+				t.Errorf("signature verification failed: %s", errVerify)
+				return
+			}
+			if !bytes.Contains(body, []byte("\n\n"+message)) {
+				t.Errorf("signed content = %q, want body %q", body, message)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_WriteBlank(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	opensslPath := stubOpenssl(t, tempDir, stubSignScript)
+
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"blank test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		opensslPath,
+		filepath.Join(root, "cert1.pem"),
+		filepath.Join(root, "key1.pem"),
+		nil,
+		tempDir,
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	dialer := &pipeDialer{server: &fakeServer{}}
+	ws.SetDialer(dialer)
+
+	// Blank payloads must be consumed without signing or sending them
+	blank := []byte("\n\r\n \t\n")
+	if n, err := ws.Write(blank); err != nil || n != len(blank) {
+		t.Errorf("Write() = %d, %v, want %d, nil", n, err, len(blank))
+	}
+	if n, err := ws.WriteBatch(blank, zapcore.ErrorLevel, 1); err != nil || n != len(blank) {
+		t.Errorf("WriteBatch() = %d, %v, want %d, nil", n, err, len(blank))
+	}
+	if _, err := ws.SendMessage(blank); err == nil {
+		t.Errorf("SendMessage() succeeded with blank message")
+	}
+	if _, err := os.Stat(opensslPath + ".in"); !os.IsNotExist(err) {
+		t.Errorf("blank message was handed to OpenSSL for signing")
+	}
+	if commands, messages := dialer.server.received(); len(commands) > 0 || len(messages) > 0 {
+		t.Errorf("blank message was sent: %q", messages)
+	}
+}
+
+func TestWriteSyncer_SetOpensslExtraArgs(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// Use a stub recording the arguments of every invocation, one per line
+	opensslPath := stubOpenssl(t, tempDir, `echo "$@" >> "$0.args"
+case "$1" in
+smime)
+	cat
+	;;
+*)
+	cat > /dev/null
+	echo "-----BEGIN PUBLIC KEY-----"
+	;;
+esac
+`)
+
+	tests := []struct {
+		name        string
+		sign        []string
+		encrypt     []string
+		wantSign    string
+		wantEncrypt string
+		wantErr     bool
+	}{
+		{"valid", []string{"-md", "sha512"}, []string{"-stream"}, "-md sha512", "-stream", false},
+		{"valid-none", nil, nil, "", "", false},
+		{"invalid-sign-out", []string{"-out", "/tmp/file"}, nil, "", "", true},
+		{"invalid-sign-signer", []string{"-signer", "other.pem"}, nil, "", "", true},
+		{"invalid-encrypt-in", nil, []string{"-in", "/etc/passwd"}, "", "", true},
+		{"invalid-encrypt-inkey-double-dash", nil, []string{"--inkey", "other.pem"}, "", "", true},
+		{"invalid-encrypt-out-attached", nil, []string{"-out=/tmp/file"}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.Remove(opensslPath + ".args")
+
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"extra args test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				opensslPath,
+				filepath.Join(root, "cert1.pem"),
+				filepath.Join(root, "key1.pem"),
+				[]string{filepath.Join(root, "cert2.pem")},
+				tempDir,
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			ws.SetDialer(&pipeDialer{server: &fakeServer{}})
+
+			err := ws.SetOpensslExtraArgs(tt.sign, tt.encrypt)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetOpensslExtraArgs() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			if _, errWrite := ws.Write([]byte("some message")); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+
+			// Check the arguments the OpenSSL commands were invoked with
+			args, errRead := os.ReadFile(opensslPath + ".args")
+			if errRead != nil {
+				t.Errorf("could not read recorded arguments: %s", errRead)
+				return
+			}
+			var signLine, encryptLine string
+			for _, line := range strings.Split(string(args), "\n") {
+				if strings.HasPrefix(line, "smime -sign ") {
+					signLine = line
+				} else if strings.HasPrefix(line, "smime -encrypt ") {
+					encryptLine = line
+				}
+			}
+			wantSignSuffix := ".pem"
+			if tt.wantSign != "" {
+				wantSignSuffix = ".pem " + tt.wantSign
+			}
+			if !strings.HasSuffix(signLine, wantSignSuffix) {
+				t.Errorf("signing arguments = '%s', want them to end with '%s'", signLine, wantSignSuffix)
+			}
+			if !strings.Contains(encryptLine, "-aes256 "+tt.wantEncrypt) || !strings.HasSuffix(encryptLine, ".pem") {
+				t.Errorf("encryption arguments = '%s', want '%s' before the certificates", encryptLine, tt.wantEncrypt)
+			}
+		})
+	}
+}
+
+func TestNewWriteSyncer_readOnlyTempDir(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("directory permissions are not enforced")
+	}
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory and make it read-only
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+	if errChmod := os.Chmod(tempDir, 0500); errChmod != nil {
+		t.Errorf("could not make temporary directory read-only: %s", errChmod)
+		return
+	}
+	defer func() { _ = os.Chmod(tempDir, 0700) }()
+
+	_, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"read-only test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		"openssl",
+		filepath.Join(root, "cert1.pem"),
+		filepath.Join(root, "key1.pem"),
+		nil,
+		tempDir,
+	)
+	if errWs == nil || !strings.Contains(errWs.Error(), "'"+tempDir+"' is not writable") {
+		t.Errorf("NewWriteSyncer() error = %v, want it to name the read-only directory", errWs)
+	}
+}
+
+func TestWriteSyncer_SetRecipientGroups(t *testing.T) {
+
+	// Prepare a plain write syncer, which does not need OpenSSL
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"rotation test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	dialer := &pipeDialer{server: &fakeServer{}}
+	ws.SetDialer(dialer)
+
+	// Invalid groups must be rejected
+	if err := ws.SetRecipientGroups([][]mail.Address{{}}, RotateRoundRobin); err == nil {
+		t.Errorf("SetRecipientGroups() accepted an empty group")
+	}
+	if err := ws.SetRecipientGroups([][]mail.Address{{{Address: "invalid"}}}, RotateRoundRobin); err == nil {
+		t.Errorf("SetRecipientGroups() accepted an invalid address")
+	}
+
+	groups := [][]mail.Address{
+		{{Name: "Alias 1", Address: "alias1@domain.tld"}},
+		{{Name: "Alias 2a", Address: "alias2a@domain.tld"}, {Name: "Alias 2b", Address: "alias2b@domain.tld"}},
+	}
+	if err := ws.SetRecipientGroups(groups, RotateRoundRobin); err != nil {
+		t.Errorf("SetRecipientGroups() error = %v", err)
+		return
+	}
+
+	// Send three batches, which must alternate between the groups
+	for i := 0; i < 3; i++ {
+		if _, errWrite := ws.Write([]byte("batch")); errWrite != nil {
+			t.Errorf("Write() error = %v", errWrite)
+			return
+		}
+	}
+
+	commands, messages := dialer.server.received()
+	var rcpts []string
+	for _, cmd := range commands {
+		if strings.HasPrefix(cmd, "RCPT") {
+			rcpts = append(rcpts, cmd)
+		}
+	}
+	wantRcpts := []string{
+		"RCPT TO:<alias1@domain.tld>",
+		"RCPT TO:<alias2a@domain.tld>",
+		"RCPT TO:<alias2b@domain.tld>",
+		"RCPT TO:<alias1@domain.tld>",
+	}
+	if strings.Join(rcpts, "\n") != strings.Join(wantRcpts, "\n") {
+		t.Errorf("rcpt = %v, want %v", rcpts, wantRcpts)
+	}
+	wantTo := []string{
+		`To: "Alias 1" <alias1@domain.tld>`,
+		`To: "Alias 2a" <alias2a@domain.tld>, "Alias 2b" <alias2b@domain.tld>`,
+		`To: "Alias 1" <alias1@domain.tld>`,
+	}
+	if len(messages) != len(wantTo) {
+		t.Errorf("received %d messages, want %d", len(messages), len(wantTo))
+		return
+	}
+	for i, want := range wantTo {
+		if !strings.Contains(string(messages[i]), want+"\n") {
+			t.Errorf("message %d = %q, want header '%s'", i, messages[i], want)
+		}
+	}
+
+	// Groups must be refused with encryption, also if the encryption certificates are set afterward
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	pem, errRead := ioutil.ReadFile(filepath.Join(filepath.Dir(file), "..", _test.TestDir, "cert2.pem"))
+	if errRead != nil {
+		t.Errorf("could not read certificate: %s", errRead)
+		return
+	}
+	wsEnc, errWsEnc := NewWriteSyncer(
+		"mail.domain.tld", 25, "", "", "rotation test", mail.Address{Address: "sender@domain.tld"},
+		[]mail.Address{{Address: "recipient@domain.tld"}}, "openssl", "", "", nil, "",
+	)
+	if errWsEnc != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWsEnc)
+		return
+	}
+	dialerEnc := &pipeDialer{server: &fakeServer{}}
+	wsEnc.SetDialer(dialerEnc)
+	if err := wsEnc.SetRecipientGroups(groups[:1], RotateRoundRobin); err != nil {
+		t.Errorf("SetRecipientGroups() error = %v", err)
+		return
+	}
+	if err := wsEnc.SetEncryptionPEM([][]byte{pem}); err != nil {
+		t.Errorf("SetEncryptionPEM() error = %v", err)
+		return
+	}
+	if _, err := wsEnc.Write([]byte("batch")); err == nil {
+		t.Errorf("Write() accepted recipient groups with encryption")
+	}
+	if _, messages := dialerEnc.server.received(); len(messages) > 0 {
+		t.Errorf("messages = %q, want none", messages)
+	}
+}
+
+func TestWriteSyncer_SetOmitSignedAttributes(t *testing.T) {
+
+	// This test needs a real OpenSSL binary to create the signatures
+	opensslPath := _test.OpensslPath
+	if opensslPath == "" {
+		var errLook error
+		opensslPath, errLook = exec.LookPath("openssl")
+		if errLook != nil {
+			t.Skip("OpenSSL not configured and not found in PATH")
+		}
+	}
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// DER encoding of the signingTime attribute's object identifier (1.2.840.113549.1.9.5)
+	oidSigningTime := []byte{0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x09, 0x05}
+
+	tests := []struct {
+		name            string
+		omit            bool
+		wantSigningTime bool
+	}{
+		{"default", false, true},
+		{"omit", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"attribute test",
+				mail.Address{Name: "Sender", Address: "zap@testing.com"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				opensslPath,
+				filepath.Join(root, "cert1.pem"),
+				filepath.Join(root, "key1.pem"),
+				nil,
+				tempDir,
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetOmitSignedAttributes(tt.omit)
+
+			if _, errWrite := ws.Write([]byte("some message")); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+			_, messages := dialer.server.received()
+			if len(messages) != 1 {
+				t.Errorf("received %d messages, want 1", len(messages))
+				return
+			}
+
+			// Extract the PKCS#7 signature from the multipart/signed message
+			msg, errMsg := mail.ReadMessage(bytes.NewReader(messages[0]))
+			if errMsg != nil {
+				t.Errorf("could not parse message: %s", errMsg)
+				return
+			}
+			_, params, errType := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			if errType != nil {
+				t.Errorf("could not parse content type: %s", errType)
+				return
+			}
+			parts := multipart.NewReader(msg.Body, params["boundary"])
+			var signature []byte
+			for {
+				part, errPart := parts.NextPart()
+				if errPart != nil {
+					break
+				}
+				if strings.Contains(part.Header.Get("Content-Type"), "pkcs7-signature") {
+					encoded, _ := ioutil.ReadAll(part)
+					signature, _ = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(encoded)), ""))
+				}
+			}
+			if len(signature) == 0 {
+				t.Errorf("no signature found in message: %s", messages[0])
+				return
+			}
+
+			if got := bytes.Contains(signature, oidSigningTime); got != tt.wantSigningTime {
+				t.Errorf("signature contains signing time = %v, want %v", got, tt.wantSigningTime)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetEnvelopeSender(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope mail.Address
+		wantMail string
+		wantErr  bool
+	}{
+		{"valid-default", mail.Address{}, "MAIL FROM:<sender@domain.tld>", false},
+		{"valid-bounce", mail.Address{Address: "bounces@relay.tld"}, "MAIL FROM:<bounces@relay.tld>", false},
+		{"valid-name-ignored", mail.Address{Name: "Bounces", Address: "bounces@relay.tld"}, "MAIL FROM:<bounces@relay.tld>", false},
+		{"invalid-address", mail.Address{Address: "not an address"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Prepare a plain write syncer, which does not need OpenSSL
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"envelope test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Team", Address: "team@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+
+			err := ws.SetEnvelopeSender(tt.envelope)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetEnvelopeSender() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			if _, errWrite := ws.Write([]byte("some message")); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+
+			// The envelope must use the configured sender, while the header keeps showing the original one
+			commands, messages := dialer.server.received()
+			if !containsString(commands, tt.wantMail) {
+				t.Errorf("commands = %v, want '%s'", commands, tt.wantMail)
+			}
+			if len(messages) != 1 || !strings.Contains(string(messages[0]), "From: \"Sender\" <sender@domain.tld>\n") {
+				t.Errorf("messages = %q, want exactly one message with the original sender in the From header", messages)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetUndisclosedRecipients(t *testing.T) {
+
+	// Prepare a plain write syncer, which does not need OpenSSL
+	recipients := []mail.Address{
+		{Name: "Alice", Address: "alice@domain.tld"},
+		{Name: "Bob", Address: "bob@domain.tld"},
+	}
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"undisclosed test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		recipients,
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	dialer := &pipeDialer{server: &fakeServer{}}
+	ws.SetDialer(dialer)
+	if err := ws.SetUndisclosedRecipients(true); err != nil {
+		t.Errorf("SetUndisclosedRecipients() error = %v", err)
+		return
+	}
+
+	if _, errWrite := ws.Write([]byte("some message")); errWrite != nil {
+		t.Errorf("Write() error = %v", errWrite)
+		return
+	}
+
+	// All recipients must receive the mail, without being listed in the header
+	commands, messages := dialer.server.received()
+	for _, r := range recipients {
+		if !containsString(commands, "RCPT TO:<"+r.Address+">") {
+			t.Errorf("commands = %v, want recipient '%s'", commands, r.Address)
+		}
+	}
+	if len(messages) != 1 {
+		t.Errorf("received %d messages, want 1", len(messages))
+		return
+	}
+	if !strings.Contains(string(messages[0]), "To: undisclosed-recipients:;\n") {
+		t.Errorf("message = %q, want placeholder in To header", messages[0])
+	}
+	for _, r := range recipients {
+		if strings.Contains(string(messages[0]), r.Address) {
+			t.Errorf("message = %q, want recipient '%s' hidden", messages[0], r.Address)
+		}
+	}
+
+	// Hiding the recipients must be refused with encryption
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	cert := filepath.Join(filepath.Dir(file), "..", _test.TestDir, "cert2.pem")
+	wsEnc, errWsEnc := NewWriteSyncer(
+		"mail.domain.tld", 25, "", "", "undisclosed test", mail.Address{Address: "sender@domain.tld"},
+		recipients[:1], "openssl", "", "", []string{cert}, "",
+	)
+	if errWsEnc != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWsEnc)
+		return
+	}
+	if err := wsEnc.SetUndisclosedRecipients(true); err == nil {
+		t.Errorf("SetUndisclosedRecipients() accepted encryption")
+	}
+
+	// Mails must be refused as well if the encryption certificates are set afterward
+	pem, errRead := ioutil.ReadFile(cert)
+	if errRead != nil {
+		t.Errorf("could not read certificate: %s", errRead)
+		return
+	}
+	wsLate, errWsLate := NewWriteSyncer(
+		"mail.domain.tld", 25, "", "", "undisclosed test", mail.Address{Address: "sender@domain.tld"},
+		recipients[:1], "openssl", "", "", nil, "",
+	)
+	if errWsLate != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWsLate)
+		return
+	}
+	dialerLate := &pipeDialer{server: &fakeServer{}}
+	wsLate.SetDialer(dialerLate)
+	if err := wsLate.SetUndisclosedRecipients(true); err != nil {
+		t.Errorf("SetUndisclosedRecipients() error = %v", err)
+		return
+	}
+	if err := wsLate.SetEncryptionPEM([][]byte{pem}); err != nil {
+		t.Errorf("SetEncryptionPEM() error = %v", err)
+		return
+	}
+	if _, err := wsLate.Write([]byte("some message")); err == nil {
+		t.Errorf("Write() accepted hidden recipients with encryption")
+	}
+	if _, messages := dialerLate.server.received(); len(messages) > 0 {
+		t.Errorf("messages = %q, want none", messages)
+	}
+
+	// Mails the encryption predicate leaves in plain text must be sent with hidden recipients
+	wsLate.SetEncryptionPredicate(func(message []byte) bool {
+		return strings.Contains(string(message), "secret")
+	})
+	if _, err := wsLate.Write([]byte("some message")); err != nil {
+		t.Errorf("Write() error = %v", err)
+		return
+	}
+	if _, err := wsLate.Write([]byte("secret message")); err == nil {
+		t.Errorf("Write() accepted hidden recipients with encryption")
+	}
+	_, messages = dialerLate.server.received()
+	if len(messages) != 1 {
+		t.Errorf("received %d messages, want 1", len(messages))
+		return
+	}
+	if !strings.Contains(string(messages[0]), "To: undisclosed-recipients:;\n") {
+		t.Errorf("message = %q, want placeholder in To header", messages[0])
+	}
+
+	// Hiding the recipients must be accepted as well if the encryption predicate is set beforehand
+	if err := wsEnc.SetUndisclosedRecipients(false); err != nil {
+		t.Errorf("SetUndisclosedRecipients() error = %v", err)
+		return
+	}
+	wsEnc.SetEncryptionPredicate(func(message []byte) bool { return false })
+	if err := wsEnc.SetUndisclosedRecipients(true); err != nil {
+		t.Errorf("SetUndisclosedRecipients() error = %v", err)
+	}
+}
+
+func TestWriteSyncer_SetStatsHandler(t *testing.T) {
+
+	// Prepare a plain write syncer, which does not need OpenSSL
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"stats test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+
+	var calls []SendStats
+	var errs []error
+	ws.SetStatsHandler(func(stats SendStats, err error) {
+		calls = append(calls, stats)
+		errs = append(errs, err)
+	})
+
+	// Successful and failed attempts must both be reported
+	ws.SetDialer(&pipeDialer{server: &fakeServer{}})
+	_, _ = ws.Write([]byte("delivered"))
+	ws.SetDialer(failDialer{})
+	_, _ = ws.Write([]byte("failed"))
+
+	if len(calls) != 2 {
+		t.Errorf("handler called %d times, want 2", len(calls))
+		return
+	}
+	if errs[0] != nil || calls[0].Connect <= 0 || calls[0].Data <= 0 || calls[0].Total <= 0 {
+		t.Errorf("handler got %+v, %v for successful attempt, want measured stages", calls[0], errs[0])
+	}
+	if errs[1] == nil || calls[1].Total <= 0 {
+		t.Errorf("handler got %+v, %v for failed attempt, want error and total", calls[1], errs[1])
+	}
+}
+
+func TestWriteSyncer_SetFooter(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		footer  string
+		want    string
+	}{
+		{"valid", "some message\n", "-- \nConfidential", "some message\r\n-- \r\nConfidential"},
+		{"valid-no-trailing-newline", "some message", "-- \nConfidential", "some message\r\n-- \r\nConfidential"},
+		{"valid-no-footer", "some message\n", "", "some message\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Prepare a plain write syncer, which does not need OpenSSL
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"footer test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetFooter(tt.footer)
+
+			message := []byte(tt.message)
+			if _, errWrite := ws.Write(message); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+			if string(message) != tt.message {
+				t.Errorf("Write() modified message to %q", message)
+			}
+
+			// The decoded body must end with the footer
+			_, messages := dialer.server.received()
+			if len(messages) != 1 {
+				t.Errorf("received %d messages, want 1", len(messages))
+				return
+			}
+			parts := bytes.SplitN(messages[0], []byte("\n\n"), 2)
+			if len(parts) != 2 {
+				t.Errorf("message = %q, want header and body", messages[0])
+				return
+			}
+			body, errDecode := base64.StdEncoding.DecodeString(strings.TrimSpace(string(parts[1])))
+			if errDecode != nil {
+				t.Errorf("could not decode body: %s", errDecode)
+				return
+			}
+			if string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetOpensslFor(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// Prepare distinct stubs recording the arguments of every invocation, one per line
+	stubs := make(map[string]string)
+	for _, name := range []string{"default", "sign", "encrypt"} {
+		dir := filepath.Join(tempDir, name)
+		if errMkdir := os.Mkdir(dir, 0700); errMkdir != nil {
+			t.Errorf("could not create stub directory: %s", errMkdir)
+			return
+		}
+		stubs[name] = stubOpenssl(t, dir, `echo "$@" >> "$0.args"
+case "$1" in
+smime)
+	cat
+	;;
+*)
+	cat > /dev/null
+	echo "-----BEGIN PUBLIC KEY-----"
+	;;
+esac
+`)
+	}
+
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"openssl test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		stubs["default"],
+		filepath.Join(root, "cert1.pem"),
+		filepath.Join(root, "key1.pem"),
+		[]string{filepath.Join(root, "cert2.pem")},
+		tempDir,
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	ws.SetDialer(&pipeDialer{server: &fakeServer{}})
+
+	// Invalid settings must be refused
+	if err := ws.SetOpensslFor(OpensslSign, filepath.Join(tempDir, "missing")); err == nil {
+		t.Errorf("SetOpensslFor() accepted missing binary")
+	}
+	if err := ws.SetOpensslFor(OpensslOperation(42), stubs["sign"]); err == nil {
+		t.Errorf("SetOpensslFor() accepted invalid operation")
+	}
+
+	if err := ws.SetOpensslFor(OpensslSign, stubs["sign"]); err != nil {
+		t.Errorf("SetOpensslFor() error = %v", err)
+		return
+	}
+	if err := ws.SetOpensslFor(OpensslEncrypt, stubs["encrypt"]); err != nil {
+		t.Errorf("SetOpensslFor() error = %v", err)
+		return
+	}
+	if _, errWrite := ws.Write([]byte("some message")); errWrite != nil {
+		t.Errorf("Write() error = %v", errWrite)
+		return
+	}
+
+	// Each operation must have invoked its own binary
+	tests := []struct {
+		stub    string
+		want    string
+		wantNot []string
+	}{
+		{"default", "", []string{"smime -sign", "smime -encrypt"}},
+		{"sign", "smime -sign", []string{"smime -encrypt"}},
+		{"encrypt", "smime -encrypt", []string{"smime -sign"}},
+	}
+	for _, tt := range tests {
+		args, _ := os.ReadFile(stubs[tt.stub] + ".args")
+		if !strings.Contains(string(args), tt.want) {
+			t.Errorf("%s binary invocations = %q, want '%s'", tt.stub, args, tt.want)
+		}
+		for _, not := range tt.wantNot {
+			if strings.Contains(string(args), not) {
+				t.Errorf("%s binary invocations = %q, must not contain '%s'", tt.stub, args, not)
+			}
+		}
+	}
+}
+
+func TestWriteSyncer_SetSubjectTemplate(t *testing.T) {
+	hostname, errHost := os.Hostname()
+	if errHost != nil {
+		t.Errorf("could not determine hostname: %s", errHost)
+		return
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		batch    bool // Whether to send via WriteBatch instead of Write
+		want     string
+		wantErr  bool
+	}{
+		{"valid-batch", "[{{.Service}}@{{.Hostname}}] {{.Count}} {{.Level}}", true, "[billing@" + hostname + "] 3 error", false},
+		{"valid-write", "[{{.Service}}] {{.Count}} {{.Level}}", false, "[billing] 0", false},
+		{"valid-line-breaks", "{{.Service}}\r\nBcc: other@domain.tld", true, "billing Bcc: other@domain.tld", false},
+		{"valid-render-failure", "{{.Unknown}}", true, "static subject", false},
+		{"valid-empty", "", true, "static subject", false},
+		{"invalid-syntax", "{{.Service", true, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Prepare a plain write syncer, which does not need OpenSSL
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"static subject",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+
+			err := ws.SetSubjectTemplate(tt.template, "billing")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetSubjectTemplate() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			var errWrite error
+			if tt.batch {
+				_, errWrite = ws.WriteBatch([]byte("some message"), zapcore.ErrorLevel, 3)
+			} else {
+				_, errWrite = ws.Write([]byte("some message"))
+			}
+			if errWrite != nil {
+				t.Errorf("write error = %v", errWrite)
+				return
+			}
+
+			_, messages := dialer.server.received()
+			if len(messages) != 1 || !strings.Contains(string(messages[0]), "\nSubject: "+tt.want+"\n") {
+				t.Errorf("messages = %q, want exactly one message with subject '%s'", messages, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_WriteBatchHeaders(t *testing.T) {
+
+	// Prepare a plain write syncer, which does not need OpenSSL
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"header test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	dialer := &pipeDialer{server: &fakeServer{}}
+	ws.SetDialer(dialer)
+
+	// Send a mixed batch via a delayed core, which determines the level and count
+	core, errCore := cores.NewDelayedCore(
+		zapcore.DebugLevel,
+		zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg", LevelKey: "level", EncodeLevel: zapcore.LowercaseLevelEncoder}),
+		ws,
+		zapcore.ErrorLevel,
+		time.Hour,
+		time.Hour,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	_ = core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: "info"}, nil)
+	_ = core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "error"}, nil)
+	_ = core.Write(zapcore.Entry{Level: zapcore.WarnLevel, Message: "warn"}, nil)
+	if err := core.Sync(); err != nil {
+		t.Errorf("Sync() error = %v", err)
+		return
+	}
+
+	// The headers must state the highest level and the total count. The dot reader of the server unifies the line feeds.
+	_, messages := dialer.server.received()
+	if len(messages) != 1 {
+		t.Errorf("received %d messages, want 1", len(messages))
+		return
+	}
+	for _, want := range []string{"\nX-ZapSmtp-Max-Level: error\n", "\nX-ZapSmtp-Entry-Count: 3\n"} {
+		if !strings.Contains(string(messages[0]), want) {
+			t.Errorf("message = %q, want header %q", messages[0], want)
+		}
+	}
+
+	// Plain writes don't know about the entries and must not state anything
+	if _, err := ws.Write([]byte("some message")); err != nil {
+		t.Errorf("Write() error = %v", err)
+		return
+	}
+	_, messages = dialer.server.received()
+	if len(messages) != 2 || strings.Contains(string(messages[1]), "X-ZapSmtp-") {
+		t.Errorf("messages = %q, want second message without batch headers", messages)
+	}
+}
+
+func TestWriteSyncer_WriteGroup(t *testing.T) {
+	tests := []struct {
+		name         string
+		template     string
+		wantSubjects []string
+	}{
+		{"default", "", []string{"group test [api]", "group test [db]"}},
+		{"template", "{{.Group}}: {{.Count}} entries", []string{"api: 1 entries", "db: 2 entries"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Prepare a plain write syncer, which does not need OpenSSL
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"group test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			if err := ws.SetSubjectTemplate(tt.template, "service"); err != nil {
+				t.Errorf("SetSubjectTemplate() error = %v", err)
+				return
+			}
+
+			// Send entries of two components via a delayed core grouping them
+			core, errCore := cores.NewDelayedCore(
+				zapcore.DebugLevel,
+				zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}),
+				ws,
+				zapcore.ErrorLevel,
+				time.Hour,
+				time.Hour,
+			)
+			if errCore != nil {
+				t.Errorf("unable to initialize delayed core: %s", errCore)
+				return
+			}
+			core.SetGroupBy(func(ent zapcore.Entry, _ []zapcore.Field) string {
+				return strings.SplitN(ent.Message, "-", 2)[0]
+			})
+			_ = core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: "api-1"}, nil)
+			_ = core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: "db-1"}, nil)
+			_ = core.Write(zapcore.Entry{Level: zapcore.WarnLevel, Message: "db-2"}, nil)
+			if err := core.Sync(); err != nil {
+				t.Errorf("Sync() error = %v", err)
+				return
+			}
+
+			// Each group must be sent as a mail of its own. The dot reader of the server unifies the line feeds.
+			_, messages := dialer.server.received()
+			if len(messages) != len(tt.wantSubjects) {
+				t.Errorf("received %d messages, want %d", len(messages), len(tt.wantSubjects))
+				return
+			}
+			for i, group := range []string{"api", "db"} {
+				for _, want := range []string{"\nSubject: " + tt.wantSubjects[i] + "\n", "\nX-ZapSmtp-Group: " + group + "\n"} {
+					if !strings.Contains(string(messages[i]), want) {
+						t.Errorf("message = %q, want header %q", messages[i], want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_WriteGroupSigned(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	opensslPath := stubOpenssl(t, tempDir, stubSignScript)
+
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"signed group test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		opensslPath,
+		filepath.Join(root, "cert1.pem"),
+		filepath.Join(root, "key1.pem"),
+		nil,
+		tempDir,
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	dialer := &pipeDialer{server: &fakeServer{}}
+	ws.SetDialer(dialer)
+
+	if _, err := ws.WriteGroup([]byte("some message"), zapcore.ErrorLevel, 3, "api"); err != nil {
+		t.Errorf("WriteGroup() error = %v", err)
+		return
+	}
+
+	// The batch headers must be visible in the header of the signed message, not only within the signed part
+	_, messages := dialer.server.received()
+	if len(messages) != 1 {
+		t.Errorf("received %d messages, want 1", len(messages))
+		return
+	}
+	msg, errRead := mail.ReadMessage(bytes.NewReader(messages[0]))
+	if errRead != nil {
+		t.Errorf("could not parse message: %s", errRead)
+		return
+	}
+	if !strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/signed") {
+		t.Errorf("message = %q, want signed message", messages[0])
+		return
+	}
+	want := map[string]string{"X-ZapSmtp-Max-Level": "error", "X-ZapSmtp-Entry-Count": "3", "X-ZapSmtp-Group": "api"}
+	for key, value := range want {
+		if got := msg.Header.Get(key); got != value {
+			t.Errorf("header %s = %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestWriteSyncer_SetEncryptionPredicate(t *testing.T) {
+	opensslPath := _test.OpensslPath
+	if opensslPath == "" {
+		var errLook error
+		opensslPath, errLook = exec.LookPath("openssl")
+		if errLook != nil {
+			t.Skip("OpenSSL not configured and not found in PATH")
+		}
+	}
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	sensitive := func(message []byte) bool { return bytes.Contains(message, []byte(`"pii":true`)) }
+	routine := `{"level":"error","msg":"disk full"}` + "\n"
+	personal := `{"level":"error","msg":"login failed","user":"alice","pii":true}` + "\n"
+
+	tests := []struct {
+		name          string
+		toCerts       []string
+		message       string
+		wantEncrypted bool
+		wantErr       bool
+	}{
+		{"valid-routine", []string{filepath.Join(root, "cert2.pem")}, routine, false, false},
+		{"valid-sensitive", []string{filepath.Join(root, "cert2.pem")}, routine + personal, true, false},
+		{"valid-routine-no-certs", nil, routine, false, false},
+		{"invalid-sensitive-no-certs", nil, personal, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"encryption test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				opensslPath,
+				"",
+				"",
+				tt.toCerts,
+				tempDir,
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetPlainTextEncoding(true)
+			ws.SetEncryptionPredicate(sensitive)
+
+			_, err := ws.Write([]byte(tt.message))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Write() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			// A failed mail must not be sent at all, others in plain text or encrypted as decided
+			_, messages := dialer.server.received()
+			if tt.wantErr {
+				if len(messages) != 0 {
+					t.Errorf("messages = %q, want none", messages)
+				}
+				return
+			}
+			if len(messages) != 1 {
+				t.Errorf("received %d messages, want 1", len(messages))
+				return
+			}
+			got := string(messages[0])
+			if encrypted := strings.Contains(got, "application/pkcs7-mime"); encrypted != tt.wantEncrypted {
+				t.Errorf("message = %q, want encrypted %v", got, tt.wantEncrypted)
+			}
+			if plain := strings.Contains(got, "disk full"); plain == tt.wantEncrypted {
+				t.Errorf("message = %q, want content readable %v", got, !tt.wantEncrypted)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetDebugDump(t *testing.T) {
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// Prepare a plain write syncer, which does not need OpenSSL
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"user",
+		"secret-password",
+		"dump test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	ws.SetDialer(&pipeDialer{server: &fakeServer{extensions: []string{"AUTH PLAIN"}}})
+	ws.SetPlainTextEncoding(true)
+
+	// Invalid directories must be refused
+	if err := ws.SetDebugDump(filepath.Join(tempDir, "missing")); err == nil {
+		t.Errorf("SetDebugDump() accepted missing directory")
+	}
+	if err := ws.SetDebugDump(tempDir); err != nil {
+		t.Errorf("SetDebugDump() error = %v", err)
+		return
+	}
+
+	// A failing delivery must still be dumped, as it is written before the transport
+	_, _ = ws.Write([]byte("some message\n"))
+
+	files, errGlob := filepath.Glob(filepath.Join(tempDir, "zapsmtp-*.eml"))
+	if errGlob != nil || len(files) != 1 {
+		t.Errorf("found dump files %v, want exactly one", files)
+		return
+	}
+	data, errRead := os.ReadFile(files[0])
+	if errRead != nil {
+		t.Errorf("could not read dump: %s", errRead)
+		return
+	}
+
+	// The dump must be a valid message without the credentials
+	msg, errParse := mail.ReadMessage(bytes.NewReader(data))
+	if errParse != nil {
+		t.Errorf("dump is not a valid message: %s", errParse)
+		return
+	}
+	if got := msg.Header.Get("Subject"); got != "dump test" {
+		t.Errorf("dump subject = '%s', want 'dump test'", got)
+	}
+	body, _ := ioutil.ReadAll(msg.Body)
+	if string(body) != "some message\r\n" {
+		t.Errorf("dump body = %q, want %q", body, "some message\r\n")
+	}
+	if bytes.Contains(data, []byte("secret-password")) {
+		t.Errorf("dump contains the password")
+	}
+}
+
+func TestWriteSyncer_SetDateLocation(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	stubPath := stubOpenssl(t, tempDir, stubSignScript)
+
+	tests := []struct {
+		name       string
+		loc        *time.Location
+		signed     bool
+		wantOffset string
+	}{
+		{"default", nil, false, "+0000"},
+		{"utc", time.UTC, false, "+0000"},
+		{"fixed", time.FixedZone("CET", 3600), false, "+0100"},
+		{"negative", time.FixedZone("EST", -5*3600), false, "-0500"},
+		{"signed", time.FixedZone("CET", 3600), true, "+0100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Prepare a plain write syncer, which does not need OpenSSL, or a signing one using the stub
+			opensslPath, certPath, keyPath, dir := "", "", "", ""
+			if tt.signed {
+				opensslPath, certPath, keyPath, dir = stubPath, filepath.Join(root, "cert1.pem"), filepath.Join(root, "key1.pem"), tempDir
+			}
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"date test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				opensslPath,
+				certPath,
+				keyPath,
+				nil,
+				dir,
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			if tt.loc != nil {
+				ws.SetDateLocation(tt.loc)
+			}
+
+			if _, errWrite := ws.Write([]byte("some message")); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+
+			// The Date header must be valid, current and in the configured time zone. Signed messages must state it
+			// in their own header, not only within the signed part.
+			_, messages := dialer.server.received()
+			if len(messages) != 1 {
+				t.Errorf("received %d messages, want 1", len(messages))
+				return
+			}
+			msg, errParse := mail.ReadMessage(bytes.NewReader(messages[0]))
+			if errParse != nil {
+				t.Errorf("could not parse message: %s", errParse)
+				return
+			}
+			if tt.signed && !strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/signed") {
+				t.Errorf("message = %q, want signed message", messages[0])
+				return
+			}
+			header := msg.Header.Get("Date")
+			date, errDate := mail.ParseDate(header)
+			if errDate != nil {
+				t.Errorf("invalid Date header '%s': %s", header, errDate)
+				return
+			}
+			if !strings.HasSuffix(header, " "+tt.wantOffset) {
+				t.Errorf("Date header = '%s', want offset %s", header, tt.wantOffset)
+			}
+			if d := time.Since(date); d < -time.Second || d > time.Minute {
+				t.Errorf("Date header = '%s', want current time", header)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetPlainTextEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		message  string
+		want7bit bool
+	}{
+		{"ascii", true, "{\"level\":\"error\",\"msg\":\"disk full\"}\n", true},
+		{"ascii-disabled", false, "{\"level\":\"error\",\"msg\":\"disk full\"}\n", false},
+		{"non-ascii", true, "{\"level\":\"error\",\"msg\":\"Festplatte voll – bitte prüfen\"}\n", false},
+		{"long-line", true, strings.Repeat("x", 999) + "\n", false},
+		{"nul", true, "null\x00byte\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Prepare a plain write syncer, which does not need OpenSSL
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"encoding test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetPlainTextEncoding(tt.enabled)
+
+			if _, errWrite := ws.Write([]byte(tt.message)); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+
+			// Check the encoding and, for 7bit, that the body is verbatim. The dot reader of the server unifies the
+			// line feeds.
+			_, messages := dialer.server.received()
+			if len(messages) != 1 {
+				t.Errorf("received %d messages, want 1", len(messages))
+				return
+			}
+			got := string(messages[0])
+			if tt.want7bit {
+				if !strings.Contains(got, "\nContent-Transfer-Encoding: 7bit\n\n"+tt.message) {
+					t.Errorf("message = %q, want verbatim 7bit body", got)
+				}
+			} else if !strings.Contains(got, "\nContent-Transfer-Encoding: base64\n") {
+				t.Errorf("message = %q, want base64 body", got)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetKeepLineEndings(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// Use a stub adding headers with sloppy line endings, like OpenSSL does on some platforms
+	opensslPath := stubOpenssl(t, tempDir, `case "$1" in
+smime)
+	cat > "$0.in"
+	printf 'MIME-Version: 1.0\nX-Stub: lone\rcarriage return\nContent-Type: multipart/signed; protocol="application/pkcs7-signature"\n\n'
+	cat "$0.in"
+	;;
+*)
+	cat > /dev/null
+	echo "-----BEGIN PUBLIC KEY-----"
+	;;
+esac
+`)
+
+	tests := []struct {
+		name      string
+		keep      bool
+		wantCanon bool
+	}{
+		{"normalized", false, true},
+		{"kept", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"line ending test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				opensslPath,
+				filepath.Join(root, "cert1.pem"),
+				filepath.Join(root, "key1.pem"),
+				nil,
+				tempDir,
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &recordingDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetKeepLineEndings(tt.keep)
+
+			if _, errWrite := ws.Write([]byte("line 1\nline 2\n")); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+
+			// Extract the transmitted message and check its line endings
+			raw := dialer.sent()
+			start := bytes.Index(raw, []byte("DATA\r\n"))
+			end := bytes.Index(raw, []byte("\r\n.\r\n"))
+			if start < 0 || end < start {
+				t.Errorf("sent = %q, want a transmitted message", raw)
+				return
+			}
+			data := raw[start+len("DATA\r\n") : end]
+			canon := bytes.Count(data, []byte("\n")) == bytes.Count(data, []byte("\r\n")) &&
+				bytes.Count(data, []byte("\r")) == bytes.Count(data, []byte("\r\n"))
+			if canon != tt.wantCanon {
+				t.Errorf("message = %q, want CRLF line endings throughout %v", data, tt.wantCanon)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_WriteAttachments(t *testing.T) {
+
+	// Prepare a plain write syncer, which does not need OpenSSL
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"attachment test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	dialer := &pipeDialer{server: &fakeServer{}}
+	ws.SetDialer(dialer)
+
+	// Simulate a fatal entry, which is written immediately along with the goroutine dump
+	core, errCore := cores.NewDelayedCore(
+		zapcore.DebugLevel,
+		zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg", LevelKey: "level", EncodeLevel: zapcore.LowercaseLevelEncoder}),
+		ws,
+		zapcore.ErrorLevel,
+		time.Hour,
+		time.Hour,
+	)
+	if errCore != nil {
+		t.Errorf("unable to initialize delayed core: %s", errCore)
+		return
+	}
+	core.SetGoroutineDump(true)
+	if err := core.Write(zapcore.Entry{Level: zapcore.FatalLevel, Message: "fatal"}, nil); err != nil {
+		t.Errorf("Write() error = %v", err)
+		return
+	}
+
+	// The mail must consist of the log entries, followed by the dump as attachment
+	_, messages := dialer.server.received()
+	if len(messages) != 1 {
+		t.Errorf("received %d messages, want 1", len(messages))
+		return
+	}
+	msg, errRead := mail.ReadMessage(bytes.NewReader(messages[0]))
+	if errRead != nil {
+		t.Errorf("could not parse message: %s", errRead)
+		return
+	}
+	mediaType, params, errType := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if errType != nil || mediaType != "multipart/mixed" {
+		t.Errorf("Content-Type = %q, want multipart/mixed", msg.Header.Get("Content-Type"))
+		return
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []*multipart.Part
+	var contents [][]byte
+	for {
+		part, errPart := reader.NextPart()
+		if errPart != nil {
+			break
+		}
+		content, errContent := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+		if errContent != nil {
+			t.Errorf("could not decode part: %s", errContent)
+			return
+		}
+		parts = append(parts, part)
+		contents = append(contents, content)
+	}
+	if len(parts) != 2 {
+		t.Errorf("message has %d parts, want 2", len(parts))
+		return
+	}
+	if !strings.Contains(string(contents[0]), `"msg":"fatal"`) {
+		t.Errorf("first part = %q, want the log entry", contents[0])
+	}
+	if parts[1].FileName() != "goroutines.txt" || !strings.Contains(string(contents[1]), "goroutine ") {
+		t.Errorf("second part = %s %q, want goroutine dump", parts[1].FileName(), contents[1])
+	}
+
+	// The content type of an attachment must be kept if set
+	attachment := cores.Attachment{Name: "events.ndjson", ContentType: "application/x-ndjson", Data: []byte("{}\n")}
+	if _, err := ws.WriteAttachments([]byte("summary"), zapcore.InfoLevel, 1, []cores.Attachment{attachment}); err != nil {
+		t.Errorf("WriteAttachments() error = %v", err)
+		return
+	}
+	_, messages = dialer.server.received()
+	if len(messages) != 2 || !strings.Contains(string(messages[1]), "\nContent-Type: application/x-ndjson\n") {
+		t.Errorf("messages = %q, want attachment of type application/x-ndjson", messages)
+	}
+}
+
+func TestWriteSyncer_SetAttachmentNamePolicy(t *testing.T) {
+	attachments := []cores.Attachment{
+		{Name: "log.txt", Data: []byte("a")},
+		{Name: "log (1).txt", Data: []byte("b")},
+		{Name: "LOG.txt", Data: []byte("c")},
+		{Name: "log.txt", Data: []byte("d")},
+		{Name: "goroutines", Data: []byte("e")},
+		{Name: "goroutines", Data: []byte("f")},
+	}
+
+	tests := []struct {
+		name      string
+		policy    AttachmentNamePolicy
+		want      []string
+		wantErr   bool
+		wantSetup bool
+	}{
+		{"rename", AttachmentRename, []string{
+			"log.txt", "log (1).txt", "LOG (2).txt", "log (3).txt", "goroutines", "goroutines (1)",
+		}, false, false},
+		{"reject", AttachmentReject, nil, true, false},
+		{"invalid", AttachmentNamePolicy(-1), nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"attachment test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			if err := ws.SetAttachmentNamePolicy(tt.policy); (err != nil) != tt.wantSetup {
+				t.Errorf("SetAttachmentNamePolicy() error = %v, wantErr %v", err, tt.wantSetup)
+				return
+			} else if err != nil {
+				return
+			}
+
+			_, errWrite := ws.WriteAttachments([]byte("some message"), zapcore.ErrorLevel, 1, attachments)
+			if (errWrite != nil) != tt.wantErr {
+				t.Errorf("WriteAttachments() error = %v, wantErr %v", errWrite, tt.wantErr)
+				return
+			}
+			_, messages := dialer.server.received()
+			if tt.wantErr {
+				if len(messages) > 0 {
+					t.Errorf("messages = %q, want none", messages)
+				}
+				return
+			}
+
+			// All attachments must arrive, under unique names, without modifying the given ones
+			if len(messages) != 1 {
+				t.Errorf("received %d messages, want 1", len(messages))
+				return
+			}
+			msg, errRead := mail.ReadMessage(bytes.NewReader(messages[0]))
+			if errRead != nil {
+				t.Errorf("could not parse message: %s", errRead)
+				return
+			}
+			_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			reader := multipart.NewReader(msg.Body, params["boundary"])
+			var names []string
+			for {
+				part, errPart := reader.NextPart()
+				if errPart != nil {
+					break
+				}
+				if part.FileName() != "" {
+					names = append(names, part.FileName())
+				}
+			}
+			if strings.Join(names, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("attachment names = %q, want %q", names, tt.want)
+			}
+			if attachments[2].Name != "LOG.txt" || attachments[3].Name != "log.txt" {
+				t.Errorf("attachments were modified: %v", attachments)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetNestedMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		message     string
+		plain       bool
+		attachments []cores.Attachment
+	}{
+		{"base64", "{\"level\":\"error\",\"msg\":\"disk full\"}\n", false, nil},
+		{"7bit", "{\"level\":\"error\",\"msg\":\"disk full\"}\n", true, nil},
+		{"non-ascii", "{\"level\":\"error\",\"msg\":\"Festplatte voll – bitte prüfen\"}\n", true, nil},
+		{"attachments", "{\"level\":\"fatal\",\"msg\":\"crash\"}\n", true, []cores.Attachment{
+			{Name: "goroutines.txt", Data: []byte("goroutine 1 [running]:\n")},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"nested test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &recordingDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetNestedMessage(true)
+			ws.SetPlainTextEncoding(tt.plain)
+
+			estimate := ws.EstimatedSize([]byte(tt.message), tt.attachments)
+			if _, err := ws.WriteAttachments([]byte(tt.message), zapcore.ErrorLevel, 1, tt.attachments); err != nil {
+				t.Errorf("WriteAttachments() error = %v", err)
+				return
+			}
+
+			// The outer mail must hold a note, followed by the nested message and the further attachments
+			_, messages := dialer.server.received()
+			if len(messages) != 1 {
+				t.Errorf("received %d messages, want 1", len(messages))
+				return
+			}
+			msg, errRead := mail.ReadMessage(bytes.NewReader(messages[0]))
+			if errRead != nil {
+				t.Errorf("could not parse message: %s", errRead)
+				return
+			}
+			mediaType, params, errType := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			if errType != nil || mediaType != "multipart/mixed" {
+				t.Errorf("Content-Type = %q, want multipart/mixed", msg.Header.Get("Content-Type"))
+				return
+			}
+			reader := multipart.NewReader(msg.Body, params["boundary"])
+			var parts []*multipart.Part
+			var contents [][]byte
+			for {
+				part, errPart := reader.NextPart()
+				if errPart != nil {
+					break
+				}
+				var content io.Reader = part
+				if part.Header.Get("Content-Transfer-Encoding") == "base64" {
+					content = base64.NewDecoder(base64.StdEncoding, part)
+				}
+				data, errContent := ioutil.ReadAll(content)
+				if errContent != nil {
+					t.Errorf("could not decode part: %s", errContent)
+					return
+				}
+				parts = append(parts, part)
+				contents = append(contents, data)
+			}
+			if len(parts) != 2+len(tt.attachments) {
+				t.Errorf("message has %d parts, want %d", len(parts), 2+len(tt.attachments))
+				return
+			}
+			if !strings.Contains(string(contents[0]), "nested message") {
+				t.Errorf("first part = %q, want note", contents[0])
+			}
+			if parts[1].Header.Get("Content-Type") != "message/rfc822" || parts[1].FileName() != "log.eml" {
+				t.Errorf("second part = %v, want nested message", parts[1].Header)
+				return
+			}
+			if enc := parts[1].Header.Get("Content-Transfer-Encoding"); enc == "base64" {
+				t.Errorf("nested message must not be base64 encoded")
+			}
+			for i, a := range tt.attachments {
+				if parts[2+i].FileName() != a.Name || !bytes.Equal(contents[2+i], a.Data) {
+					t.Errorf("part %d = %s %q, want attachment %s", 2+i, parts[2+i].FileName(), contents[2+i], a.Name)
+				}
+			}
+
+			// The nested message must parse as a mail of its own, holding the log entries
+			nested, errNested := mail.ReadMessage(bytes.NewReader(contents[1]))
+			if errNested != nil {
+				t.Errorf("could not parse nested message: %s", errNested)
+				return
+			}
+			if got := nested.Header.Get("Subject"); got != "nested test" {
+				t.Errorf("nested Subject = %q, want 'nested test'", got)
+			}
+			var body io.Reader = nested.Body
+			if nested.Header.Get("Content-Transfer-Encoding") == "base64" {
+				body = base64.NewDecoder(base64.StdEncoding, nested.Body)
+			}
+			decoded, errBody := ioutil.ReadAll(body)
+			if errBody != nil || strings.ReplaceAll(string(decoded), "\r\n", "\n") != tt.message {
+				t.Errorf("nested body = %q, want %q", decoded, tt.message)
+			}
+
+			// The estimate must cover the outer mail as well
+			raw := dialer.sent()
+			start := bytes.Index(raw, []byte("DATA\r\n"))
+			end := bytes.Index(raw, []byte("\r\n.\r\n"))
+			if size := int64(end + 2 - start - len("DATA\r\n")); start < 0 || estimate < size {
+				t.Errorf("EstimatedSize() = %d, want at least %d", estimate, size)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetAttachmentFunc(t *testing.T) {
+	ws, errWs := NewWriteSyncer(
+		"mail.domain.tld",
+		25,
+		"",
+		"",
+		"attachment test",
+		mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+		[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+		"",
+		"",
+		"",
+		nil,
+		"",
+	)
+	if errWs != nil {
+		t.Errorf("unable to initialize write syncer: %s", errWs)
+		return
+	}
+	dialer := &pipeDialer{server: &fakeServer{}}
+	ws.SetDialer(dialer)
+
+	// The content must be produced when a mail is sent, not when the function is set
+	calls := 0
+	snapshot := func() ([]byte, error) {
+		calls++
+		return []byte(strings.Repeat("x", calls)), nil
+	}
+	if err := ws.SetAttachmentFunc("metrics.txt", snapshot); err != nil {
+		t.Errorf("SetAttachmentFunc() error = %v", err)
+		return
+	}
+	if err := ws.SetAttachmentFunc("", snapshot); err == nil {
+		t.Errorf("SetAttachmentFunc() accepted an empty name")
+	}
+	if calls != 0 {
+		t.Errorf("function called %d times before sending, want 0", calls)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := ws.Write([]byte("some message")); err != nil {
+			t.Errorf("Write() error = %v", err)
+			return
+		}
+	}
+	_, messages := dialer.server.received()
+	if len(messages) != 2 {
+		t.Errorf("received %d messages, want 2", len(messages))
+		return
+	}
+	for i, want := range []string{"x", "xx"} {
+		encoded := base64.StdEncoding.EncodeToString([]byte(want))
+		if !strings.Contains(string(messages[i]), "filename=metrics.txt") ||
+			!strings.Contains(string(messages[i]), "\n\n"+encoded+"\n") {
+			t.Errorf("message %d = %q, want attachment with content %q", i, messages[i], want)
+		}
+	}
+
+	// A failing function must fail the mail
+	errSnapshot := fmt.Errorf("metrics unavailable")
+	_ = ws.SetAttachmentFunc("metrics.txt", func() ([]byte, error) { return nil, errSnapshot })
+	if _, err := ws.Write([]byte("some message")); err == nil || !strings.Contains(err.Error(), errSnapshot.Error()) {
+		t.Errorf("Write() error = %v, want %v", err, errSnapshot)
+	}
+
+	// Removing the function must stop attaching the content
+	_ = ws.SetAttachmentFunc("metrics.txt", nil)
+	if _, err := ws.Write([]byte("some message")); err != nil {
+		t.Errorf("Write() error = %v", err)
+		return
+	}
+	_, messages = dialer.server.received()
+	if len(messages) != 3 || strings.Contains(string(messages[2]), "metrics.txt") {
+		t.Errorf("messages = %q, want third one without attachment", messages)
+	}
+}
+
+func TestWriteSyncer_EstimatedSize(t *testing.T) {
+	recipients := []mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}}
+	var team []mail.Address
+	for i := 0; i < 20; i++ {
+		member := string(rune('a' + i))
+		team = append(team, mail.Address{Name: "Member " + member, Address: member + "@domain.tld"})
+	}
+	attachments := []cores.Attachment{
+		{Name: "goroutines.txt", Data: bytes.Repeat([]byte("goroutine 1 [running]:\n"), 100)},
+		{Name: "Prüfbericht – März.json", ContentType: "application/json", Data: []byte("{\"ok\":true}")},
+	}
+
+	tests := []struct {
+		name        string
+		message     string
+		plain       bool
+		footer      string
+		groups      bool
+		attachments []cores.Attachment
+	}{
+		{"ascii", strings.Repeat("{\"level\":\"error\",\"msg\":\"disk full\"}\n", 30), false, "", false, nil},
+		{"ascii-plain", strings.Repeat("{\"level\":\"error\",\"msg\":\"disk full\"}\n", 30), true, "", false, nil},
+		{"non-ascii", strings.Repeat("Festplatte voll – bitte prüfen\n", 30), true, "", false, nil},
+		{"line-feeds", strings.Repeat("\n", 500) + "x", true, "", false, nil},
+		{"footer", "some message", true, "Confidential\nDo not forward\n", false, nil},
+		{"groups", "some message", false, "", true, nil},
+		{"attachments", "some message", true, "", false, attachments},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"estimate test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				recipients,
+				"",
+				"",
+				"",
+				nil,
+				"",
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &recordingDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetPlainTextEncoding(tt.plain)
+			ws.SetFooter(tt.footer)
+			if tt.groups {
+				if err := ws.SetRecipientGroups([][]mail.Address{recipients, team}, RotateRoundRobin); err != nil {
+					t.Errorf("SetRecipientGroups() error = %v", err)
+					return
+				}
+			}
+
+			estimate := ws.EstimatedSize([]byte(tt.message), tt.attachments)
+
+			// Skip the first group of recipients, sending the mail to the longer one
+			if tt.groups {
+				if _, err := ws.Write([]byte(tt.message)); err != nil {
+					t.Errorf("Write() error = %v", err)
+					return
+				}
+			}
+
+			// Send the mail describing a batch, including the group if there are no attachments
+			var errWrite error
+			if len(tt.attachments) > 0 {
+				_, errWrite = ws.WriteAttachments([]byte(tt.message), zapcore.ErrorLevel, 30, tt.attachments)
+			} else {
+				_, errWrite = ws.WriteGroup([]byte(tt.message), zapcore.ErrorLevel, 30, "storage")
+			}
+			if errWrite != nil {
+				t.Errorf("write error = %v", errWrite)
+				return
+			}
+
+			// Extract the last transmitted message, which must not exceed the estimate
+			raw := dialer.sent()
+			start := bytes.LastIndex(raw, []byte("DATA\r\n"))
+			end := bytes.LastIndex(raw, []byte("\r\n.\r\n"))
+			if start < 0 || end < start {
+				t.Errorf("sent = %q, want a transmitted message", raw)
+				return
+			}
+			size := int64(end + 2 - start - len("DATA\r\n"))
+			if estimate < size {
+				t.Errorf("EstimatedSize() = %d, want at least %d", estimate, size)
+			}
+			if estimate > size+4096 {
+				t.Errorf("EstimatedSize() = %d, want close to %d", estimate, size)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_AlignSender(t *testing.T) {
+	_, cert, _ := testRecipientBundle(t, "signer@corp")
+
+	tests := []struct {
+		name     string
+		sender   string
+		policy   SenderAlignment
+		want     string // Sender address afterward
+		wantWarn bool
+	}{
+		{"valid-match", "signer@CORP", SenderAlignWarn, "signer@CORP", false},
+		{"valid-warn", "alerts@corp", SenderAlignWarn, "alerts@corp", true},
+		{"valid-adopt", "alerts@corp", SenderAlignAdopt, "signer@corp", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := &WriteSyncer{from: mail.Address{Name: "Alerts", Address: tt.sender}, fromCert: cert}
+
+			var warnings []error
+			if err := ws.AlignSender(tt.policy, func(err error) { warnings = append(warnings, err) }); err != nil {
+				t.Errorf("AlignSender() error = %v", err)
+				return
+			}
+			if ws.from.Address != tt.want || ws.from.Name != "Alerts" {
+				t.Errorf("AlignSender() sender = %v, want address %s", ws.from, tt.want)
+			}
+			if (len(warnings) > 0) != tt.wantWarn {
+				t.Errorf("AlignSender() warnings = %v, wantWarn %v", warnings, tt.wantWarn)
+			}
+		})
+	}
+
+	// Without a signing certificate there is nothing to align to
+	ws := &WriteSyncer{from: mail.Address{Address: "alerts@corp"}}
+	if err := ws.AlignSender(SenderAlignAdopt, nil); err == nil {
+		t.Errorf("AlignSender() accepted missing certificate")
+	}
+}
+
+func TestWriteSyncer_WriteLoneDot(t *testing.T) {
+
+	// This test needs a real OpenSSL binary to create and verify the signatures
+	opensslPath := _test.OpensslPath
+	if opensslPath == "" {
+		var errLook error
+		opensslPath, errLook = exec.LookPath("openssl")
+		if errLook != nil {
+			t.Skip("OpenSSL not configured and not found in PATH")
+		}
+	}
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// A lone dot would end the transmission prematurely, if not dot-stuffed
+	message := "line 1\n.\nline 2\n"
+
+	tests := []struct {
+		name   string
+		signed bool
+	}{
+		{"plain", false},
+		{"signed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var certPath, keyPath string
+			if tt.signed {
+				certPath = filepath.Join(root, "cert1.pem")
+				keyPath = filepath.Join(root, "key1.pem")
+			}
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"lone dot test",
+				mail.Address{Name: "Sender", Address: "zap@testing.com"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				opensslPath,
+				certPath,
+				keyPath,
+				nil,
+				tempDir,
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &recordingDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			ws.SetPlainTextEncoding(true)
+
+			if _, errWrite := ws.Write([]byte(message)); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+
+			// Check that the body arrived intact and not truncated. The dot reader of the server unifies the line feeds.
+			_, messages := dialer.server.received()
+			if len(messages) != 1 || !strings.Contains(string(messages[0]), "\n\n"+message) {
+				t.Errorf("messages = %q, want exactly one with body %q", messages, message)
+				return
+			}
+
+			// Extract the transmitted message, which must have been dot-stuffed exactly once
+			raw := dialer.sent()
+			start := bytes.Index(raw, []byte("DATA\r\n"))
+			end := bytes.Index(raw, []byte("\r\n.\r\n"))
+			if start < 0 || end < start {
+				t.Errorf("sent = %q, want a transmitted message", raw)
+				return
+			}
+			data := raw[start+len("DATA\r\n") : end+2]
+			if !bytes.Contains(data, []byte("\r\nline 1\r\n..\r\nline 2\r\n")) {
+				t.Errorf("message = %q, want dot-stuffed body", data)
+				return
+			}
+			if !tt.signed {
+				return
+			}
+
+			// Check that the signature still matches the message after removing the dot-stuffing
+			body, errVerify := Verify(opensslPath, bytes.ReplaceAll(data, []byte("\r\n.."), []byte("\r\n.")), nil)
+			if errVerify != nil {
+				t.Errorf("signature verification failed: %s", errVerify)
+				return
+			}
+			if !bytes.Contains(body, []byte("\nline 1\n.\nline 2\n")) {
+				t.Errorf("signed content = %q, want lone dot", body)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetOpensslWarningHandler(t *testing.T) {
+
+	// Retrieve the project root and build the absolute paths
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// Use stubs writing to stderr while signing, like OpenSSL does e.g. for deprecated options
+	warningPath := stubOpenssl(t, tempDir, "echo 'warning: deprecated option' >&2\n"+stubSignScript)
+	failingDir := filepath.Join(tempDir, "failing")
+	if err := os.Mkdir(failingDir, 0700); err != nil {
+		t.Errorf("could not create directory: %s", err)
+		return
+	}
+	failingPath := stubOpenssl(t, failingDir, `case "$1" in
+smime)
+	echo 'error: unable to sign' >&2
+	exit 1
+	;;
+*)
+	cat > /dev/null
+	echo "-----BEGIN PUBLIC KEY-----"
+	;;
+esac
+`)
+
+	tests := []struct {
+		name         string
+		opensslPath  string
+		handler      bool
+		wantWarnings int
+		wantErr      bool
+	}{
+		{"warning", warningPath, true, 1, false},
+		{"warning-without-handler", warningPath, false, 0, false},
+		{"failure", failingPath, true, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"warning test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				tt.opensslPath,
+				filepath.Join(root, "cert1.pem"),
+				filepath.Join(root, "key1.pem"),
+				nil,
+				tempDir,
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+			var warnings []error
+			if tt.handler {
+				ws.SetOpensslWarningHandler(func(err error) { warnings = append(warnings, err) })
+			}
+
+			// A zero exit code must be a success, regardless of the output on stderr
+			_, errWrite := ws.Write([]byte("some message"))
+			if (errWrite != nil) != tt.wantErr {
+				t.Errorf("Write() error = %v, wantErr %v", errWrite, tt.wantErr)
+				return
+			}
+			if errWrite != nil && !strings.Contains(errWrite.Error(), "unable to sign") {
+				t.Errorf("Write() error = %v, want it to contain the output of OpenSSL", errWrite)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("warnings = %v, want %d", warnings, tt.wantWarnings)
+				return
+			}
+			if len(warnings) > 0 && !strings.Contains(warnings[0].Error(), "deprecated option") {
+				t.Errorf("warnings = %v, want the output of OpenSSL", warnings)
+			}
+			if _, messages := dialer.server.received(); (len(messages) == 1) == tt.wantErr {
+				t.Errorf("received %d messages, want delivery %v", len(messages), !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteSyncer_SetSignaturePEM(t *testing.T) {
+
+	// Retrieve the project root and load the test certificates and keys
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Errorf("unable to get caller information")
+		return
+	}
+	root := filepath.Join(filepath.Dir(file), "..", _test.TestDir)
+	load := func(name string) []byte {
+		data, errRead := os.ReadFile(filepath.Join(root, name))
+		if errRead != nil {
+			t.Fatalf("could not read %s: %s", name, errRead)
+		}
+		return data
+	}
+
+	// Create a new temporary directory
+	tempDir, errDir := ioutil.TempDir("", "zapsmtp-test-*")
+	if errDir != nil {
+		t.Errorf("could not create temporary directory: %s", errDir)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	// Use a stub logging every OpenSSL invocation
+	opensslPath := stubOpenssl(t, tempDir, "echo \"$1\" >> \"$0.log\"\n"+stubSignScript)
+
+	tests := []struct {
+		name    string
+		cert    []byte
+		key     []byte
+		certs   [][]byte
+		wantErr bool
+	}{
+		{"sign", load("cert1.pem"), load("key1.pem"), nil, false},
+		{"sign-encrypt", load("cert1.pem"), load("key1.pem"), [][]byte{load("cert2.pem")}, false},
+		{"encrypt", nil, nil, [][]byte{load("cert2.pem")}, false},
+		{"sign-der", load("cert1.der"), load("key1.der"), nil, true},
+		{"sign-mismatch", load("cert1.pem"), load("key2.pem"), nil, true},
+		{"sign-swapped", load("key1.pem"), load("cert1.pem"), nil, true},
+		{"encrypt-der", nil, nil, [][]byte{load("cert2.der")}, true},
+		{"encrypt-key", nil, nil, [][]byte{load("key2.pem")}, true},
+		{"encrypt-count", nil, nil, [][]byte{load("cert1.pem"), load("cert2.pem")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.Remove(opensslPath + ".log")
+			ws, errWs := NewWriteSyncer(
+				"mail.domain.tld",
+				25,
+				"",
+				"",
+				"pem test",
+				mail.Address{Name: "Sender", Address: "sender@domain.tld"},
+				[]mail.Address{{Name: "Recipient", Address: "recipient@domain.tld"}},
+				opensslPath,
+				"",
+				"",
+				nil,
+				tempDir,
+			)
+			if errWs != nil {
+				t.Errorf("unable to initialize write syncer: %s", errWs)
+				return
+			}
+			dialer := &pipeDialer{server: &fakeServer{}}
+			ws.SetDialer(dialer)
+
+			// Set the keys, which must be refused if not PEM encoded or not matching
+			var err error
+			if tt.cert != nil {
+				err = ws.SetSignaturePEM(tt.cert, tt.key)
+			}
+			if err == nil && tt.certs != nil {
+				err = ws.SetEncryptionPEM(tt.certs)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetSignaturePEM() / SetEncryptionPEM() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			// Neither the setters nor any conversion or key pair check may have run OpenSSL
+			if _, errStat := os.Stat(opensslPath + ".log"); !os.IsNotExist(errStat) {
+				t.Errorf("OpenSSL was run by the setters")
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+
+			// Sending must only run OpenSSL for signing and encryption
+			if _, errWrite := ws.Write([]byte("some message")); errWrite != nil {
+				t.Errorf("Write() error = %v", errWrite)
+				return
+			}
+			log, _ := os.ReadFile(opensslPath + ".log")
+			if len(log) == 0 {
+				t.Errorf("OpenSSL was not run for signing or encryption")
+			}
+			for _, cmd := range strings.Fields(string(log)) {
+				if cmd != "smime" {
+					t.Errorf("OpenSSL invocations = %q, want only smime", log)
+					return
+				}
+			}
+			if _, messages := dialer.server.received(); len(messages) != 1 {
+				t.Errorf("received %d messages, want 1", len(messages))
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+// Package zapsmtptest provides helpers for testing code built on ZapSmtp, without sending any mails.
+package zapsmtptest
+
+import (
+	"sync"
+	"time"
+)
+
+// MemorySyncer is a zapcore.WriteSyncer keeping every write in memory, e.g. to stand in for the SMTP WriteSyncer
+// below a DelayedCore. Each write is recorded as a separate batch, just like it would be sent as a separate mail. It
+// is safe for concurrent use and the zero value is ready to use.
+type MemorySyncer struct {
+	mutex    sync.Mutex
+	batches  [][]byte
+	syncs    int
+	writeErr error
+	syncErr  error
+}
+
+// NewMemorySyncer returns an empty MemorySyncer
+func NewMemorySyncer() *MemorySyncer {
+	return &MemorySyncer{}
+}
+
+// Write records a copy of the payload as a new batch. If a write error is configured, nothing is recorded and the
+// error is returned instead.
+func (m *MemorySyncer) Write(p []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.writeErr != nil {
+		return 0, m.writeErr
+	}
+	m.batches = append(m.batches, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// Sync counts the call and returns the configured sync error, if any
+func (m *MemorySyncer) Sync() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.syncs++
+	return m.syncErr
+}
+
+// SetWriteError sets the error returned by subsequent writes. Passing nil makes writes succeed again.
+func (m *MemorySyncer) SetWriteError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.writeErr = err
+}
+
+// SetSyncError sets the error returned by subsequent syncs. Passing nil makes syncs succeed again.
+func (m *MemorySyncer) SetSyncError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.syncErr = err
+}
+
+// Batches returns copies of the batches written so far, in the order they were written
+func (m *MemorySyncer) Batches() [][]byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	batches := make([][]byte, len(m.batches))
+	for i, batch := range m.batches {
+		batches[i] = append([]byte(nil), batch...)
+	}
+	return batches
+}
+
+// Syncs returns the number of times Sync was called
+func (m *MemorySyncer) Syncs() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.syncs
+}
+
+// String returns all batches written so far concatenated
+func (m *MemorySyncer) String() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var s string
+	for _, batch := range m.batches {
+		s += string(batch)
+	}
+	return s
+}
+
+// WaitForBatches waits until at least n batches were written or the timeout expired, which is useful to await the
+// delayed writes of a DelayedCore. It returns whether the number of batches was reached.
+func (m *MemorySyncer) WaitForBatches(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		m.mutex.Lock()
+		count := len(m.batches)
+		m.mutex.Unlock()
+
+		if count >= n {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+// Reset discards the recorded batches and syncs. Configured errors are kept.
+func (m *MemorySyncer) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.batches = nil
+	m.syncs = 0
+}
@@ -0,0 +1,97 @@
+/*
+* ZapSmtp, a Zap (Golang) logger extension for sending urgent log messages via SMTP
+*
+* Copyright (c) Siemens AG, 2021.
+*
+* This work is licensed under the terms of the MIT license. For a copy, see the LICENSE file in the top-level
+* directory or visit <https://opensource.org/licenses/MIT>.
+*
+ */
+
+package zapsmtptest
+
+import (
+	"fmt"
+	"go.uber.org/zap/zapcore"
+	"testing"
+	"time"
+)
+
+// Make sure the MemorySyncer can be used as a zapcore.WriteSyncer
+var _ zapcore.WriteSyncer = &MemorySyncer{}
+
+func TestMemorySyncer_Write(t *testing.T) {
+	m := NewMemorySyncer()
+
+	payload := []byte("batch 1")
+	n, err := m.Write(payload)
+	if err != nil || n != len(payload) {
+		t.Errorf("Write() = %d, %v, want %d, nil", n, err, len(payload))
+		return
+	}
+	_, _ = m.Write([]byte("batch 2"))
+
+	// The recorded batch must not change with the caller's buffer
+	payload[0] = 'X'
+
+	batches := m.Batches()
+	if len(batches) != 2 || string(batches[0]) != "batch 1" || string(batches[1]) != "batch 2" {
+		t.Errorf("Batches() = %q, want [batch 1 batch 2]", batches)
+	}
+	if m.String() != "batch 1batch 2" {
+		t.Errorf("String() = '%s', want 'batch 1batch 2'", m.String())
+	}
+
+	m.Reset()
+	if len(m.Batches()) != 0 || m.Syncs() != 0 {
+		t.Errorf("Reset() kept %d batches and %d syncs", len(m.Batches()), m.Syncs())
+	}
+}
+
+func TestMemorySyncer_errors(t *testing.T) {
+	m := &MemorySyncer{}
+	errWrite := fmt.Errorf("write failed")
+	errSync := fmt.Errorf("sync failed")
+
+	// Configured errors must be returned and failed writes must not be recorded
+	m.SetWriteError(errWrite)
+	m.SetSyncError(errSync)
+	if n, err := m.Write([]byte("lost")); err != errWrite || n != 0 {
+		t.Errorf("Write() = %d, %v, want 0, %v", n, err, errWrite)
+	}
+	if err := m.Sync(); err != errSync {
+		t.Errorf("Sync() = %v, want %v", err, errSync)
+	}
+	if len(m.Batches()) != 0 {
+		t.Errorf("Batches() = %q, want none", m.Batches())
+	}
+
+	// Clearing the errors must restore normal operation
+	m.SetWriteError(nil)
+	m.SetSyncError(nil)
+	if _, err := m.Write([]byte("kept")); err != nil {
+		t.Errorf("Write() error = %v", err)
+	}
+	if err := m.Sync(); err != nil {
+		t.Errorf("Sync() error = %v", err)
+	}
+	if len(m.Batches()) != 1 || m.Syncs() != 2 {
+		t.Errorf("recorded %d batches and %d syncs, want 1 and 2", len(m.Batches()), m.Syncs())
+	}
+}
+
+func TestMemorySyncer_WaitForBatches(t *testing.T) {
+	m := NewMemorySyncer()
+
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		_, _ = m.Write([]byte("delayed"))
+	}()
+
+	if !m.WaitForBatches(1, time.Second) {
+		t.Errorf("WaitForBatches() = false, want true")
+	}
+	if m.WaitForBatches(2, time.Millisecond*20) {
+		t.Errorf("WaitForBatches() = true for missing batch, want false")
+	}
+}